@@ -0,0 +1,851 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	ptp "github.com/subutai-io/p2p/lib"
+	"github.com/subutai-io/p2p/protocol"
+)
+
+// Bootstrap node defaults
+const (
+	DefaultBootstrapTCP    = ":6881"
+	DefaultBootstrapUDP    = ":6882"
+	bootstrapClientTimeout = time.Duration(time.Second * 180)
+	bootstrapWriteTimeout  = time.Duration(time.Second * 5)
+	bootstrapMaxProxies    = 3
+)
+
+// dhtDelimiter separates DHT packets in a TCP stream
+var dhtDelimiter = []byte{0x0a, 0x0b, 0x0c, 0x0a}
+
+type bootstrapHandler func(*bootstrapClient, *protocol.DHTPacket) error
+
+// BootstrapServer is a bootstrap (DHT) node. It implements server side
+// of the DHT protocol used by daemons to find each other
+type BootstrapServer struct {
+	listener net.Listener                                // TCP or TLS listener for daemons
+	tls      *tls.Config                                 // TLS configuration. Plain TCP is used when nil
+	echo     *net.UDPConn                                // UDP echo server used for keep alive and port discovery
+	network  *net.IPNet                                  // Network assigned to swarms that didn't report any
+	clients  map[*bootstrapClient]bool                   // Active connections
+	swarms   map[string]*bootstrapSwarm                  // Swarms by infohash
+	proxies  map[string]*bootstrapProxy                  // Registered proxies by endpoint
+	handlers map[protocol.DHTPacketType]bootstrapHandler // Handlers for incoming packets
+	lock     sync.Mutex                                  // Lock for clients, swarms and proxies
+	stopping int32                                       // Set to 1 when server is terminated
+}
+
+// bootstrapClient is a connection with a single daemon
+type bootstrapClient struct {
+	conn        net.Conn          // TCP or TLS connection
+	ip          string            // Outbound IP of a daemon
+	pending     map[string]string // IPs reported by unknown peers by infohash
+	framing     int               // Framing version negotiated with a daemon
+	lastContact time.Time         // Last time data was received
+	tx          uint64            // Transferred bytes
+	rx          uint64            // Received bytes
+	lock        sync.Mutex        // Write lock. Guards framing and counters too
+}
+
+// ExecBootstrap starts p2p in bootstrap node mode
+func ExecBootstrap(tcp, udp, network, cert, key, logLevel, syslog string) {
+	if logLevel == "" {
+		ptp.SetMinLogLevelString(DefaultLog)
+	} else {
+		ptp.SetMinLogLevelString(logLevel)
+	}
+	if syslog != "" {
+		ptp.SetSyslogSocket(syslog)
+	}
+	ptp.Log(ptp.Info, "Initializing P2P Bootstrap Node")
+
+	server := new(BootstrapServer)
+	if cert != "" || key != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			ptp.Log(ptp.Error, "Failed to load TLS certificate: %s", err)
+			os.Exit(1)
+		}
+		server.tls = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err == nil {
+			ptp.Log(ptp.Info, "TLS certificate key pin: %s", ptp.SPKIPin(leaf))
+		}
+	}
+	err := server.init(tcp, udp, network)
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to start bootstrap node: %s", err)
+		os.Exit(1)
+	}
+
+	SignalChannel = make(chan os.Signal, 1)
+	signal.Notify(SignalChannel, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range SignalChannel {
+			ptp.Log(ptp.Info, "Received signal: %s", sig)
+			server.close()
+			os.Exit(0)
+		}
+	}()
+
+	go server.runEcho()
+	server.run()
+}
+
+func (s *BootstrapServer) init(tcp, udp, network string) error {
+	if tcp == "" {
+		tcp = DefaultBootstrapTCP
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", tcp)
+	if err != nil {
+		return fmt.Errorf("Bad TCP address %s: %s", tcp, err)
+	}
+	if network != "" {
+		_, s.network, err = net.ParseCIDR(network)
+		if err != nil {
+			return fmt.Errorf("Bad network %s: %s", network, err)
+		}
+	}
+	listener, err := net.ListenTCP("tcp4", tcpAddr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s: %s", tcp, err)
+	}
+	s.listener = listener
+	if s.tls != nil {
+		s.listener = tls.NewListener(listener, s.tls)
+	}
+	ptp.Log(ptp.Info, "Listening for daemons on %s", s.listener.Addr().String())
+	if udp != "" {
+		udpAddr, err := net.ResolveUDPAddr("udp4", udp)
+		if err != nil {
+			s.listener.Close()
+			return fmt.Errorf("Bad UDP address %s: %s", udp, err)
+		}
+		s.echo, err = net.ListenUDP("udp4", udpAddr)
+		if err != nil {
+			s.listener.Close()
+			return fmt.Errorf("Failed to listen on %s: %s", udp, err)
+		}
+		ptp.Log(ptp.Info, "Started UDP echo server on %s", s.echo.LocalAddr().String())
+	}
+	s.clients = make(map[*bootstrapClient]bool)
+	s.swarms = make(map[string]*bootstrapSwarm)
+	s.proxies = make(map[string]*bootstrapProxy)
+	s.setupHandlers()
+	return nil
+}
+
+func (s *BootstrapServer) setupHandlers() {
+	s.handlers = make(map[protocol.DHTPacketType]bootstrapHandler)
+	s.handlers[protocol.DHTPacketType_BadProxy] = s.packetBadProxy
+	s.handlers[protocol.DHTPacketType_Connect] = s.packetConnect
+	s.handlers[protocol.DHTPacketType_DHCP] = s.packetDHCP
+	s.handlers[protocol.DHTPacketType_Find] = s.packetFind
+	s.handlers[protocol.DHTPacketType_Forward] = s.packetForward
+	s.handlers[protocol.DHTPacketType_Node] = s.packetNode
+	s.handlers[protocol.DHTPacketType_Ping] = s.packetPing
+	s.handlers[protocol.DHTPacketType_Proxy] = s.packetProxy
+	s.handlers[protocol.DHTPacketType_RegisterProxy] = s.packetRegisterProxy
+	s.handlers[protocol.DHTPacketType_ReportLoad] = s.packetReportLoad
+	s.handlers[protocol.DHTPacketType_ReportProxy] = s.packetReportProxy
+	s.handlers[protocol.DHTPacketType_RequestProxy] = s.packetRequestProxy
+	s.handlers[protocol.DHTPacketType_State] = s.packetState
+	s.handlers[protocol.DHTPacketType_Stop] = s.packetStop
+}
+
+// isStopping returns true when server was closed
+func (s *BootstrapServer) isStopping() bool {
+	return atomic.LoadInt32(&s.stopping) == 1
+}
+
+// run accepts incoming connections until server is closed. Closed
+// listener unblocks Accept
+func (s *BootstrapServer) run() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isStopping() {
+				break
+			}
+			ptp.Log(ptp.Error, "Failed to accept connection: %s", err)
+			continue
+		}
+		c := new(bootstrapClient)
+		c.conn = conn
+		c.pending = make(map[string]string)
+		c.lastContact = time.Now()
+		c.ip, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+		s.lock.Lock()
+		s.clients[c] = true
+		s.lock.Unlock()
+		go s.serve(c)
+	}
+}
+
+// runEcho replies to every UDP datagram with an address it came from
+func (s *BootstrapServer) runEcho() {
+	if s.echo == nil {
+		return
+	}
+	buf := make([]byte, ptp.DHTBufferSize)
+	for {
+		_, src, err := s.echo.ReadFromUDP(buf)
+		if err != nil {
+			if s.isStopping() {
+				break
+			}
+			ptp.Log(ptp.Debug, "UDP echo read failed: %s", err)
+			continue
+		}
+		msg, err := ptp.CreateMessageStatic(ptp.MsgTypePing, []byte(src.String()))
+		if err != nil {
+			continue
+		}
+		s.echo.WriteToUDP(msg.Serialize(), src)
+	}
+}
+
+// close will stop listeners and drop every connection
+func (s *BootstrapServer) close() {
+	atomic.StoreInt32(&s.stopping, 1)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.echo != nil {
+		s.echo.Close()
+	}
+	s.lock.Lock()
+	clients := []*bootstrapClient{}
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.lock.Unlock()
+	for _, c := range clients {
+		c.conn.Close()
+	}
+}
+
+// serve reads packets from a single connection
+func (s *BootstrapServer) serve(c *bootstrapClient) {
+	ptp.Log(ptp.Info, "Daemon connected from %s", c.conn.RemoteAddr().String())
+	defer s.disconnect(c)
+
+	// Greeting initiates handshake on the daemon side
+	err := c.send(&protocol.DHTPacket{
+		Type:      protocol.DHTPacketType_Ping,
+		Data:      c.ip,
+		Query:     dhtFramingQuery,
+		Arguments: dhtFramingList(),
+		Extra:     AppVersion,
+		Version:   ptp.PacketVersion,
+	})
+	if err != nil {
+		ptp.Log(ptp.Warning, "Failed to greet %s: %s", c.conn.RemoteAddr().String(), err)
+		return
+	}
+
+	// Daemons that don't support framing write a single packet per write
+	buf := make([]byte, ptp.DHTBufferSize)
+	for !s.isStopping() && c.getFraming() == dhtFramingLegacy {
+		c.conn.SetReadDeadline(time.Now().Add(bootstrapClientTimeout))
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			ptp.Log(ptp.Info, "Daemon %s disconnected: %s", c.conn.RemoteAddr().String(), err)
+			return
+		}
+		c.received(n)
+		for _, data := range splitDHTData(buf[:n]) {
+			s.handle(c, data)
+		}
+	}
+
+	reader := newDHTStreamReader(c.conn, c.getFraming())
+	for !s.isStopping() {
+		c.conn.SetReadDeadline(time.Now().Add(bootstrapClientTimeout))
+		data, err := reader.next()
+		if err != nil {
+			ptp.Log(ptp.Info, "Daemon %s disconnected: %s", c.conn.RemoteAddr().String(), err)
+			return
+		}
+		c.received(len(data))
+		s.handle(c, data)
+	}
+}
+
+// disconnect will remove peers and proxies registered from this connection
+func (s *BootstrapServer) disconnect(c *bootstrapClient) {
+	c.conn.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, c)
+	for hash, swarm := range s.swarms {
+		removed := swarm.removeClient(c)
+		if removed > 0 {
+			ptp.Log(ptp.Debug, "Removed %d peers from swarm %s", removed, hash)
+		}
+		if len(swarm.peers) == 0 {
+			delete(s.swarms, hash)
+		}
+	}
+	for addr, proxy := range s.proxies {
+		if proxy.client == c {
+			ptp.Log(ptp.Info, "Proxy %s unregistered", addr)
+			delete(s.proxies, addr)
+		}
+	}
+}
+
+// splitDHTData splits received data into separate packets
+func splitDHTData(data []byte) [][]byte {
+	result := [][]byte{}
+	for len(data) > 0 {
+		i := bytes.Index(data, dhtDelimiter)
+		if i < 0 {
+			result = append(result, data)
+			break
+		}
+		if i > 0 {
+			result = append(result, data[:i])
+		}
+		data = data[i+len(dhtDelimiter):]
+	}
+	return result
+}
+
+func (s *BootstrapServer) handle(c *bootstrapClient, data []byte) {
+	packet := &protocol.DHTPacket{}
+	err := proto.Unmarshal(data, packet)
+	if err != nil {
+		ptp.Log(ptp.Warning, "Corrupted data from %s: %s [%d]", c.ip, err, len(data))
+		return
+	}
+	ptp.Log(ptp.Trace, "Received DHT packet from %s: %+v", c.ip, packet)
+
+	supported := false
+	for _, v := range ptp.SupportedVersion {
+		if v == packet.Version {
+			supported = true
+		}
+	}
+	if !supported {
+		ptp.Log(ptp.Warning, "Daemon %s uses unsupported version %d", c.ip, packet.Version)
+		c.send(&protocol.DHTPacket{
+			Type:     protocol.DHTPacketType_Unsupported,
+			Infohash: packet.Infohash,
+			Version:  ptp.PacketVersion,
+		})
+		return
+	}
+
+	handler, e := s.handlers[packet.Type]
+	if !e {
+		ptp.Log(ptp.Debug, "Unsupported packet type %s from %s", packet.Type.String(), c.ip)
+		c.sendError(packet.Infohash, "Warning", fmt.Sprintf("Packet type %s is not supported by bootstrap node", packet.Type.String()))
+		return
+	}
+	err = handler(c, packet)
+	if err == errUnknownPeer {
+		ptp.Log(ptp.Debug, "Peer %s is unknown in swarm %s", packet.Id, packet.Infohash)
+		c.send(&protocol.DHTPacket{
+			Type:     protocol.DHTPacketType_Unknown,
+			Id:       packet.Id,
+			Infohash: packet.Infohash,
+			Version:  ptp.PacketVersion,
+		})
+		return
+	}
+	if err != nil {
+		ptp.Log(ptp.Debug, "Failed to handle %s from %s: %s", packet.Type.String(), c.ip, err)
+		c.sendError(packet.Infohash, "Warning", err.Error())
+	}
+}
+
+// peer returns swarm and peer that sent this packet. Must be called under lock
+func (s *BootstrapServer) peer(c *bootstrapClient, packet *protocol.DHTPacket) (*bootstrapSwarm, *bootstrapPeer, error) {
+	swarm, e := s.swarms[packet.Infohash]
+	if !e {
+		return nil, nil, errUnknownPeer
+	}
+	peer, err := swarm.get(packet.Id)
+	if err != nil || peer.client != c {
+		return nil, nil, errUnknownPeer
+	}
+	peer.lastSeen = time.Now()
+	return swarm, peer, nil
+}
+
+func (c *bootstrapClient) send(packet *protocol.DHTPacket) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.write(packet)
+}
+
+// write sends packet using current framing. Must be called under lock
+func (c *bootstrapClient) write(packet *protocol.DHTPacket) error {
+	data, err := proto.Marshal(packet)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal DHT packet: %s", err)
+	}
+	if c.framing == dhtFramingLength {
+		data = frameDHTData(data)
+	} else {
+		data = append(data, dhtDelimiter...)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(bootstrapWriteTimeout))
+	n, err := c.conn.Write(data)
+	if err != nil {
+		return err
+	}
+	c.tx += uint64(n)
+	return nil
+}
+
+// received counts data received from a daemon
+func (c *bootstrapClient) received(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rx += uint64(n)
+	c.lastContact = time.Now()
+}
+
+func (c *bootstrapClient) getFraming() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.framing
+}
+
+// negotiateFraming confirms framing requested by a daemon. Confirmation
+// is the last packet sent in legacy format
+func (c *bootstrapClient) negotiateFraming(requested string) error {
+	framing := selectDHTFraming([]string{requested})
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.write(&protocol.DHTPacket{
+		Type:    protocol.DHTPacketType_Ping,
+		Query:   dhtFramedQuery,
+		Data:    strconv.Itoa(framing),
+		Version: ptp.PacketVersion,
+	})
+	if err != nil {
+		return err
+	}
+	c.framing = framing
+	ptp.Log(ptp.Debug, "Daemon %s uses framing version %d", c.ip, framing)
+	return nil
+}
+
+func (c *bootstrapClient) sendError(hash, level, msg string) error {
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_Error,
+		Infohash: hash,
+		Data:     level,
+		Extra:    msg,
+		Version:  ptp.PacketVersion,
+	})
+}
+
+// packetConnect registers peer in a swarm and assigns new ID to it
+func (s *BootstrapServer) packetConnect(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	if packet.Infohash == "" {
+		return fmt.Errorf("Infohash wasn't specified")
+	}
+	localPort, err := strconv.Atoi(packet.Data)
+	if err != nil || localPort <= 0 {
+		return fmt.Errorf("Bad local port: %s", packet.Data)
+	}
+	remotePort, err := strconv.Atoi(packet.Query)
+	if err != nil || remotePort <= 0 {
+		remotePort = localPort
+	}
+
+	endpoints := []string{}
+	if c.ip != "" {
+		endpoints = append(endpoints, net.JoinHostPort(c.ip, strconv.Itoa(remotePort)))
+	}
+	for _, arg := range packet.Arguments {
+		ip := net.ParseIP(arg)
+		if ip == nil || ip.To4() == nil || ip.String() == c.ip {
+			continue
+		}
+		endpoints = append(endpoints, net.JoinHostPort(ip.String(), strconv.Itoa(localPort)))
+	}
+
+	s.lock.Lock()
+	swarm, e := s.swarms[packet.Infohash]
+	if !e {
+		swarm = newBootstrapSwarm(packet.Infohash, s.network)
+		s.swarms[packet.Infohash] = swarm
+		ptp.Log(ptp.Info, "New swarm %s", packet.Infohash)
+	}
+	// Peer reconnecting over the same connection keeps its ID
+	peer, err := swarm.get(packet.Id)
+	if err != nil || peer.client != c {
+		peer = new(bootstrapPeer)
+		peer.id = uuid.New().String()
+		peer.client = c
+		swarm.peers[peer.id] = peer
+	}
+	peer.endpoints = endpoints
+	peer.proxies = packet.Proxies
+	peer.lastSeen = time.Now()
+	pending, hasPending := c.pending[packet.Infohash]
+	delete(c.pending, packet.Infohash)
+	if hasPending {
+		ip, network, err := net.ParseCIDR(pending)
+		if err == nil && swarm.setIP(peer.id, ip, network) != nil {
+			ptp.Log(ptp.Debug, "Failed to restore IP %s of peer %s", pending, peer.id)
+		}
+	}
+	id := peer.id
+	s.lock.Unlock()
+
+	ptp.Log(ptp.Info, "Peer %s joined swarm %s from %s", id, packet.Infohash, c.ip)
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_Connect,
+		Id:       id,
+		Infohash: packet.Infohash,
+		Version:  ptp.PacketVersion,
+	})
+}
+
+// packetDHCP registers reported IP or allocates a new one
+func (s *BootstrapServer) packetDHCP(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	request := packet.Data == "" || packet.Data == "127.0.0.1" || packet.Extra == "" || packet.Extra == "0"
+	cidr := fmt.Sprintf("%s/%s", packet.Data, packet.Extra)
+
+	s.lock.Lock()
+	swarm, _, err := s.peer(c, packet)
+	if err != nil {
+		// Remember reported IP until peer will reconnect
+		if !request {
+			c.pending[packet.Infohash] = cidr
+		}
+		s.lock.Unlock()
+		return err
+	}
+	if !request {
+		ip, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			s.lock.Unlock()
+			return fmt.Errorf("Failed to parse network information: %s", err)
+		}
+		err = swarm.setIP(packet.Id, ip, network)
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		ptp.Log(ptp.Debug, "Peer %s reported IP %s", packet.Id, cidr)
+		return nil
+	}
+	ip, err := swarm.allocateIP(packet.Id)
+	var ones int
+	if err == nil {
+		ones, _ = swarm.network.Mask.Size()
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ptp.Log(ptp.Info, "Assigned %s/%d to peer %s", ip.String(), ones, packet.Id)
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_DHCP,
+		Id:       packet.Id,
+		Infohash: packet.Infohash,
+		Data:     ip.String(),
+		Extra:    strconv.Itoa(ones),
+		Version:  ptp.PacketVersion,
+	})
+}
+
+// packetFind sends information about every other peer in a swarm
+func (s *BootstrapServer) packetFind(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	s.lock.Lock()
+	swarm, _, err := s.peer(c, packet)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	replies := []*protocol.DHTPacket{}
+	for _, peer := range swarm.others(packet.Id) {
+		replies = append(replies, &protocol.DHTPacket{
+			Type:      protocol.DHTPacketType_Find,
+			Id:        packet.Id,
+			Infohash:  packet.Infohash,
+			Data:      peer.id,
+			Arguments: append([]string{}, peer.endpoints...),
+			Proxies:   append([]string{}, peer.proxies...),
+			Version:   ptp.PacketVersion,
+		})
+	}
+	s.lock.Unlock()
+
+	for _, reply := range replies {
+		err := c.send(reply)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packetForward delivers payload to a peer specified in Data field
+func (s *BootstrapServer) packetForward(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	s.lock.Lock()
+	swarm, _, err := s.peer(c, packet)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	target, err := swarm.get(packet.Data)
+	s.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("Can't forward to %s: peer not found", packet.Data)
+	}
+	return target.client.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_Forward,
+		Id:       target.id,
+		Infohash: packet.Infohash,
+		Data:     packet.Id,
+		Payload:  packet.Payload,
+		Version:  ptp.PacketVersion,
+	})
+}
+
+// packetNode sends endpoints of a peer specified in Data field
+func (s *BootstrapServer) packetNode(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	s.lock.Lock()
+	swarm, _, err := s.peer(c, packet)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	target, err := swarm.get(packet.Data)
+	if err != nil {
+		s.lock.Unlock()
+		ptp.Log(ptp.Debug, "Node request for unknown peer %s", packet.Data)
+		return nil
+	}
+	endpoints := append([]string{}, target.endpoints...)
+	s.lock.Unlock()
+
+	return c.send(&protocol.DHTPacket{
+		Type:      protocol.DHTPacketType_Node,
+		Id:        packet.Id,
+		Infohash:  packet.Infohash,
+		Data:      packet.Data,
+		Arguments: endpoints,
+		Version:   ptp.PacketVersion,
+	})
+}
+
+// packetPing echoes outbound IP of a daemon
+func (s *BootstrapServer) packetPing(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	if packet.Query == dhtFramingQuery {
+		return c.negotiateFraming(packet.Data)
+	}
+	return c.send(&protocol.DHTPacket{
+		Type:    protocol.DHTPacketType_Ping,
+		Data:    c.ip,
+		Extra:   AppVersion,
+		Version: ptp.PacketVersion,
+	})
+}
+
+// packetProxy sends list of least loaded proxies
+func (s *BootstrapServer) packetProxy(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	s.lock.Lock()
+	list := []*bootstrapProxy{}
+	for _, proxy := range s.proxies {
+		list = append(list, proxy)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].load == list[j].load {
+			return list[i].addr < list[j].addr
+		}
+		return list[i].load < list[j].load
+	})
+	proxies := []string{}
+	for i := 0; i < len(list) && i < bootstrapMaxProxies; i++ {
+		proxies = append(proxies, list[i].addr)
+	}
+	s.lock.Unlock()
+
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_Proxy,
+		Id:       packet.Id,
+		Infohash: packet.Infohash,
+		Proxies:  proxies,
+		Version:  ptp.PacketVersion,
+	})
+}
+
+// packetRegisterProxy registers new proxy
+func (s *BootstrapServer) packetRegisterProxy(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	addr, err := net.ResolveUDPAddr("udp4", packet.Data)
+	if err != nil {
+		return fmt.Errorf("Bad proxy address %s: %s", packet.Data, err)
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = net.ParseIP(c.ip)
+	}
+
+	s.lock.Lock()
+	proxy := new(bootstrapProxy)
+	proxy.id = packet.Id
+	proxy.addr = addr.String()
+	proxy.client = c
+	proxy.registered = time.Now()
+	s.proxies[proxy.addr] = proxy
+	s.lock.Unlock()
+
+	ptp.Log(ptp.Info, "Registered proxy %s", proxy.addr)
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_RegisterProxy,
+		Id:       packet.Id,
+		Infohash: packet.Infohash,
+		Data:     "OK",
+		Version:  ptp.PacketVersion,
+	})
+}
+
+// packetReportLoad updates number of tunnels on a proxy
+func (s *BootstrapServer) packetReportLoad(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	load, err := strconv.Atoi(packet.Data)
+	if err != nil {
+		return fmt.Errorf("Bad proxy load: %s", packet.Data)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, proxy := range s.proxies {
+		if proxy.client == c && proxy.id == packet.Id {
+			proxy.load = load
+			return nil
+		}
+	}
+	// Proxy will register again when it receives unknown
+	return errUnknownPeer
+}
+
+// packetReportProxy saves proxies used by a peer
+func (s *BootstrapServer) packetReportProxy(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	s.lock.Lock()
+	_, peer, err := s.peer(c, packet)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	peer.proxies = packet.Proxies
+	s.lock.Unlock()
+
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_ReportProxy,
+		Id:       packet.Id,
+		Infohash: packet.Infohash,
+		Version:  ptp.PacketVersion,
+	})
+}
+
+// packetBadProxy removes proxy specified in Data field from the peer
+func (s *BootstrapServer) packetBadProxy(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, peer, err := s.peer(c, packet)
+	if err != nil {
+		return err
+	}
+	proxies := []string{}
+	for _, proxy := range peer.proxies {
+		if proxy != packet.Data {
+			proxies = append(proxies, proxy)
+		}
+	}
+	peer.proxies = proxies
+	return nil
+}
+
+// packetRequestProxy sends proxies of a peer specified in Data field
+func (s *BootstrapServer) packetRequestProxy(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	s.lock.Lock()
+	swarm, _, err := s.peer(c, packet)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	target, err := swarm.get(packet.Data)
+	if err != nil {
+		s.lock.Unlock()
+		ptp.Log(ptp.Debug, "Proxy request for unknown peer %s", packet.Data)
+		return nil
+	}
+	proxies := append([]string{}, target.proxies...)
+	s.lock.Unlock()
+
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_RequestProxy,
+		Id:       packet.Id,
+		Infohash: packet.Infohash,
+		Data:     packet.Data,
+		Proxies:  proxies,
+		Version:  ptp.PacketVersion,
+	})
+}
+
+// packetState delivers state of a sender to a peer specified in Data field
+func (s *BootstrapServer) packetState(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	s.lock.Lock()
+	swarm, _, err := s.peer(c, packet)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	target, err := swarm.get(packet.Data)
+	s.lock.Unlock()
+	if err != nil {
+		ptp.Log(ptp.Trace, "State for unknown peer %s", packet.Data)
+		return nil
+	}
+	return target.client.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_State,
+		Id:       target.id,
+		Infohash: packet.Infohash,
+		Data:     packet.Id,
+		Extra:    packet.Extra,
+		Version:  ptp.PacketVersion,
+	})
+}
+
+// packetStop removes sender from a swarm
+func (s *BootstrapServer) packetStop(c *bootstrapClient, packet *protocol.DHTPacket) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	swarm, _, err := s.peer(c, packet)
+	if err != nil {
+		// Peer is already gone
+		return nil
+	}
+	swarm.remove(packet.Id)
+	if len(swarm.peers) == 0 {
+		delete(s.swarms, packet.Infohash)
+	}
+	ptp.Log(ptp.Info, "Peer %s left swarm %s", packet.Id, packet.Infohash)
+	return nil
+}
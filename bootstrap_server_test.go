@@ -0,0 +1,300 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	ptp "github.com/subutai-io/p2p/lib"
+	"github.com/subutai-io/p2p/protocol"
+)
+
+func TestSplitDHTData(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want [][]byte
+	}{
+		{"empty", []byte{}, [][]byte{}},
+		{"no delimiter", []byte{1, 2, 3}, [][]byte{{1, 2, 3}}},
+		{"trailing delimiter", []byte{1, 2, 0x0a, 0x0b, 0x0c, 0x0a}, [][]byte{{1, 2}}},
+		{"two packets", []byte{1, 0x0a, 0x0b, 0x0c, 0x0a, 2, 3}, [][]byte{{1}, {2, 3}}},
+		{"leading delimiter", []byte{0x0a, 0x0b, 0x0c, 0x0a, 4}, [][]byte{{4}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitDHTData(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitDHTData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootstrapSwarmAllocateIP(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.10.10.0/30")
+	c := new(bootstrapClient)
+	swarm := newBootstrapSwarm("hash", nil)
+	for _, id := range []string{"a", "b", "c"} {
+		swarm.peers[id] = &bootstrapPeer{id: id, client: c}
+	}
+
+	if _, err := swarm.allocateIP("a"); err != errNoSwarmNetwork {
+		t.Fatalf("Allocation without network returned %v", err)
+	}
+	if _, err := swarm.allocateIP("unknown"); err != errUnknownPeer {
+		t.Fatalf("Allocation for unknown peer returned %v", err)
+	}
+
+	swarm.network = network
+	tests := []struct {
+		name    string
+		id      string
+		want    string
+		wantErr error
+	}{
+		{"first", "a", "10.10.10.1", nil},
+		{"second", "b", "10.10.10.2", nil},
+		{"same peer again", "a", "10.10.10.1", nil},
+		{"network is full", "c", "", errNoFreeIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := swarm.allocateIP(tt.id)
+			if err != tt.wantErr {
+				t.Fatalf("allocateIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && ip.String() != tt.want {
+				t.Errorf("allocateIP() = %s, want %s", ip.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBootstrapSwarmSetIP(t *testing.T) {
+	c := new(bootstrapClient)
+	swarm := newBootstrapSwarm("hash", nil)
+	swarm.peers["a"] = &bootstrapPeer{id: "a", client: c}
+	swarm.peers["b"] = &bootstrapPeer{id: "b", client: c}
+
+	tests := []struct {
+		name    string
+		id      string
+		cidr    string
+		wantErr bool
+	}{
+		{"first report sets network", "a", "192.168.5.1/24", false},
+		{"conflict", "b", "192.168.5.1/24", true},
+		{"other network", "b", "172.16.0.2/24", true},
+		{"free ip", "b", "192.168.5.2/24", false},
+		{"unknown peer", "c", "192.168.5.3/24", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, network, _ := net.ParseCIDR(tt.cidr)
+			if err := swarm.setIP(tt.id, ip, network); (err != nil) != tt.wantErr {
+				t.Errorf("setIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if swarm.network.String() != "192.168.5.0/24" {
+		t.Errorf("Swarm network is %s", swarm.network.String())
+	}
+	if swarm.removeClient(c) != 2 || len(swarm.peers) != 0 {
+		t.Errorf("Failed to remove peers of a client")
+	}
+}
+
+// testBootstrapConn is a minimal daemon side of a bootstrap connection
+type testBootstrapConn struct {
+	t    *testing.T
+	conn net.Conn
+	buf  []*protocol.DHTPacket
+}
+
+func (tc *testBootstrapConn) send(packet *protocol.DHTPacket) {
+	packet.Version = ptp.PacketVersion
+	data, _ := proto.Marshal(packet)
+	tc.conn.Write(data)
+	// Server expects a single packet per read
+	time.Sleep(time.Millisecond * 50)
+}
+
+func (tc *testBootstrapConn) read() *protocol.DHTPacket {
+	for len(tc.buf) == 0 {
+		tc.conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+		data := make([]byte, ptp.DHTBufferSize)
+		n, err := tc.conn.Read(data)
+		if err != nil {
+			tc.t.Fatalf("Failed to read from bootstrap: %s", err)
+		}
+		for _, d := range splitDHTData(data[:n]) {
+			packet := &protocol.DHTPacket{}
+			if err := proto.Unmarshal(d, packet); err != nil {
+				tc.t.Fatalf("Failed to unmarshal packet: %s", err)
+			}
+			tc.buf = append(tc.buf, packet)
+		}
+	}
+	packet := tc.buf[0]
+	tc.buf = tc.buf[1:]
+	return packet
+}
+
+func TestBootstrapServer(t *testing.T) {
+	server := new(BootstrapServer)
+	err := server.init("127.0.0.1:0", "127.0.0.1:0", "10.20.30.0/24")
+	if err != nil {
+		t.Fatalf("Failed to init bootstrap server: %s", err)
+	}
+	defer server.close()
+	go server.run()
+	go server.runEcho()
+
+	connect := func() *testBootstrapConn {
+		conn, err := net.Dial("tcp4", server.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+		tc := &testBootstrapConn{t: t, conn: conn}
+		greeting := tc.read()
+		if greeting.Type != protocol.DHTPacketType_Ping || greeting.Data != "127.0.0.1" {
+			t.Fatalf("Bad greeting: %+v", greeting)
+		}
+		return tc
+	}
+
+	c1 := connect()
+	defer c1.conn.Close()
+	c2 := connect()
+	defer c2.conn.Close()
+
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Infohash: "swarm", Data: "1000", Query: "2000", Arguments: []string{"192.168.1.10"}})
+	r1 := c1.read()
+	if r1.Type != protocol.DHTPacketType_Connect || len(r1.Id) != 36 {
+		t.Fatalf("Bad connect reply: %+v", r1)
+	}
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Infohash: "swarm", Data: "1001", Query: "1001"})
+	r2 := c2.read()
+	if r2.Id == r1.Id {
+		t.Fatalf("Same ID assigned twice")
+	}
+
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_DHCP, Infohash: "swarm", Id: r1.Id, Data: "127.0.0.1", Extra: "0"})
+	dhcp := c1.read()
+	if dhcp.Type != protocol.DHTPacketType_DHCP || dhcp.Data != "10.20.30.1" || dhcp.Extra != "24" {
+		t.Fatalf("Bad DHCP reply: %+v", dhcp)
+	}
+
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Find, Infohash: "swarm", Id: r2.Id})
+	find := c2.read()
+	want := []string{"127.0.0.1:2000", "192.168.1.10:1000"}
+	if find.Type != protocol.DHTPacketType_Find || find.Data != r1.Id || !reflect.DeepEqual(find.Arguments, want) {
+		t.Fatalf("Bad find reply: %+v", find)
+	}
+
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_State, Infohash: "swarm", Id: r2.Id, Data: r1.Id, Extra: "3"})
+	state := c1.read()
+	if state.Type != protocol.DHTPacketType_State || state.Data != r2.Id || state.Extra != "3" {
+		t.Fatalf("Bad state: %+v", state)
+	}
+
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_RegisterProxy, Id: r2.Id, Data: "127.0.0.1:7000"})
+	if reg := c2.read(); reg.Type != protocol.DHTPacketType_RegisterProxy || reg.Data != "OK" {
+		t.Fatalf("Bad register proxy reply: %+v", reg)
+	}
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Proxy, Infohash: "swarm", Id: r1.Id})
+	if proxies := c1.read(); !reflect.DeepEqual(proxies.Proxies, []string{"127.0.0.1:7000"}) {
+		t.Fatalf("Bad proxy list: %+v", proxies)
+	}
+
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Find, Infohash: "swarm", Id: "00000000-0000-0000-0000-000000000000"})
+	if unknown := c1.read(); unknown.Type != protocol.DHTPacketType_Unknown {
+		t.Fatalf("Expected unknown reply: %+v", unknown)
+	}
+
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping, Query: "req"})
+	if ping := c1.read(); ping.Type != protocol.DHTPacketType_Ping || ping.Data != "127.0.0.1" {
+		t.Fatalf("Bad ping reply: %+v", ping)
+	}
+
+	// Disconnected daemon should leave the swarm
+	c2.conn.Close()
+	time.Sleep(time.Millisecond * 100)
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Node, Infohash: "swarm", Id: r1.Id, Data: r2.Id})
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping, Query: "req"})
+	if ping := c1.read(); ping.Type != protocol.DHTPacketType_Ping {
+		t.Fatalf("Expected no reply for node of disconnected peer: %+v", ping)
+	}
+
+	udp, err := net.Dial("udp4", server.echo.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial echo server: %s", err)
+	}
+	defer udp.Close()
+	udp.Write([]byte{0x0D, 0x0A})
+	udp.SetReadDeadline(time.Now().Add(time.Second * 3))
+	data := make([]byte, 512)
+	n, err := udp.Read(data)
+	if err != nil {
+		t.Fatalf("No reply from echo server: %s", err)
+	}
+	msg, err := ptp.P2PMessageFromBytes(data[:n])
+	if err != nil || msg.Header.Type != uint16(ptp.MsgTypePing) || string(msg.Data) != udp.LocalAddr().String() {
+		t.Fatalf("Bad echo reply: %+v", msg)
+	}
+}
+
+func TestBootstrapServerFraming(t *testing.T) {
+	server := new(BootstrapServer)
+	err := server.init("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to init bootstrap server: %s", err)
+	}
+	defer server.close()
+	go server.run()
+
+	conn, err := net.Dial("tcp4", server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	reader := newDHTStreamReader(conn, dhtFramingLegacy)
+	read := func() *protocol.DHTPacket {
+		data, err := reader.next()
+		if err != nil {
+			t.Fatalf("Failed to read from bootstrap: %s", err)
+		}
+		packet := &protocol.DHTPacket{}
+		if err := proto.Unmarshal(data, packet); err != nil {
+			t.Fatalf("Failed to unmarshal packet: %s", err)
+		}
+		return packet
+	}
+
+	greeting := read()
+	if greeting.Query != dhtFramingQuery || selectDHTFraming(greeting.Arguments) != dhtFramingLength {
+		t.Fatalf("Greeting doesn't offer framing: %+v", greeting)
+	}
+	request, _ := proto.Marshal(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping, Query: dhtFramingQuery, Data: "1", Version: ptp.PacketVersion})
+	conn.Write(request)
+	if ack := read(); ack.Query != dhtFramedQuery || ack.Data != "1" {
+		t.Fatalf("Bad framing confirmation: %+v", ack)
+	}
+	reader.framing = dhtFramingLength
+
+	// Several packets in a single write are handled in order
+	stream := []byte{}
+	for _, query := range []string{"first", "second"} {
+		data, _ := proto.Marshal(&protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Infohash: query, Data: "1000", Version: ptp.PacketVersion})
+		stream = append(stream, frameDHTData(data)...)
+	}
+	conn.Write(stream)
+	first := read()
+	second := read()
+	if first.Type != protocol.DHTPacketType_Connect || first.Infohash != "first" || second.Infohash != "second" {
+		t.Fatalf("Bad replies: %+v %+v", first, second)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Bootstrap registry errors
+var (
+	errUnknownPeer    = errors.New("Peer is not registered in swarm")
+	errNoSwarmNetwork = errors.New("Swarm is empty")
+	errNoFreeIP       = errors.New("No free IP addresses left in swarm network")
+)
+
+// bootstrapPeer is a peer registered in a swarm
+type bootstrapPeer struct {
+	id        string           // ID assigned to this peer
+	client    *bootstrapClient // Connection this peer was registered from
+	endpoints []string         // UDP endpoints of this peer
+	proxies   []string         // Proxies used by this peer
+	ip        net.IP           // IP of p2p interface
+	lastSeen  time.Time        // Last packet received from this peer
+}
+
+// bootstrapSwarm is a list of peers sharing the same infohash
+type bootstrapSwarm struct {
+	hash    string                    // Infohash of a swarm
+	network *net.IPNet                // Network used by peers in this swarm
+	peers   map[string]*bootstrapPeer // Peers by ID
+}
+
+// bootstrapProxy is a proxy registered on bootstrap node
+type bootstrapProxy struct {
+	id         string           // ID provided by proxy during registration
+	addr       string           // UDP endpoint of a proxy
+	client     *bootstrapClient // Connection this proxy was registered from
+	load       int              // Number of tunnels reported by proxy
+	registered time.Time        // When proxy was registered
+}
+
+func newBootstrapSwarm(hash string, network *net.IPNet) *bootstrapSwarm {
+	swarm := new(bootstrapSwarm)
+	swarm.hash = hash
+	swarm.network = network
+	swarm.peers = make(map[string]*bootstrapPeer)
+	return swarm
+}
+
+// get returns peer with specified ID
+func (s *bootstrapSwarm) get(id string) (*bootstrapPeer, error) {
+	peer, e := s.peers[id]
+	if !e || peer == nil {
+		return nil, errUnknownPeer
+	}
+	return peer, nil
+}
+
+// remove will delete peer with specified ID from swarm
+func (s *bootstrapSwarm) remove(id string) {
+	delete(s.peers, id)
+}
+
+// removeClient will delete every peer registered from specified connection.
+// Returns number of peers removed
+func (s *bootstrapSwarm) removeClient(c *bootstrapClient) int {
+	removed := 0
+	for id, peer := range s.peers {
+		if peer.client == c {
+			delete(s.peers, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// others returns every peer in swarm except the one with specified ID
+// sorted by ID
+func (s *bootstrapSwarm) others(id string) []*bootstrapPeer {
+	result := []*bootstrapPeer{}
+	for pid, peer := range s.peers {
+		if pid != id {
+			result = append(result, peer)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].id < result[j].id
+	})
+	return result
+}
+
+// isUsed returns true if IP is used by any peer other than specified one
+func (s *bootstrapSwarm) isUsed(ip net.IP, id string) bool {
+	for pid, peer := range s.peers {
+		if pid != id && peer.ip != nil && peer.ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setIP will register IP reported by a peer. First reported network
+// becomes the network of a swarm
+func (s *bootstrapSwarm) setIP(id string, ip net.IP, network *net.IPNet) error {
+	peer, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	if s.isUsed(ip, id) {
+		return fmt.Errorf("IP %s is already used by another peer in swarm", ip.String())
+	}
+	if s.network == nil {
+		s.network = network
+	} else if !s.network.Contains(ip) {
+		return fmt.Errorf("IP %s doesn't belong to swarm network %s", ip.String(), s.network.String())
+	}
+	peer.ip = ip
+	return nil
+}
+
+// allocateIP will pick first free IP from the swarm network and assign it
+// to specified peer
+func (s *bootstrapSwarm) allocateIP(id string) (net.IP, error) {
+	peer, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.network == nil {
+		return nil, errNoSwarmNetwork
+	}
+	if peer.ip != nil && s.network.Contains(peer.ip) && !s.isUsed(peer.ip, id) {
+		return peer.ip, nil
+	}
+	base := s.network.IP.To4()
+	if base == nil {
+		return nil, fmt.Errorf("Only IPv4 networks are supported")
+	}
+	ones, bits := s.network.Mask.Size()
+	start := binary.BigEndian.Uint32(base)
+	size := uint32(1) << uint(bits-ones)
+	// Skip network and broadcast addresses
+	for i := uint32(1); i+1 < size; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, start+i)
+		if !s.isUsed(ip, id) {
+			peer.ip = ip
+			return ip, nil
+		}
+	}
+	return nil, errNoFreeIP
+}
@@ -0,0 +1,382 @@
+// Package client is a Go client of P2P daemon management API. It's used by
+// p2p CLI and can be used by any program that manages p2p instances
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is a default TCP port of management API
+const DefaultPort = 52523
+
+// Client sends commands to P2P daemon
+type Client struct {
+	base  string
+	http  *http.Client
+	token string
+}
+
+// New returns client of daemon listening on TCP port of localhost
+func New(port int) *Client {
+	return NewHTTP(fmt.Sprintf("http://localhost:%d", port), nil)
+}
+
+// NewUnix returns client of daemon listening on Unix socket
+func NewUnix(socket string) *Client {
+	return NewHTTP("http://unix", &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	})
+}
+
+// NewHTTP returns client of daemon available at base URL. Default HTTP
+// client is used when hc is nil
+func NewHTTP(base string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = &http.Client{}
+	}
+	return &Client{base: base, http: hc}
+}
+
+// SetToken sets bearer token sent with every request
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// Start creates new instance and returns message of daemon
+func (c *Client) Start(ctx context.Context, opts StartOptions) (string, error) {
+	return c.command(ctx, "start", &args{
+		Hash:         opts.Hash,
+		IP:           opts.IP,
+		Mac:          opts.Mac,
+		Dev:          opts.Dev,
+		Keyfile:      opts.Keyfile,
+		Key:          opts.Key,
+		KDF:          opts.KDF,
+		TTL:          opts.TTL,
+		Fwd:          opts.Fwd,
+		Port:         opts.Port,
+		InterfaceMTU: opts.MTU,
+	})
+}
+
+// Stop terminates instance
+func (c *Client) Stop(ctx context.Context, hash string) (string, error) {
+	return c.command(ctx, "stop", &args{Hash: hash})
+}
+
+// RemoveInterface removes interface from the list of interfaces used by p2p
+func (c *Client) RemoveInterface(ctx context.Context, dev string) (string, error) {
+	return c.command(ctx, "stop", &args{Dev: dev})
+}
+
+// Enable starts saved instance and restores it on daemon launch
+func (c *Client) Enable(ctx context.Context, hash string) (string, error) {
+	return c.command(ctx, "enable", &args{Hash: hash})
+}
+
+// Disable stops instance, but keeps it in save file
+func (c *Client) Disable(ctx context.Context, hash string) (string, error) {
+	return c.command(ctx, "disable", &args{Hash: hash})
+}
+
+// SetLog changes log level of daemon
+func (c *Client) SetLog(ctx context.Context, level string) (string, error) {
+	return c.command(ctx, "set", &args{Log: level})
+}
+
+// SetIP changes IP of instance interface
+func (c *Client) SetIP(ctx context.Context, hash, ip string) (string, error) {
+	return c.command(ctx, "set", &args{Hash: hash, IP: ip})
+}
+
+// SetKey adds crypto-key to instance
+func (c *Client) SetKey(ctx context.Context, hash string, key KeyOptions) error {
+	return c.do(ctx, "set", http.MethodPost, "/v1/swarm?hash="+url.QueryEscape(hash), &key, nil)
+}
+
+// Debug returns debug information of daemon
+func (c *Client) Debug(ctx context.Context) (string, error) {
+	return c.command(ctx, "debug", &args{})
+}
+
+// DebugInfo returns state of daemon, its bootstrap nodes and instances
+func (c *Client) DebugInfo(ctx context.Context) (*DebugInfo, error) {
+	info := new(DebugInfo)
+	err := c.do(ctx, "debug", http.MethodGet, "/v1/debug", nil, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Reload makes daemon read configuration file again
+func (c *Client) Reload(ctx context.Context) (string, error) {
+	return c.command(ctx, "reload", &args{})
+}
+
+// Apply reconciles instances with instances directory of daemon. Only
+// planned changes are returned when dryRun is set
+func (c *Client) Apply(ctx context.Context, dryRun bool) (string, error) {
+	return c.command(ctx, "apply", &args{DryRun: dryRun})
+}
+
+// Show returns running instances
+func (c *Client) Show(ctx context.Context) ([]Instance, error) {
+	out, err := c.show(ctx, &args{})
+	if err != nil {
+		return nil, err
+	}
+	instances := []Instance{}
+	for _, o := range out {
+		instances = append(instances, Instance{Hash: o.Hash, IP: o.IP, HardwareAddress: o.HardwareAddress})
+	}
+	return instances, nil
+}
+
+// Peers returns peers of instance
+func (c *Client) Peers(ctx context.Context, hash string) ([]Peer, error) {
+	out, err := c.show(ctx, &args{Hash: hash})
+	if err != nil {
+		return nil, err
+	}
+	peers := []Peer{}
+	for _, o := range out {
+		peers = append(peers, Peer{ID: o.ID, IP: o.IP, Endpoint: o.Endpoint, HardwareAddress: o.HardwareAddress})
+	}
+	return peers, nil
+}
+
+// CheckIP reports whether instance is integrated with peer having
+// specified IP
+func (c *Client) CheckIP(ctx context.Context, hash, ip string) (string, error) {
+	out, err := c.show(ctx, &args{Hash: hash, IP: ip})
+	if err != nil {
+		return "", err
+	}
+	if len(out) == 0 {
+		return "", &Error{Op: "show", Code: CodeNoData, Message: ErrNoData.Error()}
+	}
+	return out[0].Text, nil
+}
+
+// Keys returns crypto-keys of instance
+func (c *Client) Keys(ctx context.Context, hash string) ([]Key, error) {
+	out, err := c.show(ctx, &args{Hash: hash, Keys: true})
+	if err != nil {
+		return nil, err
+	}
+	keys := []Key{}
+	for _, o := range out {
+		keys = append(keys, Key{Fingerprint: o.Key, Until: o.Until, State: o.State, Rotated: o.Rotated})
+	}
+	return keys, nil
+}
+
+// Interfaces returns interfaces of running instances or every interface
+// ever used by p2p when all is set
+func (c *Client) Interfaces(ctx context.Context, all bool) ([]string, error) {
+	out, err := c.show(ctx, &args{Interfaces: true, All: all})
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, o := range out {
+		names = append(names, o.InterfaceName)
+	}
+	return names, nil
+}
+
+// Bindings returns interfaces of running instances along with hashes
+func (c *Client) Bindings(ctx context.Context) ([]Binding, error) {
+	out, err := c.show(ctx, &args{Interfaces: true, Bind: true})
+	if err != nil {
+		return nil, err
+	}
+	bindings := []Binding{}
+	for _, o := range out {
+		bindings = append(bindings, Binding{Hash: o.Hash, Interface: o.InterfaceName})
+	}
+	return bindings, nil
+}
+
+// MTU returns MTU used by p2p interfaces
+func (c *Client) MTU(ctx context.Context) (int, error) {
+	out, err := c.show(ctx, &args{MTU: true})
+	if err != nil {
+		return 0, err
+	}
+	if len(out) == 0 {
+		return 0, &Error{Op: "show", Code: CodeMTUNotAvailable, Message: ErrMTUNotAvailable.Error()}
+	}
+	mtu, err := strconv.Atoi(out[0].MTU)
+	if err != nil {
+		return 0, badResponse("show", err)
+	}
+	return mtu, nil
+}
+
+// Status returns connectivity status of every instance or of specific
+// instance when hash isn't empty
+func (c *Client) Status(ctx context.Context, hash string) (*Status, error) {
+	status := new(Status)
+	err := c.do(ctx, "status", http.MethodPost, "/rest/v1/status", &args{Hash: hash}, status)
+	if err != nil {
+		return nil, err
+	}
+	if status.Code != 0 {
+		return nil, &Error{Op: "status", Code: status.Code, Message: "Failed to execute `status` command"}
+	}
+	return status, nil
+}
+
+// Watch calls fn for every event of daemon until ctx is done, stream is
+// closed by daemon or fn returns error. Only events of specified instance
+// and daemon are received when hash is not empty
+func (c *Client) Watch(ctx context.Context, hash string, fn func(Event) error) error {
+	path := "/v1/events"
+	if hash != "" {
+		path += "?hash=" + url.QueryEscape(hash)
+	}
+	resp, err := c.send(ctx, "watch", http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		e := new(apiError)
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+			return badResponse("watch", fmt.Errorf("%s", resp.Status))
+		}
+		return &Error{Op: "watch", Code: e.Code, Message: e.Error}
+	}
+	// Events are sent as server-sent events with JSON data. Comments are
+	// used by daemon to keep connection alive
+	scanner := bufio.NewScanner(resp.Body)
+	data := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+			continue
+		}
+		if line != "" || data == "" {
+			continue
+		}
+		e := Event{}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return badResponse("watch", err)
+		}
+		data = ""
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return unavailable("watch", err)
+	}
+	return unavailable("watch", io.EOF)
+}
+
+// command executes daemon command that responds with code and message
+func (c *Client) command(ctx context.Context, op string, a *args) (string, error) {
+	out := new(response)
+	err := c.do(ctx, op, http.MethodPost, "/rest/v1/"+op, a, out)
+	if err != nil {
+		return "", err
+	}
+	if out.Code != 0 {
+		return "", &Error{Op: op, Code: out.Code, Message: out.Message}
+	}
+	return out.Message, nil
+}
+
+// show executes show command. Error of the first failed item is returned
+func (c *Client) show(ctx context.Context, a *args) ([]showOutput, error) {
+	out := []showOutput{}
+	err := c.do(ctx, "show", http.MethodPost, "/rest/v1/show", a, &out)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range out {
+		if o.Code != 0 {
+			return nil, &Error{Op: "show", Code: o.Code, Message: o.Error}
+		}
+	}
+	return out, nil
+}
+
+// do sends request to daemon and decodes response into out. Error statuses
+// are converted to Error: commands describe them with message and
+// resource-oriented API with error
+func (c *Client) do(ctx context.Context, op, method, path string, in, out interface{}) error {
+	resp, err := c.send(ctx, op, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return unavailable(op, err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		e := new(apiError)
+		if err := json.Unmarshal(body, e); err != nil || (e.Code == 0 && e.Message == "" && e.Error == "") {
+			return badResponse(op, fmt.Errorf("%s", resp.Status))
+		}
+		if e.Message == "" {
+			e.Message = e.Error
+		}
+		return &Error{Op: op, Code: e.Code, Message: e.Message}
+	}
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return badResponse(op, err)
+	}
+	return nil
+}
+
+func (c *Client) send(ctx context.Context, op, method, path string, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, &Error{Op: op, Message: "Failed to marshal request", Err: err}
+		}
+		body = bytes.NewBuffer(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, &Error{Op: op, Message: "Failed to create request", Err: err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, unavailable(op, err)
+	}
+	return resp, nil
+}
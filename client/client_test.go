@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// daemon answers every command with preset response and records requests
+type daemon struct {
+	status   int
+	response string
+	path     string
+	auth     string
+	args     map[string]interface{}
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.path = r.URL.RequestURI()
+	d.auth = r.Header.Get("Authorization")
+	body, _ := ioutil.ReadAll(r.Body)
+	d.args = nil
+	json.Unmarshal(body, &d.args)
+	if d.status != 0 {
+		w.WriteHeader(d.status)
+	}
+	w.Write([]byte(d.response))
+}
+
+// newTestClient returns client of test daemon. Server should be closed
+// when test finishes
+func newTestClient() (*Client, *daemon, *httptest.Server) {
+	d := new(daemon)
+	server := httptest.NewServer(d)
+	return NewHTTP(server.URL, nil), d, server
+}
+
+func TestClient_command(t *testing.T) {
+	c, d, server := newTestClient()
+	defer server.Close()
+	c.SetToken("secret")
+	ctx := context.Background()
+
+	d.response = `{"code":0,"message":"Instance created: swarm\n"}`
+	out, err := c.Start(ctx, StartOptions{Hash: "swarm", IP: "dhcp", MTU: 1400})
+	if err != nil || out != "Instance created: swarm\n" {
+		t.Fatalf("Client.Start() = %q, %v", out, err)
+	}
+	wantArgs := map[string]interface{}{"hash": "swarm", "ip": "dhcp", "interface_mtu": float64(1400)}
+	if d.path != "/rest/v1/start" || d.auth != "Bearer secret" || !reflect.DeepEqual(d.args, wantArgs) {
+		t.Errorf("Client.Start() sent %s %q %v", d.path, d.auth, d.args)
+	}
+
+	tests := []struct {
+		response string
+		code     int
+		target   error
+	}{
+		{`{"code":105,"message":"P2P Daemon is in initialization state"}`, CodeNotReady, ErrNotReady},
+		{`{"code":106,"message":"Not connected to DHT nodes"}`, CodeNotConnected, ErrNotConnected},
+		{`{"code":119,"message":"Hash already in use\n"}`, CodeHashInUse, ErrHashInUse},
+		{`{"code":603,"message":"Failed to configure network"}`, CodeNetworkFailed, ErrNetworkFailed},
+		{`{"code":12,"message":"Can't remove interface: In use"}`, 12, nil},
+	}
+	for _, tt := range tests {
+		d.response = tt.response
+		_, err := c.Start(ctx, StartOptions{Hash: "swarm"})
+		e, ok := err.(*Error)
+		if !ok || e.Code != tt.code || e.Op != "start" || e.Message == "" {
+			t.Errorf("Client.Start() error = %v, want code %d", err, tt.code)
+			continue
+		}
+		if tt.target != nil && !errors.Is(err, tt.target) {
+			t.Errorf("Client.Start() error = %v, isn't %v", err, tt.target)
+		}
+		if tt.target == nil && errors.Is(err, ErrNotReady) {
+			t.Errorf("Client.Start() error = %v matches unrelated error", err)
+		}
+	}
+
+	d.status = http.StatusUnauthorized
+	d.response = `{"code":1,"message":"Authentication required"}`
+	_, err = c.Stop(ctx, "swarm")
+	if e, ok := err.(*Error); !ok || e.Code != 1 || e.Message != "Authentication required" {
+		t.Errorf("Client.Stop() error = %v", err)
+	}
+}
+
+func TestClient_show(t *testing.T) {
+	c, d, server := newTestClient()
+	defer server.Close()
+	ctx := context.Background()
+
+	d.response = `[{"hw":"06:00:00:00:00:01","ip":"10.10.10.1","hash":"swarm"}]`
+	instances, err := c.Show(ctx)
+	want := []Instance{{Hash: "swarm", IP: "10.10.10.1", HardwareAddress: "06:00:00:00:00:01"}}
+	if err != nil || !reflect.DeepEqual(instances, want) {
+		t.Errorf("Client.Show() = %+v, %v", instances, err)
+	}
+
+	d.response = `[{"error":"Specified environment was not found","code":15}]`
+	_, err = c.Peers(ctx, "unknown")
+	if e, ok := err.(*Error); !ok || e.Code != 15 || e.Message != "Specified environment was not found" {
+		t.Errorf("Client.Peers() error = %v", err)
+	}
+
+	d.response = `[]`
+	_, err = c.CheckIP(ctx, "swarm", "10.10.10.2")
+	if e, ok := err.(*Error); !ok || e.Code != CodeNoData || !errors.Is(err, ErrNoData) {
+		t.Errorf("Client.CheckIP() error = %v", err)
+	}
+
+	d.response = `[{"mtu":"1376"}]`
+	mtu, err := c.MTU(ctx)
+	if err != nil || mtu != 1376 {
+		t.Errorf("Client.MTU() = %d, %v", mtu, err)
+	}
+
+	d.response = `[]`
+	_, err = c.MTU(ctx)
+	if !errors.Is(err, ErrMTUNotAvailable) {
+		t.Errorf("Client.MTU() error = %v, want MTU not available", err)
+	}
+
+	d.response = `{"code":0}`
+	_, err = c.Show(ctx)
+	if !errors.Is(err, ErrBadResponse) {
+		t.Errorf("Client.Show() error = %v, want bad response", err)
+	}
+}
+
+func TestClient_SetKey(t *testing.T) {
+	c, d, server := newTestClient()
+	defer server.Close()
+	ctx := context.Background()
+
+	d.status = http.StatusNoContent
+	err := c.SetKey(ctx, "swarm", KeyOptions{Key: "passphrase", Until: "1700000000"})
+	wantArgs := map[string]interface{}{"key": "passphrase", "until": "1700000000"}
+	if err != nil || d.path != "/v1/swarm?hash=swarm" || !reflect.DeepEqual(d.args, wantArgs) {
+		t.Errorf("Client.SetKey() = %v, sent %s %v", err, d.path, d.args)
+	}
+
+	d.status = http.StatusNotFound
+	d.response = `{"error":"Instance with hash swarm was not found","code":1}`
+	err = c.SetKey(ctx, "swarm", KeyOptions{Key: "passphrase"})
+	if e, ok := err.(*Error); !ok || e.Code != 1 || e.Message != "Instance with hash swarm was not found" {
+		t.Errorf("Client.SetKey() error = %v", err)
+	}
+
+	d.status = http.StatusServiceUnavailable
+	d.response = `{"error":"P2P Daemon is in initialization state","code":105}`
+	err = c.SetKey(ctx, "swarm", KeyOptions{Key: "passphrase"})
+	if !errors.Is(err, ErrNotReady) {
+		t.Errorf("Client.SetKey() error = %v, want not ready", err)
+	}
+}
+
+func TestClient_unavailable(t *testing.T) {
+	c, _, server := newTestClient()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Debug(ctx)
+	if !errors.Is(err, ErrUnavailable) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Client.Debug() error = %v, want canceled", err)
+	}
+
+	c = NewUnix("/nonexistent/p2p.sock")
+	_, err = c.Status(context.Background(), "")
+	if e, ok := err.(*Error); !ok || e.Code != 0 || !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Client.Status() error = %v, want unavailable", err)
+	}
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes reported by daemon. Other codes depend on command and are
+// available in Error.Code
+const (
+	CodeNotReady        = 105 // Daemon is in initialization state
+	CodeNotConnected    = 106 // Daemon isn't connected to DHT nodes
+	CodeNoOutboundIP    = 107 // Outbound IP wasn't received yet
+	CodeHashInUse       = 119 // Instance with the same hash is running
+	CodeRegisterFailed  = 601 // Failed to register instance with DHT
+	CodeConnectFailed   = 602 // Failed to connect instance to DHT
+	CodeNetworkFailed   = 603 // Failed to configure network interface
+	CodeNoData          = 102 // Daemon returned nothing for IP check
+	CodeMTUNotAvailable = 114 // Daemon returned no MTU value
+)
+
+// Errors matched by errors.Is against Error
+var (
+	ErrNotReady        = errors.New("P2P Daemon is in initialization state")
+	ErrNotConnected    = errors.New("Not connected to DHT nodes")
+	ErrNoOutboundIP    = errors.New("Didn't received outbound IP yet")
+	ErrHashInUse       = errors.New("Hash already in use")
+	ErrRegisterFailed  = errors.New("Failed to register instance")
+	ErrConnectFailed   = errors.New("Failed to connect instance to DHT")
+	ErrNetworkFailed   = errors.New("Failed to configure network interface")
+	ErrNoData          = errors.New("No data available")
+	ErrMTUNotAvailable = errors.New("Failed to retrieve MTU value")
+	ErrUnavailable     = errors.New("Daemon is not available")
+	ErrBadResponse     = errors.New("Bad response of daemon")
+)
+
+var codeErrors = map[int]error{
+	CodeNotReady:        ErrNotReady,
+	CodeNotConnected:    ErrNotConnected,
+	CodeNoOutboundIP:    ErrNoOutboundIP,
+	CodeHashInUse:       ErrHashInUse,
+	CodeRegisterFailed:  ErrRegisterFailed,
+	CodeConnectFailed:   ErrConnectFailed,
+	CodeNetworkFailed:   ErrNetworkFailed,
+	CodeNoData:          ErrNoData,
+	CodeMTUNotAvailable: ErrMTUNotAvailable,
+}
+
+// Error is a failure of daemon command. Code is an exit code of the same
+// CLI command and is zero when request didn't reach daemon or its response
+// couldn't be read. Err holds cause of such failures
+type Error struct {
+	Op      string
+	Code    int
+	Message string
+	Err     error
+	kind    error // ErrUnavailable or ErrBadResponse when request failed
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether code or kind of failure of error corresponds to target
+func (e *Error) Is(target error) bool {
+	if e.kind != nil && e.kind == target {
+		return true
+	}
+	err, exists := codeErrors[e.Code]
+	return exists && err == target
+}
+
+func unavailable(op string, err error) *Error {
+	return &Error{
+		Op:      op,
+		Message: "Couldn't execute command. Check if p2p daemon is running",
+		Err:     err,
+		kind:    ErrUnavailable,
+	}
+}
+
+func badResponse(op string, err error) *Error {
+	return &Error{
+		Op:      op,
+		Message: "Failed to unmarshal response",
+		Err:     err,
+		kind:    ErrBadResponse,
+	}
+}
@@ -0,0 +1,243 @@
+package client
+
+import "time"
+
+// StartOptions are options of a new instance. Hash is required, other
+// options fall back to daemon defaults
+type StartOptions struct {
+	Hash    string
+	IP      string // IP in CIDR format or "dhcp"
+	Mac     string
+	Dev     string
+	Keyfile string
+	Key     string
+	KDF     string
+	TTL     string // Time until key is active
+	Fwd     bool
+	Port    int
+	MTU     int
+}
+
+// KeyOptions is a crypto-key added to running instance. Either Key or
+// Keyfile should be specified
+type KeyOptions struct {
+	Key     string `json:"key,omitempty"`
+	Keyfile string `json:"keyfile,omitempty"`
+	KDF     string `json:"kdf,omitempty"`
+	Until   string `json:"until,omitempty"`
+}
+
+// Instance is a running instance
+type Instance struct {
+	Hash            string
+	IP              string
+	HardwareAddress string
+}
+
+// Peer is a peer of instance
+type Peer struct {
+	ID              string
+	IP              string
+	Endpoint        string
+	HardwareAddress string
+}
+
+// Key is a crypto-key of instance
+type Key struct {
+	Fingerprint string
+	Until       string
+	State       string
+	Rotated     string // Time of the last key rotation
+}
+
+// Binding is an interface of instance
+type Binding struct {
+	Hash      string
+	Interface string
+}
+
+// Status is a connectivity status of instances
+type Status struct {
+	Instances []InstanceStatus `json:"instances"`
+	Restores  []RestoreStatus  `json:"restores,omitempty"`
+	Code      int              `json:"code"`
+}
+
+// InstanceStatus is a connectivity status of instance. ID is empty when
+// status was requested for specific instance
+type InstanceStatus struct {
+	ID    string       `json:"id"`
+	IP    string       `json:"ip"`
+	Peers []PeerStatus `json:"peers"`
+}
+
+// PeerStatus is a connectivity status of peer
+type PeerStatus struct {
+	ID        string `json:"id"`
+	IP        string `json:"ip"`
+	State     string `json:"state"`
+	LastError string `json:"lastError"`
+}
+
+// RestoreStatus is a state of saved instance that wasn't restored yet
+type RestoreStatus struct {
+	ID          string    `json:"id"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	LastSuccess string    `json:"lastSuccess"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// DebugInfo is a state of daemon, its bootstrap nodes and instances.
+// Uptime is in seconds and latencies are in milliseconds
+type DebugInfo struct {
+	Version    string          `json:"version"`
+	Build      string          `json:"build"`
+	Uptime     int64           `json:"uptime"`
+	Goroutines int             `json:"goroutines"`
+	PMTU       bool            `json:"pmtu"`
+	Degraded   bool            `json:"degraded"` // No active bootstrap nodes
+	Bootstrap  []BootstrapNode `json:"bootstrap"`
+	Instances  []DebugInstance `json:"instances"`
+}
+
+// BootstrapNode is a connection with bootstrap node
+type BootstrapNode struct {
+	Endpoint      string `json:"endpoint"`
+	Rx            uint64 `json:"rx"`
+	Tx            uint64 `json:"tx"`
+	Version       string `json:"version"`
+	PacketVersion string `json:"packet_version"`
+	Framing       int    `json:"framing"`
+	TLS           string `json:"tls"`
+	Connected     bool   `json:"connected"`
+}
+
+// DebugInstance is a state of instance
+type DebugInstance struct {
+	Hash      string       `json:"hash"`
+	ID        string       `json:"id"`
+	Port      int          `json:"port"`
+	LocalIPs  []string     `json:"local_ips"`
+	Interface Interface    `json:"interface"`
+	Proxies   []DebugProxy `json:"proxies"`
+	Peers     []DebugPeer  `json:"peers"`
+}
+
+// Interface is a network interface of instance
+type Interface struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	Mac  string `json:"mac"`
+}
+
+// DebugProxy is a proxy used by instance
+type DebugProxy struct {
+	Addr    string `json:"addr"`
+	Port    int    `json:"port"`
+	Latency int64  `json:"latency"`
+}
+
+// DebugPeer is a state of peer. Endpoints and Stats are set when peer has
+// IP and MAC. Encryption is set when instance uses encryption
+type DebugPeer struct {
+	ID          string          `json:"id"`
+	State       string          `json:"state"`
+	RemoteState string          `json:"rstate"`
+	Encryption  *PeerEncryption `json:"encryption"`
+	IP          string          `json:"ip"`
+	Mac         string          `json:"mac"`
+	Endpoint    string          `json:"endpoint"`
+	Endpoints   []Endpoint      `json:"endpoints"`
+	Stats       *PeerStats      `json:"stats"`
+	Pool        []string        `json:"endpoint_pool"`
+}
+
+// Endpoint is a UDP endpoint of peer
+type Endpoint struct {
+	Addr    string `json:"addr"`
+	Latency int64  `json:"latency"`
+}
+
+// PeerEncryption is a state of encryption with peer
+type PeerEncryption struct {
+	Send     string `json:"send"`
+	Recv     string `json:"recv"`
+	Sessions int    `json:"sessions"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// PeerStats is a connection statistics of peer
+type PeerStats struct {
+	Connections       int `json:"connections"`
+	Reconnects        int `json:"reconnects"`
+	HolePunches       int `json:"hole_punches"`
+	ConnectionDelta   int `json:"connection_delta"`
+	ReconnectionDelta int `json:"reconnection_delta"`
+}
+
+// Event is a change of daemon, instance or peer state. Hash is empty for
+// events of daemon, such as connections with bootstrap nodes
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`
+	Hash    string            `json:"hash,omitempty"`
+	Peer    string            `json:"peer,omitempty"`
+	Message string            `json:"message"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// args is a request of daemon commands
+type args struct {
+	IP           string `json:"ip,omitempty"`
+	Mac          string `json:"mac,omitempty"`
+	Dev          string `json:"dev,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+	Keyfile      string `json:"keyfile,omitempty"`
+	Key          string `json:"key,omitempty"`
+	KDF          string `json:"kdf,omitempty"`
+	TTL          string `json:"ttl,omitempty"`
+	Fwd          bool   `json:"fwd,omitempty"`
+	Port         int    `json:"port,omitempty"`
+	Interfaces   bool   `json:"interfaces,omitempty"`
+	All          bool   `json:"all,omitempty"`
+	Log          string `json:"log,omitempty"`
+	Bind         bool   `json:"bind,omitempty"`
+	MTU          bool   `json:"mtu,omitempty"`
+	Keys         bool   `json:"keys,omitempty"`
+	InterfaceMTU int    `json:"interface_mtu,omitempty"`
+	DryRun       bool   `json:"dry_run,omitempty"`
+}
+
+// response is a result of daemon commands
+type response struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// showOutput is an item of show command result
+type showOutput struct {
+	ID              string `json:"id"`
+	IP              string `json:"ip"`
+	Endpoint        string `json:"endpoint"`
+	HardwareAddress string `json:"hw"`
+	Error           string `json:"error"`
+	Text            string `json:"text"`
+	Code            int    `json:"code"`
+	InterfaceName   string `json:"interface"`
+	Hash            string `json:"hash"`
+	MTU             string `json:"mtu"`
+	Key             string `json:"key"`
+	Until           string `json:"until"`
+	State           string `json:"state"`
+	Rotated         string `json:"rotated"`
+}
+
+// apiError is an error returned by daemon. Commands describe it with
+// message and resource-oriented API with error
+type apiError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
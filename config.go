@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// CommandConfigCheck validates configuration file without starting daemon.
+// P2P_* environment variables are applied the same way daemon does
+func CommandConfigCheck(configFile string) {
+	configFile = configLocation(configFile)
+	errs := checkConfig(configFile, os.LookupEnv)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("Configuration %s is valid\n", configFile)
+}
+
+// checkConfig returns every problem found in configuration file
+func checkConfig(configFile string, lookup func(string) (string, bool)) []error {
+	conf := new(ptp.Conf)
+	errs := ptp.ConfErrors{}
+	err := conf.LoadStrict(configFile)
+	if e, ok := err.(ptp.ConfErrors); ok {
+		// Unknown options don't prevent validation of known ones
+		errs = append(errs, e...)
+	} else if err != nil {
+		return []error{err}
+	}
+	err = conf.ApplyEnv(lookup)
+	if e, ok := err.(ptp.ConfErrors); ok {
+		errs = append(errs, e...)
+	}
+	err = conf.Validate()
+	if e, ok := err.(ptp.ConfErrors); ok {
+		errs = append(errs, e...)
+	}
+	return errs
+}
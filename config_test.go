@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-config")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "p2p.yaml")
+
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		want   int
+	}{
+		{"Empty", "", nil, 0},
+		{"Valid", "rpc_port: 52600\ntimeouts:\n  shutdown: 10s\ndefaults:\n  ip: dhcp\n", nil, 0},
+		{"Unknown option", "rpc_prt: 52600\nmtu: 10\n", nil, 2},
+		{"Bad environment", "rpc_port: 52600\n", map[string]string{"P2P_RPC_PORT": "0", "P2P_MTU": "big"}, 2},
+		{"Malformed", "mtu: [", nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ioutil.WriteFile(configFile, []byte(tt.config), 0600)
+			errs := checkConfig(configFile, func(name string) (string, bool) {
+				v, e := tt.env[name]
+				return v, e
+			})
+			if len(errs) != tt.want {
+				t.Errorf("checkConfig() = %v, want %d errors", errs, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/subutai-io/p2p/client"
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// controlListener is a Unix socket of management API. Socket file is
+// removed when it's closed
+var controlListener net.Listener
+
+// Legacy commands available to clients with read role
+var readOnlyCommands = map[string]bool{
+	"/rest/v1/show":   true,
+	"/rest/v1/status": true,
+	"/rest/v1/debug":  true,
+}
+
+// controlAuth authenticates clients of management API on TCP
+type controlAuth struct {
+	tokens map[string]string // Role by bearer token
+	names  map[string]string // Role by common name of client certificate
+	tls    bool              // Client certificates are verified
+}
+
+func newControlAuth(conf ptp.ControlConf) (*controlAuth, error) {
+	a := &controlAuth{
+		tokens: make(map[string]string),
+		names:  conf.TLS.Roles,
+		tls:    conf.TLS.ClientCA != "",
+	}
+	for _, t := range conf.Tokens {
+		token := t.Token
+		if t.TokenFile != "" {
+			data, err := ioutil.ReadFile(t.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read token: %s", err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		if token == "" {
+			return nil, fmt.Errorf("Token of %s role is empty", t.Role)
+		}
+		a.tokens[token] = t.Role
+	}
+	return a, nil
+}
+
+func (a *controlAuth) enabled() bool {
+	return len(a.tokens) > 0 || a.tls
+}
+
+// role returns role of authenticated client or empty string
+func (a *controlAuth) role(r *http.Request) string {
+	if a.tls && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if len(a.names) == 0 {
+			return ptp.ControlRoleAdmin
+		}
+		if role, e := a.names[r.TLS.PeerCertificates[0].Subject.CommonName]; e {
+			return role
+		}
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	presented := []byte(strings.TrimPrefix(header, "Bearer "))
+	role := ""
+	for token, tokenRole := range a.tokens {
+		// Every token is compared to keep timing independent of position
+		if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+			role = tokenRole
+		}
+	}
+	return role
+}
+
+// wrap rejects unauthenticated requests and requests that aren't allowed
+// to client's role
+func (a *controlAuth) wrap(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := a.role(r)
+		if role == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			denyControl(w, r, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if role != ptp.ControlRoleAdmin && !isReadOnlyRequest(r) {
+			denyControl(w, r, http.StatusForbidden, "Operation requires admin role")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isReadOnlyRequest(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		return r.Method == http.MethodGet
+	}
+	return readOnlyCommands[r.URL.Path]
+}
+
+// denyControl writes error in format of requested API
+func denyControl(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if strings.HasPrefix(r.URL.Path, "/rest/") {
+		resp, _ := getResponse(1, message)
+		w.WriteHeader(status)
+		w.Write(resp)
+		return
+	}
+	writeError(w, status, 1, "%s", message)
+}
+
+// controlAddress returns TCP address of management API
+func controlAddress(listen string, port int) string {
+	if listen == "" {
+		listen = "127.0.0.1"
+	}
+	if _, _, err := net.SplitHostPort(listen); err == nil {
+		return listen
+	}
+	return net.JoinHostPort(listen, strconv.Itoa(port))
+}
+
+// listenControlSocket creates Unix socket with specified owner and mode.
+// Socket left by previous launch is replaced. Other files are never
+// removed. Socket isn't accessible by others until its owner and mode are set
+func listenControlSocket(path, owner, mode string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Socket %s is in use by another daemon", path)
+		}
+		os.Remove(path)
+	}
+	l, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err == nil {
+			err = os.Chmod(path, os.FileMode(perm))
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("Failed to set mode of %s: %s", path, err)
+		}
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err == nil {
+			err = os.Chown(path, uid, gid)
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("Failed to set owner of %s: %s", path, err)
+		}
+	}
+	return l, nil
+}
+
+// lookupOwner resolves user[:group] to IDs. Group is kept when it's not
+// specified
+func lookupOwner(owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+	uid, gid := -1, -1
+	if parts[0] != "" {
+		u, err := user.Lookup(parts[0])
+		if err != nil {
+			u, err = user.LookupId(parts[0])
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			g, err = user.LookupGroupId(parts[1])
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// serveControl starts listeners of management API
+func serveControl(port int, conf ptp.ControlConf, handler http.Handler) error {
+	auth, err := newControlAuth(conf)
+	if err != nil {
+		return err
+	}
+	if conf.Socket != "" && conf.Socket != ptp.ControlDisabled {
+		l, err := listenControlSocket(conf.Socket, conf.SocketOwner, conf.SocketMode)
+		if err != nil {
+			return err
+		}
+		controlListener = l
+		ptp.Log(ptp.Info, "Management API is listening on %s", conf.Socket)
+		go http.Serve(l, handler)
+	}
+	if conf.Listen == ptp.ControlDisabled {
+		return nil
+	}
+	server := &http.Server{
+		Addr:    controlAddress(conf.Listen, port),
+		Handler: auth.wrap(handler),
+	}
+	if conf.TLS.ClientCA != "" {
+		data, err := ioutil.ReadFile(conf.TLS.ClientCA)
+		if err != nil {
+			return fmt.Errorf("Failed to read client CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No certificates found in %s", conf.TLS.ClientCA)
+		}
+		// Clients without certificates can authenticate with tokens
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+	if !auth.enabled() && !isLoopback(server.Addr) {
+		ptp.Log(ptp.Warning, "Management API on %s is available without authentication", server.Addr)
+	}
+	ptp.Log(ptp.Info, "Management API is listening on %s", server.Addr)
+	go func() {
+		var err error
+		if conf.TLS.Cert != "" {
+			err = server.ListenAndServeTLS(conf.TLS.Cert, conf.TLS.Key)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			fmt.Printf("Failed to start HTTP listener: %s", err)
+			os.Exit(98)
+		}
+	}()
+	return nil
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// newClient returns client of management API. Unix socket is used when
+// it's available and user has access to it, TCP port otherwise. Token is
+// taken from P2P_TOKEN
+func newClient(port int) *client.Client {
+	var c *client.Client
+	socket := controlSocket()
+	if canUseSocket(socket) {
+		c = client.NewUnix(socket)
+	} else {
+		c = client.New(port)
+	}
+	c.SetToken(os.Getenv("P2P_TOKEN"))
+	return c
+}
+
+// canUseSocket returns false when socket doesn't exist or user isn't
+// allowed to connect to it, e.g. isn't a member of its group
+func canUseSocket(socket string) bool {
+	if socket == ptp.ControlDisabled {
+		return false
+	}
+	info, err := os.Stat(socket)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return !errors.Is(err, os.ErrPermission)
+	}
+	conn.Close()
+	return true
+}
+
+// controlSocket returns socket from P2P_CONTROL_SOCKET or configuration file
+func controlSocket() string {
+	conf := new(ptp.Conf)
+	if err := conf.Load(configLocation("")); err != nil {
+		conf.SetDefaults()
+	}
+	conf.ApplyEnv(os.LookupEnv)
+	return conf.Control.Socket
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/subutai-io/p2p/client"
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestControlAuth_wrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-control")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "admin.token")
+	ioutil.WriteFile(tokenFile, []byte("admin-secret\n"), 0600)
+
+	auth, err := newControlAuth(ptp.ControlConf{Tokens: []ptp.ControlToken{
+		{TokenFile: tokenFile, Role: ptp.ControlRoleAdmin},
+		{Token: "read-secret", Role: ptp.ControlRoleRead},
+	}})
+	if err != nil {
+		t.Fatalf("newControlAuth() error = %v", err)
+	}
+	handler := auth.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		want   int
+	}{
+		{"No token", "GET", "/v1/instance", "", http.StatusUnauthorized},
+		{"Wrong token", "GET", "/v1/instance", "secret", http.StatusUnauthorized},
+		{"Read", "GET", "/v1/instance", "read-secret", http.StatusOK},
+		{"Read legacy", "POST", "/rest/v1/show", "read-secret", http.StatusOK},
+		{"Read modifying", "DELETE", "/v1/instance?hash=swarm", "read-secret", http.StatusForbidden},
+		{"Read legacy modifying", "POST", "/rest/v1/stop", "read-secret", http.StatusForbidden},
+		{"Admin", "DELETE", "/v1/instance?hash=swarm", "admin-secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.url, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-control")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "p2p.sock")
+
+	// Socket file left by crashed daemon
+	stale, err := listenControlSocket(path, "", "")
+	if err != nil {
+		t.Fatalf("listenControlSocket() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm()&0077 != 0 {
+		t.Errorf("listenControlSocket() created socket accessible by others: %v, %v", info.Mode(), err)
+	}
+	stale.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenControlSocket(path, "", "0600")
+	if err != nil {
+		t.Fatalf("listenControlSocket() didn't replace stale socket: %v", err)
+	}
+	defer l.Close()
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("listenControlSocket() mode = %v, %v", info.Mode(), err)
+	}
+	if _, err := listenControlSocket(path, "", ""); err == nil {
+		t.Errorf("listenControlSocket() replaced socket in use")
+	}
+	if _, err := listenControlSocket(filepath.Join(dir, "owned.sock"), "no-such-user-p2p", ""); err == nil {
+		t.Errorf("listenControlSocket() accepted unknown owner")
+	}
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, []byte("data"), 0600)
+	if _, err := listenControlSocket(file, "", ""); err == nil {
+		t.Errorf("listenControlSocket() replaced regular file")
+	}
+	if data, _ := ioutil.ReadFile(file); string(data) != "data" {
+		t.Errorf("listenControlSocket() removed regular file")
+	}
+}
+
+func TestControlAddress(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   string
+	}{
+		{"", "127.0.0.1:52523"},
+		{"0.0.0.0", "0.0.0.0:52523"},
+		{"::1", "[::1]:52523"},
+		{"10.0.0.1:8080", "10.0.0.1:8080"},
+	}
+	for _, tt := range tests {
+		if got := controlAddress(tt.listen, 52523); got != tt.want {
+			t.Errorf("controlAddress(%q) = %s, want %s", tt.listen, got, tt.want)
+		}
+	}
+}
+
+func TestClient_daemon(t *testing.T) {
+	ready := ReadyToServe
+	defer func() { ReadyToServe = ready }()
+
+	d := new(Daemon)
+	d.Instances = new(InstanceList)
+	d.Instances.init()
+	d.Restore = new(Restore)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/v1/start", d.execRESTStart)
+	mux.HandleFunc("/rest/v1/stop", d.execRESTStop)
+	mux.HandleFunc("/rest/v1/show", d.execRESTShow)
+	mux.HandleFunc("/rest/v1/status", d.execRESTStatus)
+	mux.HandleFunc("/v1/swarm", d.apiSwarm)
+	mux.HandleFunc("/v1/debug", d.apiDebug)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := client.NewHTTP(server.URL, nil)
+	ctx := context.Background()
+
+	ReadyToServe = false
+	if _, err := c.Start(ctx, client.StartOptions{Hash: "swarm"}); !errors.Is(err, client.ErrNotReady) {
+		t.Errorf("Client.Start() error = %v, want not ready", err)
+	}
+	if _, err := c.Show(ctx); !errors.Is(err, client.ErrNotReady) {
+		t.Errorf("Client.Show() error = %v, want not ready", err)
+	}
+	if _, err := c.Status(ctx, ""); !errors.Is(err, client.ErrNotReady) {
+		t.Errorf("Client.Status() error = %v, want not ready", err)
+	}
+	if _, err := c.DebugInfo(ctx); !errors.Is(err, client.ErrNotReady) {
+		t.Errorf("Client.DebugInfo() error = %v, want not ready", err)
+	}
+
+	ReadyToServe = true
+	if instances, err := c.Show(ctx); err != nil || len(instances) != 0 {
+		t.Errorf("Client.Show() = %v, %v", instances, err)
+	}
+	if status, err := c.Status(ctx, ""); err != nil || len(status.Instances) != 0 {
+		t.Errorf("Client.Status() = %v, %v", status, err)
+	}
+	if info, err := c.DebugInfo(ctx); err != nil || len(info.Instances) != 0 {
+		t.Errorf("Client.DebugInfo() = %v, %v", info, err)
+	}
+	_, err := c.Stop(ctx, "swarm")
+	if e, ok := err.(*client.Error); !ok || e.Code != 1 || e.Message != "Instance with hash swarm was not found" {
+		t.Errorf("Client.Stop() error = %v", err)
+	}
+	_, err = c.Peers(ctx, "swarm")
+	if e, ok := err.(*client.Error); !ok || e.Code != 15 {
+		t.Errorf("Client.Peers() error = %v", err)
+	}
+	err = c.SetKey(ctx, "swarm", client.KeyOptions{Key: "passphrase"})
+	if e, ok := err.(*client.Error); !ok || e.Code != 1 {
+		t.Errorf("Client.SetKey() error = %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+// +build windows
+
+package main
+
+import (
+	"net"
+)
+
+// listenUnix creates Unix socket. Access is controlled by ACL of its directory
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
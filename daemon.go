@@ -2,11 +2,9 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"net"
 	"os"
-	"os/signal"
-	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,39 +19,93 @@ var (
 // DaemonArgs arguments used by daemon to manipulate
 // p2p behaviour
 type DaemonArgs struct {
-	IP         string `json:"ip"`
-	Mac        string `json:"mac"`
-	Dev        string `json:"dev"`
-	Hash       string `json:"hash"`
-	Dht        string `json:"dht"`
-	Keyfile    string `json:"keyfile"`
-	Key        string `json:"key"`
-	TTL        string `json:"ttl"`
-	Fwd        bool   `json:"fwd"`
-	Port       int    `json:"port"`
-	Interfaces bool   `json:"interfaces"` // show only
-	All        bool   `json:"all"`        // show only
-	Command    string `json:"command"`
-	Args       string `json:"args"`
-	Log        string `json:"log"`
-	Bind       bool   `json:"bind"`
-	MTU        bool   `json:"mtu"`
+	IP           string `json:"ip"`
+	Mac          string `json:"mac"`
+	Dev          string `json:"dev"`
+	Hash         string `json:"hash"`
+	Dht          string `json:"dht"`
+	Keyfile      string `json:"keyfile"`
+	Key          string `json:"key"`
+	KDF          string `json:"kdf"`
+	TTL          string `json:"ttl"`
+	Fwd          bool   `json:"fwd"`
+	Port         int    `json:"port"`
+	Interfaces   bool   `json:"interfaces"` // show only
+	All          bool   `json:"all"`        // show only
+	Command      string `json:"command"`
+	Args         string `json:"args"`
+	Log          string `json:"log"`
+	Bind         bool   `json:"bind"`
+	MTU          bool   `json:"mtu"`
+	Keys         bool   `json:"keys"` // show only
+	InterfaceMTU int    `json:"interface_mtu"`
+	DryRun       bool   `json:"dry_run"` // apply only
 }
 
 var bootstrap DHTConnection
 var UsePMTU bool
 
+// processConfigFile loads configuration file, overrides it with P2P_*
+// environment variables and validates the result. Empty path means that
+// only defaults and environment are used
 func processConfigFile(configFile string) (*ptp.Conf, error) {
-	if configFile == "" {
-		return nil, fmt.Errorf("no config file provided")
-	}
-
 	conf := new(ptp.Conf)
 	err := conf.Load(configFile)
 	if err != nil {
 		return conf, err
 	}
-	return conf, nil
+	err = conf.ApplyEnv(os.LookupEnv)
+	if err != nil {
+		return conf, err
+	}
+	return conf, conf.Validate()
+}
+
+// configLocation returns path to configuration file: value of --config,
+// P2P_CONFIG environment variable or default location
+func configLocation(configFile string) string {
+	if configFile != "" {
+		return configFile
+	}
+	if env := os.Getenv("P2P_CONFIG"); env != "" {
+		return env
+	}
+	return ptp.DefaultConfigLocation
+}
+
+// logConfErrors logs every invalid option separately
+func logConfErrors(configFile string, err error) {
+	if errs, ok := err.(ptp.ConfErrors); ok {
+		for _, e := range errs {
+			ptp.Log(ptp.Error, "Bad configuration in %s: %s", configFile, e)
+		}
+		return
+	}
+	ptp.Log(ptp.Error, "Failed to load config file %s: %s", configFile, err)
+}
+
+// configureTimeouts applies configured timeouts. Zero value restores default
+func configureTimeouts(t ptp.Timeouts) {
+	shutdownTimeout = defaultShutdownTimeout
+	if t.Shutdown > 0 {
+		shutdownTimeout = t.Shutdown
+	}
+	restoreInitialDelay = defaultRestoreInitialDelay
+	if t.RestoreRetry > 0 {
+		restoreInitialDelay = t.RestoreRetry
+	}
+	restoreMaxDelay = defaultRestoreMaxDelay
+	if t.RestoreRetryMax > 0 {
+		restoreMaxDelay = t.RestoreRetryMax
+	}
+	keyfileCheckInterval = defaultKeyfileCheckInterval
+	if t.KeyfileCheck > 0 {
+		keyfileCheckInterval = t.KeyfileCheck
+	}
+	reconcileInterval = defaultReconcileInterval
+	if t.Reconcile > 0 {
+		reconcileInterval = t.Reconcile
+	}
 }
 
 func configureMTU(conf *ptp.Conf, mtu int, pmtu bool) {
@@ -74,8 +126,46 @@ func configureMTU(conf *ptp.Conf, mtu int, pmtu bool) {
 	}
 }
 
-// ExecDaemon starts P2P daemon
-func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configFile string, mtu int, pmtu bool) {
+// bootstrapTarget returns target that will be used to find bootstrap nodes.
+// Explicit list of endpoints specified with --target has priority over
+// configuration file, which has priority over SRV lookup
+func bootstrapTarget(config *ptp.Conf, targetURL string) string {
+	if targetURL == "" {
+		targetURL = "subutai.io"
+	}
+	if config != nil && !ptp.IsBootstrapList(targetURL) && len(config.Bootstrap) > 0 {
+		return config.GetBootstrap("")
+	}
+	return targetURL
+}
+
+// configureBootstrap returns target that will be used to find bootstrap nodes
+// and configures bootstrap cache
+func configureBootstrap(config *ptp.Conf, targetURL string) string {
+	targetURL = bootstrapTarget(config, targetURL)
+	if config != nil {
+		ptp.SetBootstrapCacheFile(config.GetBootstrapCache(""))
+		if config.BootstrapTLS.Enabled {
+			ptp.Log(ptp.Info, "Using TLS for connections with bootstrap nodes")
+			bootstrap.tls = &config.BootstrapTLS
+		}
+	} else {
+		ptp.SetBootstrapCacheFile(ptp.DefaultBootstrapCache)
+	}
+	if ptp.IsBootstrapList(targetURL) {
+		err := validateDHT(targetURL)
+		if err != nil {
+			ptp.Log(ptp.Error, "Bootstrap list is malformed: %s", err)
+			os.Exit(1)
+		}
+		ptp.Log(ptp.Info, "Using static list of bootstrap nodes: %s", targetURL)
+	}
+	return targetURL
+}
+
+// ExecDaemon starts P2P daemon. Zero values of arguments mean that they
+// weren't specified and are taken from configuration file
+func ExecDaemon(port int, targetURL, sFile, saveKey, profiling, syslog, logLevel, configFile string, mtu int, pmtu bool) {
 	ptp.Log(ptp.Info, "Initializing P2P Daemon")
 	if logLevel == "" {
 		ptp.SetMinLogLevelString(DefaultLog)
@@ -84,19 +174,39 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 	}
 
 	var err error
-	if configFile == "" {
-		configFile = ptp.DefaultConfigLocation
-	}
+	configFile = configLocation(configFile)
 	config, err := processConfigFile(configFile)
+	if os.IsNotExist(err) {
+		ptp.Log(ptp.Warning, "Config file %s not found. Using defaults", configFile)
+		config, err = processConfigFile("")
+	}
 	if err != nil {
-		ptp.Log(ptp.Error, "Failed to load config file %s: %s", configFile, err.Error())
-	} else {
-		ptp.Log(ptp.Info, "Loaded configuration from %s", configFile)
+		logConfErrors(configFile, err)
+		os.Exit(1)
 	}
-
-	if targetURL == "" {
-		targetURL = "subutai.io"
+	ptp.Log(ptp.Info, "Loaded configuration from %s", configFile)
+	settings := &daemonSettings{
+		configFile: configFile,
+		target:     targetURL,
+		logLevel:   logLevel,
+		mtu:        mtu,
+		pmtu:       pmtu,
+		conf:       config,
 	}
+	if logLevel == "" && config.Log != "" {
+		ptp.SetMinLogLevelString(config.Log)
+	}
+	port = config.GetRPCPort(port)
+	targetURL = settings.getTarget(config)
+	sFile = config.GetSave(sFile)
+	saveKey = config.GetSaveKey(saveKey)
+	profiling = config.GetProfile(profiling)
+	syslog = config.GetSyslog(syslog)
+	configureTimeouts(config.Timeouts)
+
+	targetURL = configureBootstrap(config, targetURL)
+	// Instances will use the same target for UDP keep alive sessions
+	TargetURL = targetURL
 	if syslog != "" {
 		ptp.SetSyslogSocket(syslog)
 	}
@@ -113,48 +223,42 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 
 	ReadyToServe = false
 
-	bootstrapConnected := false
-	bootstrapLastConnection := time.Unix(0, 0)
-
-	for !bootstrapConnected {
-		if time.Since(bootstrapLastConnection) > time.Duration(time.Second*5) {
-			bootstrapLastConnection = time.Now()
-			err := bootstrap.init(targetURL)
-			if err == nil {
-				bootstrapConnected = true
-			} else {
-				ptp.Log(ptp.Error, "Failed to connect to %s", targetURL)
-			}
-		}
-		time.Sleep(time.Millisecond * 100)
+	err = bootstrap.init(targetURL)
+	if err != nil {
+		ptp.Log(ptp.Warning, "Failed to find bootstrap nodes for %s: %s. Retrying in background", targetURL, err)
 	}
 
 	go bootstrap.run()
+	go bootstrap.monitor()
 	go waitOutboundIP()
 
 	proc := new(Daemon)
-	proc.init(sFile)
+	err = proc.init(sFile, saveKey)
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to initialize save file: %s", err)
+		os.Exit(1)
+	}
+	proc.settings = settings
 	setupRESTHandlers(port, proc)
 
 	go restoreInstances(proc)
+	go newKeyfileWatcher().run(proc.Instances)
+	go reconcileInstances(proc)
+	proc.hooks = make(chan chan struct{})
+	go runHooks(proc)
 
 	ReadyToServe = true
 
-	SignalChannel = make(chan os.Signal, 1)
-	signal.Notify(SignalChannel, os.Interrupt)
-
-	go waitActiveBootstrap()
-
-	go func() {
-		for sig := range SignalChannel {
-			fmt.Println("Received signal: ", sig)
-			pprof.StopCPUProfile()
-			os.Exit(0)
-		}
-	}()
+	handleSignals(proc)
+	handleReloadSignal(proc)
 
 	// main loop
 	for {
+		if proc.isStopping() {
+			// Instances are stopped by shutdown and must stay in save file
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
 		for id, inst := range proc.Instances.get() {
 			if inst == nil || inst.PTP == nil {
 				continue
@@ -170,46 +274,16 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 	}
 }
 
+// waitOutboundIP blocks until outbound IP is received from bootstrap node
 func waitOutboundIP() {
-	for _, r := range bootstrap.routers {
-		if r != nil {
-			go r.run()
-			go r.keepAlive()
-		}
-	}
-	for !bootstrap.isActive {
-		for _, r := range bootstrap.routers {
-			if r.running && r.handshaked {
-				bootstrap.isActive = true
-				break
-			}
-		}
-		time.Sleep(time.Millisecond * 100)
-	}
-	for bootstrap.ip == "" {
-		time.Sleep(time.Millisecond * 100)
-	}
-	OutboundIP = net.ParseIP(bootstrap.ip)
-}
-
-func waitActiveBootstrap() {
-	for {
-		active := 0
-		for _, r := range bootstrap.routers {
-			if !r.stop {
-				active++
-			}
-		}
-		if active == 0 {
-			ptp.Log(ptp.Info, "No active bootstrap nodes")
-			os.Exit(0)
-		}
+	for !bootstrap.isConnected() || bootstrap.getIP() == "" {
 		time.Sleep(time.Millisecond * 100)
 	}
+	OutboundIP = net.ParseIP(bootstrap.getIP())
 }
 
 func restoreInstances(daemon *Daemon) {
-	for !bootstrap.isActive {
+	for !bootstrap.isConnected() {
 		time.Sleep(100 * time.Millisecond)
 	}
 	if daemon.Restore != nil && daemon.Restore.isActive() {
@@ -222,38 +296,17 @@ func restoreInstances(daemon *Daemon) {
 			return
 		}
 
-		entries := daemon.Restore.get()
-		if len(entries) == 0 {
-			return
-		}
-
-		ptp.Log(ptp.Info, "Attempt to restore %d instances", len(entries))
-
-		restored := 0
-
-		for _, e := range entries {
-			err := daemon.run(&RunArgs{
-				IP:      e.IP,
-				Mac:     e.Mac,
-				Dev:     e.Dev,
-				Hash:    e.Hash,
-				Keyfile: e.Keyfile,
-				Key:     e.Key,
-				TTL:     e.TTL,
-			}, new(Response))
-			if err != nil {
-				ptp.Log(ptp.Error, "Failed to start instance %s during restore: %s", e.Hash, err.Error())
+		scheduled := 0
+		for _, e := range daemon.Restore.get() {
+			if !e.Enabled {
+				ptp.Log(ptp.Info, "Instance %s is disabled", e.Hash)
 				continue
-			} else {
-				restored++
-				daemon.Restore.bumpInstance(e.Hash)
 			}
+			daemon.Supervisor.add(e.Hash)
+			scheduled++
 		}
-		err = daemon.Restore.save()
-		if err != nil {
-			ptp.Log(ptp.Error, "Failed to save restore file")
-		}
-		ptp.Log(ptp.Info, "Restored %d of %d instances", restored, len(entries))
+		ptp.Log(ptp.Info, "Attempt to restore %d instances", scheduled)
+		daemon.Supervisor.run()
 	}
 }
 
@@ -264,9 +317,16 @@ func validateDHT(dht string) error {
 	}
 	eps := strings.Split(dht, ",")
 	for _, ep := range eps {
-		_, err := net.ResolveTCPAddr("tcp4", ep)
+		// Only syntax is checked here: bootstrap nodes are resolved
+		// when connecting, so startup doesn't depend on DNS
+		_, addr, err := ptp.ParseBootstrapEndpoint(ep)
 		if err != nil {
-			ptp.Log(ptp.Error, "Bootstrap %s have bad format or wrong address: %s", ep, err)
+			ptp.Log(ptp.Error, "Bootstrap %s have bad format: %s", ep, err)
+			return errBadDHTEndpoint
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		if n, err := strconv.Atoi(port); host == "" || err != nil || n < 1 || n > 65535 {
+			ptp.Log(ptp.Error, "Bootstrap %s have bad host or port", ep)
 			return errBadDHTEndpoint
 		}
 	}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestValidateDHT(t *testing.T) {
@@ -11,8 +16,14 @@ func TestValidateDHT(t *testing.T) {
 	if validateDHT("google.com") != errBadDHTEndpoint {
 		t.Fatalf("Providing URL without port doesn't generate expected error")
 	}
-	if validateDHT("iamnotexist.atall:80") != errBadDHTEndpoint {
-		t.Fatalf("Providing non existing URL doesn't generate expected error")
+	if validateDHT("google.com:65536") != errBadDHTEndpoint {
+		t.Fatalf("Providing port out of range doesn't generate expected error")
+	}
+	if validateDHT(":80") != errBadDHTEndpoint {
+		t.Fatalf("Providing endpoint without host doesn't generate expected error")
+	}
+	if validateDHT("iamnotexist.atall:80") != nil {
+		t.Fatalf("Endpoint was resolved during validation")
 	}
 	if validateDHT("google.com:80") != nil {
 		t.Fatalf("Providing correct endpoint generates error")
@@ -20,4 +31,40 @@ func TestValidateDHT(t *testing.T) {
 	if validateDHT("google.com:80,yandex.ru:80") != nil {
 		t.Fatalf("Providing correct endpoints generates error")
 	}
+	if validateDHT("tcp://127.0.0.1:6881,udp://127.0.0.1:6882") != nil {
+		t.Fatalf("Providing endpoints with protocol generates error")
+	}
+	if validateDHT("ftp://127.0.0.1:21") != errBadDHTEndpoint {
+		t.Fatalf("Providing unsupported protocol doesn't generate expected error")
+	}
+}
+
+func TestDaemon_shutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-shutdown")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := new(Daemon)
+	err = d.init(filepath.Join(dir, "save.yaml"), "")
+	if err != nil {
+		t.Fatalf("Daemon.init() error = %v", err)
+	}
+	d.Restore.addEntry(saveEntry{Hash: "hash1", Enabled: true})
+	d.Supervisor.add("hash1")
+	ReadyToServe = true
+	defer func() { ReadyToServe = false }()
+
+	d.shutdown(time.Second)
+	if !d.isStopping() || ReadyToServe {
+		t.Errorf("Daemon wasn't switched to shutdown mode")
+	}
+	if len(d.Supervisor.get()) != 0 {
+		t.Errorf("Restore wasn't cancelled")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "save.yaml"))
+	if !strings.Contains(string(data), "hash: hash1") {
+		t.Errorf("Instance was removed from save file:\n%s", data)
+	}
 }
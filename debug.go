@@ -1,26 +1,62 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
-	"os"
 	"runtime"
 	"time"
 
+	"github.com/subutai-io/p2p/client"
 	ptp "github.com/subutai-io/p2p/lib"
 )
 
+// outputDebug is an output of debug command, which follows schema of
+// client.DebugInfo
+type outputDebug struct {
+	*client.DebugInfo
+}
+
+func (o *outputDebug) tables() []outputTable {
+	daemon := outputTable{
+		header: []string{"VERSION", "BUILD", "UPTIME", "GOROUTINES", "PMTU", "DEGRADED"},
+		rows: [][]string{{
+			o.Version,
+			o.Build,
+			(time.Duration(o.Uptime) * time.Second).String(),
+			fmt.Sprintf("%d", o.Goroutines),
+			fmt.Sprintf("%t", o.PMTU),
+			fmt.Sprintf("%t", o.Degraded),
+		}},
+	}
+	nodes := outputTable{header: []string{"BOOTSTRAP", "CONNECTED", "VERSION", "FRAMING", "TLS", "RX", "TX"}}
+	for _, n := range o.Bootstrap {
+		nodes.rows = append(nodes.rows, []string{n.Endpoint, fmt.Sprintf("%t", n.Connected), n.Version, fmt.Sprintf("%d", n.Framing), n.TLS, fmt.Sprintf("%d", n.Rx), fmt.Sprintf("%d", n.Tx)})
+	}
+	peers := outputTable{header: []string{"HASH", "INTERFACE", "PORT", "PEER", "STATE", "REMOTE STATE", "IP", "ENDPOINT"}}
+	for _, inst := range o.Instances {
+		if len(inst.Peers) == 0 {
+			peers.rows = append(peers.rows, []string{inst.Hash, inst.Interface.Name, fmt.Sprintf("%d", inst.Port), "", "", "", "", ""})
+		}
+		for _, p := range inst.Peers {
+			peers.rows = append(peers.rows, []string{inst.Hash, inst.Interface.Name, fmt.Sprintf("%d", inst.Port), p.ID, p.State, p.RemoteState, p.IP, p.Endpoint})
+		}
+	}
+	return []outputTable{daemon, nodes, peers}
+}
+
 // CommandDebug prints debug information
 func CommandDebug(restPort int) {
-	out, err := sendRequest(restPort, "debug", &DaemonArgs{})
+	c := newClient(restPort)
+	if !structuredOutput() {
+		exitWithResult(c.Debug(context.Background()))
+	}
+	info, err := c.DebugInfo(context.Background())
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		exitWithError(err)
 	}
-
-	fmt.Println(out.Message)
-	os.Exit(out.Code)
+	exitWithOutput(&outputDebug{info})
 }
 
 func (d *Daemon) execRESTDebug(w http.ResponseWriter, r *http.Request) {
@@ -29,16 +65,6 @@ func (d *Daemon) execRESTDebug(w http.ResponseWriter, r *http.Request) {
 		w.Write(resp)
 		return
 	}
-	if !bootstrap.isActive {
-		resp, _ := getResponse(106, "Not connected to DHT nodes")
-		w.Write(resp)
-		return
-	}
-	if bootstrap.ip == "" {
-		resp, _ := getResponse(107, "Didn't received outbound IP yet")
-		w.Write(resp)
-		return
-	}
 	args := new(DaemonArgs)
 	err := getJSON(r.Body, args)
 	if handleMarshalError(err, w) != nil {
@@ -59,79 +85,183 @@ func (d *Daemon) execRESTDebug(w http.ResponseWriter, r *http.Request) {
 
 // Debug output debug information
 func (p *Daemon) Debug(args *Args, resp *Response) error {
-	resp.Output = fmt.Sprintf("Version: %s Build: %s\n", AppVersion, BuildID)
-	resp.Output += fmt.Sprintf("Uptime: %d h %d m %d s\n", int(time.Since(StartTime).Hours()), int(time.Since(StartTime).Minutes())%60, int(time.Since(StartTime).Seconds())%60)
-	resp.Output += fmt.Sprintf("Number of gouroutines: %d\n", runtime.NumGoroutine())
-	if ptp.UsePMTU {
-		resp.Output += fmt.Sprintf("PMTU: Enabled\n")
-	} else {
-		resp.Output += fmt.Sprintf("PMTU: Disabled\n")
+	resp.Output = formatDebug(p.debugInfo())
+	return nil
+}
+
+// debugInfo collects state of daemon, bootstrap nodes, instances and peers
+func (p *Daemon) debugInfo() *apiDebug {
+	info := &apiDebug{
+		Version:    AppVersion,
+		Build:      BuildID,
+		Uptime:     int64(time.Since(StartTime).Seconds()),
+		Goroutines: runtime.NumGoroutine(),
+		PMTU:       ptp.UsePMTU,
+		Degraded:   !bootstrap.isConnected(),
+		Bootstrap:  []apiDebugNode{},
+		Instances:  []apiDebugInstance{},
 	}
-	resp.Output += fmt.Sprintf("Bootstrap nodes information:\n")
-	for _, node := range bootstrap.routers {
+	for _, node := range bootstrap.getRouters() {
 		if node != nil {
-			resp.Output += fmt.Sprintf("  %s Rx: %d Tx: %d Version: %s Packet version: %s\n", node.addr.String(), node.rx, node.tx, node.version, node.packetVersion)
+			stats := node.stats()
+			info.Bootstrap = append(info.Bootstrap, apiDebugNode{
+				Endpoint:      node.addr.String(),
+				Rx:            stats.rx,
+				Tx:            stats.tx,
+				Version:       stats.version,
+				PacketVersion: stats.packetVersion,
+				Framing:       stats.framing,
+				TLS:           stats.tlsState,
+				Connected:     stats.connected,
+			})
 		}
 	}
-	resp.Output += fmt.Sprintf("Instances information:\n")
 	instances := p.Instances.get()
 	for _, inst := range instances {
-		resp.Output += fmt.Sprintf("Hash: %s\n", inst.ID)
-		resp.Output += fmt.Sprintf("ID: %s\n", inst.PTP.Dht.ID)
-		resp.Output += fmt.Sprintf("UDP Port: %d\n", inst.PTP.UDPSocket.GetPort())
-		resp.Output += fmt.Sprintf("Network interfaces: ")
-		for _, ip := range inst.PTP.LocalIPs {
-			resp.Output += fmt.Sprintf("%s ", ip.String())
+		i := apiDebugInstance{
+			Hash:      inst.ID,
+			ID:        inst.PTP.Dht.ID,
+			Port:      inst.PTP.UDPSocket.GetPort(),
+			LocalIPs:  []string{},
+			Interface: newAPIInterface(inst),
+			Proxies:   []apiDebugProxy{},
+			Peers:     []apiDebugPeer{},
 		}
-		resp.Output += "\n"
-		resp.Output += fmt.Sprintf("P2P Interface %s, HW Addr: %s, IP: %s\n", inst.PTP.Interface.GetName(), inst.PTP.Interface.GetHardwareAddress().String(), inst.PTP.Interface.GetIP().String())
-		resp.Output += fmt.Sprintf("Proxies: ")
-		proxyList := inst.PTP.ProxyManager.GetList()
-		if len(proxyList) == 0 {
-			resp.Output += fmt.Sprintf("No proxies in use")
+		for _, ip := range inst.PTP.LocalIPs {
+			i.LocalIPs = append(i.LocalIPs, ip.String())
 		}
-		for _, proxy := range proxyList {
+		for _, proxy := range inst.PTP.ProxyManager.GetList() {
 			if proxy.Addr == nil || proxy.Endpoint == nil {
 				continue
 			}
-			resp.Output += fmt.Sprintf("%s/%d [%d] ", proxy.Addr.String(), proxy.Endpoint.Port, ptp.NanoToMilliseconds(proxy.Latency.Nanoseconds()))
+			i.Proxies = append(i.Proxies, apiDebugProxy{
+				Addr:    proxy.Addr.String(),
+				Port:    proxy.Endpoint.Port,
+				Latency: ptp.NanoToMilliseconds(proxy.Latency.Nanoseconds()),
+			})
 		}
-		resp.Output += "\n"
-		resp.Output += fmt.Sprintf("Peers:\n")
+		for _, peer := range inst.PTP.Swarm.Get() {
+			i.Peers = append(i.Peers, newAPIDebugPeer(inst, peer))
+		}
+		info.Instances = append(info.Instances, i)
+	}
+	return info
+}
 
-		peers := inst.PTP.Swarm.Get()
-		for _, peer := range peers {
-			resp.Output += fmt.Sprintf("\t--- %s ---\n", peer.ID)
-			resp.Output += fmt.Sprintf("\tStates: %s | %s\n", ptp.StringifyState(peer.State), ptp.StringifyState(peer.RemoteState))
-			if peer.PeerLocalIP == nil {
-				resp.Output += "\tNo IP assigned\n"
-			} else if peer.PeerHW == nil {
-				resp.Output += "\tNo MAC assigned\n"
+func newAPIDebugPeer(inst *P2PInstance, peer *ptp.NetworkPeer) apiDebugPeer {
+	p := apiDebugPeer{
+		ID:          peer.ID,
+		State:       ptp.StringifyState(peer.State),
+		RemoteState: ptp.StringifyState(peer.RemoteState),
+		Pool:        []string{},
+	}
+	if inst.PTP.Crypter.Active {
+		stats := peer.Crypto.Stats()
+		p.Encryption = &apiDebugCrypto{
+			Send:     ptp.CryptoModeName(stats.SendMode),
+			Recv:     ptp.CryptoModeName(stats.RecvMode),
+			Sessions: stats.Sessions,
+			Rejected: stats.Rejected,
+		}
+	}
+	if peer.PeerLocalIP != nil {
+		p.IP = peer.PeerLocalIP.String()
+	}
+	if peer.PeerHW != nil {
+		p.Mac = peer.PeerHW.String()
+	}
+	// Connection details are known only for peers with network settings
+	if p.IP != "" && p.Mac != "" {
+		p.Endpoint = peer.Endpoint.String()
+		p.Endpoints = []apiDebugEndpoint{}
+		for _, ep := range peer.EndpointsHeap {
+			p.Endpoints = append(p.Endpoints, apiDebugEndpoint{
+				Addr:    ep.Addr.String(),
+				Latency: ptp.NanoToMilliseconds(ep.Latency.Nanoseconds()),
+			})
+		}
+		p.Stats = &apiDebugStats{
+			Connections:       peer.Stat.GetConnectionsNum(),
+			Reconnects:        peer.Stat.GetReconnectsNum(),
+			HolePunches:       peer.Stat.GetHolePunchNum(),
+			ConnectionDelta:   peer.Stat.GetConnectionTimeDelta(),
+			ReconnectionDelta: peer.Stat.GetReconnectionTimeDelta(),
+		}
+	}
+	pool := []*net.UDPAddr{}
+	pool = append(pool, peer.KnownIPs...)
+	pool = append(pool, peer.Proxies...)
+	for _, v := range pool {
+		p.Pool = append(p.Pool, v.String())
+	}
+	return p
+}
+
+// formatDebug renders debug information as text of debug command
+func formatDebug(info *apiDebug) string {
+	out := fmt.Sprintf("Version: %s Build: %s\n", info.Version, info.Build)
+	out += fmt.Sprintf("Uptime: %d h %d m %d s\n", info.Uptime/3600, info.Uptime/60%60, info.Uptime%60)
+	out += fmt.Sprintf("Number of gouroutines: %d\n", info.Goroutines)
+	if info.PMTU {
+		out += fmt.Sprintf("PMTU: Enabled\n")
+	} else {
+		out += fmt.Sprintf("PMTU: Disabled\n")
+	}
+	out += fmt.Sprintf("Bootstrap nodes information:\n")
+	if info.Degraded {
+		out += fmt.Sprintf("  No active bootstrap nodes. Running in degraded mode\n")
+	}
+	for _, node := range info.Bootstrap {
+		out += fmt.Sprintf("  %s Rx: %d Tx: %d Version: %s Packet version: %s Framing: %d TLS: %s Connected: %t\n", node.Endpoint, node.Rx, node.Tx, node.Version, node.PacketVersion, node.Framing, node.TLS, node.Connected)
+	}
+	out += fmt.Sprintf("Instances information:\n")
+	for _, inst := range info.Instances {
+		out += fmt.Sprintf("Hash: %s\n", inst.Hash)
+		out += fmt.Sprintf("ID: %s\n", inst.ID)
+		out += fmt.Sprintf("UDP Port: %d\n", inst.Port)
+		out += fmt.Sprintf("Network interfaces: ")
+		for _, ip := range inst.LocalIPs {
+			out += fmt.Sprintf("%s ", ip)
+		}
+		out += "\n"
+		out += fmt.Sprintf("P2P Interface %s, HW Addr: %s, IP: %s\n", inst.Interface.Name, inst.Interface.Mac, inst.Interface.IP)
+		out += fmt.Sprintf("Proxies: ")
+		if len(inst.Proxies) == 0 {
+			out += fmt.Sprintf("No proxies in use")
+		}
+		for _, proxy := range inst.Proxies {
+			out += fmt.Sprintf("%s/%d [%d] ", proxy.Addr, proxy.Port, proxy.Latency)
+		}
+		out += "\n"
+		out += fmt.Sprintf("Peers:\n")
+		for _, peer := range inst.Peers {
+			out += fmt.Sprintf("\t--- %s ---\n", peer.ID)
+			out += fmt.Sprintf("\tStates: %s | %s\n", peer.State, peer.RemoteState)
+			if peer.Encryption != nil {
+				out += fmt.Sprintf("\tEncryption: %s | %s Sessions: %d Rejected: %d\n", peer.Encryption.Send, peer.Encryption.Recv, peer.Encryption.Sessions, peer.Encryption.Rejected)
+			}
+			if peer.IP == "" {
+				out += "\tNo IP assigned\n"
+			} else if peer.Mac == "" {
+				out += "\tNo MAC assigned\n"
 			} else {
-				resp.Output += fmt.Sprintf("\tNetwork: %s %s\n", peer.PeerLocalIP.String(), peer.PeerHW.String())
-				resp.Output += fmt.Sprintf("\tEndpoint: %s\n", peer.Endpoint)
-				resp.Output += fmt.Sprintf("\tAll Endpoints: ")
-				for _, ep := range peer.EndpointsHeap {
-					resp.Output += fmt.Sprintf("%s [%d] ", ep.Addr.String(), ptp.NanoToMilliseconds(ep.Latency.Nanoseconds()))
+				out += fmt.Sprintf("\tNetwork: %s %s\n", peer.IP, peer.Mac)
+				out += fmt.Sprintf("\tEndpoint: %s\n", peer.Endpoint)
+				out += fmt.Sprintf("\tAll Endpoints: ")
+				for _, ep := range peer.Endpoints {
+					out += fmt.Sprintf("%s [%d] ", ep.Addr, ep.Latency)
 				}
-				resp.Output += "\n"
-				c := peer.Stat.GetConnectionsNum()
-				r := peer.Stat.GetReconnectsNum()
-				hp := peer.Stat.GetHolePunchNum()
-				cdelta := peer.Stat.GetConnectionTimeDelta()
-				rdelta := peer.Stat.GetReconnectionTimeDelta()
-				resp.Output += fmt.Sprintf("Stats: [C: %d] [R: %d] [HP: %d] [CDelta: %d] [RDelta: %d]\n", c, r, hp, cdelta, rdelta)
+				out += "\n"
+				s := peer.Stats
+				out += fmt.Sprintf("Stats: [C: %d] [R: %d] [HP: %d] [CDelta: %d] [RDelta: %d]\n", s.Connections, s.Reconnects, s.HolePunches, s.ConnectionDelta, s.ReconnectionDelta)
 			}
-			resp.Output += fmt.Sprintf("\tEndpoints pool: ")
-			pool := []*net.UDPAddr{}
-			pool = append(pool, peer.KnownIPs...)
-			pool = append(pool, peer.Proxies...)
-			for _, v := range pool {
-				resp.Output += fmt.Sprintf("%s ", v.String())
+			out += fmt.Sprintf("\tEndpoints pool: ")
+			for _, v := range peer.Pool {
+				out += fmt.Sprintf("%s ", v)
 			}
-			resp.Output += "\n"
-			resp.Output += fmt.Sprintf("\t--- End of %s ---\n", peer.ID)
+			out += "\n"
+			out += fmt.Sprintf("\t--- End of %s ---\n", peer.ID)
 		}
 	}
-	return nil
+	return out
 }
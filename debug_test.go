@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFormatDebug(t *testing.T) {
+	info := &apiDebug{
+		Version:    "8.0.0",
+		Build:      "abc",
+		Uptime:     3725,
+		Goroutines: 12,
+		Degraded:   true,
+		Bootstrap: []apiDebugNode{
+			{Endpoint: "10.0.0.1:6881", Rx: 10, Tx: 20, Version: "1", PacketVersion: "2", Framing: 1, TLS: "off"},
+		},
+		Instances: []apiDebugInstance{{
+			Hash:      "swarm",
+			ID:        "id",
+			Port:      6000,
+			LocalIPs:  []string{"192.168.1.2"},
+			Interface: &apiInterface{Name: "p2p1", IP: "10.10.10.1", Mac: "06:00:00:00:00:01"},
+			Proxies:   []apiDebugProxy{{Addr: "10.0.0.2:7000", Port: 7001, Latency: 15}},
+			Peers: []apiDebugPeer{
+				{ID: "peer-a", State: "Connected", RemoteState: "Connected", Pool: []string{}},
+				{
+					ID:          "peer-b",
+					State:       "Connected",
+					RemoteState: "Connected",
+					Encryption:  &apiDebugCrypto{Send: "aead", Recv: "aead", Sessions: 1},
+					IP:          "10.10.10.2",
+					Mac:         "06:00:00:00:00:02",
+					Endpoint:    "192.168.1.3:6000",
+					Endpoints:   []apiDebugEndpoint{{Addr: "192.168.1.3:6000", Latency: 3}},
+					Stats:       &apiDebugStats{Connections: 1},
+					Pool:        []string{"192.168.1.3:6000"},
+				},
+			},
+		}},
+	}
+	want := "Version: 8.0.0 Build: abc\n" +
+		"Uptime: 1 h 2 m 5 s\n" +
+		"Number of gouroutines: 12\n" +
+		"PMTU: Disabled\n" +
+		"Bootstrap nodes information:\n" +
+		"  No active bootstrap nodes. Running in degraded mode\n" +
+		"  10.0.0.1:6881 Rx: 10 Tx: 20 Version: 1 Packet version: 2 Framing: 1 TLS: off Connected: false\n" +
+		"Instances information:\n" +
+		"Hash: swarm\n" +
+		"ID: id\n" +
+		"UDP Port: 6000\n" +
+		"Network interfaces: 192.168.1.2 \n" +
+		"P2P Interface p2p1, HW Addr: 06:00:00:00:00:01, IP: 10.10.10.1\n" +
+		"Proxies: 10.0.0.2:7000/7001 [15] \n" +
+		"Peers:\n" +
+		"\t--- peer-a ---\n" +
+		"\tStates: Connected | Connected\n" +
+		"\tNo IP assigned\n" +
+		"\tEndpoints pool: \n" +
+		"\t--- End of peer-a ---\n" +
+		"\t--- peer-b ---\n" +
+		"\tStates: Connected | Connected\n" +
+		"\tEncryption: aead | aead Sessions: 1 Rejected: 0\n" +
+		"\tNetwork: 10.10.10.2 06:00:00:00:00:02\n" +
+		"\tEndpoint: 192.168.1.3:6000\n" +
+		"\tAll Endpoints: 192.168.1.3:6000 [3] \n" +
+		"Stats: [C: 1] [R: 0] [HP: 0] [CDelta: 0] [RDelta: 0]\n" +
+		"\tEndpoints pool: 192.168.1.3:6000 \n" +
+		"\t--- End of peer-b ---\n"
+	if got := formatDebug(info); got != want {
+		t.Errorf("formatDebug() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	ptp "github.com/subutai-io/p2p/lib"
@@ -17,49 +18,232 @@ var (
 	ErrorBadRouterAddress = errors.New("Bad router address")
 )
 
+// How often list of bootstrap nodes is resolved again while
+// there is no active connection with any of them
+const bootstrapUpdateInterval = time.Duration(time.Second * 30)
+
 // DHTConnection to a DHT bootstrap node
 type DHTConnection struct {
 	routers     []*DHTRouter             // Bootstrap nodes
-	routersList map[int]string           // List of bootstrap nodes received from SRV lookup
+	routersList []string                 // List of bootstrap nodes received from SRV lookup, configuration or cache
+	target      string                   // SRV entry name or list of bootstrap nodes
+	routersLock sync.RWMutex             // Mutex for routers, routersList and target
 	lock        sync.Mutex               // Mutex for register/unregister
 	instances   map[string]*P2PInstance  // Instances
 	registered  []string                 // List of registered swarm IDs
 	incoming    chan *protocol.DHTPacket // Packets received by routers
 	ip          string                   // Our outbound IP
 	isActive    bool                     // Whether DHT connection is active or not
+	stateLock   sync.RWMutex             // Mutex for ip and isActive
+	tls         *ptp.BootstrapTLS        // TLS configuration of bootstrap connections
 }
 
+// init prepares connection and starts routers for every bootstrap node
+// that was found. When none were found routers will be resolved again
+// by monitor
 func (dht *DHTConnection) init(target string) error {
 	ptp.Log(ptp.Debug, "Initializing connection to a bootstrap nodes")
+	dht.target = target
 	dht.incoming = make(chan *protocol.DHTPacket)
-	var err error
-	dht.routersList, err = ptp.SrvLookup(target, "tcp", "subutai.io")
+	dht.routers = nil
+	dht.instances = make(map[string]*P2PInstance)
+	return dht.updateRouters()
+}
+
+// updateRouters resolves list of bootstrap nodes and starts routers for
+// nodes that are not known yet. Existing routers keep reconnecting on their own.
+// Malformed nodes are skipped
+func (dht *DHTConnection) updateRouters() error {
+	return dht.startRouters(dht.getTarget(), false)
+}
+
+// setTarget switches connection to a new list of bootstrap nodes. Target is
+// changed only when routers of new nodes were started, so failed switch
+// keeps current nodes. Routers of nodes that are not in the new list are stopped
+func (dht *DHTConnection) setTarget(target string) error {
+	return dht.startRouters(target, true)
+}
+
+// startRouters resolves target and starts routers of its nodes. When target
+// is switched routers of other nodes are stopped
+func (dht *DHTConnection) startRouters(target string, switchTarget bool) error {
+	routersList, err := ptp.ResolveBootstrap(target, "tcp")
 	if err != nil {
 		ptp.Log(ptp.Debug, "Failed to get bootstrap nodes: %s", err.Error())
-		dht.routersList = make(map[int]string)
+		routersList = []string{}
 	}
-	if len(dht.routersList) == 0 {
+
+	dht.routersLock.Lock()
+	defer dht.routersLock.Unlock()
+	if !switchTarget && target != dht.target {
+		// Target was switched while nodes were resolved
+		return nil
+	}
+	if len(routersList) == 0 {
 		return ErrorNoRouters
 	}
-	for _, r := range dht.routersList {
+	routers := append([]*DHTRouter{}, dht.routers...)
+	valid := 0
+	for _, r := range routersList {
 		if r == "" {
 			continue
 		}
+		exists := false
+		for _, router := range routers {
+			if router.router == r {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			valid++
+			continue
+		}
 		addr, err := net.ResolveTCPAddr("tcp4", r)
 		if err != nil {
 			ptp.Log(ptp.Error, "Bad router address provided [%s]: %s", r, err)
-			return ErrorBadRouterAddress
+			continue
 		}
 		router := new(DHTRouter)
 		router.addr = addr
 		router.router = r
+		if dht.tls != nil && dht.tls.Enabled {
+			router.tlsConfig, err = dht.tls.ClientConfig(r)
+			if err != nil {
+				ptp.Log(ptp.Error, "Bad TLS configuration for %s: %s", r, err)
+				continue
+			}
+		}
 		router.data = dht.incoming
-		dht.routers = append(dht.routers, router)
+		routers = append(routers, router)
+		valid++
+		go router.run()
+		go router.keepAlive()
+	}
+	if valid == 0 {
+		return ErrorBadRouterAddress
+	}
+	dht.routersList = routersList
+	if switchTarget {
+		dht.target = target
+		active := []*DHTRouter{}
+		for _, router := range routers {
+			found := false
+			for _, r := range routersList {
+				if router.router == r {
+					found = true
+					break
+				}
+			}
+			if found {
+				active = append(active, router)
+			} else {
+				ptp.Log(ptp.Info, "Disconnecting from bootstrap node %s", router.router)
+				router.close()
+			}
+		}
+		routers = active
+	}
+	dht.routers = routers
+	return nil
+}
+
+// getTarget returns SRV entry name or list of bootstrap nodes in use
+func (dht *DHTConnection) getTarget() string {
+	dht.routersLock.RLock()
+	defer dht.routersLock.RUnlock()
+	return dht.target
+}
+
+// getRouters returns copy of the list of routers
+func (dht *DHTConnection) getRouters() []*DHTRouter {
+	dht.routersLock.RLock()
+	defer dht.routersLock.RUnlock()
+	return append([]*DHTRouter{}, dht.routers...)
+}
+
+// getRouter returns router of bootstrap node or nil
+func (dht *DHTConnection) getRouter(node string) *DHTRouter {
+	for _, r := range dht.getRouters() {
+		if r != nil && r.router == node {
+			return r
+		}
 	}
-	dht.instances = make(map[string]*P2PInstance)
 	return nil
 }
 
+// getInstances returns copy of registered instances
+func (dht *DHTConnection) getInstances() []*P2PInstance {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	instances := []*P2PInstance{}
+	for _, inst := range dht.instances {
+		instances = append(instances, inst)
+	}
+	return instances
+}
+
+// getInstance returns registered instance or nil
+func (dht *DHTConnection) getInstance(hash string) *P2PInstance {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	return dht.instances[hash]
+}
+
+// hasActiveRouters returns true if at least one router completed handshake
+func (dht *DHTConnection) hasActiveRouters() bool {
+	for _, r := range dht.getRouters() {
+		if r != nil && r.isConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+// isConnected returns true while handshake with at least one bootstrap
+// node is completed
+func (dht *DHTConnection) isConnected() bool {
+	dht.stateLock.RLock()
+	defer dht.stateLock.RUnlock()
+	return dht.isActive
+}
+
+// getIP returns outbound IP reported by bootstrap nodes
+func (dht *DHTConnection) getIP() string {
+	dht.stateLock.RLock()
+	defer dht.stateLock.RUnlock()
+	return dht.ip
+}
+
+// monitor tracks state of bootstrap connection. When every bootstrap node
+// is lost daemon keeps working in degraded mode: established tunnels keep
+// forwarding traffic while routers reconnect in background and list of
+// bootstrap nodes is resolved again
+func (dht *DHTConnection) monitor() {
+	lastUpdate := time.Now()
+	for {
+		active := dht.hasActiveRouters()
+		if active != dht.isConnected() {
+			if active {
+				ptp.Log(ptp.Info, "Connection with bootstrap nodes established")
+			} else {
+				ptp.Log(ptp.Warning, "Lost connection with every bootstrap node. Running in degraded mode")
+			}
+			dht.stateLock.Lock()
+			dht.isActive = active
+			dht.stateLock.Unlock()
+		}
+		if !active && time.Since(lastUpdate) > bootstrapUpdateInterval {
+			lastUpdate = time.Now()
+			err := dht.updateRouters()
+			if err != nil {
+				ptp.Log(ptp.Warning, "Failed to update list of bootstrap nodes: %s", err)
+			}
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
 func (dht *DHTConnection) registerInstance(hash string, inst *P2PInstance) error {
 	dht.lock.Lock()
 	defer dht.lock.Unlock()
@@ -108,17 +292,43 @@ func (dht *DHTConnection) send(packet *protocol.DHTPacket) {
 		ptp.Log(ptp.Error, "Failed to marshal DHT Packet: %s", err)
 	}
 	ptp.Log(ptp.Trace, "Sending marshaled DHT Packet of size [%d]", len(data))
-	for i, router := range dht.routers {
-		if router.running && router.handshaked {
-			n, err := router.sendRaw(data)
+	for _, router := range dht.getRouters() {
+		if router.isConnected() {
+			dht.sendTo(router, data)
+		}
+	}
+}
+
+// sendTo sends marshaled packet to a single bootstrap node
+func (dht *DHTConnection) sendTo(router *DHTRouter, data []byte) error {
+	_, err := router.sendRaw(data)
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to send data to %s", router.addr.String())
+		return err
+	}
+	return nil
+}
+
+// restoreInstances registers every instance again on bootstrap node
+// that has reconnected, since it may not know about our swarms anymore
+func (dht *DHTConnection) restoreInstances(router *DHTRouter) {
+	send := func(packet *protocol.DHTPacket) error {
+		data, err := proto.Marshal(packet)
+		if err != nil {
+			return err
+		}
+		return dht.sendTo(router, data)
+	}
+	for _, inst := range dht.getInstances() {
+		if inst == nil || inst.PTP == nil || inst.PTP.Interface == nil {
+			continue
+		}
+		go func(inst *P2PInstance) {
+			err := inst.PTP.RestoreDHT(send)
 			if err != nil {
-				ptp.Log(ptp.Error, "Failed to send data to %s", router.addr.String())
-				continue
+				ptp.Log(ptp.Warning, "Failed to register %s on bootstrap node %s: %s", inst.ID, router.router, err)
 			}
-			if n >= 0 {
-				dht.routers[i].tx += uint64(n)
-			}
-		}
+		}(inst)
 	}
 }
 
@@ -132,15 +342,18 @@ func (dht *DHTConnection) run() {
 		// Ping should always provide us with outbound IP value
 		if packet.Type == protocol.DHTPacketType_Ping && packet.Data != "" {
 			ptp.Log(ptp.Info, "Received outbound IP: %s", packet.Data)
+			dht.stateLock.Lock()
 			dht.ip = packet.Data
+			dht.stateLock.Unlock()
 
-			if packet.Extra != "" && packet.Query == "handshaked" {
-				// Resend our IP
-				for _, inst := range dht.instances {
-					if inst == nil || inst.PTP == nil {
-						continue
-					}
-					inst.PTP.ReportIP(inst.PTP.Interface.GetIP().String(), inst.PTP.Interface.GetHardwareAddress().String(), inst.PTP.Interface.GetName())
+			if packet.Query == "handshaked" {
+				dht.cacheRouters()
+			}
+
+			if packet.Extra != "" && packet.Query == "handshaked" && len(packet.Arguments) == 1 {
+				router := dht.getRouter(packet.Arguments[0])
+				if router != nil {
+					dht.restoreInstances(router)
 				}
 			}
 
@@ -149,8 +362,8 @@ func (dht *DHTConnection) run() {
 		if packet.Infohash == "" {
 			continue
 		}
-		i, e := dht.instances[packet.Infohash]
-		if e && i != nil && i.PTP != nil && !i.PTP.Shutdown && i.PTP.Dht != nil && i.PTP.Dht.IncomingData != nil {
+		i := dht.getInstance(packet.Infohash)
+		if i != nil && i.PTP != nil && !i.PTP.Shutdown && i.PTP.Dht != nil && i.PTP.Dht.IncomingData != nil {
 			i.PTP.Dht.IncomingData <- packet
 		} else {
 			ptp.Log(ptp.Debug, "DHT received data for unknown instance %s: %+v", packet.Infohash, packet)
@@ -158,6 +371,21 @@ func (dht *DHTConnection) run() {
 	}
 }
 
+// cacheRouters will save addresses of handshaked routers, so they can be
+// used on next start when SRV lookup is not available
+func (dht *DHTConnection) cacheRouters() {
+	working := []string{}
+	for _, r := range dht.getRouters() {
+		if r != nil && r.isConnected() {
+			working = append(working, r.router)
+		}
+	}
+	err := ptp.SaveBootstrapCache("tcp", working)
+	if err != nil {
+		ptp.Log(ptp.Warning, "Failed to save bootstrap cache: %s", err)
+	}
+}
+
 func (dht *DHTConnection) unregisterInstance(hash string) error {
 	dht.lock.Lock()
 	defer dht.lock.Unlock()
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Framing of DHT packets in a TCP stream. Framing is negotiated during
+// handshake: bootstrap node lists supported framing versions in a greeting
+// and daemon requests one of them. Until negotiation is completed (or when
+// one of the sides doesn't support it) legacy format is used: daemon writes
+// a single packet per write and bootstrap node terminates every packet
+// with dhtDelimiter
+const (
+	dhtFramingLegacy = 0 // Delimiter-based format
+	dhtFramingLength = 1 // Every packet is prepended with 4-byte big-endian length
+
+	dhtFramingQuery  = "framing" // Query of a greeting and of a framing request
+	dhtFramedQuery   = "framed"  // Query of a framing request confirmation
+	dhtMaxPacketSize = 1024 * 1024
+)
+
+// dhtFramingVersions is a list of framing versions supported by this side
+var dhtFramingVersions = []int{dhtFramingLength}
+
+// dhtStreamReader decodes packets from a TCP stream one by one, so packets
+// that straddle several reads are reassembled and their order is preserved
+type dhtStreamReader struct {
+	reader  *bufio.Reader // Buffered connection
+	framing int           // Framing version currently used
+}
+
+func newDHTStreamReader(r io.Reader, framing int) *dhtStreamReader {
+	return &dhtStreamReader{
+		reader:  bufio.NewReaderSize(r, 4096),
+		framing: framing,
+	}
+}
+
+// next returns next packet from the stream
+func (s *dhtStreamReader) next() ([]byte, error) {
+	if s.framing == dhtFramingLength {
+		return s.nextFrame()
+	}
+	return s.nextDelimited()
+}
+
+func (s *dhtStreamReader) nextFrame() ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(s.reader, header)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > dhtMaxPacketSize {
+		return nil, fmt.Errorf("DHT packet is too large: %d bytes", length)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(s.reader, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// nextDelimited reads data until delimiter. Empty packets are skipped
+func (s *dhtStreamReader) nextDelimited() ([]byte, error) {
+	data := []byte{}
+	last := dhtDelimiter[len(dhtDelimiter)-1]
+	for {
+		chunk, err := s.reader.ReadSlice(last)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if len(data) > dhtMaxPacketSize+len(dhtDelimiter) {
+			return nil, fmt.Errorf("DHT packet is too large: no delimiter in %d bytes", len(data))
+		}
+		if err == nil && bytes.HasSuffix(data, dhtDelimiter) {
+			data = data[:len(data)-len(dhtDelimiter)]
+			if len(data) > 0 {
+				return data, nil
+			}
+		}
+	}
+}
+
+// frameDHTData prepends packet with its length
+func frameDHTData(data []byte) []byte {
+	framed := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(framed, uint32(len(data)))
+	copy(framed[4:], data)
+	return framed
+}
+
+// selectDHTFraming returns the highest framing version from the list that
+// is supported by this side or dhtFramingLegacy if there is none
+func selectDHTFraming(versions []string) int {
+	selected := dhtFramingLegacy
+	for _, v := range versions {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		for _, supported := range dhtFramingVersions {
+			if version == supported && version > selected {
+				selected = version
+			}
+		}
+	}
+	return selected
+}
+
+// dhtFramingList returns list of supported framing versions as strings
+func dhtFramingList() []string {
+	list := []string{}
+	for _, v := range dhtFramingVersions {
+		list = append(list, strconv.Itoa(v))
+	}
+	return list
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDHTStreamReader(t *testing.T) {
+	payload := []byte{1, 0x0a, 0x0b, 0x0c, 0x0a, 2}
+	framed := append(frameDHTData(payload), frameDHTData([]byte{3})...)
+	tests := []struct {
+		name    string
+		framing int
+		data    []byte
+		want    [][]byte
+	}{
+		{"legacy", dhtFramingLegacy, []byte{1, 2, 0x0a, 0x0b, 0x0c, 0x0a, 3, 0x0a, 0x0b, 0x0c, 0x0a}, [][]byte{{1, 2}, {3}}},
+		{"legacy leading delimiter", dhtFramingLegacy, []byte{0x0a, 0x0b, 0x0c, 0x0a, 4, 0x0a, 0x0b, 0x0c, 0x0a}, [][]byte{{4}}},
+		{"legacy partial delimiter", dhtFramingLegacy, []byte{0x0a, 0x0b, 5, 0x0a, 0x0b, 0x0c, 0x0a}, [][]byte{{0x0a, 0x0b, 5}}},
+		{"length", dhtFramingLength, framed, [][]byte{payload, {3}}},
+		{"length empty packet", dhtFramingLength, frameDHTData([]byte{}), [][]byte{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every read returns a single byte, so packets straddle reads
+			reader := newDHTStreamReader(iotest.OneByteReader(bytes.NewReader(tt.data)), tt.framing)
+			got := [][]byte{}
+			for {
+				data, err := reader.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("next() error = %v", err)
+				}
+				got = append(got, data)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDHTStreamReaderTooLarge(t *testing.T) {
+	data := frameDHTData(make([]byte, dhtMaxPacketSize+1))
+	reader := newDHTStreamReader(bytes.NewReader(data), dhtFramingLength)
+	if _, err := reader.next(); err == nil || err == io.EOF {
+		t.Errorf("Oversized packet was accepted: %v", err)
+	}
+}
+
+func TestSelectDHTFraming(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		want     int
+	}{
+		{"nil", nil, dhtFramingLegacy},
+		{"unknown", []string{"7", "bad"}, dhtFramingLegacy},
+		{"supported", []string{"7", "1"}, dhtFramingLength},
+		{"own list", dhtFramingList(), dhtFramingLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectDHTFraming(tt.versions); got != tt.want {
+				t.Errorf("selectDHTFraming() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -11,9 +14,12 @@ import (
 	"github.com/subutai-io/p2p/protocol"
 )
 
+// dhtTLSHandshakeTimeout limits time of TLS handshake with a bootstrap node
+const dhtTLSHandshakeTimeout = time.Duration(time.Second * 10)
+
 // DHTRouter represents a connection to a router
 type DHTRouter struct {
-	conn          *net.TCPConn             // TCP connection to a bootsrap node
+	conn          net.Conn                 // TCP or TLS connection to a bootsrap node
 	addr          *net.TCPAddr             // TCP address of a bootstrap node
 	router        string                   // Address of a bootstrap node
 	running       bool                     // Whether router is running or not
@@ -26,56 +32,106 @@ type DHTRouter struct {
 	lastContact   time.Time                // Last communication
 	packetVersion string                   // Version of packet on DHT
 	version       string                   // Version of DHT
+	framing       int                      // Framing version used for this connection
+	reader        *dhtStreamReader         // Decoder of incoming packets
+	greeting      *protocol.DHTPacket      // Greeting received while framing is negotiated
+	tlsConfig     *tls.Config              // TLS configuration. Plain TCP is used when nil
+	tlsState      string                   // Human-readable state of TLS session
+	lock          sync.Mutex               // Mutex for connection state. Reader and greeting are used by run only
+}
+
+// dhtRouterStats is a snapshot of router state
+type dhtRouterStats struct {
+	connected     bool
+	fails         int
+	tx            uint64
+	rx            uint64
+	packetVersion string
+	version       string
+	framing       int
+	tlsState      string
 }
 
 func (dht *DHTRouter) run() {
+	dht.lock.Lock()
 	dht.running = false
 	dht.handshaked = false
 	dht.version = "Unknown"
 	dht.packetVersion = "Unknown"
+	dht.lock.Unlock()
 
-	for !dht.stop {
-		for !dht.running {
+	for !dht.isStopped() {
+		for !dht.isRunning() {
 			dht.connect()
-			if dht.running || dht.stop {
+			if dht.isRunning() || dht.isStopped() {
 				break
 			}
 			dht.sleep()
 		}
-		data := make([]byte, ptp.DHTBufferSize)
-		n, err := dht.conn.Read(data)
+		if dht.isStopped() {
+			break
+		}
+		data, err := dht.reader.next()
 		if err != nil {
 			ptp.Log(ptp.Warning, "BSN socket closed: %s", err)
-			dht.running = false
-			dht.handshaked = false
+			if dht.disconnect() {
+				dht.publish(ptp.EventBootstrapDisconnected, fmt.Sprintf("Connection closed: %s", err))
+			}
 			continue
 		}
+		dht.lock.Lock()
 		dht.lastContact = time.Now()
-		go dht.handleData(data[:n])
+		dht.rx += uint64(len(data))
+		dht.lock.Unlock()
+		// Packets are routed in the order they were received
+		dht.routeData(data)
 	}
 }
 
-func (dht *DHTRouter) handleData(data []byte) {
-	length := len(data)
-	dht.rx += uint64(length)
-	i := 0
-	handled := 0
-	ptp.Log(ptp.Trace, "Handling data: data length is [%d]", len(data))
-	for i >= 0 {
-		i = bytes.Index(data, []byte{0x0a, 0x0b, 0x0c, 0x0a})
-		if i <= 0 {
-			break
-		}
-		handled++
-		dht.routeData(data[:i])
-		if i+4 < len(data) {
-			data = data[i+4:]
-		} else {
-			break
-		}
-	}
-	if handled == 0 {
-		dht.routeData(data[:length])
+// isRunning returns true when connection with bootstrap node is established
+func (dht *DHTRouter) isRunning() bool {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	return dht.running
+}
+
+// isConnected returns true when handshake with bootstrap node is completed
+func (dht *DHTRouter) isConnected() bool {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	return dht.running && dht.handshaked
+}
+
+func (dht *DHTRouter) isStopped() bool {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	return dht.stop
+}
+
+// disconnect marks connection as lost and returns true if handshake was
+// completed on it
+func (dht *DHTRouter) disconnect() bool {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	handshaked := dht.handshaked
+	dht.running = false
+	dht.handshaked = false
+	return handshaked
+}
+
+// stats returns snapshot of router state
+func (dht *DHTRouter) stats() dhtRouterStats {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	return dhtRouterStats{
+		connected:     dht.running && dht.handshaked,
+		fails:         dht.fails,
+		tx:            dht.tx,
+		rx:            dht.rx,
+		packetVersion: dht.packetVersion,
+		version:       dht.version,
+		framing:       dht.framing,
+		tlsState:      dht.tlsState,
 	}
 }
 
@@ -89,7 +145,10 @@ func (dht *DHTRouter) routeData(data []byte) {
 		return
 	}
 	ptp.Log(ptp.Trace, "Received DHT packet: %+v", packet)
-	if packet.Type == protocol.DHTPacketType_Ping && dht.handshaked == false {
+	dht.lock.Lock()
+	handshaked := dht.handshaked
+	dht.lock.Unlock()
+	if packet.Type == protocol.DHTPacketType_Ping && handshaked == false {
 		supported := false
 		for _, v := range ptp.SupportedVersion {
 			if v == packet.Version {
@@ -98,53 +157,165 @@ func (dht *DHTRouter) routeData(data []byte) {
 		}
 		if !supported {
 			ptp.Log(ptp.Error, "Version mismatch. Server have %d. We have %d", packet.Version, ptp.PacketVersion)
+			dht.lock.Lock()
 			dht.stop = true
 			if dht.conn != nil {
 				dht.conn.Close()
 			}
+			dht.lock.Unlock()
+		} else if packet.Query == dhtFramedQuery && dht.greeting != nil {
+			framing, _ := strconv.Atoi(packet.Data)
+			if framing != dhtFramingLegacy {
+				ptp.Log(ptp.Debug, "Switching to framing version %d with %s", framing, dht.addr.String())
+				dht.setFraming(framing)
+			}
+			dht.completeHandshake()
+			return
 		} else {
-			dht.handshaked = true
-			ptp.Log(ptp.Info, "Connected to a bootstrap node: %s [%s]", dht.addr.String(), packet.Data)
-			dht.packetVersion = fmt.Sprintf("%d", packet.Version)
-			if packet.Extra != "" {
-				ptp.Log(ptp.Info, "DHT Version: %s", packet.Extra)
-				dht.version = packet.Extra
+			dht.greeting = packet
+			framing := selectDHTFraming(packet.Arguments)
+			if packet.Query != dhtFramingQuery || framing == dhtFramingLegacy || dht.requestFraming(framing) != nil {
+				dht.completeHandshake()
 			}
-			packet.Query = "handshaked"
-			dht.data <- packet
 			return
 		}
 	}
-	if !dht.handshaked {
+	if !handshaked {
 		ptp.Log(ptp.Trace, "Skipping packet: not handshaked")
 		return
 	}
 	dht.data <- packet
 }
 
+// requestFraming asks bootstrap node to switch to specified framing. Handshake
+// is completed when bootstrap node confirms it
+func (dht *DHTRouter) requestFraming(framing int) error {
+	packet := &protocol.DHTPacket{
+		Type:    protocol.DHTPacketType_Ping,
+		Query:   dhtFramingQuery,
+		Data:    strconv.Itoa(framing),
+		Version: ptp.PacketVersion,
+	}
+	data, err := proto.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	_, err = dht.sendRaw(data)
+	if err != nil {
+		ptp.Log(ptp.Warning, "Failed to request framing from %s: %s", dht.addr.String(), err)
+	}
+	return err
+}
+
+func (dht *DHTRouter) setFraming(framing int) {
+	dht.lock.Lock()
+	dht.framing = framing
+	dht.lock.Unlock()
+	if dht.reader != nil {
+		dht.reader.framing = framing
+	}
+}
+
+// completeHandshake passes greeting of a bootstrap node to the connection
+func (dht *DHTRouter) completeHandshake() {
+	packet := dht.greeting
+	dht.greeting = nil
+	dht.lock.Lock()
+	dht.handshaked = true
+	dht.packetVersion = fmt.Sprintf("%d", packet.Version)
+	if packet.Extra != "" {
+		dht.version = packet.Extra
+	}
+	dht.lock.Unlock()
+	ptp.Log(ptp.Info, "Connected to a bootstrap node: %s [%s]", dht.addr.String(), packet.Data)
+	dht.publish(ptp.EventBootstrapConnected, "Connected to a bootstrap node")
+	if packet.Extra != "" {
+		ptp.Log(ptp.Info, "DHT Version: %s", packet.Extra)
+	}
+	packet.Query = "handshaked"
+	// Connection uses it to register instances on this node only
+	packet.Arguments = []string{dht.router}
+	dht.data <- packet
+}
+
 func (dht *DHTRouter) connect() {
+	dht.greeting = nil
+	dht.lock.Lock()
 	dht.handshaked = false
 	dht.running = false
-
+	dht.framing = dhtFramingLegacy
 	if dht.conn != nil {
 		dht.conn.Close()
 		dht.conn = nil
 	}
+	dht.lock.Unlock()
 
-	var err error
-	dht.conn, err = net.DialTCP("tcp4", nil, dht.addr)
+	tcpConn, err := net.DialTCP("tcp4", nil, dht.addr)
 	if err != nil {
+		dht.lock.Lock()
 		dht.fails++
+		dht.lock.Unlock()
 		ptp.Log(ptp.Error, "Failed to establish connection with %s: %s", dht.addr.String(), err)
 		return
 	}
+	var conn net.Conn = tcpConn
+	tlsState := "Disabled"
+	if dht.tlsConfig != nil {
+		// Router is marked as failed when certificate can't be verified
+		tlsConn, err := dht.startTLS(conn)
+		if err != nil {
+			dht.lock.Lock()
+			dht.fails++
+			dht.tlsState = fmt.Sprintf("Failed: %s", err)
+			dht.lock.Unlock()
+			ptp.Log(ptp.Error, "TLS handshake with %s failed: %s", dht.addr.String(), err)
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+		tlsState = dht.tlsSessionState(tlsConn)
+		ptp.Log(ptp.Info, "Established TLS session with %s: %s", dht.addr.String(), tlsState)
+	}
+	dht.reader = newDHTStreamReader(conn, dhtFramingLegacy)
+
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	if dht.stop {
+		// Router was closed while connecting
+		conn.Close()
+		return
+	}
+	dht.conn = conn
+	dht.tlsState = tlsState
 	dht.lastContact = time.Now()
 	dht.fails = 0
 	dht.running = true
 }
 
+// startTLS performs TLS handshake and verifies certificate of a bootstrap node
+func (dht *DHTRouter) startTLS(conn net.Conn) (*tls.Conn, error) {
+	client := tls.Client(conn, dht.tlsConfig)
+	client.SetDeadline(time.Now().Add(dhtTLSHandshakeTimeout))
+	err := client.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	client.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// tlsSessionState returns human-readable state of TLS session
+func (dht *DHTRouter) tlsSessionState(conn *tls.Conn) string {
+	state := conn.ConnectionState()
+	tlsState := fmt.Sprintf("%s %s", ptp.TLSVersionName(state.Version), ptp.CipherSuiteName(state.CipherSuite))
+	if len(state.PeerCertificates) > 0 {
+		tlsState += " " + ptp.SPKIPin(state.PeerCertificates[0])
+	}
+	return tlsState
+}
+
 func (dht *DHTRouter) sleep() {
-	multiplier := dht.fails * 5
+	multiplier := dht.stats().fails * 5
 	if multiplier > 30 {
 		multiplier = 30
 	}
@@ -158,30 +329,71 @@ func (dht *DHTRouter) sleep() {
 
 func (dht *DHTRouter) keepAlive() {
 	lastPing := time.Now()
+	dht.lock.Lock()
 	dht.lastContact = time.Now()
-	for {
-		if time.Since(lastPing) > time.Duration(time.Millisecond*30000) && time.Since(dht.lastContact) > time.Duration(time.Millisecond*40) {
+	dht.lock.Unlock()
+	for !dht.isStopped() {
+		dht.lock.Lock()
+		handshaked, running, lastContact := dht.handshaked, dht.running, dht.lastContact
+		dht.lock.Unlock()
+		if handshaked && time.Since(lastPing) > time.Duration(time.Millisecond*30000) && time.Since(lastContact) > time.Duration(time.Millisecond*40) {
 			lastPing = time.Now()
 			if dht.ping() != nil {
 				ptp.Log(ptp.Error, "DHT router ping failed")
 			}
 		}
-		if time.Since(dht.lastContact) > time.Duration(time.Millisecond*60000) && dht.running {
+		if time.Since(lastContact) > time.Duration(time.Millisecond*60000) && running {
 			ptp.Log(ptp.Warning, "Disconnected from DHT router %s by timeout", dht.addr.String())
-			dht.handshaked = false
-			dht.running = false
-			dht.conn.Close()
-			dht.conn = nil
+			dht.lock.Lock()
+			if dht.conn != nil {
+				dht.conn.Close()
+				dht.conn = nil
+			}
+			dht.lock.Unlock()
+			if dht.disconnect() {
+				dht.publish(ptp.EventBootstrapDisconnected, "Disconnected by timeout")
+			}
 		}
 		time.Sleep(time.Millisecond * 100)
 	}
 }
 
+// publish sends event about connection with bootstrap node
+func (dht *DHTRouter) publish(eventType, message string) {
+	ptp.Events.Publish(ptp.Event{
+		Type:    eventType,
+		Message: message,
+		Data:    map[string]string{"router": dht.router},
+	})
+}
+
+// close terminates connection with bootstrap node
+func (dht *DHTRouter) close() {
+	dht.lock.Lock()
+	defer dht.lock.Unlock()
+	dht.stop = true
+	dht.handshaked = false
+	dht.running = false
+	if dht.conn != nil {
+		dht.conn.Close()
+	}
+}
+
 func (dht *DHTRouter) sendRaw(data []byte) (int, error) {
-	if dht.conn == nil {
+	dht.lock.Lock()
+	conn, framing := dht.conn, dht.framing
+	dht.lock.Unlock()
+	if conn == nil {
 		return -1, fmt.Errorf("Can't send: connection is nil")
 	}
-	return dht.conn.Write(data)
+	if framing == dhtFramingLength {
+		data = frameDHTData(data)
+	}
+	n, err := conn.Write(data)
+	dht.lock.Lock()
+	dht.tx += uint64(n)
+	dht.lock.Unlock()
+	return n, err
 }
 
 func (dht *DHTRouter) ping() error {
@@ -1,7 +1,17 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	ptp "github.com/subutai-io/p2p/lib"
@@ -38,3 +48,207 @@ func TestRouteData(t *testing.T) {
 		router.routeData(b)
 	}
 }
+
+func TestDHTConnectionDegradedMode(t *testing.T) {
+	server := new(BootstrapServer)
+	err := server.init("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start bootstrap server: %s", err)
+	}
+	addr := server.listener.Addr().String()
+	go server.run()
+
+	dht := new(DHTConnection)
+	err = dht.init("tcp://" + addr)
+	if err != nil {
+		t.Fatalf("Failed to init DHT connection: %s", err)
+	}
+	// Known routers must not be duplicated
+	if dht.updateRouters() != nil || len(dht.routers) != 1 {
+		t.Fatalf("Expected single router, got %d", len(dht.routers))
+	}
+	defer func() {
+		for _, r := range dht.getRouters() {
+			r.close()
+		}
+	}()
+	go dht.run()
+	go dht.monitor()
+
+	waitState := func(active bool, timeout time.Duration) {
+		started := time.Now()
+		for dht.isConnected() != active {
+			if time.Since(started) > timeout {
+				t.Fatalf("DHT connection didn't switch to active=%t", active)
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+
+	waitState(true, time.Second*3)
+	if framing := dht.getRouters()[0].stats().framing; framing != dhtFramingLength {
+		t.Fatalf("Router didn't negotiate framing: %d", framing)
+	}
+	server.close()
+	waitState(false, time.Second*3)
+
+	server = new(BootstrapServer)
+	err = server.init(addr, "", "")
+	if err != nil {
+		t.Fatalf("Failed to restart bootstrap server: %s", err)
+	}
+	defer server.close()
+	go server.run()
+	waitState(true, time.Second*15)
+}
+
+func testTLSCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bootstrap"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key}, cert
+}
+
+func TestDHTConnection_updateRouters(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		wantErr     error
+		wantRouters int
+	}{
+		{"valid", "tcp://127.0.0.1:1", nil, 1},
+		{"bad node skipped", "tcp://127.0.0.1:99999,tcp://127.0.0.1:1", nil, 1},
+		{"every node is bad", "tcp://127.0.0.1:99999", ErrorBadRouterAddress, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dht := new(DHTConnection)
+			err := dht.init(tt.target)
+			routers := dht.getRouters()
+			for _, r := range routers {
+				r.close()
+			}
+			if err != tt.wantErr {
+				t.Errorf("DHTConnection.updateRouters() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(routers) != tt.wantRouters {
+				t.Errorf("DHTConnection.updateRouters() started %d routers, want %d", len(routers), tt.wantRouters)
+			}
+		})
+	}
+}
+
+func TestDHTConnection_setTarget(t *testing.T) {
+	dht := new(DHTConnection)
+	if err := dht.init("tcp://127.0.0.1:1"); err != nil {
+		t.Fatalf("Failed to init DHT connection: %s", err)
+	}
+	defer func() {
+		for _, r := range dht.getRouters() {
+			r.close()
+		}
+	}()
+
+	tests := []struct {
+		name       string
+		target     string
+		wantErr    bool
+		wantTarget string
+		wantRouter string
+	}{
+		{"bad nodes", "tcp://127.0.0.1:99999", true, "tcp://127.0.0.1:1", "127.0.0.1:1"},
+		{"switched", "tcp://127.0.0.1:2", false, "tcp://127.0.0.1:2", "127.0.0.1:2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := dht.setTarget(tt.target); (err != nil) != tt.wantErr {
+				t.Errorf("DHTConnection.setTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if dht.getTarget() != tt.wantTarget {
+				t.Errorf("DHTConnection.setTarget() target = %s, want %s", dht.getTarget(), tt.wantTarget)
+			}
+			routers := dht.getRouters()
+			if len(routers) != 1 || routers[0].router != tt.wantRouter {
+				t.Errorf("DHTConnection.setTarget() routers = %v, want %s", routers, tt.wantRouter)
+			}
+		})
+	}
+}
+
+func TestDHTRouterTLS(t *testing.T) {
+	certificate, cert := testTLSCertificate(t)
+	_, other := testTLSCertificate(t)
+
+	server := new(BootstrapServer)
+	server.tls = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	err := server.init("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start bootstrap server: %s", err)
+	}
+	defer server.close()
+	go server.run()
+	addr := server.listener.Addr().String()
+
+	tests := []struct {
+		name      string
+		pin       string
+		handshake bool
+	}{
+		{"pinned", ptp.SPKIPin(cert), true},
+		{"wrong pin", ptp.SPKIPin(other), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &ptp.BootstrapTLS{Enabled: true, Nodes: map[string]ptp.BootstrapTLSNode{addr: {Pins: []string{tt.pin}}}}
+			router := new(DHTRouter)
+			router.addr, _ = net.ResolveTCPAddr("tcp4", addr)
+			router.router = addr
+			router.data = make(chan *protocol.DHTPacket, 1)
+			router.tlsConfig, err = conf.ClientConfig(addr)
+			if err != nil {
+				t.Fatalf("Bad TLS configuration: %s", err)
+			}
+			defer router.close()
+			go router.run()
+
+			if tt.handshake {
+				select {
+				case packet := <-router.data:
+					if packet.Query != "handshaked" || router.stats().framing != dhtFramingLength {
+						t.Fatalf("Bad handshake: %+v", packet)
+					}
+				case <-time.After(time.Second * 3):
+					t.Fatalf("Handshake over TLS timed out")
+				}
+				if tlsState := router.stats().tlsState; !strings.Contains(tlsState, ptp.SPKIPin(cert)) {
+					t.Errorf("Bad TLS state: %s", tlsState)
+				}
+				return
+			}
+			started := time.Now()
+			for router.stats().fails == 0 {
+				if time.Since(started) > time.Second*3 {
+					t.Fatalf("Router wasn't marked as failed")
+				}
+				time.Sleep(time.Millisecond * 50)
+			}
+			if stats := router.stats(); stats.connected || !strings.HasPrefix(stats.tlsState, "Failed") {
+				t.Errorf("Bad TLS state: %s", stats.tlsState)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// CommandEnable will start instance from its save entry and
+// restore it on next daemon launches
+func CommandEnable(rpcPort int, hash string) {
+	commandSetEnabled(rpcPort, "enable", hash)
+}
+
+// CommandDisable will stop instance, but keep it in a save file,
+// so it can be enabled later
+func CommandDisable(rpcPort int, hash string) {
+	commandSetEnabled(rpcPort, "disable", hash)
+}
+
+func commandSetEnabled(rpcPort int, command, hash string) {
+	if hash == "" {
+		fmt.Fprintf(os.Stderr, "Not enough parameters for %s command\n", command)
+		os.Exit(2)
+	}
+	c := newClient(rpcPort)
+	if command == "enable" {
+		exitWithResult(c.Enable(context.Background(), hash))
+	}
+	exitWithResult(c.Disable(context.Background(), hash))
+}
+
+func (d *Daemon) execRESTEnable(w http.ResponseWriter, r *http.Request) {
+	d.execRESTSetEnabled(w, r, d.Enable)
+}
+
+func (d *Daemon) execRESTDisable(w http.ResponseWriter, r *http.Request) {
+	d.execRESTSetEnabled(w, r, d.Disable)
+}
+
+func (d *Daemon) execRESTSetEnabled(w http.ResponseWriter, r *http.Request, handler func(*DaemonArgs, *Response) error) {
+	if !ReadyToServe {
+		resp, _ := getResponse(105, "P2P Daemon is in initialization state")
+		w.Write(resp)
+		return
+	}
+	args := new(DaemonArgs)
+	err := getJSON(r.Body, args)
+	if handleMarshalError(err, w) != nil {
+		return
+	}
+	response := new(Response)
+	handler(&DaemonArgs{Hash: args.Hash}, response)
+	resp, err := getResponse(response.ExitCode, response.Output)
+	if err != nil {
+		ptp.Log(ptp.Error, "Internal error: %s", err)
+		return
+	}
+	w.Write(resp)
+}
+
+// Enable marks saved instance as enabled and starts it
+func (d *Daemon) Enable(args *DaemonArgs, resp *Response) error {
+	entry, err := d.savedEntry(args, resp)
+	if err != nil {
+		return err
+	}
+	ptp.Log(ptp.Info, "Enabling instance %s", args.Hash)
+	d.Supervisor.remove(args.Hash)
+	if isSealed(entry.Key) {
+		resp.ExitCode = 1
+		resp.Output = "Key of instance " + args.Hash + " can't be decrypted"
+		return errors.New(resp.Output)
+	}
+	if d.Instances.getInstance(args.Hash) == nil {
+		err = d.run(entry.runArgs(), resp)
+		if err != nil {
+			return err
+		}
+	}
+	d.Restore.bumpInstance(args.Hash)
+	d.Restore.setLastError(args.Hash, nil)
+	d.saveEnabled(args.Hash, true)
+	resp.ExitCode = 0
+	resp.Output = "Instance " + args.Hash + " enabled"
+	return nil
+}
+
+// Disable stops instance and marks it as disabled. Save entry is kept,
+// so instance won't be restored until it's enabled again
+func (d *Daemon) Disable(args *DaemonArgs, resp *Response) error {
+	_, err := d.savedEntry(args, resp)
+	if err != nil {
+		return err
+	}
+	ptp.Log(ptp.Info, "Disabling instance %s", args.Hash)
+	d.Supervisor.remove(args.Hash)
+	inst := d.Instances.getInstance(args.Hash)
+	if inst != nil {
+		d.stopInstance(inst)
+	}
+	d.saveEnabled(args.Hash, false)
+	resp.ExitCode = 0
+	resp.Output = "Instance " + args.Hash + " disabled"
+	return nil
+}
+
+// savedEntry returns save entry of instance specified in arguments
+func (d *Daemon) savedEntry(args *DaemonArgs, resp *Response) (saveEntry, error) {
+	if args.Hash == "" {
+		resp.ExitCode = 2
+		resp.Output = "Hash was not specified"
+		return saveEntry{}, errors.New(resp.Output)
+	}
+	if d.Restore == nil || !d.Restore.isActive() {
+		resp.ExitCode = 3
+		resp.Output = "Save file is not configured. Launch daemon with -save"
+		return saveEntry{}, errors.New(resp.Output)
+	}
+	entry, exists := d.Restore.getEntry(args.Hash)
+	if !exists {
+		resp.ExitCode = 1
+		resp.Output = "Instance with hash " + args.Hash + " was not found in save file"
+		return saveEntry{}, errors.New(resp.Output)
+	}
+	return entry, nil
+}
+
+func (d *Daemon) saveEnabled(hash string, enabled bool) {
+	err := d.Restore.setEnabled(hash, enabled)
+	if err != nil {
+		ptp.Log(ptp.Error, "%s", err)
+		return
+	}
+	err = d.Restore.save()
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to save instance information: %s", err)
+	}
+}
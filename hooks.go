@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+const (
+	defaultHookTimeout    = time.Duration(time.Second * 10)
+	defaultHookRetryDelay = time.Duration(time.Second * 1)
+	hookKillDelay         = time.Duration(time.Second * 1)
+)
+
+// hookQueueSize is a number of events waiting for a hook. Events are
+// dropped when hook doesn't keep up
+const hookQueueSize = 256
+
+// runningHooks counts hooks that still have events to deliver
+var runningHooks sync.WaitGroup
+
+// hook runs executable or webhook on matching events. Events are
+// delivered one at a time in the order they were published
+type hook struct {
+	conf  ptp.HookConf
+	queue chan ptp.Event
+}
+
+func newHook(conf ptp.HookConf) *hook {
+	h := &hook{
+		conf:  conf,
+		queue: make(chan ptp.Event, hookQueueSize),
+	}
+	runningHooks.Add(1)
+	go h.run()
+	return h
+}
+
+func (h *hook) name() string {
+	if h.conf.Exec != "" {
+		return h.conf.Exec
+	}
+	return h.conf.URL
+}
+
+func (h *hook) matches(e ptp.Event) bool {
+	if len(h.conf.Events) == 0 {
+		return true
+	}
+	for _, t := range h.conf.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver queues event without blocking
+func (h *hook) deliver(e ptp.Event) {
+	select {
+	case h.queue <- e:
+	default:
+		ptp.Log(ptp.Warning, "Hook %s doesn't keep up. Dropping %s event", h.name(), e.Type)
+	}
+}
+
+// stop terminates hook after queued events were delivered
+func (h *hook) stop() {
+	close(h.queue)
+}
+
+func (h *hook) run() {
+	defer runningHooks.Done()
+	for e := range h.queue {
+		h.call(e)
+	}
+}
+
+// call runs hook until it succeeds or retries are exhausted
+func (h *hook) call(e ptp.Event) error {
+	timeout := defaultHookTimeout
+	if h.conf.Timeout > 0 {
+		timeout = h.conf.Timeout
+	}
+	delay := defaultHookRetryDelay
+	if h.conf.RetryDelay > 0 {
+		delay = h.conf.RetryDelay
+	}
+	var err error
+	for attempt := 0; attempt <= h.conf.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if h.conf.Exec != "" {
+			err = runHookExec(ctx, h.conf, e)
+		} else {
+			err = callWebhook(ctx, h.conf.URL, e)
+		}
+		cancel()
+		if err == nil {
+			return nil
+		}
+		ptp.Log(ptp.Warning, "Hook %s failed on %s event: %s", h.name(), e.Type, err)
+	}
+	ptp.Log(ptp.Error, "Hook %s failed on %s event after %d attempts", h.name(), e.Type, h.conf.Retries+1)
+	return err
+}
+
+// runHookExec runs executable with event in its environment. Executable
+// is killed together with its children when context is done
+func runHookExec(ctx context.Context, conf ptp.HookConf, e ptp.Event) error {
+	cmd := exec.Command(conf.Exec, conf.Args...)
+	cmd.Env = append(os.Environ(), hookEnv(e)...)
+	output := new(bytes.Buffer)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Children of killed executable may keep its output open
+		killProcessGroup(cmd)
+		select {
+		case <-done:
+		case <-time.After(hookKillDelay):
+		}
+		return fmt.Errorf("Timed out")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// callWebhook sends event as JSON. Any status except 2xx is a failure
+func callWebhook(ctx context.Context, url string, e ptp.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// hookEnv returns environment describing event. Data of event is passed
+// in upper-cased variables, e.g. P2P_IP
+func hookEnv(e ptp.Event) []string {
+	env := []string{
+		"P2P_EVENT=" + e.Type,
+		"P2P_TIME=" + e.Time.Format(time.RFC3339),
+		"P2P_HASH=" + e.Hash,
+		"P2P_PEER=" + e.Peer,
+		"P2P_MESSAGE=" + e.Message,
+	}
+	keys := []string{}
+	for key := range e.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, "P2P_"+strings.ToUpper(key)+"="+e.Data[key])
+	}
+	return env
+}
+
+// hookDispatcher delivers events to hooks of daemon and instances.
+// Hooks are recreated when their configuration changes
+type hookDispatcher struct {
+	daemon    []*hook
+	instances map[string][]*hook // Hooks of instances by hash
+}
+
+func newHookDispatcher() *hookDispatcher {
+	return &hookDispatcher{instances: make(map[string][]*hook)}
+}
+
+// runHooks delivers events of daemon to configured hooks until flush is
+// requested. Queued events are delivered and hooks are stopped before
+// channel received with request is closed
+func runHooks(d *Daemon) {
+	events := ptp.Events.Subscribe("")
+	hd := newHookDispatcher()
+	dispatch := func(e ptp.Event) {
+		var confs []ptp.HookConf
+		running := false
+		if e.Hash != "" {
+			inst := d.Instances.getInstance(e.Hash)
+			if inst != nil {
+				confs = inst.Args.Hooks
+				running = true
+			}
+		}
+		hd.dispatch(e, d.settings.hooks(), confs, running)
+	}
+	for {
+		select {
+		case e := <-events:
+			dispatch(e)
+		case done := <-d.hooks:
+			ptp.Events.Unsubscribe(events)
+			for len(events) > 0 {
+				dispatch(<-events)
+			}
+			hd.stop()
+			runningHooks.Wait()
+			close(done)
+			return
+		}
+	}
+}
+
+// flushHooks waits until events published so far are delivered by hooks
+// or deadline passes
+func (d *Daemon) flushHooks(deadline time.Time) {
+	if d.hooks == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case d.hooks <- done:
+	case <-time.After(time.Until(deadline)):
+		ptp.Log(ptp.Warning, "Shutdown timeout passed. Events weren't delivered to hooks")
+		return
+	}
+	select {
+	case <-done:
+		ptp.Log(ptp.Debug, "Events were delivered to hooks")
+	case <-time.After(time.Until(deadline)):
+		ptp.Log(ptp.Warning, "Shutdown timeout passed. Some events weren't delivered to hooks")
+	}
+}
+
+// dispatch queues event to matching hooks. Hooks of instance are kept
+// until its instance.stopped event is delivered, since instance is
+// removed before that
+func (hd *hookDispatcher) dispatch(e ptp.Event, daemon, instance []ptp.HookConf, running bool) {
+	hd.daemon = updateHooks(hd.daemon, daemon)
+	if running {
+		hd.instances[e.Hash] = updateHooks(hd.instances[e.Hash], instance)
+	}
+	hooks := append([]*hook{}, hd.daemon...)
+	if e.Hash != "" {
+		hooks = append(hooks, hd.instances[e.Hash]...)
+	}
+	for _, h := range hooks {
+		if h.matches(e) {
+			h.deliver(e)
+		}
+	}
+	if e.Type == ptp.EventInstanceStopped {
+		for _, h := range hd.instances[e.Hash] {
+			h.stop()
+		}
+		delete(hd.instances, e.Hash)
+	}
+}
+
+// stop terminates every hook after queued events were delivered
+func (hd *hookDispatcher) stop() {
+	for _, h := range hd.daemon {
+		h.stop()
+	}
+	for hash, hooks := range hd.instances {
+		for _, h := range hooks {
+			h.stop()
+		}
+		delete(hd.instances, hash)
+	}
+	hd.daemon = nil
+}
+
+// updateHooks returns running hooks when configuration is the same or
+// stops them and starts new ones
+func updateHooks(hooks []*hook, confs []ptp.HookConf) []*hook {
+	same := len(hooks) == len(confs)
+	for i := 0; same && i < len(confs); i++ {
+		same = reflect.DeepEqual(hooks[i].conf, confs[i])
+	}
+	if same {
+		return hooks
+	}
+	for _, h := range hooks {
+		h.stop()
+	}
+	updated := []*hook{}
+	for _, conf := range confs {
+		updated = append(updated, newHook(conf))
+	}
+	return updated
+}
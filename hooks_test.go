@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestHookEnv(t *testing.T) {
+	e := ptp.Event{
+		Time:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Type:    ptp.EventInterfaceUp,
+		Hash:    "swarm",
+		Message: "Interface p2p1 received IP 10.10.10.1",
+		Data:    map[string]string{"ip": "10.10.10.1", "interface": "p2p1"},
+	}
+	want := []string{
+		"P2P_EVENT=interface.up",
+		"P2P_TIME=2026-01-02T03:04:05Z",
+		"P2P_HASH=swarm",
+		"P2P_PEER=",
+		"P2P_MESSAGE=Interface p2p1 received IP 10.10.10.1",
+		"P2P_INTERFACE=p2p1",
+		"P2P_IP=10.10.10.1",
+	}
+	if got := hookEnv(e); !reflect.DeepEqual(got, want) {
+		t.Errorf("hookEnv() = %q, want %q", got, want)
+	}
+}
+
+func TestHook_exec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Hook uses shell")
+	}
+	dir, err := ioutil.TempDir("", "p2p-hooks")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "events")
+
+	h := newHook(ptp.HookConf{Exec: "/bin/sh", Args: []string{"-c", `echo "$P2P_EVENT $P2P_PEER" >> ` + out}})
+	for _, peer := range []string{"a", "b", "c"} {
+		h.deliver(ptp.Event{Type: ptp.EventPeerConnected, Peer: peer})
+	}
+	h.stop()
+	want := "peer.connected a\npeer.connected b\npeer.connected c\n"
+	for started := time.Now(); time.Since(started) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if data, _ := ioutil.ReadFile(out); string(data) == want {
+			break
+		}
+	}
+	if data, _ := ioutil.ReadFile(out); string(data) != want {
+		t.Errorf("Hook delivered events out of order: %q", data)
+	}
+
+	// Shell forks sleep, which keeps output open unless it's killed too
+	h = &hook{conf: ptp.HookConf{Exec: "/bin/sh", Args: []string{"-c", "sleep 5; true"}, Timeout: 50 * time.Millisecond}}
+	started := time.Now()
+	if err := h.call(ptp.Event{}); err == nil || time.Since(started) > 2*time.Second {
+		t.Errorf("hook.call() error = %v after %s, want timeout", err, time.Since(started))
+	}
+}
+
+func TestDaemon_flushHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Hook uses shell")
+	}
+	dir, err := ioutil.TempDir("", "p2p-hooks")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "events")
+
+	conf := &ptp.Conf{Hooks: []ptp.HookConf{{Exec: "/bin/sh", Args: []string{"-c", `sleep 0.1; echo "$P2P_EVENT $P2P_HASH" >> ` + out}}}}
+	d := &Daemon{
+		Instances: new(InstanceList),
+		settings:  &daemonSettings{conf: conf},
+		hooks:     make(chan chan struct{}),
+	}
+	d.Instances.init()
+	go runHooks(d)
+	// Dispatcher subscribes asynchronously
+	time.Sleep(50 * time.Millisecond)
+	ptp.Events.Publish(ptp.Event{Type: ptp.EventBootstrapConnected})
+	ptp.Events.Publish(ptp.Event{Type: ptp.EventInstanceStopped, Hash: "swarm"})
+	d.flushHooks(time.Now().Add(5 * time.Second))
+
+	want := "bootstrap.connected \ninstance.stopped swarm\n"
+	if data, _ := ioutil.ReadFile(out); string(data) != want {
+		t.Errorf("flushHooks() returned before events were delivered: %q", data)
+	}
+}
+
+func TestHook_webhook(t *testing.T) {
+	var lock sync.Mutex
+	calls := 0
+	received := ptp.Event{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	e := ptp.Event{Type: ptp.EventInstanceStopped, Hash: "swarm", Message: "Instance stopped"}
+	h := &hook{conf: ptp.HookConf{URL: server.URL, Retries: 1, RetryDelay: time.Millisecond}}
+	if err := h.call(e); err == nil || calls != 2 {
+		t.Errorf("hook.call() error = %v after %d calls, want failure after 2", err, calls)
+	}
+	if err := h.call(e); err != nil || received.Hash != "swarm" || received.Type != ptp.EventInstanceStopped {
+		t.Errorf("hook.call() error = %v, received %+v", err, received)
+	}
+}
+
+func TestHookDispatcher_dispatch(t *testing.T) {
+	var lock sync.Mutex
+	got := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := ptp.Event{}
+		json.NewDecoder(r.Body).Decode(&e)
+		lock.Lock()
+		got = append(got, r.URL.Path+" "+e.Type+" "+e.Hash)
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	daemon := []ptp.HookConf{{URL: server.URL + "/daemon", Events: []string{ptp.EventBootstrapConnected, ptp.EventInstanceStopped}}}
+	instance := []ptp.HookConf{{URL: server.URL + "/instance"}}
+	hd := newHookDispatcher()
+	hd.dispatch(ptp.Event{Type: ptp.EventInstanceStarted, Hash: "swarm"}, daemon, instance, true)
+	hd.dispatch(ptp.Event{Type: ptp.EventBootstrapConnected}, daemon, nil, false)
+	hd.dispatch(ptp.Event{Type: ptp.EventPeerConnected, Hash: "other"}, daemon, nil, true)
+	hd.dispatch(ptp.Event{Type: ptp.EventPeerConnected, Hash: "swarm"}, daemon, instance, true)
+	// Instance is removed before its stopped event is published
+	hd.dispatch(ptp.Event{Type: ptp.EventInstanceStopped, Hash: "swarm"}, daemon, nil, false)
+	hd.dispatch(ptp.Event{Type: ptp.EventPeerConnected, Hash: "swarm"}, daemon, nil, false)
+	if _, e := hd.instances["swarm"]; e {
+		t.Errorf("dispatch() kept hooks of stopped instance")
+	}
+
+	want := map[string][]string{
+		"/daemon":   {"/daemon bootstrap.connected ", "/daemon instance.stopped swarm"},
+		"/instance": {"/instance instance.started swarm", "/instance peer.connected swarm", "/instance instance.stopped swarm"},
+	}
+	byHook := map[string][]string{}
+	for started := time.Now(); time.Since(started) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		byHook = map[string][]string{}
+		lock.Lock()
+		for _, call := range got {
+			path := call[:strings.Index(call, " ")]
+			byHook[path] = append(byHook[path], call)
+		}
+		lock.Unlock()
+		if reflect.DeepEqual(byHook, want) {
+			break
+		}
+	}
+	if !reflect.DeepEqual(byHook, want) {
+		t.Errorf("dispatch() delivered %q, want %q", byHook, want)
+	}
+}
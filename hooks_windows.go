@@ -0,0 +1,15 @@
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup kills executable. Its children are left running
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
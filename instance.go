@@ -12,16 +12,20 @@ import (
 // RunArgs is a list of arguments used at instance startup and
 // some other RPC calls
 type RunArgs struct {
-	IP          string `json:"ip"`
-	Mac         string `json:"mac"`
-	Dev         string `json:"dev"`
-	Hash        string `json:"hash"`
-	Dht         string `json:"dht"`
-	Keyfile     string `json:"keyfile"`
-	Key         string `json:"key"`
-	TTL         string `json:"ttl"`
-	Fwd         bool   `json:"fwd"`
-	Port        int    `json:"port"`
+	IP          string         `json:"ip"`
+	Mac         string         `json:"mac"`
+	Dev         string         `json:"dev"`
+	Hash        string         `json:"hash"`
+	Dht         string         `json:"dht"`
+	Keyfile     string         `json:"keyfile"`
+	Key         string         `json:"key"`
+	KDF         string         `json:"kdf"` // Key derivation function. Key is a passphrase when set
+	TTL         string         `json:"ttl"`
+	Fwd         bool           `json:"fwd"`
+	Port        int            `json:"port"`
+	MTU         int            `json:"mtu"`             // MTU of this instance. Global MTU is used when zero
+	Source      string         `json:"source"`          // Definition file of instance managed by instances directory
+	Hooks       []ptp.HookConf `json:"hooks,omitempty"` // Hooks of instance declared in definition file
 	LastSuccess time.Time
 }
 
@@ -328,11 +332,17 @@ type Response struct {
 type Daemon struct {
 	Instances  *InstanceList
 	Restore    *Restore
+	Supervisor *restoreSupervisor
 	OutboundIP net.IP
+	settings   *daemonSettings    // Arguments and configuration used on start
+	stopping   int32              // Set to 1 when daemon is shutting down
+	hooks      chan chan struct{} // Flush requests of hook dispatcher
 }
 
 // init will initialize daemon, instnaces and restore subsystems
-func (d *Daemon) init(saveFile string) error {
+// Keys in the save file are encrypted with machine key from saveKey file.
+// When it's not specified key is stored next to the save file
+func (d *Daemon) init(saveFile, saveKey string) error {
 	d.Instances = new(InstanceList)
 	d.Instances.init()
 	d.Restore = new(Restore)
@@ -340,7 +350,18 @@ func (d *Daemon) init(saveFile string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	d.Supervisor = newRestoreSupervisor(d.Restore, func(e saveEntry) error {
+		return d.run(e.runArgs(), new(Response))
+	}, func(hash string) bool {
+		return d.Instances.getInstance(hash) != nil
+	})
+	if saveFile == "" {
+		return nil
+	}
+	if saveKey == "" {
+		saveKey = saveFile + ".key"
+	}
+	return d.Restore.initSecrets(saveKey)
 }
 
 // Execute is a dummy method used for tests
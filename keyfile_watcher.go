@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+const defaultKeyfileCheckInterval = time.Duration(time.Second * 5)
+
+// Key files of running instances are polled and applied again when their
+// content changes. Malformed files are rejected and instances keep their
+// current keys
+var keyfileCheckInterval = defaultKeyfileCheckInterval
+
+// keyfileWatcher tracks key files used by instances
+type keyfileWatcher struct {
+	hashes map[string][sha256.Size]byte // Hash of the last processed content by path
+	errors map[string]string            // Last read error by path
+}
+
+func newKeyfileWatcher() *keyfileWatcher {
+	return &keyfileWatcher{
+		hashes: make(map[string][sha256.Size]byte),
+		errors: make(map[string]string),
+	}
+}
+
+func (w *keyfileWatcher) run(instances *InstanceList) {
+	for {
+		w.check(instances.get())
+		time.Sleep(keyfileCheckInterval)
+	}
+}
+
+// check reloads key files that were changed since the last check
+func (w *keyfileWatcher) check(instances map[string]*P2PInstance) {
+	files := make(map[string][]*P2PInstance)
+	for _, inst := range instances {
+		if inst == nil || inst.PTP == nil || inst.Args.Keyfile == "" {
+			continue
+		}
+		files[inst.Args.Keyfile] = append(files[inst.Args.Keyfile], inst)
+	}
+	for path := range w.hashes {
+		if _, e := files[path]; !e {
+			delete(w.hashes, path)
+			delete(w.errors, path)
+		}
+	}
+
+	for path, list := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if w.errors[path] != err.Error() {
+				ptp.Log(ptp.Error, "Failed to read key file %s: %s. Keeping current keys", path, err)
+				w.errors[path] = err.Error()
+			}
+			continue
+		}
+		delete(w.errors, path)
+		hash := sha256.Sum256(data)
+		if previous, e := w.hashes[path]; e && previous == hash {
+			continue
+		}
+		for _, inst := range list {
+			// Keys derived from passphrases depend on swarm
+			keys, err := ptp.ParseKeyFile(data, inst.ID)
+			if err != nil {
+				ptp.Log(ptp.Error, "Rejected key file %s for instance %s: %s. Keeping current keys", path, inst.ID, err)
+				continue
+			}
+			inst.PTP.Crypter.SetFileKeys(keys)
+			ptp.Log(ptp.Info, "Applied %d keys from %s to instance %s", len(keys), path, inst.ID)
+		}
+		w.hashes[path] = hash
+	}
+}
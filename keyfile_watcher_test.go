@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestKeyfileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-keyfile")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.yaml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("Failed to write key file: %s", err)
+		}
+	}
+
+	inst := &P2PInstance{ID: "hash", PTP: new(ptp.PeerToPeer), Args: RunArgs{Keyfile: path}}
+	other := &P2PInstance{ID: "other", PTP: new(ptp.PeerToPeer)}
+	instances := map[string]*P2PInstance{"hash": inst, "other": other}
+	w := newKeyfileWatcher()
+	// Key passed with -key option is kept together with keys of the file
+	inst.PTP.Crypter.AddKey(ptp.CryptoKey{Key: []byte("cli-key-012345678901234567890123"), Until: time.Unix(1900000000, 0)})
+
+	write("keys:\n  - key: 01234567890123456789012345678901\n    until: 1900000000\n")
+	w.check(instances)
+	if len(inst.PTP.Crypter.KeyStatus()) != 2 || len(other.PTP.Crypter.KeyStatus()) != 0 {
+		t.Fatalf("Key file wasn't applied")
+	}
+
+	write("keys:\n  - key: abcdefghijklmnopqrstuvwxyz012345\n    until: 1900000001\n  - key: ABCDEFGHIJKLMNOPQRSTUVWXYZ012345\n    until: 1900000002\n")
+	w.check(instances)
+	if len(inst.PTP.Crypter.KeyStatus()) != 3 {
+		t.Errorf("Changed key file wasn't applied")
+	}
+
+	write("keys:\n  - key: short\n")
+	w.check(instances)
+	if len(inst.PTP.Crypter.KeyStatus()) != 3 {
+		t.Errorf("Malformed key file was applied")
+	}
+
+	os.Remove(path)
+	w.check(instances)
+	if len(inst.PTP.Crypter.KeyStatus()) != 3 {
+		t.Errorf("Keys were dropped when key file disappeared")
+	}
+}
@@ -0,0 +1,187 @@
+package ptp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Bootstrap nodes can be specified in three different ways:
+// * SRV entry name (e.g. `dht`) which will be resolved under `subutai.io` domain
+// * Comma-separated list of endpoints (e.g. `tcp://10.0.0.1:6881,udp://10.0.0.1:6882`)
+// * `bootstrap` list in configuration file with the same endpoint format
+// Endpoint without scheme is treated as a TCP endpoint
+
+// BootstrapDomain is a domain used for SRV lookup of bootstrap nodes
+const BootstrapDomain = "subutai.io"
+
+// BootstrapCache holds last known working bootstrap endpoints
+type BootstrapCache struct {
+	TCP     []string  `yaml:"tcp"`
+	UDP     []string  `yaml:"udp"`
+	Updated time.Time `yaml:"updated"`
+}
+
+var (
+	bootstrapCacheFile string
+	bootstrapCacheLock sync.Mutex
+)
+
+// SetBootstrapCacheFile sets location of the bootstrap cache file. Empty path disables cache
+func SetBootstrapCacheFile(path string) {
+	bootstrapCacheLock.Lock()
+	bootstrapCacheFile = path
+	bootstrapCacheLock.Unlock()
+}
+
+// IsBootstrapList returns true if target is a list of explicit endpoints
+// rather than SRV entry name
+func IsBootstrapList(target string) bool {
+	return strings.Contains(target, ":")
+}
+
+// ParseBootstrapEndpoint splits endpoint into protocol and address parts
+func ParseBootstrapEndpoint(endpoint string) (string, string, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	proto := "tcp"
+	if i := strings.Index(endpoint, "://"); i != -1 {
+		proto = strings.ToLower(endpoint[:i])
+		endpoint = endpoint[i+3:]
+	}
+	if proto != "tcp" && proto != "udp" {
+		return "", "", fmt.Errorf("Unsupported bootstrap protocol: %s", proto)
+	}
+	_, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("Bad bootstrap endpoint %s: %s", endpoint, err)
+	}
+	if port == "" {
+		return "", "", fmt.Errorf("Bad bootstrap endpoint %s: missing port", endpoint)
+	}
+	return proto, endpoint, nil
+}
+
+// FilterBootstrapList returns addresses of the specified protocol from
+// comma-separated list of endpoints
+func FilterBootstrapList(list, proto string) ([]string, error) {
+	result := []string{}
+	for _, ep := range strings.Split(list, ",") {
+		if strings.TrimSpace(ep) == "" {
+			continue
+		}
+		p, addr, err := ParseBootstrapEndpoint(ep)
+		if err != nil {
+			return nil, err
+		}
+		if p == proto {
+			result = append(result, addr)
+		}
+	}
+	return result, nil
+}
+
+// ResolveBootstrap returns list of bootstrap endpoints for specified protocol.
+// Target is either a comma-separated list of endpoints or SRV entry name.
+// When SRV lookup fails or returns nothing, cached list will be used instead
+func ResolveBootstrap(target, proto string) ([]string, error) {
+	if IsBootstrapList(target) {
+		return FilterBootstrapList(target, proto)
+	}
+	result := []string{}
+	records, err := SrvLookup(target, proto, BootstrapDomain)
+	if err == nil {
+		for i := 0; i < len(records); i++ {
+			if records[i] != "" {
+				result = append(result, records[i])
+			}
+		}
+	}
+	if len(result) > 0 {
+		return result, nil
+	}
+	if err != nil {
+		Log(Warning, "SRV lookup for %s/%s failed: %s. Trying bootstrap cache", target, proto, err)
+	}
+	cached, cerr := LoadBootstrapCache()
+	if cerr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	if proto == "udp" {
+		result = cached.UDP
+	} else {
+		result = cached.TCP
+	}
+	if len(result) > 0 {
+		Log(Info, "Using %d cached %s bootstrap endpoints from %s", len(result), proto, cached.Updated.String())
+	}
+	return result, nil
+}
+
+// LoadBootstrapCache reads bootstrap cache file
+func LoadBootstrapCache() (*BootstrapCache, error) {
+	bootstrapCacheLock.Lock()
+	defer bootstrapCacheLock.Unlock()
+	return loadBootstrapCache()
+}
+
+func loadBootstrapCache() (*BootstrapCache, error) {
+	cache := new(BootstrapCache)
+	if bootstrapCacheFile == "" {
+		return cache, fmt.Errorf("Bootstrap cache is disabled")
+	}
+	data, err := ioutil.ReadFile(bootstrapCacheFile)
+	if err != nil {
+		return cache, err
+	}
+	err = yaml.Unmarshal(data, cache)
+	if err != nil {
+		return cache, fmt.Errorf("Failed to parse bootstrap cache: %s", err)
+	}
+	return cache, nil
+}
+
+// SaveBootstrapCache replaces cached list of endpoints for specified protocol
+func SaveBootstrapCache(proto string, endpoints []string) error {
+	if len(endpoints) == 0 {
+		return nil
+	}
+	bootstrapCacheLock.Lock()
+	defer bootstrapCacheLock.Unlock()
+	if bootstrapCacheFile == "" {
+		return nil
+	}
+	cache, err := loadBootstrapCache()
+	if err != nil && !os.IsNotExist(err) {
+		Log(Warning, "Overwriting broken bootstrap cache: %s", err)
+	}
+	if proto == "udp" {
+		cache.UDP = endpoints
+	} else {
+		cache.TCP = endpoints
+	}
+	cache.Updated = time.Now()
+	data, err := yaml.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(bootstrapCacheFile), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := bootstrapCacheFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, bootstrapCacheFile)
+}
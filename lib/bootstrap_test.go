@@ -0,0 +1,100 @@
+package ptp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseBootstrapEndpoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoint  string
+		wantProto string
+		wantAddr  string
+		wantErr   bool
+	}{
+		{"no scheme", "10.0.0.1:6881", "tcp", "10.0.0.1:6881", false},
+		{"tcp scheme", "tcp://dht.local:6881", "tcp", "dht.local:6881", false},
+		{"udp scheme", " UDP://10.0.0.1:6882 ", "udp", "10.0.0.1:6882", false},
+		{"bad scheme", "ftp://10.0.0.1:21", "", "", true},
+		{"no port", "10.0.0.1", "", "", true},
+		{"empty port", "10.0.0.1:", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proto, addr, err := ParseBootstrapEndpoint(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBootstrapEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if proto != tt.wantProto || addr != tt.wantAddr {
+				t.Errorf("ParseBootstrapEndpoint() = %s %s, want %s %s", proto, addr, tt.wantProto, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestResolveBootstrap(t *testing.T) {
+	list := "10.0.0.1:6881,udp://10.0.0.1:6882,tcp://10.0.0.2:6881"
+	tests := []struct {
+		name    string
+		target  string
+		proto   string
+		want    []string
+		wantErr bool
+	}{
+		{"tcp from list", list, "tcp", []string{"10.0.0.1:6881", "10.0.0.2:6881"}, false},
+		{"udp from list", list, "udp", []string{"10.0.0.1:6882"}, false},
+		{"malformed list", "10.0.0.1:6881,ftp://1.1.1.1:1", "tcp", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveBootstrap(tt.target, tt.proto)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveBootstrap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResolveBootstrap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootstrapCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-bootstrap-cache")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache", "bootstrap.yaml")
+	defer SetBootstrapCacheFile("")
+
+	SetBootstrapCacheFile("")
+	if SaveBootstrapCache("tcp", []string{"10.0.0.1:6881"}) != nil {
+		t.Fatalf("Saving with disabled cache produced an error")
+	}
+	if _, err := LoadBootstrapCache(); err == nil {
+		t.Fatalf("Loading disabled cache didn't produce an error")
+	}
+
+	SetBootstrapCacheFile(path)
+	if err := SaveBootstrapCache("tcp", []string{"10.0.0.1:6881"}); err != nil {
+		t.Fatalf("Failed to save tcp cache: %s", err)
+	}
+	if err := SaveBootstrapCache("udp", []string{"10.0.0.1:6882"}); err != nil {
+		t.Fatalf("Failed to save udp cache: %s", err)
+	}
+	// Empty list should never overwrite last known working nodes
+	if err := SaveBootstrapCache("tcp", []string{}); err != nil {
+		t.Fatalf("Failed to save empty list: %s", err)
+	}
+	cache, err := LoadBootstrapCache()
+	if err != nil {
+		t.Fatalf("Failed to load cache: %s", err)
+	}
+	if !reflect.DeepEqual(cache.TCP, []string{"10.0.0.1:6881"}) || !reflect.DeepEqual(cache.UDP, []string{"10.0.0.1:6882"}) {
+		t.Errorf("Loaded cache doesn't match saved: %+v", cache)
+	}
+}
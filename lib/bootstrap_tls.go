@@ -0,0 +1,203 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Connection with bootstrap nodes can be protected with TLS. Certificate
+// of a bootstrap node is verified against CA bundle (system roots are used
+// when bundle is not specified) or against a list of SPKI pins. Pins are
+// base64-encoded SHA-256 hashes of a subject public key info prefixed with
+// `sha256/`, which is the same format used by HPKP and curl:
+//
+//   openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der |
+//     openssl dgst -sha256 -binary | base64
+
+// BootstrapTLS is a TLS configuration of bootstrap connections
+type BootstrapTLS struct {
+	Enabled bool                        `yaml:"enabled"` // Whether TLS is used
+	CA      string                      `yaml:"ca"`      // CA bundle used for every bootstrap node
+	Nodes   map[string]BootstrapTLSNode `yaml:"nodes"`   // Per-node settings by host:port
+}
+
+// BootstrapTLSNode is a TLS configuration of a single bootstrap node
+type BootstrapTLSNode struct {
+	CA         string   `yaml:"ca"`          // CA bundle for this node
+	Pins       []string `yaml:"pins"`        // SPKI pins. When specified CA verification is optional
+	ServerName string   `yaml:"server_name"` // Name expected in certificate. Host part of address by default
+}
+
+// ClientConfig returns TLS configuration for connection with specified
+// bootstrap node
+func (t *BootstrapTLS) ClientConfig(addr string) (*tls.Config, error) {
+	if t == nil || !t.Enabled {
+		return nil, fmt.Errorf("TLS is disabled")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Bad bootstrap address %s: %s", addr, err)
+	}
+	node := t.Nodes[addr]
+	config := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if node.ServerName != "" {
+		config.ServerName = node.ServerName
+	}
+
+	ca := t.CA
+	if node.CA != "" {
+		ca = node.CA
+	}
+	if ca != "" {
+		config.RootCAs, err = LoadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(node.Pins) == 0 {
+		return config, nil
+	}
+	pins, err := parseSPKIPins(node.Pins)
+	if err != nil {
+		return nil, err
+	}
+	roots := config.RootCAs
+	verifyCA := ca != ""
+	// Pins replace default verification, CA bundle is still checked when
+	// it was explicitly specified
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		certs := []*x509.Certificate{}
+		for _, r := range raw {
+			cert, err := x509.ParseCertificate(r)
+			if err != nil {
+				return fmt.Errorf("Bad certificate of bootstrap node: %s", err)
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return fmt.Errorf("Bootstrap node didn't provide certificate")
+		}
+		if verifyCA {
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       config.ServerName,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, cert := range certs {
+			if MatchSPKIPin(cert, pins) {
+				return nil
+			}
+		}
+		return fmt.Errorf("Certificate of bootstrap node doesn't match any pin")
+	}
+	return config, nil
+}
+
+// LoadCertPool reads PEM-encoded certificates from a file
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA bundle: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// SPKIPin returns pin of a certificate public key
+func SPKIPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// MatchSPKIPin returns true if public key of a certificate matches one of the pins
+func MatchSPKIPin(cert *x509.Certificate, pins [][]byte) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(hash[:], pin) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSPKIPins(list []string) ([][]byte, error) {
+	pins := [][]byte{}
+	for _, p := range list {
+		encoded := strings.TrimPrefix(strings.TrimSpace(p), "sha256/")
+		pin, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("Bad SPKI pin: %s", p)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// TLSVersionName returns human-readable name of TLS version
+func TLSVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("Unknown (%x)", version)
+}
+
+// cipherSuiteNames are names of cipher suites that can be negotiated
+// with TLS 1.2 and later
+var cipherSuiteNames = map[uint16]string{
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+	tls.TLS_AES_128_GCM_SHA256:                  "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:                  "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256:            "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+// CipherSuiteName returns human-readable name of TLS cipher suite
+func CipherSuiteName(id uint16) string {
+	name, exists := cipherSuiteNames[id]
+	if exists {
+		return name
+	}
+	return fmt.Sprintf("Unknown (%x)", id)
+}
@@ -0,0 +1,87 @@
+package ptp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func generateTestCertificate(t *testing.T) (*x509.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bootstrap"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})
+}
+
+func TestBootstrapTLS_ClientConfig(t *testing.T) {
+	cert, certPEM := generateTestCertificate(t)
+	other, otherPEM := generateTestCertificate(t)
+	ca := "/tmp/test-p2p-bootstrap-ca.pem"
+	ioutil.WriteFile(ca, certPEM, 0600)
+	defer os.Remove(ca)
+	otherCA := "/tmp/test-p2p-bootstrap-other-ca.pem"
+	ioutil.WriteFile(otherCA, otherPEM, 0600)
+	defer os.Remove(otherCA)
+
+	addr := "127.0.0.1:6881"
+	tests := []struct {
+		name      string
+		tls       *BootstrapTLS
+		addr      string
+		wantErr   bool
+		verifyErr bool
+	}{
+		{"nil", nil, addr, true, false},
+		{"disabled", &BootstrapTLS{}, addr, true, false},
+		{"bad address", &BootstrapTLS{Enabled: true}, "127.0.0.1", true, false},
+		{"missing ca", &BootstrapTLS{Enabled: true, CA: "/tmp/test-p2p-missing-ca.pem"}, addr, true, false},
+		{"ca only", &BootstrapTLS{Enabled: true, CA: ca}, addr, false, false},
+		{"bad pin", &BootstrapTLS{Enabled: true, Nodes: map[string]BootstrapTLSNode{addr: {Pins: []string{"sha256/bad"}}}}, addr, true, false},
+		{"pin", &BootstrapTLS{Enabled: true, Nodes: map[string]BootstrapTLSNode{addr: {Pins: []string{SPKIPin(cert)}}}}, addr, false, false},
+		{"wrong pin", &BootstrapTLS{Enabled: true, Nodes: map[string]BootstrapTLSNode{addr: {Pins: []string{SPKIPin(other)}}}}, addr, false, true},
+		{"pin and ca", &BootstrapTLS{Enabled: true, CA: ca, Nodes: map[string]BootstrapTLSNode{addr: {Pins: []string{SPKIPin(cert)}}}}, addr, false, false},
+		{"pin and wrong ca", &BootstrapTLS{Enabled: true, Nodes: map[string]BootstrapTLSNode{addr: {CA: otherCA, Pins: []string{SPKIPin(cert)}}}}, addr, false, true},
+		{"pin of other node", &BootstrapTLS{Enabled: true, Nodes: map[string]BootstrapTLSNode{"10.0.0.1:6881": {Pins: []string{SPKIPin(other)}}}}, addr, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.tls.ClientConfig(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BootstrapTLS.ClientConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil || config.VerifyPeerCertificate == nil {
+				return
+			}
+			err = config.VerifyPeerCertificate([][]byte{cert.Raw}, nil)
+			if (err != nil) != tt.verifyErr {
+				t.Errorf("VerifyPeerCertificate() error = %v, verifyErr %v", err, tt.verifyErr)
+			}
+		})
+	}
+}
@@ -161,6 +161,8 @@ func commIPSetHandler(data []byte, p *PeerToPeer) ([]byte, error) {
 		if bytes.Equal(peer.PeerLocalIP, ip) && peer.Endpoint != nil {
 			// That IP already set on other peer. Call a conflict
 			Log(Info, "Reporting IP conflict")
+			p.publish(EventIPConflict, id, map[string]string{"ip": ip.String(), "owner": peer.ID},
+				"Peer announced IP %s that is used by %s", ip.String(), peer.ID)
 			payload := make([]byte, 42)
 			binary.BigEndian.PutUint16(payload[0:2], CommIPConflict)
 			copy(payload[2:38], p.Dht.ID)
@@ -173,6 +175,9 @@ func commIPSetHandler(data []byte, p *PeerToPeer) ([]byte, error) {
 
 	for _, peer := range p.Swarm.Get() {
 		if peer.ID == id {
+			if !bytes.Equal(peer.PeerLocalIP, ip) {
+				p.publish(EventPeerIP, id, map[string]string{"ip": ip.String()}, "Peer changed IP to %s", ip.String())
+			}
 			peer.PeerLocalIP = ip
 			return nil, nil
 		}
@@ -194,6 +199,7 @@ func commIPConflictHandler(data []byte, p *PeerToPeer) ([]byte, error) {
 	ip := net.IP(data[36:40])
 
 	if p.Interface.IsAuto() && p.Interface.IsConfigured() && bytes.Equal(ip, p.Interface.GetIP()) {
+		p.publish(EventIPConflict, "", map[string]string{"ip": ip.String()}, "IP %s is used by another peer. Interface was deconfigured", ip.String())
 		p.Interface.Deconfigure()
 		return nil, nil
 	}
@@ -3,16 +3,163 @@ package ptp
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
+// DefaultRPCPort is a port of REST API used when it wasn't configured
+const DefaultRPCPort = 52523
+
+// EnvPrefix is a prefix of environment variables overriding configuration.
+// Name of a variable is an upper-cased YAML key of the option. Keys of
+// nested sections are joined with underscore, e.g. P2P_TIMEOUTS_SHUTDOWN
+const EnvPrefix = "P2P_"
+
+// Conf is a daemon configuration. Every option can be set in configuration
+// file and overridden with environment variable. Command line arguments
+// have priority over both
 type Conf struct {
-	IPTool  string `yaml:"iptool"`
-	TAPTool string `yaml:"taptool"`
-	INFFile string `yaml:"inf_file"`
-	MTU     int    `yaml:"mtu"`
-	PMTU    bool   `yaml:"pmtu"`
+	IPTool         string           `yaml:"iptool"`
+	TAPTool        string           `yaml:"taptool"`
+	INFFile        string           `yaml:"inf_file"`
+	MTU            int              `yaml:"mtu"`
+	PMTU           bool             `yaml:"pmtu"`
+	Bootstrap      []string         `yaml:"bootstrap"`
+	BootstrapCache string           `yaml:"bootstrap_cache"`
+	BootstrapTLS   BootstrapTLS     `yaml:"bootstrap_tls"`
+	Log            string           `yaml:"log"`
+	RPCPort        int              `yaml:"rpc_port"`
+	Target         string           `yaml:"target"`
+	Save           string           `yaml:"save"`
+	SaveKey        string           `yaml:"save_key"`
+	Syslog         string           `yaml:"syslog"`
+	Profile        string           `yaml:"profile"`
+	InstancesDir   string           `yaml:"instances_dir"` // Directory with definitions of instances managed by daemon
+	Timeouts       Timeouts         `yaml:"timeouts"`
+	Defaults       InstanceDefaults `yaml:"defaults"`
+	Control        ControlConf      `yaml:"control"`
+	Hooks          []HookConf       `yaml:"hooks"` // Hooks run on events of daemon and every instance
+}
+
+// Timeouts of daemon operations. Zero value means built-in default
+type Timeouts struct {
+	Shutdown        time.Duration `yaml:"shutdown"`          // Time given to instances to stop
+	RestoreRetry    time.Duration `yaml:"restore_retry"`     // Delay before the first retry of failed restore
+	RestoreRetryMax time.Duration `yaml:"restore_retry_max"` // Maximum delay between restore retries
+	KeyfileCheck    time.Duration `yaml:"keyfile_check"`     // How often key files are checked for changes
+	Reconcile       time.Duration `yaml:"reconcile"`         // How often instances directory is applied
+}
+
+// InstanceDefaults are used by new instances started without these options
+type InstanceDefaults struct {
+	IP      string `yaml:"ip"`      // IP address or "dhcp"
+	Keyfile string `yaml:"keyfile"` // Key file used when no key was specified
+	Fwd     bool   `yaml:"fwd"`     // Force usage of proxies
+}
+
+// HookConf is an executable or webhook run on events. Executable receives
+// event in P2P_* environment variables, webhook receives it as JSON body
+// of POST request. Failed runs are retried after retry_delay
+type HookConf struct {
+	Events     []string      `yaml:"events"`      // Types of events. Hook is run on every event when empty
+	Exec       string        `yaml:"exec"`        // Path to executable
+	Args       []string      `yaml:"args"`        // Arguments of executable
+	URL        string        `yaml:"url"`         // URL of webhook
+	Timeout    time.Duration `yaml:"timeout"`     // Time given to a single run
+	Retries    int           `yaml:"retries"`     // Number of retries of failed run
+	RetryDelay time.Duration `yaml:"retry_delay"` // Delay between retries
+}
+
+// Validate checks hook and returns the first error
+func (h *HookConf) Validate() error {
+	if (h.Exec == "") == (h.URL == "") {
+		return fmt.Errorf("either exec or url should be specified")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("url %s is not an HTTP URL", h.URL)
+		}
+	}
+	if len(h.Args) > 0 && h.Exec == "" {
+		return fmt.Errorf("args require exec")
+	}
+	for _, e := range h.Events {
+		if !eventTypes[e] {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("timeout %s is negative", h.Timeout)
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("retries %d is negative", h.Retries)
+	}
+	if h.RetryDelay < 0 {
+		return fmt.Errorf("retry_delay %s is negative", h.RetryDelay)
+	}
+	return nil
+}
+
+// ControlDisabled disables listener of management API
+const ControlDisabled = "none"
+
+// Roles of management API clients
+const (
+	ControlRoleRead  = "read"  // Can only query information
+	ControlRoleAdmin = "admin" // Can manage instances and daemon
+)
+
+// ControlConf configures listeners and authentication of management API.
+// Clients connected to Unix socket are admins. Authentication is
+// required on TCP when tokens or client CA are specified
+type ControlConf struct {
+	Socket      string         `yaml:"socket"`       // Path to Unix socket
+	SocketOwner string         `yaml:"socket_owner"` // Owner of socket in user[:group] format
+	SocketMode  string         `yaml:"socket_mode"`  // Permissions of socket in octal format
+	Listen      string         `yaml:"listen"`       // TCP address. Port defaults to rpc_port
+	Tokens      []ControlToken `yaml:"tokens"`
+	TLS         ControlTLS     `yaml:"tls"`
+}
+
+// ControlToken is a bearer token of management API client
+type ControlToken struct {
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"` // File with token used instead of token
+	Role      string `yaml:"role"`
+}
+
+// ControlTLS enables HTTPS on TCP. Clients with certificates signed by
+// client CA are authenticated
+type ControlTLS struct {
+	Cert     string            `yaml:"cert"`
+	Key      string            `yaml:"key"`
+	ClientCA string            `yaml:"client_ca"`
+	Roles    map[string]string `yaml:"roles"` // Roles by common name. Every client is admin when empty
+}
+
+// ConfErrors is a list of invalid configuration options
+type ConfErrors []error
+
+func (e ConfErrors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ConfErrors) add(option, format string, v ...interface{}) {
+	*e = append(*e, fmt.Errorf("%s: %s", option, fmt.Sprintf(format, v...)))
 }
 
 func (c *Conf) Load(filepath string) error {
@@ -31,12 +178,52 @@ func (c *Conf) Load(filepath string) error {
 	return nil
 }
 
+// LoadStrict loads configuration like Load, but rejects unknown options.
+// Unknown and mistyped options are reported as ConfErrors
+func (c *Conf) LoadStrict(filepath string) error {
+	c.SetDefaults()
+	yamlFile, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+	err = yaml.UnmarshalStrict(yamlFile, c)
+	if terr, ok := err.(*yaml.TypeError); ok {
+		var errs ConfErrors
+		for _, e := range terr.Errors {
+			errs = append(errs, fmt.Errorf("%s", e))
+		}
+		return errs
+	}
+	if err != nil {
+		return fmt.Errorf("config parse failed: %s", err.Error())
+	}
+	return nil
+}
+
 func (c *Conf) SetDefaults() {
 	c.IPTool = DefaultIPTool
 	c.TAPTool = DefaultTAPTool
 	c.INFFile = DefaultINFFile
 	c.MTU = DefaultMTU
 	c.PMTU = DefaultPMTU
+	c.Bootstrap = []string{}
+	c.BootstrapCache = DefaultBootstrapCache
+	c.BootstrapTLS = BootstrapTLS{}
+	c.Log = ""
+	c.RPCPort = DefaultRPCPort
+	c.Target = ""
+	c.Save = ""
+	c.SaveKey = ""
+	c.Syslog = ""
+	c.Profile = ""
+	c.InstancesDir = ""
+	c.Control = ControlConf{
+		Socket:     DefaultControlSocket,
+		SocketMode: "0660",
+		Listen:     "127.0.0.1",
+	}
+	c.Timeouts = Timeouts{}
+	c.Defaults = InstanceDefaults{}
 }
 
 func (c *Conf) GetIPTool(preset string) string {
@@ -70,3 +257,235 @@ func (c *Conf) GetMTU(preset int) int {
 func (c *Conf) GetPMTU() bool {
 	return c.PMTU
 }
+
+// GetBootstrap returns comma-separated list of bootstrap endpoints.
+// Preset (value of --target) has priority over configuration file
+func (c *Conf) GetBootstrap(preset string) string {
+	if preset != "" {
+		return preset
+	}
+	return strings.Join(c.Bootstrap, ",")
+}
+
+func (c *Conf) GetBootstrapCache(preset string) string {
+	if preset != "" {
+		return preset
+	}
+	return c.BootstrapCache
+}
+
+func (c *Conf) GetRPCPort(preset int) int {
+	if preset != 0 {
+		return preset
+	}
+	return c.RPCPort
+}
+
+func (c *Conf) GetTarget(preset string) string {
+	if preset != "" {
+		return preset
+	}
+	return c.Target
+}
+
+func (c *Conf) GetSave(preset string) string {
+	if preset != "" {
+		return preset
+	}
+	return c.Save
+}
+
+func (c *Conf) GetSaveKey(preset string) string {
+	if preset != "" {
+		return preset
+	}
+	return c.SaveKey
+}
+
+func (c *Conf) GetSyslog(preset string) string {
+	if preset != "" {
+		return preset
+	}
+	return c.Syslog
+}
+
+func (c *Conf) GetProfile(preset string) string {
+	if preset != "" {
+		return preset
+	}
+	return c.Profile
+}
+
+func (c *Conf) GetLog(preset string) string {
+	if preset != "" {
+		return preset
+	}
+	return c.Log
+}
+
+// ApplyEnv overrides options with environment variables returned by
+// lookup. Empty variables are ignored. Lists are comma-separated
+func (c *Conf) ApplyEnv(lookup func(string) (string, bool)) error {
+	var errs ConfErrors
+	applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, "", lookup, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *ControlConf) validate(errs *ConfErrors) {
+	if c.SocketMode != "" {
+		if _, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil {
+			errs.add("control.socket_mode", "%q is not an octal number", c.SocketMode)
+		}
+	}
+	if c.Listen != "" && c.Listen != ControlDisabled && net.ParseIP(c.Listen) == nil {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			errs.add("control.listen", "%s", err)
+		}
+	}
+	for i, t := range c.Tokens {
+		option := fmt.Sprintf("control.tokens[%d]", i)
+		if (t.Token == "") == (t.TokenFile == "") {
+			errs.add(option, "either token or token_file should be specified")
+		}
+		if t.Role != ControlRoleRead && t.Role != ControlRoleAdmin {
+			errs.add(option, "unknown role %q", t.Role)
+		}
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs.add("control.tls", "both cert and key should be specified")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		errs.add("control.tls.client_ca", "requires cert and key")
+	}
+	for name, role := range c.TLS.Roles {
+		if role != ControlRoleRead && role != ControlRoleAdmin {
+			errs.add("control.tls.roles", "unknown role %q of %s", role, name)
+		}
+	}
+}
+
+func applyEnv(v reflect.Value, prefix, path string, lookup func(string) (string, bool), errs *ConfErrors) {
+	durationType := reflect.TypeOf(time.Duration(0))
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		option := path + key
+		if field.Kind() == reflect.Struct {
+			applyEnv(field, name+"_", option+".", lookup, errs)
+			continue
+		}
+		value, exists := lookup(name)
+		if !exists || value == "" {
+			continue
+		}
+		switch {
+		case field.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs.add(option, "%s has bad duration %q", name, value)
+				continue
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs.add(option, "%s has bad number %q", name, value)
+				continue
+			}
+			field.SetInt(int64(n))
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs.add(option, "%s has bad boolean %q", name, value)
+				continue
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			list := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+	}
+}
+
+// Validate checks every option and returns ConfErrors describing each
+// invalid one
+func (c *Conf) Validate() error {
+	var errs ConfErrors
+	if c.RPCPort < 1 || c.RPCPort > 65535 {
+		errs.add("rpc_port", "%d is out of range 1-65535", c.RPCPort)
+	}
+	if c.MTU < 576 || c.MTU > 65535 {
+		errs.add("mtu", "%d is out of range 576-65535", c.MTU)
+	}
+	switch strings.ToLower(c.Log) {
+	case "", "trace", "debug", "info", "warning", "error":
+	default:
+		errs.add("log", "unknown log level %q", c.Log)
+	}
+	switch c.Profile {
+	case "", "cpu", "mem", "memory":
+	default:
+		errs.add("profile", "unknown profiling type %q", c.Profile)
+	}
+	for _, ep := range c.Bootstrap {
+		if _, _, err := ParseBootstrapEndpoint(ep); err != nil {
+			errs.add("bootstrap", "%s", err)
+		}
+	}
+	if IsBootstrapList(c.Target) {
+		for _, ep := range strings.Split(c.Target, ",") {
+			if _, _, err := ParseBootstrapEndpoint(ep); err != nil {
+				errs.add("target", "%s", err)
+			}
+		}
+	}
+	if c.Syslog != "" {
+		if _, _, err := net.SplitHostPort(c.Syslog); err != nil {
+			errs.add("syslog", "%s", err)
+		}
+	}
+	timeouts := map[string]time.Duration{
+		"timeouts.shutdown":          c.Timeouts.Shutdown,
+		"timeouts.restore_retry":     c.Timeouts.RestoreRetry,
+		"timeouts.restore_retry_max": c.Timeouts.RestoreRetryMax,
+		"timeouts.keyfile_check":     c.Timeouts.KeyfileCheck,
+		"timeouts.reconcile":         c.Timeouts.Reconcile,
+	}
+	for _, option := range []string{"timeouts.shutdown", "timeouts.restore_retry", "timeouts.restore_retry_max", "timeouts.keyfile_check", "timeouts.reconcile"} {
+		if timeouts[option] < 0 {
+			errs.add(option, "%s is negative", timeouts[option])
+		}
+	}
+	if c.Timeouts.RestoreRetryMax > 0 && c.Timeouts.RestoreRetry > c.Timeouts.RestoreRetryMax {
+		errs.add("timeouts.restore_retry", "%s is greater than restore_retry_max", c.Timeouts.RestoreRetry)
+	}
+	if c.Defaults.IP != "" && c.Defaults.IP != "dhcp" && net.ParseIP(c.Defaults.IP) == nil {
+		if _, _, err := net.ParseCIDR(c.Defaults.IP); err != nil {
+			errs.add("defaults.ip", "%q is not an IP address or \"dhcp\"", c.Defaults.IP)
+		}
+	}
+	c.Control.validate(&errs)
+	for i, h := range c.Hooks {
+		if err := h.Validate(); err != nil {
+			errs.add(fmt.Sprintf("hooks[%d]", i), "%s", err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
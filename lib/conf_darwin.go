@@ -4,6 +4,12 @@ package ptp
 
 const DefaultConfigLocation = "/Applications/SubutaiP2P.app/Contents/Resources/p2p.yaml"
 
+// DefaultBootstrapCache is a location of the file with last known working bootstrap nodes
+const DefaultBootstrapCache = "/Applications/SubutaiP2P.app/Contents/Resources/bootstrap.yaml"
+
+// DefaultControlSocket is a Unix socket of management API
+const DefaultControlSocket = "/var/run/p2p.sock"
+
 // Platform specific defaults
 const (
 	DefaultIPTool  = "/sbin/ifconfig" // Default network interface configuration tool for Darwin OS
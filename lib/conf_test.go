@@ -2,7 +2,11 @@ package ptp
 
 import (
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_Conf_Load(t *testing.T) {
@@ -281,3 +285,124 @@ func Test_Conf_getPMTU(t *testing.T) {
 		})
 	}
 }
+
+func Test_Conf_ApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"P2P_RPC_PORT":          "52600",
+		"P2P_PMTU":              "true",
+		"P2P_BOOTSTRAP":         "tcp://10.0.0.1:6881, udp://10.0.0.1:6882",
+		"P2P_TIMEOUTS_SHUTDOWN": "10s",
+		"P2P_DEFAULTS_KEYFILE":  "/etc/p2p/swarm.key",
+		"P2P_SAVE":              "",
+	}
+	lookup := func(name string) (string, bool) {
+		v, e := env[name]
+		return v, e
+	}
+	c := new(Conf)
+	c.SetDefaults()
+	c.Save = "/var/lib/p2p/save.yaml"
+	if err := c.ApplyEnv(lookup); err != nil {
+		t.Fatalf("Conf.ApplyEnv() error = %v", err)
+	}
+	if c.RPCPort != 52600 || !c.PMTU || c.Timeouts.Shutdown != 10*time.Second || c.Defaults.Keyfile != "/etc/p2p/swarm.key" {
+		t.Errorf("Conf.ApplyEnv() didn't apply variables: %+v", c)
+	}
+	if !reflect.DeepEqual(c.Bootstrap, []string{"tcp://10.0.0.1:6881", "udp://10.0.0.1:6882"}) {
+		t.Errorf("Conf.ApplyEnv() bootstrap = %v", c.Bootstrap)
+	}
+	if c.Save != "/var/lib/p2p/save.yaml" {
+		t.Errorf("Conf.ApplyEnv() applied empty variable")
+	}
+
+	env = map[string]string{
+		"P2P_MTU":                      "big",
+		"P2P_TIMEOUTS_RESTORE_RETRY":   "5",
+		"P2P_BOOTSTRAP_TLS_ENABLED":    "maybe",
+		"P2P_TIMEOUTS_RESTORE_RETRY_X": "1s",
+	}
+	err := c.ApplyEnv(lookup)
+	if errs, ok := err.(ConfErrors); !ok || len(errs) != 3 {
+		t.Errorf("Conf.ApplyEnv() error = %v, want 3 errors", err)
+	}
+}
+
+func Test_Conf_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Conf)
+		want   int
+	}{
+		{"defaults", func(c *Conf) {}, 0},
+		{"valid", func(c *Conf) {
+			c.Target = "tcp://10.0.0.1:6881,udp://10.0.0.1:6882"
+			c.Syslog = "127.0.0.1:514"
+			c.Profile = "cpu"
+			c.Timeouts.RestoreRetry = time.Second
+			c.Timeouts.RestoreRetryMax = time.Minute
+			c.Defaults.IP = "10.10.10.1/24"
+		}, 0},
+		{"every field", func(c *Conf) {
+			c.RPCPort = 70000
+			c.MTU = 100
+			c.Log = "verbose"
+			c.Profile = "gpu"
+			c.Bootstrap = []string{"http://10.0.0.1"}
+			c.Target = "tcp://10.0.0.1"
+			c.Syslog = "localhost"
+			c.Timeouts.Shutdown = -time.Second
+			c.Defaults.IP = "10.10.10"
+		}, 9},
+		{"control", func(c *Conf) {
+			c.Control.SocketMode = "rw"
+			c.Control.Listen = "localhost"
+			c.Control.Tokens = []ControlToken{{Role: "root"}, {Token: "secret", Role: ControlRoleRead}}
+			c.Control.TLS.ClientCA = "/etc/p2p/ca.pem"
+		}, 5},
+		{"hooks", func(c *Conf) {
+			c.Hooks = []HookConf{
+				{Exec: "/etc/p2p/up.sh", Events: []string{EventInterfaceUp, EventPeerConnected}, Timeout: time.Second},
+				{URL: "https://example.com/p2p", Retries: 3},
+				{Exec: "/etc/p2p/up.sh", URL: "https://example.com/p2p"},
+				{URL: "ftp://example.com/p2p"},
+				{Exec: "/etc/p2p/up.sh", Events: []string{"peer.up"}},
+				{URL: "http://example.com/p2p", Args: []string{"up"}},
+				{Exec: "/etc/p2p/up.sh", Retries: -1},
+			}
+		}, 5},
+		{"retry delays", func(c *Conf) {
+			c.Timeouts.RestoreRetry = time.Hour
+			c.Timeouts.RestoreRetryMax = time.Minute
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(Conf)
+			c.SetDefaults()
+			tt.modify(c)
+			err := c.Validate()
+			errs, _ := err.(ConfErrors)
+			if len(errs) != tt.want || (err == nil) != (tt.want == 0) {
+				t.Errorf("Conf.Validate() error = %v, want %d errors", err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Conf_LoadStrict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-conf")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "p2p.yaml")
+	ioutil.WriteFile(path, []byte("mtu: 1400\nmtuu: 1300\ntimeouts:\n  shutdown: soon\n"), 0600)
+	c := new(Conf)
+	err = c.LoadStrict(path)
+	if errs, ok := err.(ConfErrors); !ok || len(errs) != 2 {
+		t.Errorf("Conf.LoadStrict() error = %v, want 2 errors", err)
+	}
+	if c.MTU != 1400 {
+		t.Errorf("Conf.LoadStrict() didn't load valid options")
+	}
+}
@@ -4,6 +4,13 @@ package ptp
 
 const DefaultConfigLocation = "C:\\ProgramData\\subutai\\bin\\p2p.yaml"
 
+// DefaultBootstrapCache is a location of the file with last known working bootstrap nodes
+const DefaultBootstrapCache = "C:\\ProgramData\\subutai\\bin\\bootstrap.yaml"
+
+// DefaultControlSocket is a Unix socket of management API. Unix sockets
+// are not used on Windows
+const DefaultControlSocket = ""
+
 // Platform specific defaults
 const (
 	DefaultIPTool  = "netsh.exe"                                            // Default network interface configuration tool for Darwin OS
@@ -5,31 +5,59 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
 	"strconv"
+	"sync"
 	"time"
-
-	"gopkg.in/yaml.v2"
 )
 
 // CryptoKey represents a key and it's expiration date
 type CryptoKey struct {
-	TTLConfig string `yaml:"ttl"`
-	KeyConfig string `yaml:"key"`
+	TTLConfig string    `yaml:"ttl"`
+	KeyConfig string    `yaml:"key"`
+	From      time.Time // Key is not used for encryption before this date
 	Until     time.Time
 	Key       []byte
 }
 
+// KeyOverlap is how long expired key is still accepted for decryption after
+// rotation. It covers clock difference between peers
+const KeyOverlap = time.Duration(time.Minute * 1)
+
 // Crypto is a object used by crypto subsystem
 type Crypto struct {
 	Keys      []CryptoKey
 	ActiveKey CryptoKey
 	Active    bool
+	Rotated   time.Time     // Time of the last key rotation
+	warned    bool          // Whether expiration of active key without replacement was reported
+	keysLock  *sync.RWMutex // Guards keys. Crypto is copied by value, so copies share it
+	fileKeys  [][]byte      // Keys that were loaded from key file
+}
+
+// sharedKeysLock guards keys of Crypto that didn't receive its own lock,
+// e.g. one that is used without instance
+var sharedKeysLock sync.RWMutex
+
+// lock returns lock of keys. Crypto of an instance receives it in Init
+func (c *Crypto) lock() *sync.RWMutex {
+	if c.keysLock == nil {
+		return &sharedKeysLock
+	}
+	return c.keysLock
+}
+
+// KeyStatus is a state of a key displayed to user
+type KeyStatus struct {
+	Fingerprint string    // First bytes of key hash
+	Until       time.Time // Expiration date
+	State       string    // active, standby or overlap
 }
 
 // EnrichKeyValues update information about current and feature keys
-func (c Crypto) EnrichKeyValues(ckey CryptoKey, key, datetime string) CryptoKey {
+func (c *Crypto) EnrichKeyValues(ckey CryptoKey, key, datetime string) CryptoKey {
 	var err error
 	i, err := strconv.ParseInt(datetime, 10, 64)
 	ckey.Until = time.Now()
@@ -48,37 +76,221 @@ func (c Crypto) EnrichKeyValues(ckey CryptoKey, key, datetime string) CryptoKey
 	return ckey
 }
 
-// ReadKeysFromFile read a file stored in a file system and extracts keys to be used
-func (c Crypto) ReadKeysFromFile(filepath string) {
-	yamlFile, err := ioutil.ReadFile(filepath)
+// ReadKeysFromFile reads key file and replaces keys with its content
+func (c *Crypto) ReadKeysFromFile(filepath, salt string) error {
+	keys, err := LoadKeyFile(filepath, salt)
 	if err != nil {
-		Log(Error, "Failed to read key file yaml: %v", err)
-		c.Active = false
-		return
+		return err
 	}
-	var ckey CryptoKey
-	err = yaml.Unmarshal(yamlFile, ckey)
-	if err != nil {
-		Log(Error, "Failed to parse config: %v", err)
-		c.Active = false
+	c.SetFileKeys(keys)
+	c.Active = true
+	return nil
+}
+
+// AddKey appends key to the list. First key becomes active
+func (c *Crypto) AddKey(key CryptoKey) {
+	c.lock().Lock()
+	defer c.lock().Unlock()
+	c.Keys = append(c.Keys, key)
+	if c.ActiveKey.Key == nil {
+		c.ActiveKey = key
+	}
+	Log(Info, "Added encryption key %s valid until %s", keyFingerprint(key.Key), key.Until.String())
+}
+
+// SetKeys replaces list of keys. Active key is kept if it's still in the
+// list, otherwise the first key valid at the moment is activated
+func (c *Crypto) SetKeys(keys []CryptoKey) {
+	c.lock().Lock()
+	defer c.lock().Unlock()
+	c.setKeys(keys)
+}
+
+// SetFileKeys replaces keys loaded from key file. Keys that were added in
+// other ways, e.g. with -key option, are kept
+func (c *Crypto) SetFileKeys(keys []CryptoKey) {
+	c.lock().Lock()
+	defer c.lock().Unlock()
+	merged := []CryptoKey{}
+	for _, key := range c.Keys {
+		if !c.isFileKey(key.Key) {
+			merged = append(merged, key)
+		}
+	}
+	c.fileKeys = [][]byte{}
+	for _, key := range keys {
+		c.fileKeys = append(c.fileKeys, key.Key)
+	}
+	c.setKeys(append(merged, keys...))
+}
+
+func (c *Crypto) isFileKey(key []byte) bool {
+	for _, k := range c.fileKeys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Crypto) setKeys(keys []CryptoKey) {
+	c.Keys = keys
+	if len(keys) == 0 {
 		return
 	}
-	ckey = c.EnrichKeyValues(ckey, ckey.KeyConfig, ckey.TTLConfig)
-	c.Active = true
-	c.Keys = append(c.Keys, ckey)
+	for _, key := range keys {
+		if bytes.Equal(key.Key, c.ActiveKey.Key) {
+			c.ActiveKey = key
+			return
+		}
+	}
+	active := keys[0]
+	now := time.Now()
+	for _, key := range keys {
+		if !now.Before(key.From) && now.Before(key.Until) {
+			active = key
+			break
+		}
+	}
+	if c.ActiveKey.Key != nil {
+		Log(Info, "Encryption key %s was removed. Switched to key %s valid until %s", keyFingerprint(c.ActiveKey.Key), keyFingerprint(active.Key), active.Until.String())
+		c.Rotated = now
+	}
+	c.ActiveKey = active
+	c.warned = false
+}
+
+// rotationDue returns true when active key has to be replaced or some key
+// has to be retired
+func (c *Crypto) rotationDue(now time.Time) bool {
+	c.lock().RLock()
+	defer c.lock().RUnlock()
+	if c.ActiveKey.Key != nil && now.After(c.ActiveKey.Until) {
+		if !c.warned {
+			return true
+		}
+		for _, key := range c.Keys {
+			if !now.Before(key.From) && now.Before(key.Until) && !bytes.Equal(key.Key, c.ActiveKey.Key) {
+				return true
+			}
+		}
+	}
+	for _, key := range c.Keys {
+		if now.After(key.Until.Add(KeyOverlap)) && !bytes.Equal(key.Key, c.ActiveKey.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rotate switches to the next valid key when active key expires and retires
+// keys that expired more than KeyOverlap ago. Returns true if active key was
+// changed. Keys are locked for writing only when there is something to change
+func (c *Crypto) Rotate() bool {
+	now := time.Now()
+	if !c.rotationDue(now) {
+		return false
+	}
+	c.lock().Lock()
+	defer c.lock().Unlock()
+	rotated := false
+	if c.ActiveKey.Key != nil && now.After(c.ActiveKey.Until) {
+		for _, key := range c.Keys {
+			if !now.Before(key.From) && now.Before(key.Until) && !bytes.Equal(key.Key, c.ActiveKey.Key) {
+				Log(Info, "Encryption key %s expired. Rotated to key %s valid until %s", keyFingerprint(c.ActiveKey.Key), keyFingerprint(key.Key), key.Until.String())
+				c.ActiveKey = key
+				c.Rotated = now
+				c.warned = false
+				rotated = true
+				break
+			}
+		}
+		if !rotated && !c.warned {
+			Log(Warning, "Encryption key %s expired at %s and there is no replacement. Keep using it", keyFingerprint(c.ActiveKey.Key), c.ActiveKey.Until.String())
+			c.warned = true
+		}
+	}
+	keys := []CryptoKey{}
+	for _, key := range c.Keys {
+		if now.After(key.Until.Add(KeyOverlap)) && !bytes.Equal(key.Key, c.ActiveKey.Key) {
+			Log(Info, "Retired encryption key %s expired at %s", keyFingerprint(key.Key), key.Until.String())
+			continue
+		}
+		keys = append(keys, key)
+	}
+	c.Keys = keys
+	return rotated
+}
+
+// activeKey returns key used to encrypt messages
+func (c *Crypto) activeKey() []byte {
+	c.lock().RLock()
+	defer c.lock().RUnlock()
+	return c.ActiveKey.Key
+}
+
+// validKeys returns keys accepted for decryption: active key first, then
+// keys that are still valid or expired within overlap window
+func (c *Crypto) validKeys() [][]byte {
+	c.lock().RLock()
+	defer c.lock().RUnlock()
+	keys := [][]byte{}
+	if c.ActiveKey.Key != nil {
+		keys = append(keys, c.ActiveKey.Key)
+	}
+	now := time.Now()
+	for _, key := range c.Keys {
+		if now.After(key.Until.Add(KeyOverlap)) || bytes.Equal(key.Key, c.ActiveKey.Key) {
+			continue
+		}
+		keys = append(keys, key.Key)
+	}
+	return keys
+}
+
+// KeyStatus returns state of every key
+func (c *Crypto) KeyStatus() []KeyStatus {
+	c.lock().RLock()
+	defer c.lock().RUnlock()
+	status := []KeyStatus{}
+	now := time.Now()
+	for _, key := range c.Keys {
+		s := KeyStatus{Fingerprint: keyFingerprint(key.Key), Until: key.Until, State: "standby"}
+		if bytes.Equal(key.Key, c.ActiveKey.Key) {
+			s.State = "active"
+		} else if now.After(key.Until) {
+			s.State = "overlap"
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// LastRotation returns time of the last key rotation
+func (c *Crypto) LastRotation() time.Time {
+	c.lock().RLock()
+	defer c.lock().RUnlock()
+	return c.Rotated
+}
+
+func keyFingerprint(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:4])
 }
 
 // Encrypt encrypts data
-func (c Crypto) encrypt(key []byte, data []byte) ([]byte, error) {
+func (c *Crypto) encrypt(key []byte, data []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(data) != aes.BlockSize {
-		padding := aes.BlockSize - len(data)%aes.BlockSize
-		data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
-	}
+	// Receiver truncates decrypted data to the length from the header,
+	// so padding is always applied
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	padded := make([]byte, len(data), len(data)+padding)
+	copy(padded, data)
+	data = append(padded, bytes.Repeat([]byte{byte(padding)}, padding)...)
 
 	encData := make([]byte, aes.BlockSize+len(data))
 	iv := encData[:aes.BlockSize]
@@ -93,17 +305,78 @@ func (c Crypto) encrypt(key []byte, data []byte) ([]byte, error) {
 }
 
 // Decrypt decrypts data
-func (c Crypto) decrypt(key []byte, data []byte) ([]byte, error) {
+func (c *Crypto) decrypt(key []byte, data []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	encData := data[aes.BlockSize:]
-	if len(data)%aes.BlockSize != 0 {
-		return nil, fmt.Errorf("Input not full blocks: %s", string(data))
+	if len(data) < aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Input not full blocks: %d bytes", len(data))
 	}
+	encData := data[aes.BlockSize:]
 	mode := cipher.NewCBCDecrypter(block, data[:aes.BlockSize])
 	mode.CryptBlocks(encData, encData)
 
 	return encData, nil
 }
+
+// decryptMessage decrypts message with active key first and tries other
+// valid keys during overlap. Legacy cipher has no authentication, so another
+// key is accepted only when it's the single key that produces a non-empty
+// padding
+func (c *Crypto) decryptMessage(data []byte, length int) ([]byte, error) {
+	keys := c.validKeys()
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No valid keys")
+	}
+	if len(keys) == 1 {
+		return c.decrypt(keys[0], data)
+	}
+	plain, err := c.decrypt(keys[0], append([]byte{}, data...))
+	if err != nil {
+		return nil, err
+	}
+	if validPadding(plain, length, true) {
+		return plain, nil
+	}
+	var match []byte
+	for _, key := range keys[1:] {
+		plain, err = c.decrypt(key, append([]byte{}, data...))
+		if err != nil {
+			return nil, err
+		}
+		if !validPadding(plain, length, false) {
+			continue
+		}
+		if match != nil {
+			return nil, fmt.Errorf("Message matches several keys")
+		}
+		match = plain
+	}
+	if match == nil {
+		return nil, fmt.Errorf("None of %d keys matches", len(keys))
+	}
+	return match, nil
+}
+
+// validPadding returns true if data after specified length is a valid
+// padding. Older versions don't pad data which is exactly one block long,
+// so empty padding is valid only when allowed
+func validPadding(data []byte, length int, allowEmpty bool) bool {
+	if length > len(data) {
+		return false
+	}
+	padding := data[length:]
+	if len(padding) == 0 {
+		return allowEmpty
+	}
+	if len(padding) > aes.BlockSize {
+		return false
+	}
+	for _, b := range padding {
+		if int(b) != len(padding) {
+			return false
+		}
+	}
+	return true
+}
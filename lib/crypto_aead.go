@@ -0,0 +1,614 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Authenticated encryption of peer traffic. Every instance generates a random
+// session tag on start. Messages are sealed with AES-256-GCM using a key
+// derived from the swarm key and ID of a sender, so peers sharing the same
+// swarm key never reuse nonces. Nonce is a session tag followed by a message
+// counter: tag lets receiver find the sender, counter is checked against a
+// sliding replay window of that sender.
+//
+// Mode is negotiated with CommCryptoModes packets after peers were connected.
+// Until peer confirms the mode (or when peer runs an older version, which
+// never confirms it) legacy AES-CBC is used. Negotiation packets are
+// authenticated with the swarm key and legacy mode is refused once peer
+// announced support of authenticated encryption, so it can't be downgraded.
+// Requests carry a timestamp that grows with every request and responses
+// echo it, so old negotiation packets can't be replayed.
+
+// Encryption modes
+const (
+	CryptoModeCBC uint8 = 0 // Legacy AES-CBC without authentication
+	CryptoModeGCM uint8 = 1 // AES-256-GCM with replay protection
+)
+
+// CryptoModes is a list of modes supported by this peer in order of preference
+var CryptoModes = []uint8{CryptoModeGCM}
+
+// Authenticated encryption parameters
+const (
+	ReplayWindowSize          = 1024                            // Number of counters tracked by replay window
+	CryptoNegotiationInterval = time.Duration(time.Second * 15) // How often negotiation request is repeated
+	aeadNonceSize             = 12                              // Size of a nonce: tag[4] counter[8]
+	aeadKeyContext            = "p2p aead key"                  // Context of key derivation
+	aeadOverhead              = aeadNonceSize + 2 + 16          // Nonce, inner type and GCM tag
+	cryptoModesContext        = "p2p crypto modes"              // Context of negotiation MAC
+	cryptoModesMACSize        = sha256.Size                     // Size of negotiation MAC
+)
+
+// CryptoModeName returns human-readable name of encryption mode
+func CryptoModeName(mode uint8) string {
+	switch mode {
+	case CryptoModeCBC:
+		return "AES-CBC"
+	case CryptoModeGCM:
+		return "AES-GCM"
+	}
+	return fmt.Sprintf("Unknown (%d)", mode)
+}
+
+// ReplayWindow is a sliding window of message counters received from a peer
+type ReplayWindow struct {
+	top    uint64                        // Highest counter received
+	bitmap [ReplayWindowSize / 64]uint64 // Received counters
+	lock   sync.Mutex
+}
+
+// Check returns false if message with this counter was already received
+// or is too old. Otherwise counter is marked as received
+func (w *ReplayWindow) Check(counter uint64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if counter > w.top {
+		if counter-w.top >= ReplayWindowSize {
+			w.bitmap = [ReplayWindowSize / 64]uint64{}
+		} else {
+			for i := w.top + 1; i < counter; i++ {
+				w.clear(i)
+			}
+		}
+		w.top = counter
+		w.set(counter)
+		return true
+	}
+	if w.top-counter >= ReplayWindowSize {
+		return false
+	}
+	if w.isSet(counter) {
+		return false
+	}
+	w.set(counter)
+	return true
+}
+
+func (w *ReplayWindow) reset() {
+	w.lock.Lock()
+	w.top = 0
+	w.bitmap = [ReplayWindowSize / 64]uint64{}
+	w.lock.Unlock()
+}
+
+func (w *ReplayWindow) set(counter uint64) {
+	i := counter % ReplayWindowSize
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+func (w *ReplayWindow) clear(counter uint64) {
+	i := counter % ReplayWindowSize
+	w.bitmap[i/64] &^= 1 << (i % 64)
+}
+
+func (w *ReplayWindow) isSet(counter uint64) bool {
+	i := counter % ReplayWindowSize
+	return w.bitmap[i/64]&(1<<(i%64)) != 0
+}
+
+// PeerCrypto is a state of encryption negotiated with a single peer. It's
+// guarded by lock
+type PeerCrypto struct {
+	SendMode       uint8        // Mode used for messages sent to the peer
+	RecvMode       uint8        // Mode peer uses for messages sent to us
+	RemoteTag      uint32       // Session tag of the peer
+	LastNegotiated time.Time    // Last time negotiation request was sent
+	Rejected       uint64       // Number of rejected messages
+	Authenticated  bool         // Whether peer already sent authenticated messages
+	window         ReplayWindow // Counters of received messages
+	cipher         cipher.AEAD  // Cipher used to open messages of the peer
+	cipherKey      []byte       // Swarm key cipher was derived from
+	LastHandshake  time.Time    // Last time handshake was initiated by us
+	advertisedAEAD bool         // Whether peer announced support of authenticated encryption
+	modesSent      uint64       // Timestamp of the last negotiation request sent to the peer
+	modesRecv      uint64       // Timestamp of the last negotiation request accepted from the peer
+
+	sessions            []*peerSession  // Sessions established with handshakes
+	pending             *handshakeState // Handshake initiated by us
+	lastRemoteEphemeral []byte          // Ephemeral key of the last handshake initiated by peer
+	lastReply           string          // Reply to that handshake
+	sentTimestamp       uint64          // Timestamp of the last handshake initiated by us
+	recvTimestamp       uint64          // Timestamp of the last handshake initiated by peer
+	lock                sync.Mutex      // Lock for sessions, handshake and negotiation state
+}
+
+// PeerCryptoStats is a snapshot of encryption state of a peer
+type PeerCryptoStats struct {
+	SendMode uint8
+	RecvMode uint8
+	Sessions int
+	Rejected uint64
+}
+
+// Stats returns snapshot of encryption state
+func (c *PeerCrypto) Stats() PeerCryptoStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return PeerCryptoStats{
+		SendMode: c.SendMode,
+		RecvMode: c.RecvMode,
+		Sessions: len(c.sessions),
+		Rejected: c.Rejected,
+	}
+}
+
+func (c *PeerCrypto) sendMode() uint8 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.SendMode
+}
+
+func (c *PeerCrypto) isAuthenticated() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Authenticated
+}
+
+// negotiationDue returns true when legacy mode is used and negotiation
+// request wasn't sent recently
+func (c *PeerCrypto) negotiationDue() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.SendMode == CryptoModeCBC && time.Since(c.LastNegotiated) > CryptoNegotiationInterval
+}
+
+func (c *PeerCrypto) reject() {
+	c.lock.Lock()
+	c.Rejected++
+	c.lock.Unlock()
+}
+
+// AEADSession is a local state of authenticated encryption of an instance
+type AEADSession struct {
+	Tag       uint32            // Random tag of this session
+	counter   uint64            // Counter of sent messages
+	peers     map[uint32]string // IDs of peers by their session tags
+	cipher    cipher.AEAD       // Cipher used to seal our messages
+	cipherKey []byte            // Swarm key cipher was derived from
+	cipherID  string            // ID cipher was derived for
+	lock      sync.RWMutex
+}
+
+// NewAEADSession creates session with a random tag
+func NewAEADSession() (*AEADSession, error) {
+	tag := make([]byte, 4)
+	_, err := rand.Read(tag)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate session tag: %s", err)
+	}
+	return &AEADSession{
+		Tag:   binary.BigEndian.Uint32(tag),
+		peers: make(map[uint32]string),
+	}, nil
+}
+
+// register binds session tag of a peer to its ID
+func (s *AEADSession) register(tag uint32, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if existing, e := s.peers[tag]; e && existing != id {
+		return fmt.Errorf("Session tag %x is already used by %s", tag, existing)
+	}
+	s.peers[tag] = id
+	return nil
+}
+
+// unregister removes tags of a peer
+func (s *AEADSession) unregister(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for tag, pid := range s.peers {
+		if pid == id {
+			delete(s.peers, tag)
+		}
+	}
+}
+
+// reserve registers random unused tag for a session with a peer
+func (s *AEADSession) reserve(id string) (uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tag := make([]byte, 4)
+	for i := 0; i < 16; i++ {
+		_, err := rand.Read(tag)
+		if err != nil {
+			return 0, err
+		}
+		t := binary.BigEndian.Uint32(tag)
+		if _, e := s.peers[t]; e || t == 0 || t == s.Tag {
+			continue
+		}
+		s.peers[t] = id
+		return t, nil
+	}
+	return 0, fmt.Errorf("Failed to find unused session tag")
+}
+
+// release removes a single tag
+func (s *AEADSession) release(tag uint32) {
+	s.lock.Lock()
+	delete(s.peers, tag)
+	s.lock.Unlock()
+}
+
+func (s *AEADSession) releaseSessions(sessions []*peerSession) {
+	for _, session := range sessions {
+		s.release(session.id)
+	}
+}
+
+func (s *AEADSession) peer(tag uint32) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	id, e := s.peers[tag]
+	return id, e
+}
+
+// newAEADCipher derives key of a sender from the swarm key and creates cipher
+func newAEADCipher(key []byte, id string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(aeadKeyContext))
+	mac.Write([]byte(id))
+	return newGCM(mac.Sum(nil))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal creates authenticated message. Inner type of a message is encrypted
+// together with payload, network protocol is authenticated
+func (s *AEADSession) seal(key []byte, id string, msgType MsgType, payload []byte, proto uint16) (*P2PMessage, error) {
+	s.lock.Lock()
+	if s.cipher == nil || s.cipherID != id || !bytes.Equal(s.cipherKey, key) {
+		c, err := newAEADCipher(key, id)
+		if err != nil {
+			s.lock.Unlock()
+			return nil, err
+		}
+		s.cipher = c
+		s.cipherID = id
+		s.cipherKey = key
+	}
+	aead := s.cipher
+	s.lock.Unlock()
+	return sealAEAD(aead, s.Tag, atomic.AddUint64(&s.counter, 1), msgType, payload, proto), nil
+}
+
+func sealAEAD(aead cipher.AEAD, tag uint32, counter uint64, msgType MsgType, payload []byte, proto uint16) *P2PMessage {
+	nonce := make([]byte, aeadNonceSize)
+	binary.BigEndian.PutUint32(nonce[0:4], tag)
+	binary.BigEndian.PutUint64(nonce[4:12], counter)
+
+	plain := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(plain[0:2], uint16(msgType))
+	copy(plain[2:], payload)
+
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MagicCookie
+	msg.Header.Type = uint16(MsgTypeAEAD)
+	msg.Header.NetProto = proto
+	msg.Header.Length = uint16(len(payload))
+	msg.Data = aead.Seal(nonce, nonce, plain, aeadAdditionalData(proto))
+	return msg
+}
+
+func aeadAdditionalData(proto uint16) []byte {
+	ad := make([]byte, 2)
+	binary.BigEndian.PutUint16(ad, proto)
+	return ad
+}
+
+// openAEAD authenticates and decrypts message sealed by a peer. Returned
+// message has the original type
+func (p *PeerToPeer) openAEAD(msg *P2PMessage) (*P2PMessage, error) {
+	if p.AEAD == nil {
+		return nil, fmt.Errorf("Authenticated encryption is not initialized")
+	}
+	if p.Swarm == nil {
+		return nil, fmt.Errorf("nil peer list")
+	}
+	if len(msg.Data) < aeadOverhead {
+		return nil, fmt.Errorf("Authenticated message is too short")
+	}
+	nonce := msg.Data[:aeadNonceSize]
+	tag := binary.BigEndian.Uint32(nonce[0:4])
+	id, e := p.AEAD.peer(tag)
+	if !e {
+		return nil, fmt.Errorf("Authenticated message from unknown session")
+	}
+	peer := p.Swarm.GetPeer(id)
+	if peer == nil {
+		return nil, fmt.Errorf("Authenticated message from unknown peer %s", id)
+	}
+	var plain []byte
+	var err error
+	window := &peer.Crypto.window
+	session := peer.Crypto.session(tag)
+	if session != nil {
+		window = &session.window
+		plain, err = session.recv.Open(nil, nonce, msg.Data[aeadNonceSize:], aeadAdditionalData(msg.Header.NetProto))
+	} else {
+		plain, err = p.openWithSwarmKeys(peer, nonce, msg)
+	}
+	if err != nil {
+		peer.Crypto.reject()
+		return nil, fmt.Errorf("Failed to authenticate message from %s", id)
+	}
+	// Window is updated only by authentic messages
+	if !window.Check(binary.BigEndian.Uint64(nonce[4:12])) {
+		peer.Crypto.reject()
+		return nil, fmt.Errorf("Replayed message from %s", id)
+	}
+	peer.Crypto.lock.Lock()
+	if session != nil {
+		// Peer proved it has session keys, so we can use them too
+		session.confirmed = true
+	}
+	peer.Crypto.Authenticated = true
+	peer.Crypto.lock.Unlock()
+	result := new(P2PMessage)
+	result.Header = new(P2PMessageHeader)
+	*result.Header = *msg.Header
+	result.Header.Type = binary.BigEndian.Uint16(plain[0:2])
+	result.Header.Length = uint16(len(plain) - 2)
+	result.Data = plain[2:]
+	return result, nil
+}
+
+// openWithSwarmKeys opens message with ciphers derived from every valid
+// swarm key. Cipher of the active key is cached
+func (p *PeerToPeer) openWithSwarmKeys(peer *NetworkPeer, nonce []byte, msg *P2PMessage) ([]byte, error) {
+	err := fmt.Errorf("No valid keys")
+	for i, key := range p.Crypter.validKeys() {
+		peer.Crypto.lock.Lock()
+		aead, cipherKey := peer.Crypto.cipher, peer.Crypto.cipherKey
+		peer.Crypto.lock.Unlock()
+		if aead == nil || !bytes.Equal(cipherKey, key) {
+			aead, err = newAEADCipher(key, peer.ID)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				peer.Crypto.lock.Lock()
+				peer.Crypto.cipher = aead
+				peer.Crypto.cipherKey = key
+				peer.Crypto.lock.Unlock()
+			}
+		}
+		var plain []byte
+		plain, err = aead.Open(nil, nonce, msg.Data[aeadNonceSize:], aeadAdditionalData(msg.Header.NetProto))
+		if err == nil {
+			return plain, nil
+		}
+	}
+	return nil, err
+}
+
+// createPeerMessage creates encrypted message for a peer. Message is sealed
+// with session keys when handshake was completed, with AEAD when peer has
+// negotiated it and with legacy cipher otherwise
+func (p *PeerToPeer) createPeerMessage(peer *NetworkPeer, msgType MsgType, payload []byte, proto uint16) (*P2PMessage, error) {
+	if peer != nil && p.Crypter.Active && p.AEAD != nil && p.Dht != nil {
+		session := peer.Crypto.sendSession()
+		if session != nil {
+			return session.seal(msgType, payload, proto), nil
+		}
+	}
+	if peer != nil && p.Crypter.Active && p.AEAD != nil && p.Dht != nil && peer.Crypto.sendMode() == CryptoModeGCM {
+		return p.AEAD.seal(p.Crypter.activeKey(), p.Dht.ID, msgType, payload, proto)
+	}
+	return p.CreateMessage(msgType, payload, proto, true)
+}
+
+// requiresAEAD returns true if traffic from this address belongs to a peer
+// that already switched to authenticated encryption, so legacy messages
+// must be dropped
+func (p *PeerToPeer) requiresAEAD(src *net.UDPAddr) bool {
+	if p.Swarm == nil || src == nil {
+		return false
+	}
+	for _, peer := range p.Swarm.Get() {
+		if peer.Crypto.isAuthenticated() && peer.Endpoint != nil && peer.Endpoint.String() == src.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// requestCryptoModes sends list of supported modes to a peer. Format of
+// CommCryptoModes packet: id[36] tag[4] response[1] timestamp[8] modes[...] mac[32]
+func (p *PeerToPeer) requestCryptoModes(peer *NetworkPeer) error {
+	if p.AEAD == nil || p.Dht == nil || p.UDPSocket == nil {
+		return fmt.Errorf("Authenticated encryption is not initialized")
+	}
+	if peer.Endpoint == nil {
+		return fmt.Errorf("Peer %s has no endpoint", peer.ID)
+	}
+	msg, err := p.CreateMessage(MsgTypeComm, p.cryptoModesRequest(peer, CryptoModes), 0, true)
+	if err != nil {
+		return err
+	}
+	_, err = p.UDPSocket.SendMessage(msg, peer.Endpoint)
+	return err
+}
+
+// cryptoModesRequest creates negotiation request with a new timestamp.
+// Only response to this request will be accepted
+func (p *PeerToPeer) cryptoModesRequest(peer *NetworkPeer, modes []uint8) []byte {
+	peer.Crypto.lock.Lock()
+	now := time.Now()
+	// Timestamp must grow even if clock goes back
+	timestamp := uint64(now.UnixNano())
+	if timestamp <= peer.Crypto.modesSent {
+		timestamp = peer.Crypto.modesSent + 1
+	}
+	peer.Crypto.modesSent = timestamp
+	peer.Crypto.LastNegotiated = now
+	peer.Crypto.lock.Unlock()
+	return p.cryptoModesPayload(peer.ID, 0, timestamp, modes)
+}
+
+func (p *PeerToPeer) cryptoModesPayload(receiver string, response byte, timestamp uint64, modes []uint8) []byte {
+	payload := make([]byte, 51, 51+len(modes))
+	binary.BigEndian.PutUint16(payload[0:2], CommCryptoModes)
+	copy(payload[2:38], p.Dht.ID)
+	binary.BigEndian.PutUint32(payload[38:42], p.AEAD.Tag)
+	payload[42] = response
+	binary.BigEndian.PutUint64(payload[43:51], timestamp)
+	payload = append(payload, modes...)
+	return append(payload, cryptoModesMAC(p.Crypter.activeKey(), receiver, payload[2:])...)
+}
+
+// cryptoModesMAC authenticates negotiation packet with the swarm key. MAC
+// covers receiver, so packet can't be replayed to other peers
+func cryptoModesMAC(key []byte, receiver string, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(cryptoModesContext))
+	mac.Write([]byte(receiver))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// verifyCryptoModes returns true if negotiation packet addressed to us was
+// authenticated with any valid swarm key
+func (p *PeerToPeer) verifyCryptoModes(data []byte) bool {
+	signed := data[:len(data)-cryptoModesMACSize]
+	mac := data[len(data)-cryptoModesMACSize:]
+	for _, key := range p.Crypter.validKeys() {
+		if hmac.Equal(mac, cryptoModesMAC(key, p.Dht.ID, signed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// commCryptoModesHandler handles negotiation of encryption mode. Request
+// registers session of a peer and is answered with selected mode. Response
+// allows us to use selected mode for messages sent to the peer. Requests
+// older than accepted one and responses to other requests are rejected
+func commCryptoModesHandler(data []byte, p *PeerToPeer) ([]byte, error) {
+	err := commPacketCheck(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 50+cryptoModesMACSize {
+		return nil, fmt.Errorf("wrong payload size: %d", len(data))
+	}
+	if !p.Crypter.Active || p.AEAD == nil || p.Dht == nil {
+		return nil, fmt.Errorf("encryption is disabled")
+	}
+	if !p.verifyCryptoModes(data) {
+		return nil, fmt.Errorf("crypto modes failed authentication")
+	}
+	if p.Swarm == nil {
+		return nil, fmt.Errorf("nil peer list")
+	}
+	id := string(data[0:36])
+	peer := p.Swarm.GetPeer(id)
+	if peer == nil {
+		return nil, fmt.Errorf("crypto modes from unknown peer %s", id)
+	}
+	tag := binary.BigEndian.Uint32(data[36:40])
+	timestamp := binary.BigEndian.Uint64(data[41:49])
+	modes := data[49 : len(data)-cryptoModesMACSize]
+
+	peer.Crypto.lock.Lock()
+	defer peer.Crypto.lock.Unlock()
+	if data[40] == 1 {
+		if timestamp != peer.Crypto.modesSent {
+			return nil, fmt.Errorf("crypto modes response from %s doesn't match request", id)
+		}
+		if len(modes) == 0 || (modes[0] != CryptoModeCBC && !supportedCryptoMode(modes[0])) {
+			return nil, fmt.Errorf("peer %s selected unsupported mode", id)
+		}
+		if modes[0] == CryptoModeCBC && peer.Crypto.advertisedAEAD {
+			return nil, fmt.Errorf("peer %s tried to downgrade encryption to %s", id, CryptoModeName(modes[0]))
+		}
+		if modes[0] != CryptoModeCBC {
+			peer.Crypto.advertisedAEAD = true
+		}
+		if peer.Crypto.SendMode != modes[0] {
+			Log(Info, "Using %s encryption for peer %s", CryptoModeName(modes[0]), id)
+		}
+		peer.Crypto.SendMode = modes[0]
+		return nil, nil
+	}
+
+	if timestamp < peer.Crypto.modesRecv {
+		return nil, fmt.Errorf("stale crypto modes request from %s", id)
+	}
+	mode := CryptoModeCBC
+	for _, m := range CryptoModes {
+		if mode == CryptoModeCBC && bytes.IndexByte(modes, m) != -1 {
+			mode = m
+		}
+	}
+	if mode == CryptoModeCBC && peer.Crypto.advertisedAEAD {
+		return nil, fmt.Errorf("peer %s tried to downgrade encryption to %s", id, CryptoModeName(mode))
+	}
+	if mode != CryptoModeCBC {
+		peer.Crypto.advertisedAEAD = true
+		if peer.Crypto.RemoteTag != tag {
+			if existing, e := p.AEAD.peer(peer.Crypto.RemoteTag); e && existing == id && peer.Crypto.findSession(peer.Crypto.RemoteTag) == nil {
+				p.AEAD.release(peer.Crypto.RemoteTag)
+			}
+			peer.Crypto.window.reset()
+			peer.Crypto.Authenticated = false
+		}
+		err = p.AEAD.register(tag, id)
+		if err != nil {
+			// Peer will repeat request later
+			return nil, fmt.Errorf("can't enable authenticated encryption for %s: %s", id, err)
+		}
+		peer.Crypto.RemoteTag = tag
+	}
+	peer.Crypto.RecvMode = mode
+	peer.Crypto.modesRecv = timestamp
+	return p.cryptoModesPayload(id, 1, timestamp, []uint8{mode}), nil
+}
+
+func supportedCryptoMode(mode uint8) bool {
+	for _, m := range CryptoModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReplayWindow_Check(t *testing.T) {
+	w := new(ReplayWindow)
+	tests := []struct {
+		name    string
+		counter uint64
+		want    bool
+	}{
+		{"first", 1, true},
+		{"replay", 1, false},
+		{"gap", 5, true},
+		{"out of order", 3, true},
+		{"out of order replay", 3, false},
+		{"jump", 5 + ReplayWindowSize - 1, true},
+		{"oldest in window", 5 + 1, true},
+		{"replay at window edge", 5, false},
+		{"far jump", 10 * ReplayWindowSize, true},
+		{"before far jump", 10*ReplayWindowSize - 1, true},
+		{"replay after far jump", 10 * ReplayWindowSize, false},
+		{"too old", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := w.Check(tt.counter); got != tt.want {
+				t.Errorf("ReplayWindow.Check(%d) = %t, want %t", tt.counter, got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestAEADPeer(t *testing.T, id string, key []byte) *PeerToPeer {
+	p := new(PeerToPeer)
+	if err := p.Init(); err != nil {
+		t.Fatalf("Failed to init instance: %s", err)
+	}
+	p.Dht = new(DHTClient)
+	p.Dht.ID = id
+	p.Crypter.Active = true
+	p.Crypter.ActiveKey = CryptoKey{Key: key}
+	return p
+}
+
+func TestAEADNegotiation(t *testing.T) {
+	key := []byte("01234567890123456789012345678901")
+	aID := "00000000-0000-0000-0000-00000000000a"
+	bID := "00000000-0000-0000-0000-00000000000b"
+	cID := "00000000-0000-0000-0000-00000000000c"
+	a := newTestAEADPeer(t, aID, key)
+	b := newTestAEADPeer(t, bID, key)
+	peerB := &NetworkPeer{ID: bID}
+	peerA := &NetworkPeer{ID: aID}
+	a.Swarm.Update(bID, peerB)
+	b.Swarm.Update(aID, peerA)
+
+	// Not negotiated yet: legacy encryption is used
+	msg, err := a.createPeerMessage(peerB, MsgTypeNenc, []byte("payload"), 2048)
+	if err != nil || msg.Header.Type != MsgTypeNenc {
+		t.Fatalf("Expected legacy message: %v %+v", err, msg)
+	}
+
+	// Peer without AEAD support answers with legacy mode
+	request := a.cryptoModesRequest(peerB, []uint8{CryptoModeCBC})
+	response, err := commCryptoModesHandler(request[2:], b)
+	if err != nil || response[51] != CryptoModeCBC {
+		t.Fatalf("Bad response to legacy request: %v %v", err, response)
+	}
+	commCryptoModesHandler(response[2:], a)
+	if peerB.Crypto.SendMode != CryptoModeCBC {
+		t.Fatalf("Legacy peer was switched to %s", CryptoModeName(peerB.Crypto.SendMode))
+	}
+
+	request = a.cryptoModesRequest(peerB, CryptoModes)
+	response, err = commCryptoModesHandler(request[2:], b)
+	if err != nil {
+		t.Fatalf("Failed to handle request: %s", err)
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != CommCryptoModes || peerA.Crypto.RecvMode != CryptoModeGCM {
+		t.Fatalf("Bad response: %v", response)
+	}
+	if _, err = commCryptoModesHandler(response[2:], a); err != nil {
+		t.Fatalf("Failed to handle response: %s", err)
+	}
+	if peerB.Crypto.SendMode != CryptoModeGCM {
+		t.Fatalf("Mode wasn't negotiated")
+	}
+
+	// Negotiation can't be forged, replayed or downgraded once peer announced AEAD
+	sent := peerB.Crypto.modesSent
+	forged := b.cryptoModesPayload(aID, 1, sent, []uint8{CryptoModeCBC})
+	forged[len(forged)-1] ^= 1
+	if _, err = commCryptoModesHandler(forged[2:], a); err == nil {
+		t.Errorf("Forged response was accepted")
+	}
+	outsider := newTestAEADPeer(t, bID, []byte("11111111111111111111111111111111"))
+	if _, err = commCryptoModesHandler(outsider.cryptoModesPayload(aID, 1, sent, []uint8{CryptoModeCBC})[2:], a); err == nil {
+		t.Errorf("Response authenticated with another key was accepted")
+	}
+	if _, err = commCryptoModesHandler(b.cryptoModesPayload(cID, 1, sent, []uint8{CryptoModeGCM})[2:], a); err == nil {
+		t.Errorf("Response addressed to another peer was accepted")
+	}
+	if _, err = commCryptoModesHandler(b.cryptoModesPayload(aID, 1, sent, []uint8{CryptoModeCBC})[2:], a); err == nil {
+		t.Errorf("Downgrading response was accepted")
+	}
+	if _, err = commCryptoModesHandler(a.cryptoModesRequest(peerB, []uint8{CryptoModeCBC})[2:], b); err == nil {
+		t.Errorf("Downgrading request was accepted")
+	}
+	if _, err = commCryptoModesHandler(response[2:], a); err == nil {
+		t.Errorf("Response to old request was accepted")
+	}
+	// Replayed request must not reset replay window with a new tag
+	a.AEAD.Tag++
+	replayed := a.cryptoModesPayload(bID, 0, sent-1, CryptoModes)
+	if _, err = commCryptoModesHandler(replayed[2:], b); err == nil || peerA.Crypto.RemoteTag == a.AEAD.Tag {
+		t.Errorf("Stale request was accepted")
+	}
+	a.AEAD.Tag--
+	if peerB.Crypto.SendMode != CryptoModeGCM || peerA.Crypto.RecvMode != CryptoModeGCM {
+		t.Fatalf("Mode was downgraded")
+	}
+
+	msg, err = a.createPeerMessage(peerB, MsgTypeNenc, []byte("payload"), 2048)
+	if err != nil || msg.Header.Type != MsgTypeAEAD {
+		t.Fatalf("Expected authenticated message: %v %+v", err, msg)
+	}
+	received, err := P2PMessageFromBytes(msg.Serialize())
+	if err != nil {
+		t.Fatalf("Failed to deserialize message: %s", err)
+	}
+	opened, err := b.openAEAD(received)
+	if err != nil {
+		t.Fatalf("Failed to open message: %s", err)
+	}
+	if opened.Header.Type != MsgTypeNenc || opened.Header.NetProto != 2048 || !bytes.Equal(opened.Data, []byte("payload")) {
+		t.Fatalf("Bad opened message: %+v %s", opened.Header, opened.Data)
+	}
+	if _, err = b.openAEAD(received); err == nil {
+		t.Errorf("Replayed message was accepted")
+	}
+
+	msg, _ = a.createPeerMessage(peerB, MsgTypeNenc, []byte("payload"), 2048)
+	msg.Data[len(msg.Data)-1] ^= 1
+	if _, err = b.openAEAD(msg); err == nil {
+		t.Errorf("Tampered message was accepted")
+	}
+	msg, _ = a.createPeerMessage(peerB, MsgTypeNenc, []byte("payload"), 2048)
+	msg.Header.NetProto = 2054
+	if _, err = b.openAEAD(msg); err == nil {
+		t.Errorf("Message with modified protocol was accepted")
+	}
+	if peerA.Crypto.Rejected != 3 {
+		t.Errorf("Expected 3 rejected messages, got %d", peerA.Crypto.Rejected)
+	}
+
+	other := newTestAEADPeer(t, aID, []byte("11111111111111111111111111111111"))
+	msg, _ = other.AEAD.seal(other.Crypter.ActiveKey.Key, aID, MsgTypeNenc, []byte("payload"), 2048)
+	if _, err = b.openAEAD(msg); err == nil {
+		t.Errorf("Message from unknown session was accepted")
+	}
+}
@@ -0,0 +1,428 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Per-peer session keys. Handshake is piggybacked on the introduction
+// exchange and follows Noise NNpsk0 pattern:
+//
+//   IntroReq: id[36] endpoint | base64(version[1] e_i[32] timestamp[8] mac1[16])
+//   Intro:    id,mac,ip,endpoint,base64(version[1] e_r[32] session[4] mac2[16])
+//
+// Swarm key is used as a pre-shared key for authentication only: mac1 proves
+// that initiator knows it, while it is also mixed into key derivation, so
+// mac2 proves the same for the responder. Timestamps of initiations grow
+// with every new ephemeral key and responder rejects initiations that are not
+// newer than the last one, so replayed handshakes can't evict live sessions. Traffic keys are derived from
+// ephemeral X25519 keys which are discarded after handshake, so recorded
+// traffic can't be decrypted with the swarm key. Initiator re-keys every
+// SessionRekeyInterval. Old sessions are accepted until SessionLifetime
+// passes, so packets in flight are not lost during re-keying.
+//
+// Older peers echo handshake back as a part of the endpoint and never send
+// a reply, so connection with them falls back to swarm key encryption.
+
+// Session parameters
+const (
+	HandshakeVersion     byte = 1
+	SessionRekeyInterval      = time.Duration(time.Minute * 10)
+	SessionLifetime           = time.Duration(time.Minute * 25)
+	HandshakeTimeout          = time.Duration(time.Second * 30)
+	maxPeerSessions           = 4
+	handshakeMACSize          = 16
+	handshakeSeparator        = "|"
+	handshakeInitSize         = 1 + curve25519.PointSize + 8 + handshakeMACSize
+	handshakeReplySize        = 1 + curve25519.PointSize + 4 + handshakeMACSize
+)
+
+// peerSession is a set of traffic keys established by a single handshake
+type peerSession struct {
+	id        uint32       // Session ID. Used as a tag of nonces
+	send      cipher.AEAD  // Cipher for messages sent to the peer
+	recv      cipher.AEAD  // Cipher for messages received from the peer
+	counter   uint64       // Counter of sent messages
+	window    ReplayWindow // Counters of received messages
+	created   time.Time    // Time of handshake
+	initiator bool         // Whether handshake was initiated by us
+	confirmed bool         // Whether peer proved possession of keys
+}
+
+// handshakeState is a handshake initiated by us
+type handshakeState struct {
+	private   []byte
+	public    []byte
+	psk       []byte
+	timestamp []byte
+	created   time.Time
+}
+
+// splitHandshake separates handshake from endpoint of an introduction request
+func splitHandshake(data string) (string, string) {
+	i := strings.Index(data, handshakeSeparator)
+	if i == -1 {
+		return data, ""
+	}
+	return data[:i], data[i+len(handshakeSeparator):]
+}
+
+// introRequestPayload returns payload of an introduction request. When
+// encryption is enabled handshake initiation is appended to it
+func (p *PeerToPeer) introRequestPayload(np *NetworkPeer, ep *net.UDPAddr) []byte {
+	payload := p.Dht.ID + ep.String()
+	if !p.Crypter.Active {
+		return []byte(payload)
+	}
+	hs, err := p.initiateHandshake(np, false)
+	if err != nil {
+		Log(Debug, "Failed to initiate handshake with %s: %s", np.ID, err)
+		return []byte(payload)
+	}
+	return []byte(payload + handshakeSeparator + hs)
+}
+
+// initiateHandshake returns handshake initiation. Pending handshake is reused
+// until it times out, so several introduction requests sent to different
+// endpoints carry the same ephemeral key
+func (p *PeerToPeer) initiateHandshake(np *NetworkPeer, force bool) (string, error) {
+	if p.Dht == nil {
+		return "", fmt.Errorf("nil dht")
+	}
+	np.Crypto.lock.Lock()
+	defer np.Crypto.lock.Unlock()
+	hs := np.Crypto.pending
+	if force || hs == nil || time.Since(hs.created) > HandshakeTimeout {
+		hs = new(handshakeState)
+		hs.private = make([]byte, curve25519.ScalarSize)
+		_, err := io.ReadFull(rand.Reader, hs.private)
+		if err != nil {
+			return "", err
+		}
+		hs.public, err = curve25519.X25519(hs.private, curve25519.Basepoint)
+		if err != nil {
+			return "", err
+		}
+		hs.psk = p.Crypter.activeKey()
+		hs.created = time.Now()
+		// Timestamp must grow even if clock goes back
+		timestamp := uint64(hs.created.UnixNano())
+		if timestamp <= np.Crypto.sentTimestamp {
+			timestamp = np.Crypto.sentTimestamp + 1
+		}
+		np.Crypto.sentTimestamp = timestamp
+		hs.timestamp = make([]byte, 8)
+		binary.BigEndian.PutUint64(hs.timestamp, timestamp)
+		np.Crypto.pending = hs
+	}
+	np.Crypto.LastHandshake = time.Now()
+	data := make([]byte, 0, handshakeInitSize)
+	data = append(data, HandshakeVersion)
+	data = append(data, hs.public...)
+	data = append(data, hs.timestamp...)
+	data = append(data, handshakeMAC(hs.psk, "p2p hs1", []byte(p.Dht.ID), []byte(np.ID), hs.public, hs.timestamp)...)
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// respondHandshake verifies handshake initiated by a peer, establishes new
+// session and returns handshake reply. Repeated initiation with the same
+// ephemeral key gets the same reply, older initiations are rejected
+func (p *PeerToPeer) respondHandshake(np *NetworkPeer, encoded string) (string, error) {
+	if p.Dht == nil || p.AEAD == nil {
+		return "", fmt.Errorf("Authenticated encryption is not initialized")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) != handshakeInitSize {
+		return "", fmt.Errorf("Malformed handshake from %s", np.ID)
+	}
+	if data[0] != HandshakeVersion {
+		return "", fmt.Errorf("Unsupported handshake version %d from %s", data[0], np.ID)
+	}
+	// Initiator may use any of valid keys during rotation
+	var psk []byte
+	remote := data[1 : 1+curve25519.PointSize]
+	timestamp := data[1+curve25519.PointSize : 9+curve25519.PointSize]
+	for _, key := range p.Crypter.validKeys() {
+		mac := handshakeMAC(key, "p2p hs1", []byte(np.ID), []byte(p.Dht.ID), remote, timestamp)
+		if hmac.Equal(mac, data[9+curve25519.PointSize:]) {
+			psk = key
+			break
+		}
+	}
+	if psk == nil {
+		return "", fmt.Errorf("Handshake from %s failed authentication", np.ID)
+	}
+
+	np.Crypto.lock.Lock()
+	if bytes.Equal(np.Crypto.lastRemoteEphemeral, remote) {
+		reply := np.Crypto.lastReply
+		np.Crypto.lock.Unlock()
+		return reply, nil
+	}
+	if binary.BigEndian.Uint64(timestamp) <= np.Crypto.recvTimestamp {
+		np.Crypto.lock.Unlock()
+		return "", fmt.Errorf("Stale handshake from %s", np.ID)
+	}
+	np.Crypto.recvTimestamp = binary.BigEndian.Uint64(timestamp)
+	np.Crypto.lock.Unlock()
+
+	private := make([]byte, curve25519.ScalarSize)
+	_, err = io.ReadFull(rand.Reader, private)
+	if err != nil {
+		return "", err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	secret, err := curve25519.X25519(private, remote)
+	if err != nil {
+		return "", fmt.Errorf("Bad ephemeral key from %s: %s", np.ID, err)
+	}
+	id, err := p.AEAD.reserve(np.ID)
+	if err != nil {
+		return "", err
+	}
+	session, auth, err := newPeerSession(secret, psk, np.ID, p.Dht.ID, remote, public, id, false)
+	if err != nil {
+		p.AEAD.release(id)
+		return "", err
+	}
+
+	data = make([]byte, 0, handshakeReplySize)
+	data = append(data, HandshakeVersion)
+	data = append(data, public...)
+	sid := make([]byte, 4)
+	binary.BigEndian.PutUint32(sid, id)
+	data = append(data, sid...)
+	data = append(data, handshakeMAC(auth, "p2p hs2", remote, public, sid)...)
+	reply := base64.StdEncoding.EncodeToString(data)
+
+	np.Crypto.lock.Lock()
+	np.Crypto.lastRemoteEphemeral = remote
+	np.Crypto.lastReply = reply
+	evicted := np.Crypto.addSession(session)
+	np.Crypto.lock.Unlock()
+	p.AEAD.releaseSessions(evicted)
+	Log(Debug, "Established session %x with %s as responder", id, np.ID)
+	return reply, nil
+}
+
+// completeHandshake verifies reply to our handshake and establishes session
+func (p *PeerToPeer) completeHandshake(np *NetworkPeer, encoded string) error {
+	if p.Dht == nil || p.AEAD == nil {
+		return fmt.Errorf("Authenticated encryption is not initialized")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) != handshakeReplySize {
+		return fmt.Errorf("Malformed handshake reply from %s", np.ID)
+	}
+	if data[0] != HandshakeVersion {
+		return fmt.Errorf("Unsupported handshake version %d from %s", data[0], np.ID)
+	}
+	remote := data[1 : 1+curve25519.PointSize]
+	sid := data[1+curve25519.PointSize : 5+curve25519.PointSize]
+	id := binary.BigEndian.Uint32(sid)
+
+	np.Crypto.lock.Lock()
+	hs := np.Crypto.pending
+	if hs == nil || time.Since(hs.created) > HandshakeTimeout {
+		np.Crypto.lock.Unlock()
+		return fmt.Errorf("No pending handshake with %s", np.ID)
+	}
+	np.Crypto.lock.Unlock()
+
+	secret, err := curve25519.X25519(hs.private, remote)
+	if err != nil {
+		return fmt.Errorf("Bad ephemeral key from %s: %s", np.ID, err)
+	}
+	session, auth, err := newPeerSession(secret, hs.psk, p.Dht.ID, np.ID, hs.public, remote, id, true)
+	if err != nil {
+		return err
+	}
+	mac := handshakeMAC(auth, "p2p hs2", hs.public, remote, sid)
+	if !hmac.Equal(mac, data[5+curve25519.PointSize:]) {
+		return fmt.Errorf("Handshake reply from %s failed authentication", np.ID)
+	}
+	err = p.AEAD.register(id, np.ID)
+	if err != nil {
+		return err
+	}
+
+	np.Crypto.lock.Lock()
+	if np.Crypto.pending == hs {
+		// Ephemeral key is not needed anymore
+		np.Crypto.pending = nil
+	}
+	evicted := np.Crypto.addSession(session)
+	np.Crypto.lock.Unlock()
+	p.AEAD.releaseSessions(evicted)
+	Log(Debug, "Established session %x with %s as initiator", id, np.ID)
+	return nil
+}
+
+// rekey sends new handshake to the peer
+func (p *PeerToPeer) rekey(np *NetworkPeer) error {
+	if p.UDPSocket == nil {
+		return fmt.Errorf("nil udp socket")
+	}
+	if np.Endpoint == nil {
+		return fmt.Errorf("Peer %s has no endpoint", np.ID)
+	}
+	hs, err := p.initiateHandshake(np, true)
+	if err != nil {
+		return err
+	}
+	payload := []byte(p.Dht.ID + np.Endpoint.String() + handshakeSeparator + hs)
+	msg, err := p.CreateMessage(MsgTypeIntroReq, payload, 0, true)
+	if err != nil {
+		return err
+	}
+	_, err = p.UDPSocket.SendMessage(msg, np.Endpoint)
+	return err
+}
+
+// maintainSessions removes expired sessions and re-keys when it's time
+func (p *PeerToPeer) maintainSessions(np *NetworkPeer) {
+	if p.AEAD == nil {
+		return
+	}
+	np.Crypto.lock.Lock()
+	expired := []*peerSession{}
+	sessions := []*peerSession{}
+	for _, s := range np.Crypto.sessions {
+		if time.Since(s.created) > SessionLifetime {
+			expired = append(expired, s)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	np.Crypto.sessions = sessions
+	rekey := time.Since(np.Crypto.LastHandshake) > SessionRekeyInterval
+	for _, s := range sessions {
+		if s.initiator && time.Since(s.created) < SessionRekeyInterval {
+			rekey = false
+		}
+	}
+	np.Crypto.lock.Unlock()
+	p.AEAD.releaseSessions(expired)
+	if rekey {
+		Log(Debug, "Re-keying session with %s", np.ID)
+		err := p.rekey(np)
+		if err != nil {
+			Log(Debug, "Failed to re-key session with %s: %s", np.ID, err)
+		}
+	}
+}
+
+// newPeerSession derives traffic keys of a session and a key used to
+// authenticate handshake reply
+func newPeerSession(secret, psk []byte, initiator, responder string, ei, er []byte, id uint32, isInitiator bool) (*peerSession, []byte, error) {
+	info := bytes.NewBufferString("p2p session")
+	info.WriteString(initiator)
+	info.WriteString(responder)
+	info.Write(ei)
+	info.Write(er)
+	binary.Write(info, binary.BigEndian, id)
+	keys := make([]byte, 96)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, psk, info.Bytes()), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	i2r, err := newGCM(keys[0:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	r2i, err := newGCM(keys[32:64])
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &peerSession{
+		id:        id,
+		created:   time.Now(),
+		initiator: isInitiator,
+		confirmed: isInitiator,
+	}
+	if isInitiator {
+		s.send, s.recv = i2r, r2i
+	} else {
+		s.send, s.recv = r2i, i2r
+	}
+	return s, keys[64:96], nil
+}
+
+func handshakeMAC(key []byte, label string, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)[:handshakeMACSize]
+}
+
+// seal creates message encrypted with session keys
+func (s *peerSession) seal(msgType MsgType, payload []byte, proto uint16) *P2PMessage {
+	return sealAEAD(s.send, s.id, atomic.AddUint64(&s.counter, 1), msgType, payload, proto)
+}
+
+// addSession appends session and returns sessions evicted to keep the
+// limit. Must be called under lock
+func (c *PeerCrypto) addSession(s *peerSession) []*peerSession {
+	c.sessions = append(c.sessions, s)
+	evicted := []*peerSession{}
+	for len(c.sessions) > maxPeerSessions {
+		evicted = append(evicted, c.sessions[0])
+		c.sessions = c.sessions[1:]
+	}
+	return evicted
+}
+
+// sendSession returns the newest confirmed session
+func (c *PeerCrypto) sendSession() *peerSession {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := len(c.sessions) - 1; i >= 0; i-- {
+		if c.sessions[i].confirmed {
+			return c.sessions[i]
+		}
+	}
+	return nil
+}
+
+// session returns session with specified ID
+func (c *PeerCrypto) session(id uint32) *peerSession {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.findSession(id)
+}
+
+// findSession returns session with specified ID. Must be called under lock
+func (c *PeerCrypto) findSession(id uint32) *peerSession {
+	for _, s := range c.sessions {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// Sessions returns number of active sessions
+func (c *PeerCrypto) Sessions() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.sessions)
+}
@@ -0,0 +1,127 @@
+package ptp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestKeyExchange(t *testing.T) {
+	key := []byte("01234567890123456789012345678901")
+	aID := "00000000-0000-0000-0000-00000000000a"
+	bID := "00000000-0000-0000-0000-00000000000b"
+	a := newTestAEADPeer(t, aID, key)
+	b := newTestAEADPeer(t, bID, key)
+	peerB := &NetworkPeer{ID: bID}
+	peerA := &NetworkPeer{ID: aID}
+	a.Swarm.Update(bID, peerB)
+	b.Swarm.Update(aID, peerA)
+
+	hs1, err := a.initiateHandshake(peerB, false)
+	if err != nil {
+		t.Fatalf("Failed to initiate handshake: %s", err)
+	}
+	if again, _ := a.initiateHandshake(peerB, false); again != hs1 {
+		t.Errorf("Pending handshake wasn't reused")
+	}
+
+	other := newTestAEADPeer(t, bID, []byte("11111111111111111111111111111111"))
+	other.Swarm.Update(aID, &NetworkPeer{ID: aID})
+	if _, err = other.respondHandshake(other.Swarm.GetPeer(aID), hs1); err == nil {
+		t.Errorf("Handshake with different swarm key was accepted")
+	}
+
+	hs2, err := b.respondHandshake(peerA, hs1)
+	if err != nil {
+		t.Fatalf("Failed to respond to handshake: %s", err)
+	}
+	if again, _ := b.respondHandshake(peerA, hs1); again != hs2 || peerA.Crypto.Sessions() != 1 {
+		t.Errorf("Repeated handshake created new session")
+	}
+	// Responder waits for key confirmation
+	if peerA.Crypto.sendSession() != nil {
+		t.Errorf("Responder session was confirmed before receiving data")
+	}
+
+	tampered := []byte(hs2)
+	tampered[len(tampered)-3] ^= 1
+	if err = a.completeHandshake(peerB, string(tampered)); err == nil {
+		t.Errorf("Tampered handshake reply was accepted")
+	}
+	if err = a.completeHandshake(peerB, hs2); err != nil {
+		t.Fatalf("Failed to complete handshake: %s", err)
+	}
+	if err = a.completeHandshake(peerB, hs2); err == nil {
+		t.Errorf("Handshake was completed twice")
+	}
+
+	for i, c := range []struct {
+		from, to   *PeerToPeer
+		peer, self *NetworkPeer
+	}{{a, b, peerB, peerA}, {b, a, peerA, peerB}} {
+		msg, err := c.from.createPeerMessage(c.peer, MsgTypeNenc, []byte("payload"), 2048)
+		if err != nil || msg.Header.Type != MsgTypeAEAD {
+			t.Fatalf("%d: Expected session message: %v %+v", i, err, msg)
+		}
+		received, _ := P2PMessageFromBytes(msg.Serialize())
+		opened, err := c.to.openAEAD(received)
+		if err != nil {
+			t.Fatalf("%d: Failed to open message: %s", i, err)
+		}
+		if opened.Header.Type != MsgTypeNenc || !bytes.Equal(opened.Data, []byte("payload")) {
+			t.Fatalf("%d: Bad opened message: %+v %s", i, opened.Header, opened.Data)
+		}
+		if _, err = c.to.openAEAD(received); err == nil {
+			t.Errorf("%d: Replayed message was accepted", i)
+		}
+	}
+
+	// Old session is accepted until it expires
+	old, _ := a.createPeerMessage(peerB, MsgTypeNenc, []byte("old"), 2048)
+	first := hs1
+	hs1, _ = a.initiateHandshake(peerB, true)
+	hs2, err = b.respondHandshake(peerA, hs1)
+	if err != nil {
+		t.Fatalf("Failed to respond to re-key: %s", err)
+	}
+	if err = a.completeHandshake(peerB, hs2); err != nil {
+		t.Fatalf("Failed to complete re-key: %s", err)
+	}
+	if _, err = b.openAEAD(old); err != nil {
+		t.Errorf("Message of previous session was rejected: %s", err)
+	}
+	if _, err = b.respondHandshake(peerA, first); err == nil || peerA.Crypto.Sessions() != 2 {
+		t.Errorf("Replayed handshake was accepted")
+	}
+	for _, s := range peerA.Crypto.sessions {
+		s.created = time.Now().Add(-SessionLifetime)
+	}
+	b.maintainSessions(peerA)
+	if peerA.Crypto.Sessions() != 0 {
+		t.Errorf("Expired sessions were not removed")
+	}
+	old, _ = a.createPeerMessage(peerB, MsgTypeNenc, []byte("old"), 2048)
+	if _, err = b.openAEAD(old); err == nil {
+		t.Errorf("Message of expired session was accepted")
+	}
+}
+
+func TestKeyExchangeFallback(t *testing.T) {
+	key := []byte("01234567890123456789012345678901")
+	aID := "00000000-0000-0000-0000-00000000000a"
+	bID := "00000000-0000-0000-0000-00000000000b"
+	a := newTestAEADPeer(t, aID, key)
+	peerB := &NetworkPeer{ID: bID}
+	a.Swarm.Update(bID, peerB)
+
+	hs1, _ := a.initiateHandshake(peerB, false)
+	// Older peer sends request back as an endpoint
+	endpoint, handshake := splitHandshake("192.168.0.1:1234" + handshakeSeparator + hs1)
+	if endpoint != "192.168.0.1:1234" || handshake != hs1 {
+		t.Fatalf("Failed to split handshake: %s %s", endpoint, handshake)
+	}
+	msg, err := a.createPeerMessage(peerB, MsgTypeNenc, []byte("payload"), 2048)
+	if err != nil || msg.Header.Type != MsgTypeNenc {
+		t.Errorf("Expected legacy message: %v %+v", err, msg)
+	}
+}
@@ -1,6 +1,8 @@
 package ptp
 
 import (
+	"bytes"
+	"crypto/aes"
 	//"crypto/rand"
 	"math/rand"
 	"reflect"
@@ -80,3 +82,125 @@ func TestCrypto_encrypt(t *testing.T) {
 		})
 	}
 }
+
+func TestCrypto_decrypt(t *testing.T) {
+	key := []byte("01234567890123456789012345678901")
+	c := Crypto{}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"empty", []byte{}, false},
+		{"single block", []byte("0123456789abcdef"), false},
+		{"partial block", []byte("hello"), false},
+		{"several blocks", []byte("0123456789abcdef0123456789abcdef0"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := c.encrypt(key, tt.data)
+			if err != nil {
+				t.Fatalf("Crypto.encrypt() error = %v", err)
+			}
+			if len(enc)%16 != 0 || len(enc) <= len(tt.data)+16 {
+				t.Errorf("Data wasn't padded: %d bytes", len(enc))
+			}
+			dec, err := c.decrypt(key, enc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Crypto.decrypt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(dec[:len(tt.data)], tt.data) {
+				t.Errorf("Crypto.decrypt() = %v, want %v", dec[:len(tt.data)], tt.data)
+			}
+		})
+	}
+	if _, err := c.decrypt(key, []byte("short")); err == nil {
+		t.Errorf("Crypto.decrypt() accepted partial block")
+	}
+}
+
+func TestCrypto_Rotate(t *testing.T) {
+	now := time.Now()
+	expired := CryptoKey{Key: []byte("00000000000000000000000000000000"), Until: now.Add(-time.Second)}
+	retired := CryptoKey{Key: []byte("11111111111111111111111111111111"), Until: now.Add(-2 * KeyOverlap)}
+	next := CryptoKey{Key: []byte("22222222222222222222222222222222"), Until: now.Add(time.Hour)}
+	later := CryptoKey{Key: []byte("33333333333333333333333333333333"), Until: now.Add(2 * time.Hour)}
+
+	c := new(Crypto)
+	c.AddKey(expired)
+	c.AddKey(retired)
+	c.AddKey(next)
+	c.AddKey(later)
+	if !bytes.Equal(c.activeKey(), expired.Key) {
+		t.Fatalf("First key is not active")
+	}
+	if !c.Rotate() {
+		t.Fatalf("Expired key wasn't rotated")
+	}
+	if !bytes.Equal(c.activeKey(), next.Key) || c.LastRotation().IsZero() {
+		t.Errorf("Rotated to wrong key: %s", c.activeKey())
+	}
+	if c.Rotate() {
+		t.Errorf("Valid key was rotated")
+	}
+	want := [][]byte{next.Key, expired.Key, later.Key}
+	if got := c.validKeys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("validKeys() = %s, want %s", got, want)
+	}
+	states := []string{}
+	for _, s := range c.KeyStatus() {
+		states = append(states, s.State)
+	}
+	if !reflect.DeepEqual(states, []string{"overlap", "active", "standby"}) {
+		t.Errorf("KeyStatus() = %v", states)
+	}
+
+	// Active key is kept when there is no replacement
+	single := new(Crypto)
+	single.AddKey(retired)
+	if single.Rotate() || !bytes.Equal(single.activeKey(), retired.Key) || len(single.Keys) != 1 {
+		t.Errorf("Active key without replacement was retired")
+	}
+	if single.rotationDue(time.Now()) {
+		t.Errorf("Rotation is due after expiration was reported")
+	}
+	single.AddKey(next)
+	if !single.rotationDue(time.Now()) || !single.Rotate() {
+		t.Errorf("Replacement of expired key wasn't activated")
+	}
+}
+
+func TestCrypto_decryptMessage(t *testing.T) {
+	oldKey := []byte("00000000000000000000000000000000")
+	newKey := []byte("11111111111111111111111111111111")
+	c := new(Crypto)
+	c.AddKey(CryptoKey{Key: oldKey, Until: time.Now().Add(time.Hour)})
+	c.AddKey(CryptoKey{Key: newKey, Until: time.Now().Add(2 * time.Hour)})
+
+	for _, key := range [][]byte{oldKey, newKey} {
+		data := []byte("payload encrypted during overlap")
+		enc, _ := c.encrypt(key, data)
+		dec, err := c.decryptMessage(enc, len(data))
+		if err != nil {
+			t.Fatalf("Crypto.decryptMessage() error = %v", err)
+		}
+		if !bytes.Equal(dec[:len(data)], data) {
+			t.Errorf("Crypto.decryptMessage() = %v, want %v", dec[:len(data)], data)
+		}
+	}
+	data := []byte("payload")
+	enc, _ := c.encrypt([]byte("22222222222222222222222222222222"), data)
+	if _, err := c.decryptMessage(enc, len(data)); err == nil {
+		t.Errorf("Message encrypted with unknown key was accepted")
+	}
+
+	// Older versions don't pad messages of full blocks. Such messages can
+	// only be checked against active key
+	data = []byte("0123456789abcdef0123456789abcdef")
+	enc, _ = c.encrypt(oldKey, data)
+	enc = enc[:len(enc)-aes.BlockSize]
+	dec, err := c.decryptMessage(enc, len(data))
+	if err != nil || !bytes.Equal(dec, data) {
+		t.Errorf("Crypto.decryptMessage() of unpadded message = %v, %v", dec, err)
+	}
+}
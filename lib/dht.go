@@ -74,6 +74,24 @@ func (dht *DHTClient) Init(hash string) error {
 // Connect sends `conn` packet to a DHT
 func (dht *DHTClient) Connect(ipList []net.IP, proxyList []*proxyServer) error {
 	dht.Connected = false
+	err := dht.send(dht.connectPacket(ipList, proxyList))
+	if err != nil {
+		return fmt.Errorf("Failed to handshake with bootstrap node: %s", err)
+	}
+	// Waiting for 3 seconds to get connection confirmation
+	sent := time.Now()
+	for time.Since(sent) < time.Duration(5000*time.Millisecond) {
+		if dht.Connected {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	Log(Error, "DHT handshake didn't finish")
+	return fmt.Errorf("Couldn't handshake with bootstrap node")
+}
+
+// connectPacket returns `conn` packet with local IPs and proxies of instance
+func (dht *DHTClient) connectPacket(ipList []net.IP, proxyList []*proxyServer) *protocol.DHTPacket {
 	if dht.RemotePort == 0 {
 		dht.RemotePort = dht.LocalPort
 	}
@@ -99,7 +117,7 @@ func (dht *DHTClient) Connect(ipList []net.IP, proxyList []*proxyServer) error {
 		proxies = append(proxies, proxy.Endpoint.String())
 	}
 
-	packet := &protocol.DHTPacket{
+	return &protocol.DHTPacket{
 		Type:      protocol.DHTPacketType_Connect,
 		Infohash:  dht.NetworkHash,
 		Id:        dht.ID,
@@ -109,20 +127,6 @@ func (dht *DHTClient) Connect(ipList []net.IP, proxyList []*proxyServer) error {
 		Arguments: ips,
 		Proxies:   proxies,
 	}
-	err := dht.send(packet)
-	if err != nil {
-		return fmt.Errorf("Failed to handshake with bootstrap node: %s", err)
-	}
-	// Waiting for 3 seconds to get connection confirmation
-	sent := time.Now()
-	for time.Since(sent) < time.Duration(5000*time.Millisecond) {
-		if dht.Connected {
-			return nil
-		}
-		time.Sleep(time.Millisecond * 100)
-	}
-	Log(Error, "DHT handshake didn't finish")
-	return fmt.Errorf("Couldn't handshake with bootstrap node")
 }
 
 func (dht *DHTClient) read() (*protocol.DHTPacket, error) {
@@ -140,31 +144,8 @@ func (dht *DHTClient) read() (*protocol.DHTPacket, error) {
 func (dht *DHTClient) send(packet *protocol.DHTPacket) error {
 	// if dht.OutgoingData != nil && !dht.isShutdown {
 	if dht.OutgoingData != nil {
-		// dht.OutgoingData <- packet
-		if len(packet.Arguments) == 0 && len(packet.Proxies) == 0 {
-			dht.OutgoingData <- packet
-		} else {
-			for len(packet.Arguments) != 0 || len(packet.Proxies) != 0 {
-				blockLengthArgs := min(10, len(packet.Arguments))
-				blockLengthProxies := min(10, len(packet.Proxies))
-				args := packet.Arguments[:blockLengthArgs]
-				proxies := packet.Proxies[:blockLengthProxies]
-				currentPacket := &protocol.DHTPacket{
-					Type:      packet.Type,
-					Id:        packet.Id,
-					Infohash:  packet.Infohash,
-					Data:      packet.Data,
-					Query:     packet.Query,
-					Arguments: args,
-					Proxies:   proxies,
-					Extra:     packet.Extra,
-					Payload:   packet.Payload,
-					Version:   packet.Version,
-				}
-				dht.OutgoingData <- currentPacket
-				packet.Arguments = packet.Arguments[blockLengthArgs:]
-				packet.Proxies = packet.Proxies[blockLengthProxies:]
-			}
+		for _, currentPacket := range splitPacket(packet) {
+			dht.OutgoingData <- currentPacket
 		}
 	} else {
 		// Log(Debug, "%+v ||| %+v", dht.OutgoingData, dht.isShutdown)
@@ -173,6 +154,35 @@ func (dht *DHTClient) send(packet *protocol.DHTPacket) error {
 	return nil
 }
 
+// splitPacket splits packet with long lists of arguments and proxies into
+// packets with 10 entries of each at most
+func splitPacket(packet *protocol.DHTPacket) []*protocol.DHTPacket {
+	if len(packet.Arguments) == 0 && len(packet.Proxies) == 0 {
+		return []*protocol.DHTPacket{packet}
+	}
+	packets := []*protocol.DHTPacket{}
+	arguments, proxyList := packet.Arguments, packet.Proxies
+	for len(arguments) != 0 || len(proxyList) != 0 {
+		blockLengthArgs := min(10, len(arguments))
+		blockLengthProxies := min(10, len(proxyList))
+		packets = append(packets, &protocol.DHTPacket{
+			Type:      packet.Type,
+			Id:        packet.Id,
+			Infohash:  packet.Infohash,
+			Data:      packet.Data,
+			Query:     packet.Query,
+			Arguments: arguments[:blockLengthArgs],
+			Proxies:   proxyList[:blockLengthProxies],
+			Extra:     packet.Extra,
+			Payload:   packet.Payload,
+			Version:   packet.Version,
+		})
+		arguments = arguments[blockLengthArgs:]
+		proxyList = proxyList[blockLengthProxies:]
+	}
+	return packets
+}
+
 // sendFind will send request for network peers known to BSN. As a response BSN will send array of IDs of peers in this swarm
 func (dht *DHTClient) sendFind() error {
 	dht.LastUpdate = time.Now()
@@ -180,13 +190,17 @@ func (dht *DHTClient) sendFind() error {
 		return fmt.Errorf("Failed to find peers: Infohash is not set")
 	}
 	Log(Debug, "Requesting swarm updates")
-	packet := &protocol.DHTPacket{
+	return dht.send(dht.findPacket())
+}
+
+// findPacket returns request for peers of the swarm
+func (dht *DHTClient) findPacket() *protocol.DHTPacket {
+	return &protocol.DHTPacket{
 		Type:     protocol.DHTPacketType_Find,
 		Id:       dht.ID,
 		Infohash: dht.NetworkHash,
 		Version:  PacketVersion,
 	}
-	return dht.send(packet)
 }
 
 // sendNode will send request of IPs of particular peer known to BSN
@@ -238,6 +252,11 @@ func (dht *DHTClient) sendState(id, state string) error {
 }
 
 func (dht *DHTClient) sendDHCP(ip net.IP, network *net.IPNet) error {
+	return dht.send(dht.dhcpPacket(ip, network))
+}
+
+// dhcpPacket returns report of IP used by instance
+func (dht *DHTClient) dhcpPacket(ip net.IP, network *net.IPNet) *protocol.DHTPacket {
 	subnet := "0"
 	if ip == nil {
 		ip = net.ParseIP("127.0.0.1")
@@ -246,7 +265,7 @@ func (dht *DHTClient) sendDHCP(ip net.IP, network *net.IPNet) error {
 		ones, _ := network.Mask.Size()
 		subnet = fmt.Sprintf("%d", ones)
 	}
-	packet := &protocol.DHTPacket{
+	return &protocol.DHTPacket{
 		Type:     protocol.DHTPacketType_DHCP,
 		Id:       dht.ID,
 		Infohash: dht.NetworkHash,
@@ -254,7 +273,6 @@ func (dht *DHTClient) sendDHCP(ip net.IP, network *net.IPNet) error {
 		Extra:    subnet,
 		Version:  PacketVersion,
 	}
-	return dht.send(packet)
 }
 
 func (dht *DHTClient) sendProxy() error {
@@ -297,6 +315,20 @@ func (dht *DHTClient) sendReportProxy(addr []*net.UDPAddr) error {
 	return dht.send(packet)
 }
 
+// sendStop notifies bootstrap node that this peer leaves the swarm
+func (dht *DHTClient) sendStop() error {
+	if len(dht.ID) != 36 {
+		return fmt.Errorf("Failed to send stop: Malformed ID")
+	}
+	packet := &protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_Stop,
+		Id:       dht.ID,
+		Infohash: dht.NetworkHash,
+		Version:  PacketVersion,
+	}
+	return dht.send(packet)
+}
+
 // Close will close all connections and switch DHT object to shutdown mode, which will terminate every loop/goroutine
 func (dht *DHTClient) Close() error {
 	if dht.IncomingData != nil {
@@ -328,16 +360,20 @@ func (dht *DHTClient) WaitID() error {
 	return nil
 }
 
-// RegisterProxy will register current node as a proxy on bootstrap node
+// RegisterProxy will register current node as a proxy on bootstrap node.
+// The same ID is used for subsequent registrations and load reports
 func (dht *DHTClient) RegisterProxy(ip net.IP, port int) error {
-	id, err := uuid.NewUUID()
-	if err != nil {
-		return fmt.Errorf("Failed to generate ID: %s", err)
+	if len(dht.ID) != 36 {
+		id, err := uuid.NewUUID()
+		if err != nil {
+			return fmt.Errorf("Failed to generate ID: %s", err)
+		}
+		dht.ID = id.String()
 	}
 
 	packet := &protocol.DHTPacket{
 		Type:     protocol.DHTPacketType_RegisterProxy,
-		Id:       id.String(),
+		Id:       dht.ID,
 		Infohash: dht.NetworkHash,
 		Data:     fmt.Sprintf("%s:%d", ip.String(), port),
 		Version:  PacketVersion,
@@ -347,5 +383,15 @@ func (dht *DHTClient) RegisterProxy(ip net.IP, port int) error {
 
 // ReportLoad will send amount of tunnels created on particular proxy
 func (dht *DHTClient) ReportLoad(clientsNum int) error {
-	return nil
+	if len(dht.ID) != 36 {
+		return fmt.Errorf("Failed to report load: proxy is not registered")
+	}
+	packet := &protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_ReportLoad,
+		Id:       dht.ID,
+		Infohash: dht.NetworkHash,
+		Data:     fmt.Sprintf("%d", clientsNum),
+		Version:  PacketVersion,
+	}
+	return dht.send(packet)
 }
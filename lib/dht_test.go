@@ -711,7 +711,9 @@ func TestDHTClient_ReportLoad(t *testing.T) {
 		args    args
 		wantErr bool
 	}{
-		{"t1", fields{}, args{}, false},
+		{"t1", fields{}, args{}, true},
+		{"t2", fields{ID: "00000000-0000-0000-0000-000000000000"}, args{}, true},
+		{"t3", fields{ID: "00000000-0000-0000-0000-000000000000", OutgoingData: make(chan *protocol.DHTPacket, 1)}, args{5}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,146 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Types of events published on event bus
+const (
+	EventPeerState             = "peer.state"             // Peer changed state
+	EventPeerEndpoint          = "peer.endpoint"          // Peer switched or lost endpoint
+	EventPeerIP                = "peer.ip"                // Peer announced new IP
+	EventPeerConnected         = "peer.connected"         // Peer switched to connected state
+	EventPeerStopped           = "peer.stopped"           // Peer switched to stopped state
+	EventInterfaceUp           = "interface.up"           // Interface of instance received IP
+	EventInstanceStarted       = "instance.started"       // Instance was created
+	EventInstanceStopped       = "instance.stopped"       // Instance was terminated
+	EventInterfaceFailed       = "interface.failed"       // TAP interface can't be read
+	EventProxyActivated        = "proxy.activated"        // Peer became available over proxy
+	EventIPConflict            = "ip.conflict"            // IP is used by another peer
+	EventBootstrapConnected    = "bootstrap.connected"    // Handshake with bootstrap node completed
+	EventBootstrapDisconnected = "bootstrap.disconnected" // Connection with bootstrap node was lost
+)
+
+var eventTypes = map[string]bool{
+	EventPeerState:             true,
+	EventPeerEndpoint:          true,
+	EventPeerIP:                true,
+	EventPeerConnected:         true,
+	EventPeerStopped:           true,
+	EventInterfaceUp:           true,
+	EventInstanceStarted:       true,
+	EventInstanceStopped:       true,
+	EventInterfaceFailed:       true,
+	EventProxyActivated:        true,
+	EventIPConflict:            true,
+	EventBootstrapConnected:    true,
+	EventBootstrapDisconnected: true,
+}
+
+// eventQueueSize is a number of events queued for every subscriber.
+// Events are dropped for subscribers that don't keep up
+const eventQueueSize = 256
+
+// Event is a change of daemon, instance or peer state. Hash is empty for
+// events of daemon
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`
+	Hash    string            `json:"hash,omitempty"`
+	Peer    string            `json:"peer,omitempty"`
+	Message string            `json:"message"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// EventBus delivers events to subscribers
+type EventBus struct {
+	subscribers map[chan Event]string
+	dropped     map[chan Event]uint64
+	lock        sync.RWMutex
+}
+
+// Events is an event bus of the daemon
+var Events = NewEventBus()
+
+// NewEventBus returns event bus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]string),
+		dropped:     make(map[chan Event]uint64),
+	}
+}
+
+// Subscribe returns channel of events. Only events of instance with
+// specified hash and events of daemon are delivered when hash is not empty
+func (b *EventBus) Subscribe(hash string) chan Event {
+	ch := make(chan Event, eventQueueSize)
+	b.lock.Lock()
+	b.subscribers[ch] = hash
+	b.lock.Unlock()
+	return ch
+}
+
+// Unsubscribe stops delivery of events and returns number of events
+// dropped for this subscriber
+func (b *EventBus) Unsubscribe(ch chan Event) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	dropped := b.dropped[ch]
+	delete(b.subscribers, ch)
+	delete(b.dropped, ch)
+	return dropped
+}
+
+// Publish sends event to subscribers without blocking
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch, hash := range b.subscribers {
+		if hash != "" && e.Hash != "" && hash != e.Hash {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			b.dropped[ch]++
+		}
+	}
+}
+
+// publish sends event of this instance
+func (p *PeerToPeer) publish(eventType, peer string, data map[string]string, format string, v ...interface{}) {
+	hash := ""
+	if p.Dht != nil {
+		hash = p.Dht.NetworkHash
+	}
+	Events.Publish(Event{
+		Type:    eventType,
+		Hash:    hash,
+		Peer:    peer,
+		Message: fmt.Sprintf(format, v...),
+		Data:    data,
+	})
+}
+
+// interfaceUp sends event about IP received by interface of this instance.
+// Method is a way IP was obtained: static, dhcp or discovery
+func (p *PeerToPeer) interfaceUp(method string) {
+	if p.Interface == nil || p.Interface.GetIP() == nil {
+		return
+	}
+	data := map[string]string{
+		"interface": p.Interface.GetName(),
+		"ip":        p.Interface.GetIP().String(),
+		"method":    method,
+	}
+	if mask := p.Interface.GetMask(); mask != nil {
+		data["mask"] = net.IP(mask).String()
+	}
+	p.publish(EventInterfaceUp, "", data, "Interface %s received IP %s", data["interface"], data["ip"])
+}
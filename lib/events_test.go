@@ -0,0 +1,55 @@
+package ptp
+
+import (
+	"testing"
+)
+
+func TestEventBus_Publish(t *testing.T) {
+	b := NewEventBus()
+	all := b.Subscribe("")
+	swarm := b.Subscribe("swarm")
+
+	tests := []struct {
+		name      string
+		event     Event
+		wantAll   bool
+		wantSwarm bool
+	}{
+		{"Instance", Event{Type: EventPeerState, Hash: "swarm"}, true, true},
+		{"Other instance", Event{Type: EventPeerState, Hash: "other"}, true, false},
+		{"Daemon", Event{Type: EventBootstrapConnected}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b.Publish(tt.event)
+			if got := len(all) == 1; got != tt.wantAll {
+				t.Errorf("EventBus.Publish() delivered = %v, want %v", got, tt.wantAll)
+			}
+			if got := len(swarm) == 1; got != tt.wantSwarm {
+				t.Errorf("EventBus.Publish() delivered to swarm = %v, want %v", got, tt.wantSwarm)
+			}
+			if len(all) > 0 {
+				if e := <-all; e.Time.IsZero() {
+					t.Errorf("EventBus.Publish() didn't set time")
+				}
+			}
+			if len(swarm) > 0 {
+				<-swarm
+			}
+		})
+	}
+
+	for i := 0; i < eventQueueSize+3; i++ {
+		b.Publish(Event{Type: EventPeerIP, Hash: "other"})
+	}
+	if dropped := b.Unsubscribe(all); dropped != 3 {
+		t.Errorf("EventBus.Unsubscribe() = %d, want 3", dropped)
+	}
+	if dropped := b.Unsubscribe(swarm); dropped != 0 {
+		t.Errorf("EventBus.Unsubscribe() = %d, want 0", dropped)
+	}
+	b.Publish(Event{Type: EventPeerIP})
+	if len(swarm) != 0 {
+		t.Errorf("EventBus.Publish() delivered event after Unsubscribe()")
+	}
+}
@@ -0,0 +1,157 @@
+package ptp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Keys can be derived from a passphrase instead of being used as is. Swarm
+// infohash is used as a salt, so the same passphrase gives different keys
+// in different swarms. KDF is specified as a name optionally followed by
+// cost parameters, e.g. `argon2id:t=3,m=65536,p=4` or `scrypt:n=32768,r=8,p=1`.
+// Every peer of a swarm must use the same parameters
+
+// Key derivation functions
+const (
+	KDFRaw      = "raw"      // Key is used as is
+	KDFScrypt   = "scrypt"   // scrypt
+	KDFArgon2id = "argon2id" // Argon2id
+)
+
+// Default cost of key derivation
+const (
+	DefaultScryptN        = 32768
+	DefaultScryptR        = 8
+	DefaultScryptP        = 1
+	DefaultArgon2Time     = 3
+	DefaultArgon2Memory   = 64 * 1024 // KiB
+	DefaultArgon2Threads  = 4
+	derivedKeySize        = 32
+	maxArgon2Memory       = 4 * 1024 * 1024
+	maxScryptMemoryFactor = 1 << 30
+)
+
+// KDFParams is a key derivation function with its cost
+type KDFParams struct {
+	Name string
+	N    int    // scrypt CPU/memory cost
+	R    int    // scrypt block size
+	P    int    // scrypt parallelization or Argon2 threads
+	T    uint32 // Argon2 iterations
+	M    uint32 // Argon2 memory in KiB
+}
+
+// ParseKDF parses KDF specification. Missing parameters are set to defaults
+func ParseKDF(spec string) (KDFParams, error) {
+	spec = strings.TrimSpace(spec)
+	name := spec
+	options := ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		name, options = spec[:i], spec[i+1:]
+	}
+	params := KDFParams{Name: strings.ToLower(name)}
+	switch params.Name {
+	case "", KDFRaw:
+		params.Name = KDFRaw
+		if options != "" {
+			return params, fmt.Errorf("Raw keys don't have parameters")
+		}
+		return params, nil
+	case KDFScrypt:
+		params.N, params.R, params.P = DefaultScryptN, DefaultScryptR, DefaultScryptP
+	case KDFArgon2id:
+		params.T, params.M, params.P = DefaultArgon2Time, DefaultArgon2Memory, DefaultArgon2Threads
+	default:
+		return params, fmt.Errorf("Unknown KDF: %s", name)
+	}
+
+	for _, option := range strings.Split(options, ",") {
+		if option == "" {
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return params, fmt.Errorf("Bad KDF parameter: %s", option)
+		}
+		value, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil || value == 0 {
+			return params, fmt.Errorf("Bad value of KDF parameter %s: %s", kv[0], kv[1])
+		}
+		switch params.Name + ":" + kv[0] {
+		case "scrypt:n":
+			params.N = int(value)
+		case "scrypt:r":
+			params.R = int(value)
+		case "scrypt:p", "argon2id:p":
+			params.P = int(value)
+		case "argon2id:t":
+			params.T = uint32(value)
+		case "argon2id:m":
+			params.M = uint32(value)
+		default:
+			return params, fmt.Errorf("Unknown %s parameter: %s", params.Name, kv[0])
+		}
+	}
+	return params, params.validate()
+}
+
+func (k KDFParams) validate() error {
+	switch k.Name {
+	case KDFScrypt:
+		if k.N < 2 || k.N&(k.N-1) != 0 {
+			return fmt.Errorf("scrypt n must be a power of two")
+		}
+		if uint64(k.R)*uint64(k.P) >= maxScryptMemoryFactor {
+			return fmt.Errorf("scrypt r*p is too large")
+		}
+	case KDFArgon2id:
+		if k.P > 255 {
+			return fmt.Errorf("argon2id p must be less than 256")
+		}
+		if k.M < 8*uint32(k.P) || k.M > maxArgon2Memory {
+			return fmt.Errorf("argon2id m must be between 8*p and %d KiB", maxArgon2Memory)
+		}
+	}
+	return nil
+}
+
+// String returns specification with every parameter, so it can be stored
+// and give the same key even if defaults change
+func (k KDFParams) String() string {
+	switch k.Name {
+	case KDFScrypt:
+		return fmt.Sprintf("%s:n=%d,r=%d,p=%d", k.Name, k.N, k.R, k.P)
+	case KDFArgon2id:
+		return fmt.Sprintf("%s:t=%d,m=%d,p=%d", k.Name, k.T, k.M, k.P)
+	}
+	return KDFRaw
+}
+
+// DeriveKey derives AES-256 key from a passphrase. Raw passphrase must be
+// a valid AES key
+func DeriveKey(passphrase, salt string, params KDFParams) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("Empty passphrase")
+	}
+	switch params.Name {
+	case KDFScrypt:
+		key, err := scrypt.Key([]byte(passphrase), []byte(salt), params.N, params.R, params.P, derivedKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to derive key: %s", err)
+		}
+		return key, nil
+	case KDFArgon2id:
+		return argon2.IDKey([]byte(passphrase), []byte(salt), params.T, params.M, uint8(params.P), derivedKeySize), nil
+	case KDFRaw, "":
+		err := validateKeyLength([]byte(passphrase))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(passphrase), nil
+	}
+	return nil, fmt.Errorf("Unknown KDF: %s", params.Name)
+}
@@ -0,0 +1,65 @@
+package ptp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseKDF(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", KDFRaw, false},
+		{"raw", "raw", KDFRaw, false},
+		{"raw with params", "raw:n=1", "", true},
+		{"unknown", "pbkdf2", "", true},
+		{"scrypt defaults", "scrypt", "scrypt:n=32768,r=8,p=1", false},
+		{"scrypt cost", "scrypt:n=1024,p=2", "scrypt:n=1024,r=8,p=2", false},
+		{"scrypt bad n", "scrypt:n=1000", "", true},
+		{"argon2id defaults", "argon2id", "argon2id:t=3,m=65536,p=4", false},
+		{"argon2id cost", "Argon2id:t=1,m=1024,p=1", "argon2id:t=1,m=1024,p=1", false},
+		{"argon2id low memory", "argon2id:m=8,p=4", "", true},
+		{"unknown parameter", "argon2id:n=1", "", true},
+		{"zero value", "scrypt:r=0", "", true},
+		{"malformed parameter", "scrypt:n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseKDF(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKDF() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseKDF() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	for _, spec := range []string{"scrypt:n=1024", "argon2id:t=1,m=1024,p=1"} {
+		params, _ := ParseKDF(spec)
+		key, err := DeriveKey("passphrase", "swarm1", params)
+		if err != nil || len(key) != 32 {
+			t.Fatalf("%s: DeriveKey() = %v, %v", spec, key, err)
+		}
+		again, _ := DeriveKey("passphrase", "swarm1", params)
+		if !bytes.Equal(key, again) {
+			t.Errorf("%s: Key is not deterministic", spec)
+		}
+		other, _ := DeriveKey("passphrase", "swarm2", params)
+		if bytes.Equal(key, other) {
+			t.Errorf("%s: Key doesn't depend on salt", spec)
+		}
+	}
+	raw, _ := ParseKDF("")
+	if _, err := DeriveKey("short", "swarm", raw); err == nil {
+		t.Errorf("Raw key of a wrong length was accepted")
+	}
+	if _, err := DeriveKey("", "swarm", raw); err == nil {
+		t.Errorf("Empty passphrase was accepted")
+	}
+}
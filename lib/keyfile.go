@@ -0,0 +1,128 @@
+package ptp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Key file holds a list of keys with their validity windows:
+//
+//   keys:
+//     - key: "01234567890123456789012345678901"
+//       until: 2026-01-01T00:00:00Z
+//     - key: "abcdefghijklmnopqrstuvwxyz012345"
+//       from: 2025-12-31T23:00:00Z
+//       until: 2026-02-01T00:00:00Z
+//
+// Dates are RFC 3339 timestamps or Unix time. When `kdf` of an entry is
+// specified, key is a passphrase and actual key is derived from it (see
+// ParseKDF). Legacy format with a single `key` and `ttl` is supported as well
+
+// keyFile is a content of a key file
+type keyFile struct {
+	Keys []keyFileEntry `yaml:"keys"`
+	Key  string         `yaml:"key"` // Legacy single key
+	TTL  string         `yaml:"ttl"` // Expiration date of legacy key
+}
+
+type keyFileEntry struct {
+	Key   string `yaml:"key"`
+	KDF   string `yaml:"kdf"`
+	From  string `yaml:"from"`
+	Until string `yaml:"until"`
+}
+
+// LoadKeyFile reads and validates key file. Salt is used to derive keys
+// from passphrases
+func LoadKeyFile(path, salt string) ([]CryptoKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read key file: %s", err)
+	}
+	keys, err := ParseKeyFile(data, salt)
+	if err != nil {
+		return nil, fmt.Errorf("Bad key file %s: %s", path, err)
+	}
+	return keys, nil
+}
+
+// ParseKeyFile parses content of a key file
+func ParseKeyFile(data []byte, salt string) ([]CryptoKey, error) {
+	file := keyFile{}
+	err := yaml.UnmarshalStrict(data, &file)
+	if err != nil {
+		return nil, err
+	}
+	if file.Key != "" {
+		if len(file.Keys) != 0 {
+			return nil, fmt.Errorf("key and keys can't be used together")
+		}
+		var key CryptoKey
+		key = (&Crypto{}).EnrichKeyValues(key, file.Key, file.TTL)
+		if err := validateKeyLength(key.Key); err != nil {
+			return nil, err
+		}
+		return []CryptoKey{key}, nil
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	keys := []CryptoKey{}
+	for i, entry := range file.Keys {
+		kdf, err := ParseKDF(entry.KDF)
+		if err != nil {
+			return nil, fmt.Errorf("key #%d: %s", i+1, err)
+		}
+		key := CryptoKey{}
+		key.Key, err = DeriveKey(entry.Key, salt, kdf)
+		if err != nil {
+			return nil, fmt.Errorf("key #%d: %s", i+1, err)
+		}
+		if entry.Until == "" {
+			return nil, fmt.Errorf("key #%d: until is not specified", i+1)
+		}
+		key.Until, err = parseKeyDate(entry.Until)
+		if err != nil {
+			return nil, fmt.Errorf("key #%d: bad until: %s", i+1, err)
+		}
+		if entry.From != "" {
+			key.From, err = parseKeyDate(entry.From)
+			if err != nil {
+				return nil, fmt.Errorf("key #%d: bad from: %s", i+1, err)
+			}
+			if !key.From.Before(key.Until) {
+				return nil, fmt.Errorf("key #%d: from is not before until", i+1)
+			}
+		}
+		for j, other := range keys {
+			if bytes.Equal(other.Key, key.Key) {
+				return nil, fmt.Errorf("key #%d: duplicates key #%d", i+1, j+1)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func validateKeyLength(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("key must be 16, 24 or 32 bytes long, got %d", len(key))
+}
+
+// parseKeyDate parses RFC 3339 timestamp or Unix time
+func parseKeyDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
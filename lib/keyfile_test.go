@@ -0,0 +1,66 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseKeyFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    int
+		wantErr bool
+	}{
+		{"empty", "", 0, true},
+		{"malformed", "keys: [", 0, true},
+		{"unknown field", "keys:\n  - key: 01234567890123456789012345678901\n    untill: 1\n", 0, true},
+		{"legacy", "key: 01234567890123456789012345678901\nttl: 1900000000\n", 1, false},
+		{"legacy and list", "key: 01234567890123456789012345678901\nkeys:\n  - key: abcdefghijklmnopqrstuvwxyz012345\n    until: 1900000000\n", 0, true},
+		{"short key", "keys:\n  - key: short\n    until: 1900000000\n", 0, true},
+		{"no until", "keys:\n  - key: 01234567890123456789012345678901\n", 0, true},
+		{"bad until", "keys:\n  - key: 01234567890123456789012345678901\n    until: tomorrow\n", 0, true},
+		{"from after until", "keys:\n  - key: 01234567890123456789012345678901\n    from: 2030-01-01T00:00:00Z\n    until: 2029-01-01T00:00:00Z\n", 0, true},
+		{"duplicate", "keys:\n  - key: 01234567890123456789012345678901\n    until: 1900000000\n  - key: 01234567890123456789012345678901\n    until: 1900000001\n", 0, true},
+		{"derived", "keys:\n  - key: passphrase\n    kdf: scrypt:n=1024\n    until: 1900000000\n", 1, false},
+		{"bad kdf", "keys:\n  - key: passphrase\n    kdf: md5\n    until: 1900000000\n", 0, true},
+		{"list", "keys:\n  - key: 01234567890123456789012345678901\n    until: 2029-01-01T00:00:00Z\n  - key: abcdefghijklmnop\n    from: 2028-12-31T00:00:00Z\n    until: 1900000000\n", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseKeyFile([]byte(tt.data), "hash")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKeyFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("ParseKeyFile() returned %d keys, want %d", len(got), tt.want)
+			}
+		})
+	}
+
+	keys, _ := ParseKeyFile([]byte("keys:\n  - key: abcdefghijklmnop\n    from: 2028-12-31T00:00:00Z\n    until: 1900000000\n"), "hash")
+	if !keys[0].From.Equal(time.Date(2028, 12, 31, 0, 0, 0, 0, time.UTC)) || keys[0].Until.Unix() != 1900000000 {
+		t.Errorf("Bad validity window: %s - %s", keys[0].From, keys[0].Until)
+	}
+}
+
+func TestCrypto_SetKeys(t *testing.T) {
+	now := time.Now()
+	first := CryptoKey{Key: []byte("00000000000000000000000000000000"), Until: now.Add(time.Hour)}
+	future := CryptoKey{Key: []byte("11111111111111111111111111111111"), From: now.Add(time.Hour), Until: now.Add(2 * time.Hour)}
+	second := CryptoKey{Key: []byte("22222222222222222222222222222222"), Until: now.Add(3 * time.Hour)}
+
+	c := new(Crypto)
+	c.SetKeys([]CryptoKey{future, first})
+	if string(c.activeKey()) != string(first.Key) {
+		t.Errorf("Key that is not valid yet was activated")
+	}
+	c.SetKeys([]CryptoKey{second, first})
+	if string(c.activeKey()) != string(first.Key) || !c.LastRotation().IsZero() {
+		t.Errorf("Active key was changed while it's still in the list")
+	}
+	c.SetKeys([]CryptoKey{future, second})
+	if string(c.activeKey()) != string(second.Key) || c.LastRotation().IsZero() {
+		t.Errorf("Removed key is still active")
+	}
+}
@@ -89,7 +89,7 @@ func (p *PeerToPeer) CreateMessage(msgType MsgType, payload []byte, proto uint16
 	msg.Header.Length = uint16(len(payload))
 	if p.Crypter.Active && encrypt {
 		var err error
-		msg.Data, err = p.Crypter.encrypt(p.Crypter.ActiveKey.Key, payload)
+		msg.Data, err = p.Crypter.encrypt(p.Crypter.activeKey(), payload)
 		if err != nil {
 			return nil, err
 		}
@@ -109,13 +109,14 @@ func CreateMessageStatic(msgType MsgType, payload []byte) (*P2PMessage, error) {
 
 // Network is a network subsystem
 type Network struct {
-	host       string
-	port       int
-	remotePort int
-	addr       *net.UDPAddr
-	conn       *net.UDPConn
-	inBuffer   [4096]byte
-	disposed   bool
+	host          string
+	port          int
+	remotePort    int
+	addr          *net.UDPAddr
+	conn          *net.UDPConn
+	inBuffer      [4096]byte
+	disposed      bool
+	keepAliveAddr string // Echo server used for keep alive session
 }
 
 // Close will terminate packet reader
@@ -169,7 +170,7 @@ func (uc *Network) KeepAlive(target string) error {
 		return fmt.Errorf("Nil Connection")
 	}
 
-	addresses, err := SrvLookup(target, "udp", "subutai.io")
+	addresses, err := ResolveBootstrap(target, "udp")
 	if err != nil {
 		return fmt.Errorf("Failed to lookup address for keep alive session: %s", err.Error())
 	}
@@ -177,15 +178,11 @@ func (uc *Network) KeepAlive(target string) error {
 		return fmt.Errorf("No suitable address for keep alive")
 	}
 
-	firstAddr, e := addresses[0]
-	if !e {
-		return fmt.Errorf("Failed to retrieve keep alive address at index 0")
-	}
-
-	addr, err := net.ResolveUDPAddr("udp4", firstAddr)
+	addr, err := net.ResolveUDPAddr("udp4", addresses[0])
 	if err != nil {
 		return fmt.Errorf("Failed to resolve UDP addr for keep alive session: %s", err.Error())
 	}
+	uc.keepAliveAddr = addresses[0]
 
 	data := []byte{0x0D, 0x0A}
 	keepAlive := time.Now()
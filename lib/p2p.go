@@ -8,6 +8,7 @@ import (
 	"time"
 
 	upnp "github.com/NebulousLabs/go-upnp"
+	"github.com/subutai-io/p2p/protocol"
 )
 
 // GlobalMTU value specified on daemon start
@@ -21,6 +22,7 @@ type PeerToPeer struct {
 	LocalIPs        []net.IP                             // List of IPs available in the system
 	Dht             *DHTClient                           // DHT Client
 	Crypter         Crypto                               // Cryptography subsystem
+	AEAD            *AEADSession                         // Authenticated encryption session
 	Shutdown        bool                                 // Set to true when instance in shutdown mode
 	ForwardMode     bool                                 // Skip local peer discovery
 	ReadyToStop     bool                                 // Set to true when instance is ready to stop
@@ -43,7 +45,8 @@ type PeerHandshake struct {
 	IP           net.IP
 	HardwareAddr net.HardwareAddr
 	Endpoint     *net.UDPAddr
-	AutoIP       bool // Whether or not peer have automatic IP
+	AutoIP       bool   // Whether or not peer have automatic IP
+	Handshake    string // Reply to key exchange. Empty when peer doesn't support it
 }
 
 // ActiveInterfaces is a global (daemon-wise) list of reserved IP addresses
@@ -121,6 +124,7 @@ func (p *PeerToPeer) ListenInterface() error {
 		packet, err := p.Interface.ReadPacket()
 		if err != nil && err != errPacketTooBig {
 			Log(Error, "Reading packet: %s", err)
+			p.publish(EventInterfaceFailed, "", map[string]string{"interface": p.Interface.GetName()}, "Reading packet: %s", err)
 			p.Close()
 			break
 		}
@@ -182,7 +186,11 @@ func New(mac, hash, keyfile, key, ttl, target string, fwd bool, port int, outbou
 	}
 
 	if keyfile != "" {
-		p.Crypter.ReadKeysFromFile(keyfile)
+		err = p.Crypter.ReadKeysFromFile(keyfile, hash)
+		if err != nil {
+			Log(Error, "%s", err)
+			return nil
+		}
 	}
 	if key != "" {
 		// Override key from file
@@ -191,8 +199,8 @@ func New(mac, hash, keyfile, key, ttl, target string, fwd bool, port int, outbou
 		}
 		var newKey CryptoKey
 		newKey = p.Crypter.EnrichKeyValues(newKey, key, ttl)
-		p.Crypter.Keys = append(p.Crypter.Keys, newKey)
-		p.Crypter.ActiveKey = p.Crypter.Keys[0]
+		p.Crypter.AddKey(newKey)
+		p.Crypter.ActiveKey = newKey
 		p.Crypter.Active = true
 	}
 
@@ -343,9 +351,14 @@ func (p *PeerToPeer) attemptPortForward(port uint16, name string) error {
 
 // Init will initialize PeerToPeer
 func (p *PeerToPeer) Init() error {
+	if p.Crypter.keysLock == nil {
+		p.Crypter.keysLock = new(sync.RWMutex)
+	}
 	p.Swarm = new(Swarm)
 	p.Swarm.Init()
-	return nil
+	var err error
+	p.AEAD, err = NewAEADSession()
+	return err
 }
 
 func (p *PeerToPeer) validateMac(mac string) net.HardwareAddr {
@@ -432,6 +445,7 @@ func (p *PeerToPeer) RequestIP(mac, device string) (net.IP, net.IPMask, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to configure interface: %s", err)
 	}
+	p.interfaceUp("dhcp")
 	return p.Dht.IP, p.Dht.Network.Mask, nil
 }
 
@@ -466,9 +480,43 @@ func (p *PeerToPeer) ReportIP(ipAddress, mac, device string) (net.IP, net.IPMask
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to configure interface: %s", err)
 	}
+	p.interfaceUp("static")
 	return ip, ipnet.Mask, nil
 }
 
+// RestoreDHT will register instance on bootstrap node again, report IP of the
+// interface and request list of peers. Used when connection with bootstrap
+// node was restored. Packets are passed to send, so they reach only the node
+// that was reconnected
+func (p *PeerToPeer) RestoreDHT(send func(*protocol.DHTPacket) error) error {
+	if p.Dht == nil {
+		return fmt.Errorf("RestoreDHT: nil dht")
+	}
+	if p.ProxyManager == nil {
+		return fmt.Errorf("RestoreDHT: nil proxy manager")
+	}
+	if p.Interface == nil {
+		return fmt.Errorf("RestoreDHT: nil interface")
+	}
+	Log(Info, "Registering instance %s on bootstrap node", p.Hash)
+	p.FindNetworkAddresses()
+	packets := splitPacket(p.Dht.connectPacket(p.LocalIPs, p.ProxyManager.GetList()))
+	ip := p.Interface.GetIP()
+	mask := p.Interface.GetMask()
+	if ip != nil && mask != nil {
+		packets = append(packets, p.Dht.dhcpPacket(ip, &net.IPNet{IP: ip.Mask(mask), Mask: mask}))
+	}
+	p.Dht.LastUpdate = time.Now()
+	packets = append(packets, p.Dht.findPacket())
+	for _, packet := range packets {
+		err := send(packet)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Run is a main loop
 func (p *PeerToPeer) Run() error {
 	if p.Dht == nil {
@@ -496,6 +544,9 @@ func (p *PeerToPeer) Run() error {
 		p.checkLastDHTUpdate()
 		p.checkProxies()
 		p.checkPeers()
+		if p.Crypter.Active {
+			p.Crypter.Rotate()
+		}
 		time.Sleep(100 * time.Millisecond)
 		if !initialRequestSent && time.Since(started) > time.Duration(time.Millisecond*5000) {
 			initialRequestSent = true
@@ -543,6 +594,9 @@ func (p *PeerToPeer) removeStoppedPeers() error {
 		if peer.State == PeerStateStop {
 			Log(Info, "Removing peer %s", id)
 			p.Swarm.Delete(id)
+			if p.AEAD != nil {
+				p.AEAD.unregister(id)
+			}
 			Log(Info, "Peer %s has been removed", id)
 			break
 		}
@@ -678,6 +732,7 @@ func (p *PeerToPeer) discoverIP() error {
 		Log(Error, "Couldn't find free IP for this swarm")
 		return fmt.Errorf("Failed to get free IP for this swarm")
 	}
+	p.interfaceUp("discovery")
 
 	return nil
 }
@@ -707,6 +762,12 @@ func (p *PeerToPeer) notifyIP() error {
 // and create a comma-separated line
 // endpoint is an address that received this introduction message
 func (p *PeerToPeer) PrepareIntroductionMessage(id, endpoint string) (*P2PMessage, error) {
+	return p.prepareIntroduction(id, endpoint, "")
+}
+
+// prepareIntroduction creates introduction message. Reply to key exchange
+// is appended to it when specified
+func (p *PeerToPeer) prepareIntroduction(id, endpoint, handshake string) (*P2PMessage, error) {
 	if p.Interface == nil {
 		return nil, fmt.Errorf("PrepareIntroductionMessage: nil interface")
 	}
@@ -717,6 +778,9 @@ func (p *PeerToPeer) PrepareIntroductionMessage(id, endpoint string) (*P2PMessag
 	}
 
 	var intro = id + "," + p.Interface.GetHardwareAddress().String() + "," + ip + "," + endpoint
+	if handshake != "" {
+		intro += "," + handshake
+	}
 	msg, err := p.CreateMessage(MsgTypeIntro, []byte(intro), 0, true)
 	if err != nil {
 		return nil, err
@@ -774,6 +838,7 @@ func (p *PeerToPeer) Close() error {
 	p.deactivateInterface()
 	p.stopPeers()
 	p.Shutdown = true
+	p.leaveSwarm()
 	p.stopDHT()
 	p.stopSocket()
 	p.stopInterface()
@@ -829,6 +894,19 @@ func (p *PeerToPeer) stopPeers() error {
 	return nil
 }
 
+// leaveSwarm notifies bootstrap node, so other peers will stop
+// connecting to this instance
+func (p *PeerToPeer) leaveSwarm() error {
+	if p.Dht == nil {
+		return fmt.Errorf("nil dht")
+	}
+	err := p.Dht.sendStop()
+	if err != nil {
+		Log(Debug, "Failed to notify bootstrap node about departure: %s", err)
+	}
+	return err
+}
+
 func (p *PeerToPeer) stopDHT() error {
 	if p.Dht == nil {
 		return fmt.Errorf("nil dht")
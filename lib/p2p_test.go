@@ -1,12 +1,15 @@
 package ptp
 
 import (
+	"fmt"
 	"net"
 	"os"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/subutai-io/p2p/protocol"
 )
 
 func TestPeerToPeer_AssignInterface(t *testing.T) {
@@ -1882,3 +1885,47 @@ func TestPeerToPeer_stopSocket(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerToPeer_RestoreDHT(t *testing.T) {
+	pm := new(ProxyManager)
+	pm.init()
+	iface, _ := newTAP("ip", "10.0.0.1", "00:11:22:33:44:55", "255.255.255.0", DefaultMTU, false)
+
+	sent := []*protocol.DHTPacket{}
+	send := func(packet *protocol.DHTPacket) error {
+		sent = append(sent, packet)
+		return nil
+	}
+	failed := func(packet *protocol.DHTPacket) error {
+		return fmt.Errorf("Closed")
+	}
+
+	tests := []struct {
+		name      string
+		p         *PeerToPeer
+		send      func(*protocol.DHTPacket) error
+		wantErr   bool
+		wantTypes []protocol.DHTPacketType
+	}{
+		{"nil dht", &PeerToPeer{}, send, true, nil},
+		{"nil proxy manager", &PeerToPeer{Dht: new(DHTClient)}, send, true, nil},
+		{"nil interface", &PeerToPeer{Dht: new(DHTClient), ProxyManager: pm}, send, true, nil},
+		{"failed send", &PeerToPeer{Dht: new(DHTClient), ProxyManager: pm, Interface: iface}, failed, true, nil},
+		{"restored", &PeerToPeer{Dht: new(DHTClient), ProxyManager: pm, Interface: iface}, send, false, []protocol.DHTPacketType{protocol.DHTPacketType_Connect, protocol.DHTPacketType_DHCP, protocol.DHTPacketType_Find}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = []*protocol.DHTPacket{}
+			if err := tt.p.RestoreDHT(tt.send); (err != nil) != tt.wantErr {
+				t.Errorf("PeerToPeer.RestoreDHT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			types := []protocol.DHTPacketType{}
+			for _, packet := range sent {
+				types = append(types, packet.Type)
+			}
+			if len(tt.wantTypes) > 0 && !reflect.DeepEqual(types, tt.wantTypes) {
+				t.Errorf("PeerToPeer.RestoreDHT() sent = %v, want %v", types, tt.wantTypes)
+			}
+		})
+	}
+}
@@ -131,7 +131,11 @@ func (p *PeerToPeer) handlePacketIPv4(contents []byte, proto int) error {
 		return fmt.Errorf("Wrong packet type in IPv4 handler. Got %d. Expecting %d", f.EtherType, ethernet.EtherTypeIPv4)
 	}
 
-	msg, err := p.CreateMessage(MsgTypeNenc, contents, uint16(proto), true)
+	var peer *NetworkPeer
+	if p.Swarm != nil {
+		peer = p.Swarm.GetPeerByMac(f.Destination.String())
+	}
+	msg, err := p.createPeerMessage(peer, MsgTypeNenc, contents, uint16(proto))
 	if err == nil && msg != nil {
 		_, err = p.SendTo(f.Destination, msg)
 		return err
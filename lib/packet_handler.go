@@ -31,15 +31,30 @@ func (p *PeerToPeer) HandleP2PMessage(count int, srcAddr *net.UDPAddr, err error
 		Log(Error, "Received broken message")
 		return fmt.Errorf("Broken P2P message")
 	}
-	// Decrypt message if crypter is active
-	if p.Crypter.Active && (msg.Header.Type == MsgTypeIntro || msg.Header.Type == MsgTypeNenc || msg.Header.Type == MsgTypeIntroReq || msg.Header.Type == MsgTypeTest || msg.Header.Type == MsgTypeXpeerPing || msg.Header.Type == MsgTypeComm) {
+	if msg.Header.Type == MsgTypeAEAD {
+		if !p.Crypter.Active {
+			return fmt.Errorf("Authenticated message received while encryption is disabled")
+		}
+		var openErr error
+		msg, openErr = p.openAEAD(msg)
+		if openErr != nil {
+			Log(Debug, "Failed to open message from %s: %s", srcAddr, openErr)
+			return openErr
+		}
+	} else if p.Crypter.Active && (msg.Header.Type == MsgTypeIntro || msg.Header.Type == MsgTypeNenc || msg.Header.Type == MsgTypeIntroReq || msg.Header.Type == MsgTypeTest || msg.Header.Type == MsgTypeXpeerPing || msg.Header.Type == MsgTypeComm) {
 		var decErr error
-		msg.Data, decErr = p.Crypter.decrypt(p.Crypter.ActiveKey.Key, msg.Data)
+		msg.Data, decErr = p.Crypter.decryptMessage(msg.Data, int(msg.Header.Length))
 		if decErr != nil {
 			Log(Error, "Failed to decrypt message: %s", decErr)
 			return fmt.Errorf("Failed to decrypt message: %s", decErr)
 		}
+		if int(msg.Header.Length) > len(msg.Data) {
+			return fmt.Errorf("Decrypted message is too short")
+		}
 		msg.Data = msg.Data[:msg.Header.Length]
+		if msg.Header.Type == MsgTypeNenc && p.requiresAEAD(srcAddr) {
+			return fmt.Errorf("Unauthenticated message from %s", srcAddr)
+		}
 	}
 
 	callback, exists := p.MessageHandlers[msg.Header.Type]
@@ -92,6 +107,10 @@ func (p *PeerToPeer) HandlePingMessage(msg *P2PMessage, srcAddr *net.UDPAddr) er
 	port := addr.Port
 	if p.UDPSocket.remotePort == 0 {
 		p.UDPSocket.remotePort = port
+		if p.UDPSocket.keepAliveAddr != "" {
+			// Echo server replied, so it can be used when DNS is not available
+			go SaveBootstrapCache("udp", []string{p.UDPSocket.keepAliveAddr})
+		}
 		return nil
 	}
 	if port != p.UDPSocket.GetPort() && port != p.UDPSocket.remotePort && port != 0 {
@@ -214,6 +233,12 @@ func (p *PeerToPeer) HandleIntroMessage(msg *P2PMessage, srcAddr *net.UDPAddr) e
 	}
 	peer.LastContact = time.Now()
 	peer.addEndpoint(hs.Endpoint)
+	if hs.Handshake != "" && p.Crypter.Active {
+		err = p.completeHandshake(peer, hs.Handshake)
+		if err != nil {
+			Log(Debug, "Key exchange with %s failed: %s", peer.ID, err)
+		}
+	}
 	for _, np := range p.Swarm.Get() {
 		if np == nil {
 			continue
@@ -270,7 +295,16 @@ func (p *PeerToPeer) HandleIntroRequestMessage(msg *P2PMessage, srcAddr *net.UDP
 		Log(Trace, "Introduction request came from unknown peer: %s -> %s [%s]", id, msg.Data[36:], srcAddr.String())
 		return fmt.Errorf("Introduction request from unknown peer: %s -> %s [%s]", id, msg.Data[36:], srcAddr.String())
 	}
-	response, err := p.PrepareIntroductionMessage(p.Dht.ID, string(msg.Data[36:]))
+	endpoint, handshake := splitHandshake(string(msg.Data[36:]))
+	reply := ""
+	if handshake != "" && p.Crypter.Active {
+		var err error
+		reply, err = p.respondHandshake(peer, handshake)
+		if err != nil {
+			Log(Debug, "Key exchange with %s failed: %s", id, err)
+		}
+	}
+	response, err := p.prepareIntroduction(p.Dht.ID, endpoint, reply)
 	if err != nil {
 		Log(Error, "Failed to prepare intro message: %s", err.Error())
 		return fmt.Errorf("Failed to prepare introduction message: %s", err.Error())
@@ -323,6 +357,8 @@ func (p *PeerToPeer) HandleProxyMessage(msg *P2PMessage, srcAddr *net.UDPAddr) e
 	rc := p.ProxyManager.activate(srcAddr.String(), ep)
 	if rc {
 		Log(Debug, "This peer is now available over %s", ep.String())
+		p.publish(EventProxyActivated, "", map[string]string{"proxy": srcAddr.String(), "endpoint": ep.String()},
+			"This peer is now available over %s", ep.String())
 		return nil
 	}
 	return fmt.Errorf("Failed to activate proxy %s", ep.String())
@@ -491,6 +527,11 @@ func (p *PeerToPeer) HandleComm(msg *P2PMessage, srcAddr *net.UDPAddr) error {
 		if err != nil {
 			return err
 		}
+	case CommCryptoModes:
+		response, err = commCryptoModesHandler(data, p)
+		if err != nil {
+			return err
+		}
 	default:
 		Log(Error, "Unknown communication packet: %d", commType)
 		return fmt.Errorf("unknown comm type")
@@ -34,6 +34,7 @@ type NetworkPeer struct {
 	LastPunch          time.Time                          // Last time we run hole punch
 	Stat               PeerStats                          // Peer statistics
 	RoutingRequired    bool                               // Whether or not routing is required
+	Crypto             PeerCrypto                         // Encryption negotiated with this peer
 }
 
 func (np *NetworkPeer) reportState(ptpc *PeerToPeer) error {
@@ -56,6 +57,13 @@ func (np *NetworkPeer) SetState(state PeerState, ptpc *PeerToPeer) error {
 	}
 	if state != np.State {
 		Log(Debug, "Peer %s changed state from %s to %s", np.ID, StringifyState(np.State), StringifyState(state))
+		ptpc.publish(EventPeerState, np.ID, map[string]string{"from": StringifyState(np.State), "to": StringifyState(state)},
+			"Peer changed state from %s to %s", StringifyState(np.State), StringifyState(state))
+		if state == PeerStateConnected {
+			ptpc.publish(EventPeerConnected, np.ID, nil, "Peer connected")
+		} else if state == PeerStateStop {
+			ptpc.publish(EventPeerStopped, np.ID, nil, "Peer stopped")
+		}
 	}
 	np.State = state
 	np.reportState(ptpc)
@@ -287,7 +295,7 @@ func (np *NetworkPeer) punchUDPHole(ptpc *PeerToPeer) error {
 			if err != nil || active {
 				continue
 			}
-			payload := []byte(ptpc.Dht.ID + ep.String())
+			payload := ptpc.introRequestPayload(np, ep)
 			msg, err := ptpc.CreateMessage(MsgTypeIntroReq, payload, 0, true)
 			if err != nil {
 				Log(Error, "Couldn't create an intro message: %s", err)
@@ -470,10 +478,17 @@ func (np *NetworkPeer) route(ptpc *PeerToPeer) error {
 		np.Stat = stat
 
 		if len(np.EndpointsHeap) > 0 {
+			if np.Endpoint == nil || np.Endpoint.String() != np.EndpointsHeap[0].Addr.String() {
+				ptpc.publish(EventPeerEndpoint, np.ID, map[string]string{"endpoint": np.EndpointsHeap[0].Addr.String()},
+					"Peer is now available at %s", np.EndpointsHeap[0].Addr.String())
+			}
 			np.Endpoint = np.EndpointsHeap[0].Addr
 			np.ConnectionAttempts = 0
 		} else {
 			Log(Debug, "No active endpoints. Disconnecting peer %s", np.ID)
+			if np.Endpoint != nil {
+				ptpc.publish(EventPeerEndpoint, np.ID, nil, "Peer lost endpoint %s", np.Endpoint.String())
+			}
 			np.Endpoint = nil
 			np.SetState(PeerStateDisconnect, ptpc)
 		}
@@ -516,6 +531,17 @@ func (np *NetworkPeer) stateConnected(ptpc *PeerToPeer) error {
 	np.pingEndpoints(ptpc)
 	np.syncWithRemoteState(ptpc)
 
+	// Older peers never confirm negotiation and keep using legacy encryption
+	if ptpc.Crypter.Active && np.Crypto.negotiationDue() {
+		err := ptpc.requestCryptoModes(np)
+		if err != nil {
+			Log(Debug, "Failed to negotiate encryption with %s: %s", np.ID, err)
+		}
+	}
+	if ptpc.Crypter.Active {
+		ptpc.maintainSessions(np)
+	}
+
 	// if time.Since(np.LastFind) > time.Duration(time.Second*90) {
 	// 	Log(Debug, "No endpoints and no updates from DHT")
 	// 	np.SetState(PeerStateDisconnect, ptpc)
@@ -0,0 +1,372 @@
+package ptp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Relay is a proxy server used by peers that can't reach each other
+// directly. Every peer that sends MsgTypeProxy with its ID to the control
+// socket receives a dedicated tunnel endpoint. Traffic sent to the endpoint
+// by other peers is forwarded to the owner of the tunnel from a return
+// socket allocated for every remote peer. Traffic sent by the owner to a
+// return socket is forwarded to its remote peer from the tunnel endpoint
+type Relay struct {
+	IP      net.IP                  // IP advertised in tunnel endpoints
+	Control *Network                // Control socket used for tunnel requests, pings and latency
+	tunnels map[string]*relayTunnel // Tunnels by ID of a peer
+	lock    sync.RWMutex            // Lock for tunnels, their state and control listener
+	control *relayListener          // Listener of control socket
+	done    chan struct{}           // Closed when relay is stopped
+}
+
+// relayTunnel is an endpoint allocated for a single peer
+type relayTunnel struct {
+	id       string                  // ID of a peer owning this tunnel
+	owner    *net.UDPAddr            // Address of a peer owning this tunnel
+	remotes  map[string]*relayRemote // Remote peers by address
+	socket   *Network                // Endpoint socket
+	listener *relayListener          // Listener of endpoint socket
+	lastSeen time.Time               // Last time owner responded
+	tx       uint64                  // Bytes sent to the owner
+	rx       uint64                  // Bytes received from the owner
+}
+
+// relayRemote is a remote peer of a tunnel. Owner sends traffic for this
+// peer to the return socket
+type relayRemote struct {
+	addr     *net.UDPAddr   // Address of a remote peer
+	socket   *Network       // Return socket
+	listener *relayListener // Listener of return socket
+	lastSeen time.Time      // Last time remote peer sent data
+}
+
+// relayListener reads socket of the relay until it's closed. Socket is
+// closed only after listener has stopped
+type relayListener struct {
+	conn    *net.UDPConn
+	stopped int32         // Set to 1 when listener is stopped
+	done    chan struct{} // Closed when listener has returned
+}
+
+// Init will create control socket of the relay
+func (r *Relay) Init(ip net.IP, port int) error {
+	if ip == nil {
+		return fmt.Errorf("Relay IP wasn't specified")
+	}
+	r.IP = ip
+	r.tunnels = make(map[string]*relayTunnel)
+	r.done = make(chan struct{})
+	r.Control = new(Network)
+	err := r.Control.Init("", port)
+	if err != nil {
+		return fmt.Errorf("Failed to create control socket: %s", err)
+	}
+	return nil
+}
+
+// Run will start control socket listener and maintenance loop
+func (r *Relay) Run() {
+	r.lock.Lock()
+	if r.isClosed() {
+		r.lock.Unlock()
+		return
+	}
+	r.control = listenRelay(r.Control, r.handleControl)
+	r.lock.Unlock()
+
+	lastPing := time.Now()
+	ticker := time.NewTicker(time.Millisecond * 500)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		if time.Since(lastPing) > RelayPingInterval {
+			lastPing = time.Now()
+			r.ping()
+		}
+		r.removeStaleTunnels()
+	}
+}
+
+// isClosed returns true when relay was stopped. Must be called under lock
+func (r *Relay) isClosed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close will stop relay and close all tunnels
+func (r *Relay) Close() error {
+	if r.done == nil {
+		return nil
+	}
+	r.lock.Lock()
+	if r.isClosed() {
+		r.lock.Unlock()
+		return nil
+	}
+	close(r.done)
+	listeners := []*relayListener{}
+	for id, tunnel := range r.tunnels {
+		listeners = append(listeners, tunnel.listeners()...)
+		delete(r.tunnels, id)
+	}
+	control := r.control
+	r.lock.Unlock()
+
+	// Listeners take the lock, so they're stopped without it
+	for _, l := range listeners {
+		l.close()
+	}
+	if control != nil {
+		return control.close()
+	}
+	if r.Control != nil {
+		return r.Control.Close()
+	}
+	return nil
+}
+
+// Clients returns number of active tunnels
+func (r *Relay) Clients() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.tunnels)
+}
+
+func (r *Relay) handleControl(count int, src *net.UDPAddr, err error, buff []byte) error {
+	if err != nil {
+		Log(Debug, "Relay control socket read failed: %s", err)
+		return err
+	}
+	data := make([]byte, count)
+	copy(data, buff[:count])
+	msg, err := P2PMessageFromBytes(data)
+	if err != nil || msg == nil {
+		return fmt.Errorf("Broken message from %s", src.String())
+	}
+
+	switch MsgType(msg.Header.Type) {
+	case MsgTypeProxy:
+		return r.handleTunnelRequest(string(msg.Data), src)
+	case MsgTypePing:
+		// Owners echo our pings back
+		r.touch(src)
+		return nil
+	case MsgTypeLatency:
+		if len(msg.Data) < len(LatencyProxyHeader) || !bytes.Equal(msg.Data[:len(LatencyProxyHeader)], LatencyProxyHeader) {
+			return fmt.Errorf("Unexpected latency message from %s", src.String())
+		}
+		r.touch(src)
+		_, err := r.Control.SendMessage(msg, src)
+		return err
+	}
+	Log(Trace, "Relay received unsupported message type %d from %s", msg.Header.Type, src.String())
+	return nil
+}
+
+// handleTunnelRequest will allocate new tunnel for a peer or reuse an
+// existing one and send its endpoint back
+func (r *Relay) handleTunnelRequest(id string, src *net.UDPAddr) error {
+	if len(id) != 36 {
+		return fmt.Errorf("Malformed ID in tunnel request from %s", src.String())
+	}
+	r.lock.Lock()
+	if r.isClosed() {
+		r.lock.Unlock()
+		return nil
+	}
+	tunnel, exists := r.tunnels[id]
+	if !exists {
+		tunnel = new(relayTunnel)
+		tunnel.id = id
+		tunnel.remotes = make(map[string]*relayRemote)
+		tunnel.socket = new(Network)
+		err := tunnel.socket.Init("", 0)
+		if err != nil {
+			r.lock.Unlock()
+			return fmt.Errorf("Failed to create tunnel for %s: %s", id, err)
+		}
+		r.tunnels[id] = tunnel
+		tunnel.listener = listenRelay(tunnel.socket, r.forward(tunnel))
+		Log(Info, "Created tunnel %d for peer %s [%s]", tunnel.socket.GetPort(), id, src.String())
+	}
+	tunnel.owner = src
+	tunnel.lastSeen = time.Now()
+	endpoint := net.JoinHostPort(r.IP.String(), strconv.Itoa(tunnel.socket.GetPort()))
+	r.lock.Unlock()
+
+	msg, err := CreateMessageStatic(MsgTypeProxy, []byte(endpoint))
+	if err != nil {
+		return err
+	}
+	_, err = r.Control.SendMessage(msg, src)
+	return err
+}
+
+// touch updates tunnels owned by specified address
+func (r *Relay) touch(src *net.UDPAddr) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, tunnel := range r.tunnels {
+		if tunnel.owner != nil && tunnel.owner.String() == src.String() {
+			tunnel.lastSeen = time.Now()
+		}
+	}
+}
+
+// ping sends ping to owners of all tunnels. Peers will echo it back
+func (r *Relay) ping() {
+	msg, err := CreateMessageStatic(MsgTypePing, []byte("ping"))
+	if err != nil {
+		return
+	}
+	r.lock.RLock()
+	owners := make(map[string]*net.UDPAddr)
+	for _, tunnel := range r.tunnels {
+		if tunnel.owner != nil {
+			owners[tunnel.owner.String()] = tunnel.owner
+		}
+	}
+	r.lock.RUnlock()
+	for _, owner := range owners {
+		r.Control.SendMessage(msg, owner)
+	}
+}
+
+func (r *Relay) removeStaleTunnels() {
+	stale := []*relayListener{}
+	r.lock.Lock()
+	for id, tunnel := range r.tunnels {
+		if time.Since(tunnel.lastSeen) > RelayTunnelTimeout {
+			Log(Info, "Closing tunnel of peer %s by timeout", id)
+			stale = append(stale, tunnel.listeners()...)
+			delete(r.tunnels, id)
+			continue
+		}
+		for addr, remote := range tunnel.remotes {
+			if time.Since(remote.lastSeen) > RelayTunnelTimeout {
+				stale = append(stale, remote.listener)
+				delete(tunnel.remotes, addr)
+			}
+		}
+	}
+	r.lock.Unlock()
+	for _, l := range stale {
+		l.close()
+	}
+}
+
+// listeners returns listeners of tunnel endpoint and return sockets
+func (t *relayTunnel) listeners() []*relayListener {
+	listeners := []*relayListener{t.listener}
+	for _, remote := range t.remotes {
+		listeners = append(listeners, remote.listener)
+	}
+	return listeners
+}
+
+// listenRelay starts listener of socket
+func listenRelay(socket *Network, handler UDPReceivedCallback) *relayListener {
+	l := &relayListener{conn: socket.conn, done: make(chan struct{})}
+	go l.run(handler)
+	return l
+}
+
+func (l *relayListener) run(handler UDPReceivedCallback) {
+	defer close(l.done)
+	buf := make([]byte, 4096)
+	for {
+		n, src, err := l.conn.ReadFromUDP(buf)
+		if atomic.LoadInt32(&l.stopped) == 1 {
+			return
+		}
+		handler(n, src, err, buf)
+	}
+}
+
+// close stops listener and closes its socket
+func (l *relayListener) close() error {
+	atomic.StoreInt32(&l.stopped, 1)
+	// Unblocks read in progress
+	l.conn.SetReadDeadline(time.Now())
+	<-l.done
+	return l.conn.Close()
+}
+
+// forward returns handler of tunnel endpoint. Data of remote peers is
+// passed to the owner from return socket of each remote peer
+func (r *Relay) forward(t *relayTunnel) UDPReceivedCallback {
+	return func(count int, src *net.UDPAddr, err error, buff []byte) error {
+		if err != nil {
+			return err
+		}
+		header, err := P2PMessageHeaderFromBytes(buff[:count])
+		if err != nil || header == nil || header.Magic != MagicCookie {
+			return fmt.Errorf("Tunnel %s received non-p2p data from %s", t.id, src.String())
+		}
+		r.lock.Lock()
+		if r.tunnels[t.id] != t {
+			// Return sockets of closed tunnel would never be closed
+			r.lock.Unlock()
+			return fmt.Errorf("Tunnel %s was closed", t.id)
+		}
+		owner := t.owner
+		if owner == nil {
+			r.lock.Unlock()
+			return fmt.Errorf("Tunnel %s has no owner", t.id)
+		}
+		if src.String() == owner.String() {
+			r.lock.Unlock()
+			return fmt.Errorf("Tunnel %s received data from owner. Return socket of remote peer must be used", t.id)
+		}
+		remote, exists := t.remotes[src.String()]
+		if !exists {
+			remote = &relayRemote{addr: src, socket: new(Network)}
+			err = remote.socket.Init("", 0)
+			if err != nil {
+				r.lock.Unlock()
+				return fmt.Errorf("Failed to create return socket of tunnel %s: %s", t.id, err)
+			}
+			t.remotes[src.String()] = remote
+			remote.listener = listenRelay(remote.socket, r.reply(t, remote))
+		}
+		remote.lastSeen = time.Now()
+		t.tx += uint64(count)
+		r.lock.Unlock()
+		_, err = remote.socket.SendRawBytes(buff[:count], owner)
+		return err
+	}
+}
+
+// reply returns handler of return socket. Data of the owner is passed to
+// the remote peer from tunnel endpoint
+func (r *Relay) reply(t *relayTunnel, remote *relayRemote) UDPReceivedCallback {
+	return func(count int, src *net.UDPAddr, err error, buff []byte) error {
+		if err != nil {
+			return err
+		}
+		r.lock.Lock()
+		if t.owner == nil || src.String() != t.owner.String() {
+			r.lock.Unlock()
+			return fmt.Errorf("Return socket of tunnel %s received data from %s", t.id, src.String())
+		}
+		t.lastSeen = time.Now()
+		t.rx += uint64(count)
+		r.lock.Unlock()
+		_, err = t.socket.SendRawBytes(buff[:count], remote.addr)
+		return err
+	}
+}
@@ -0,0 +1,109 @@
+package ptp
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func relayTestRead(t *testing.T, conn *net.UDPConn) (*P2PMessage, *net.UDPAddr) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	buf := make([]byte, 4096)
+	n, src, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Failed to read from relay: %s", err)
+	}
+	msg, err := P2PMessageFromBytes(buf[:n])
+	if err != nil || msg == nil {
+		t.Fatalf("Broken message from relay: %v", err)
+	}
+	return msg, src
+}
+
+func TestRelay(t *testing.T) {
+	relay := new(Relay)
+	if relay.Init(nil, 0) == nil {
+		t.Fatalf("Relay was initialized without IP")
+	}
+	err := relay.Init(net.ParseIP("127.0.0.1"), 0)
+	if err != nil {
+		t.Fatalf("Failed to init relay: %s", err)
+	}
+	defer relay.Close()
+	go relay.Run()
+
+	control, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:"+strconv.Itoa(relay.Control.GetPort()))
+	owner, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer owner.Close()
+	remote, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer remote.Close()
+
+	// Malformed ID must be ignored
+	bad, _ := CreateMessageStatic(MsgTypeProxy, []byte("short"))
+	owner.WriteToUDP(bad.Serialize(), control)
+
+	id := "00000000-0000-0000-0000-000000000001"
+	request, _ := CreateMessageStatic(MsgTypeProxy, []byte(id))
+	owner.WriteToUDP(request.Serialize(), control)
+	reply, src := relayTestRead(t, owner)
+	if reply.Header.Type != uint16(MsgTypeProxy) || src.String() != control.String() {
+		t.Fatalf("Bad tunnel reply: %+v from %s", reply.Header, src)
+	}
+	endpoint, err := net.ResolveUDPAddr("udp4", string(reply.Data))
+	if err != nil {
+		t.Fatalf("Bad tunnel endpoint %s: %s", reply.Data, err)
+	}
+	if relay.Clients() != 1 {
+		t.Fatalf("Expected 1 tunnel, got %d", relay.Clients())
+	}
+
+	// Repeated request returns the same endpoint
+	owner.WriteToUDP(request.Serialize(), control)
+	reply, _ = relayTestRead(t, owner)
+	if string(reply.Data) != endpoint.String() || relay.Clients() != 1 {
+		t.Fatalf("Repeated request created new tunnel: %s", reply.Data)
+	}
+
+	other, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer other.Close()
+
+	// Remote peers -> owner. Each remote peer has its own return address
+	data, _ := CreateMessageStatic(MsgTypeNenc, []byte("hello"))
+	remote.WriteToUDP(data.Serialize(), endpoint)
+	msg, returnRemote := relayTestRead(t, owner)
+	if string(msg.Data) != "hello" || returnRemote.String() == endpoint.String() {
+		t.Fatalf("Owner received %s from %s", msg.Data, returnRemote)
+	}
+	data, _ = CreateMessageStatic(MsgTypeNenc, []byte("hi"))
+	other.WriteToUDP(data.Serialize(), endpoint)
+	msg, returnOther := relayTestRead(t, owner)
+	if string(msg.Data) != "hi" || returnOther.String() == returnRemote.String() {
+		t.Fatalf("Owner received %s from %s", msg.Data, returnOther)
+	}
+
+	// Owner -> remote peers. Replies reach the peer of return address
+	// from tunnel endpoint, regardless of which peer spoke last
+	data, _ = CreateMessageStatic(MsgTypeNenc, []byte("world"))
+	owner.WriteToUDP(data.Serialize(), returnRemote)
+	msg, src = relayTestRead(t, remote)
+	if string(msg.Data) != "world" || src.String() != endpoint.String() {
+		t.Fatalf("Remote received %s from %s", msg.Data, src)
+	}
+	data, _ = CreateMessageStatic(MsgTypeNenc, []byte("there"))
+	owner.WriteToUDP(data.Serialize(), returnOther)
+	msg, _ = relayTestRead(t, other)
+	if string(msg.Data) != "there" {
+		t.Fatalf("Other remote received %s", msg.Data)
+	}
+
+	// Latency probes are echoed by control socket
+	ts, _ := time.Now().MarshalBinary()
+	latency, _ := CreateMessageStatic(MsgTypeLatency, append(LatencyProxyHeader, ts...))
+	owner.WriteToUDP(latency.Serialize(), control)
+	msg, _ = relayTestRead(t, owner)
+	if msg.Header.Type != uint16(MsgTypeLatency) || !bytes.Equal(msg.Data[:4], LatencyProxyHeader) {
+		t.Fatalf("Bad latency response: %+v", msg.Header)
+	}
+}
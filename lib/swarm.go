@@ -136,6 +136,17 @@ func (l *Swarm) GetEndpoint(mac string) (*net.UDPAddr, error) {
 	return nil, fmt.Errorf("Specified hardware address was not found in table")
 }
 
+// GetPeerByMac returns peer with specified hardware address
+func (l *Swarm) GetPeerByMac(mac string) *NetworkPeer {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	id, exists := l.tableMacID[mac]
+	if exists {
+		return l.peers[id]
+	}
+	return nil
+}
+
 // GetID returns ID by specified IP
 func (l *Swarm) GetID(ip string) (string, error) {
 	l.lock.RLock()
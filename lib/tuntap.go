@@ -69,6 +69,7 @@ type TAP interface {
 	Run()
 	IsConfigured() bool
 	MarkConfigured()
+	SetMTU(int) error
 	EnablePMTU()
 	DisablePMTU()
 	IsPMTUEnabled() bool
@@ -239,6 +239,22 @@ func (t *TAPDarwin) MarkConfigured() {
 	t.Configured = true
 }
 
+// SetMTU changes MTU of the interface. New value is applied immediately
+// when interface is already created
+func (t *TAPDarwin) SetMTU(mtu int) error {
+	t.MTU = mtu
+	if t.file == nil || t.Tool == "" {
+		return nil
+	}
+	setmtu := exec.Command(t.Tool, t.Name, "mtu", fmt.Sprintf("%d", mtu))
+	err := setmtu.Run()
+	if err != nil {
+		Log(Error, "Failed to set MTU on device %s: %v", t.Name, err)
+		return err
+	}
+	return nil
+}
+
 func (t *TAPDarwin) EnablePMTU() {
 	t.PMTU = true
 }
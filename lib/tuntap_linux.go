@@ -341,6 +341,16 @@ func (tap *TAPLinux) MarkConfigured() {
 	tap.Configured = true
 }
 
+// SetMTU changes MTU of the interface. New value is applied immediately
+// when interface is already created
+func (tap *TAPLinux) SetMTU(mtu int) error {
+	tap.MTU = mtu
+	if tap.file == nil {
+		return nil
+	}
+	return tap.setMTU()
+}
+
 func (tap *TAPLinux) EnablePMTU() {
 	tap.PMTU = true
 }
@@ -496,6 +496,11 @@ func (t *TAPWindows) MarkConfigured() {
 	t.Configured = true
 }
 
+// SetMTU is not supported: MTU of TAP adapter is controlled by its driver
+func (t *TAPWindows) SetMTU(mtu int) error {
+	return fmt.Errorf("MTU of TAP adapter is controlled by its driver")
+}
+
 func (t *TAPWindows) EnablePMTU() {
 	t.PMTU = true
 }
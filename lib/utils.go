@@ -201,11 +201,11 @@ func isDeviceExists(name string) bool {
 }
 
 // ParseIntroString receives a comma-separated string with ID, MAC and IP of a peer
-// and returns this data
+// and returns this data. Optional fifth field is a reply to key exchange
 func ParseIntroString(intro string) (*PeerHandshake, error) {
 	hs := &PeerHandshake{}
 	parts := strings.Split(intro, ",")
-	if len(parts) != 4 {
+	if len(parts) != 4 && len(parts) != 5 {
 		return nil, fmt.Errorf("Failed to parse introduction string: %s", intro)
 	}
 	hs.ID = parts[0]
@@ -225,10 +225,15 @@ func ParseIntroString(intro string) (*PeerHandshake, error) {
 			return nil, fmt.Errorf("Failed to parse IP address from introduction packet")
 		}
 	}
-	hs.Endpoint, err = net.ResolveUDPAddr("udp4", parts[3])
+	// Peers that don't support key exchange send our request back
+	endpoint, _ := splitHandshake(parts[3])
+	hs.Endpoint, err = net.ResolveUDPAddr("udp4", endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse handshake endpoint: %s", parts[3])
 	}
+	if len(parts) == 5 {
+		hs.Handshake = parts[4]
+	}
 
 	return hs, nil
 }
@@ -266,6 +266,9 @@ func TestParseIntroString(t *testing.T) {
 	hs0.IP = net.ParseIP("10.11.12.13")
 	hs0.HardwareAddr, _ = net.ParseMAC("00:11:22:33:44:55")
 	hs0.Endpoint, _ = net.ResolveUDPAddr("udp4", "192.168.0.1:1234")
+	hs1 := new(PeerHandshake)
+	*hs1 = *hs0
+	hs1.Handshake = "AQID"
 
 	tests := []struct {
 		name    string
@@ -279,6 +282,9 @@ func TestParseIntroString(t *testing.T) {
 		{"broken ip", args{",00:11:22:33:44:55,a,"}, nil, true},
 		{"broken udp addr", args{",00:11:22:33:44:55,10.11.12.13,a:b"}, nil, true},
 		{"passing", args{"1,00:11:22:33:44:55,10.11.12.13,192.168.0.1:1234"}, hs0, false},
+		{"echoed handshake", args{"1,00:11:22:33:44:55,10.11.12.13,192.168.0.1:1234|AQID"}, hs0, false},
+		{"handshake reply", args{"1,00:11:22:33:44:55,10.11.12.13,192.168.0.1:1234,AQID"}, hs1, false},
+		{"too many parts", args{"1,00:11:22:33:44:55,10.11.12.13,192.168.0.1:1234,AQID,"}, nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
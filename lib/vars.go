@@ -31,6 +31,7 @@ const (
 	MsgTypeConf              = 10 // Confirmation
 	MsgTypeLatency           = 11 // Latency measurement
 	MsgTypeComm              = 12 // Internal cross peer communication
+	MsgTypeAEAD              = 13 // Message sealed with authenticated encryption
 )
 
 // Common communication packet types
@@ -60,6 +61,11 @@ const (
 	CommDiscoveryUnsupported        = 27 // Unsupported packet version
 )
 
+// Crypto communication packets
+const (
+	CommCryptoModes uint16 = 30 // Negotiation of encryption mode
+)
+
 // Network Constants
 const (
 	MagicCookie uint16 = 0xabcd
@@ -131,4 +137,6 @@ const (
 	ProxyLatencyRequestInterval    time.Duration = time.Second * 15         // How often we should update latency with proxies
 	EndpointLatencyRequestInterval time.Duration = time.Second * 15         // How often we should update latency with endpoints
 	UDPHolePunchTimeout            time.Duration = time.Millisecond * 20000 // How long we will for udp hole punching to finish
+	RelayPingInterval              time.Duration = time.Second * 30         // How often relay pings owners of tunnels. Must be less than proxy timeout on peers
+	RelayTunnelTimeout             time.Duration = time.Second * 180        // Tunnel is closed when owner doesn't respond for this period
 )
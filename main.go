@@ -19,8 +19,11 @@ var AppVersion = "Unknown"
 // BuildID usually holds output of `git describe`
 var BuildID = "Unknown"
 
+// DefaultTarget is a SRV lookup service used when no target was specified
+const DefaultTarget = "dht"
+
 // TargetURL will point p2p to specified service under default domain for SRV lookup
-var TargetURL = "dht"
+var TargetURL = DefaultTarget
 
 // DefaultLog is used when it was not specified during build
 var DefaultLog = "INFO"
@@ -68,6 +71,7 @@ func main() {
 	// Command-line flags
 	var (
 		SaveFile       string // Save file where p2p will store data about instances
+		SaveKey        string // Machine key used to encrypt keys in save file
 		RPCPort        int    // Port that p2p is daemon is listening to
 		Profiling      string // Profiling type
 		Syslog         string // Syslog socket
@@ -76,11 +80,14 @@ func main() {
 		Mac            string // Hardware address of p2p interface
 		InterfaceName  string // Name of p2p interface
 		Keyfile        string // Path to a file with crypto key
+		KDF            string // Key derivation function
 		Key            string // AES key
 		Until          string // Until date this key will be active in Unix timestamp
 		Ports          string // Ports range for an instance
 		UDPPort        int    // Specific UDP port for an instance
 		UseForwarders  bool   // Whether or not p2p should force usage of proxy servers for this instance
+		SwarmFile      string // Path to a file with instance definition
+		DryRun         bool   // Show planned changes without applying them
 		ShowInterfaces bool   // Whether or not p2p show command should return information about interfaces in use
 		ShowAll        bool   //
 		ShowBind       bool   // used with show --interfaces
@@ -89,9 +96,18 @@ func main() {
 		InstallService bool   // If yes - service will be installed (used with service)
 		MTU            int    // MTU for p2p interface
 		ShowMTU        bool   // Show MTU value
+		ShowKeys       bool   // Show encryption keys of an instance
 		PMTU           bool   // Whether or not PMTU capabilities should be used
 		SRVEntry       string // SRV Entry for service lookup
 		ConfigFile     string // Path to configuration YAML file
+		BootstrapTCP   string // TCP address of a bootstrap node
+		BootstrapUDP   string // UDP address of an echo server
+		Network        string // Default network for DHCP on bootstrap node
+		TLSCert        string // TLS certificate of a bootstrap node
+		TLSKey         string // TLS private key of a bootstrap node
+		ProxyPort      int    // UDP port of a proxy
+		ProxyIP        string // IP advertised by proxy
+		Output         string // Output format of command
 	)
 
 	app := cli.NewApp()
@@ -120,7 +136,7 @@ func main() {
 				},
 				&cli.StringFlag{
 					Name:        "target",
-					Usage:       "Comma-separated list of endpoints",
+					Usage:       "SRV entry name or comma-separated list of bootstrap endpoints: tcp://host:port,udp://host:port",
 					Value:       TargetURL,
 					Destination: &TargetURL,
 				},
@@ -130,6 +146,12 @@ func main() {
 					Value:       "",
 					Destination: &SaveFile,
 				},
+				&cli.StringFlag{
+					Name:        "save-key",
+					Usage:       "Path to a machine key used to encrypt keys in save file. Created when missing. Defaults to save file path with .key suffix. Passphrase from P2P_SAVE_PASSPHRASE is used instead when set",
+					Value:       "",
+					Destination: &SaveKey,
+				},
 				&cli.StringFlag{
 					Name:        "profile",
 					Usage:       "Run p2p in profiling mode. Possible value: mem, cpu",
@@ -173,10 +195,114 @@ func main() {
 				},
 			},
 			Action: func(c *cli.Context) error {
-				if SRVEntry == "" {
-					SRVEntry = TargetURL
+				// Options that weren't specified are taken from configuration file
+				rpcPort := 0
+				if c.IsSet("rpc-port") {
+					rpcPort = RPCPort
+				}
+				target := SRVEntry
+				if target == "" && c.IsSet("target") {
+					target = TargetURL
 				}
-				ExecDaemon(RPCPort, SRVEntry, SaveFile, Profiling, Syslog, LogLevel, ConfigFile, MTU, PMTU)
+				ExecDaemon(rpcPort, target, SaveFile, SaveKey, Profiling, Syslog, LogLevel, ConfigFile, MTU, PMTU)
+				return nil
+			},
+		},
+		{
+			Name:  "bootstrap",
+			Usage: "Run p2p in bootstrap node mode",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "tcp",
+					Usage:       "Address to listen for daemon connections",
+					Value:       DefaultBootstrapTCP,
+					Destination: &BootstrapTCP,
+				},
+				&cli.StringFlag{
+					Name:        "udp",
+					Usage:       "Address of UDP echo server. Empty value disables echo server",
+					Value:       DefaultBootstrapUDP,
+					Destination: &BootstrapUDP,
+				},
+				&cli.StringFlag{
+					Name:        "network",
+					Usage:       "Network used for IP allocation in swarms that didn't report any, e.g. 10.10.10.0/24",
+					Value:       "",
+					Destination: &Network,
+				},
+				&cli.StringFlag{
+					Name:        "cert",
+					Usage:       "PEM-encoded TLS certificate. Daemons will be accepted over TLS when specified",
+					Value:       "",
+					Destination: &TLSCert,
+				},
+				&cli.StringFlag{
+					Name:        "key",
+					Usage:       "PEM-encoded private key of TLS certificate",
+					Value:       "",
+					Destination: &TLSKey,
+				},
+				&cli.StringFlag{
+					Name:        "log",
+					Usage:       "Log level. Available levels: trace, debug, info, warning, error",
+					Value:       "",
+					Destination: &LogLevel,
+				},
+				&cli.StringFlag{
+					Name:        "syslog",
+					Usage:       "Specify syslog socket",
+					Value:       "",
+					Destination: &Syslog,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				ExecBootstrap(BootstrapTCP, BootstrapUDP, Network, TLSCert, TLSKey, LogLevel, Syslog)
+				return nil
+			},
+		},
+		{
+			Name:  "proxy",
+			Usage: "Run p2p in proxy mode",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "port",
+					Usage:       "UDP port for proxy control socket. Random port will be used if not specified",
+					Value:       0,
+					Destination: &ProxyPort,
+				},
+				&cli.StringFlag{
+					Name:        "ip",
+					Usage:       "IP address advertised to peers. Outbound IP reported by bootstrap node is used by default",
+					Value:       "",
+					Destination: &ProxyIP,
+				},
+				&cli.StringFlag{
+					Name:        "target",
+					Usage:       "SRV entry name or comma-separated list of bootstrap endpoints: tcp://host:port,udp://host:port",
+					Value:       TargetURL,
+					Destination: &TargetURL,
+				},
+				&cli.StringFlag{
+					Name:        "log",
+					Usage:       "Log level. Available levels: trace, debug, info, warning, error",
+					Value:       "",
+					Destination: &LogLevel,
+				},
+				&cli.StringFlag{
+					Name:        "syslog",
+					Usage:       "Specify syslog socket",
+					Value:       "",
+					Destination: &Syslog,
+				},
+				&cli.StringFlag{
+					Name:        "config",
+					Usage:       "Path to configuration YAML file",
+					Value:       "",
+					Destination: &ConfigFile,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				ExecProxy(ProxyPort, ProxyIP, TargetURL, LogLevel, Syslog, ConfigFile)
 				return nil
 			},
 		},
@@ -217,6 +343,12 @@ func main() {
 					Value:       52523,
 					Destination: &RPCPort,
 				},
+				&cli.StringFlag{
+					Name:        "output",
+					Usage:       "Output format: text, json, yaml or table",
+					Value:       OutputText,
+					Destination: &Output,
+				},
 				&cli.StringFlag{
 					Name:        "hash",
 					Usage:       "Infohash of p2p swarm",
@@ -225,8 +357,8 @@ func main() {
 				},
 				&cli.StringFlag{
 					Name:        "ip",
-					Usage:       "IP Address of p2p interface. Can be specified in CIDR format or use \"dhcp\" to pick free unused IP",
-					Value:       "dhcp",
+					Usage:       "IP Address of p2p interface. Can be specified in CIDR format or use \"dhcp\" to pick free unused IP. Defaults to daemon configuration or \"dhcp\"",
+					Value:       "",
 					Destination: &IP,
 				},
 				&cli.StringFlag{
@@ -253,6 +385,12 @@ func main() {
 					Value:       "",
 					Destination: &Key,
 				},
+				&cli.StringFlag{
+					Name:        "kdf",
+					Usage:       "Derive key from a passphrase: scrypt or argon2id with optional cost, e.g. argon2id:t=3,m=65536,p=4. Raw key is used by default",
+					Value:       "",
+					Destination: &KDF,
+				},
 				&cli.StringFlag{
 					Name:        "ttl, until",
 					Usage:       "Time until specified key will be active",
@@ -276,9 +414,20 @@ func main() {
 					Usage:       "Force proxy servers usage",
 					Destination: &UseForwarders,
 				},
+				&cli.StringFlag{
+					Name:        "file",
+					Usage:       "Path to a YAML file with instance definition. Specified arguments have priority over the file",
+					Value:       "",
+					Destination: &SwarmFile,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				CommandStart(RPCPort, IP, Infohash, Mac, InterfaceName, Keyfile, Key, Until, UseForwarders, UDPPort)
+				setOutputFormat(Output)
+				if SwarmFile != "" {
+					CommandStartFile(RPCPort, SwarmFile, IP, Infohash, Mac, InterfaceName, Keyfile, Key, KDF, Until, UseForwarders, UDPPort)
+					return nil
+				}
+				CommandStart(RPCPort, IP, Infohash, Mac, InterfaceName, Keyfile, Key, KDF, Until, UseForwarders, UDPPort, 0)
 				return nil
 			},
 		},
@@ -292,6 +441,12 @@ func main() {
 					Value:       52523,
 					Destination: &RPCPort,
 				},
+				&cli.StringFlag{
+					Name:        "output",
+					Usage:       "Output format: text, json, yaml or table",
+					Value:       OutputText,
+					Destination: &Output,
+				},
 				&cli.StringFlag{
 					Name:        "hash",
 					Usage:       "Infohash of instance that needs to be shutdown",
@@ -306,10 +461,55 @@ func main() {
 				},
 			},
 			Action: func(c *cli.Context) error {
+				setOutputFormat(Output)
 				CommandStop(RPCPort, Infohash, InterfaceName)
 				return nil
 			},
 		},
+		{
+			Name:  "enable",
+			Usage: "Start saved p2p instance and restore it on daemon launch",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "rpc-port",
+					Usage:       "RPC port",
+					Value:       52523,
+					Destination: &RPCPort,
+				},
+				&cli.StringFlag{
+					Name:        "hash",
+					Usage:       "Infohash of instance that needs to be enabled",
+					Value:       "",
+					Destination: &Infohash,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				CommandEnable(RPCPort, Infohash)
+				return nil
+			},
+		},
+		{
+			Name:  "disable",
+			Usage: "Shutdown p2p instance, but keep it in save file",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "rpc-port",
+					Usage:       "RPC port",
+					Value:       52523,
+					Destination: &RPCPort,
+				},
+				&cli.StringFlag{
+					Name:        "hash",
+					Usage:       "Infohash of instance that needs to be disabled",
+					Value:       "",
+					Destination: &Infohash,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				CommandDisable(RPCPort, Infohash)
+				return nil
+			},
+		},
 		{
 			Name:  "show",
 			Usage: "Display different information about p2p daemon or instances",
@@ -320,6 +520,12 @@ func main() {
 					Value:       52523,
 					Destination: &RPCPort,
 				},
+				&cli.StringFlag{
+					Name:        "output",
+					Usage:       "Output format: text, json, yaml or table",
+					Value:       OutputText,
+					Destination: &Output,
+				},
 				&cli.StringFlag{
 					Name:        "hash",
 					Usage:       "Display information about specific instance",
@@ -352,9 +558,15 @@ func main() {
 					Usage:       "Display current MTU value in P2P",
 					Destination: &ShowMTU,
 				},
+				&cli.BoolFlag{
+					Name:        "keys",
+					Usage:       "In combination with -hash this will show encryption keys of the instance and their rotation state",
+					Destination: &ShowKeys,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				CommandShow(RPCPort, Infohash, IP, ShowInterfaces, ShowAll, ShowBind, ShowMTU)
+				setOutputFormat(Output)
+				CommandShow(RPCPort, Infohash, IP, ShowInterfaces, ShowAll, ShowBind, ShowMTU, ShowKeys)
 				return nil
 			},
 		},
@@ -368,6 +580,12 @@ func main() {
 					Value:       52523,
 					Destination: &RPCPort,
 				},
+				&cli.StringFlag{
+					Name:        "output",
+					Usage:       "Output format: text, json, yaml or table",
+					Value:       OutputText,
+					Destination: &Output,
+				},
 				&cli.StringFlag{
 					Name:        "log",
 					Usage:       "Log level. Available levels: trace, debug, info, warning, error",
@@ -400,6 +618,7 @@ func main() {
 				},
 			},
 			Action: func(c *cli.Context) error {
+				setOutputFormat(Output)
 				CommandSet(RPCPort, LogLevel, Infohash, "", Key, Until, IP)
 				return nil
 			},
@@ -414,8 +633,15 @@ func main() {
 					Value:       52523,
 					Destination: &RPCPort,
 				},
+				&cli.StringFlag{
+					Name:        "output",
+					Usage:       "Output format: text, json, yaml or table",
+					Value:       OutputText,
+					Destination: &Output,
+				},
 			},
 			Action: func(c *cli.Context) error {
+				setOutputFormat(Output)
 				CommandDebug(RPCPort)
 				return nil
 			},
@@ -430,6 +656,12 @@ func main() {
 					Value:       52523,
 					Destination: &RPCPort,
 				},
+				&cli.StringFlag{
+					Name:        "output",
+					Usage:       "Output format: text, json, yaml or table",
+					Value:       OutputText,
+					Destination: &Output,
+				},
 				&cli.StringFlag{
 					Name:        "hash",
 					Usage:       "Limit results to specified instance",
@@ -438,10 +670,99 @@ func main() {
 				},
 			},
 			Action: func(c *cli.Context) error {
+				setOutputFormat(Output)
 				CommandStatus(RPCPort, Infohash)
 				return nil
 			},
 		},
+		{
+			Name:  "watch",
+			Usage: "Print events of daemon and instances as they happen",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "rpc-port",
+					Usage:       "RPC port",
+					Value:       52523,
+					Destination: &RPCPort,
+				},
+				&cli.StringFlag{
+					Name:        "output",
+					Usage:       "Output format: text, json or yaml",
+					Value:       OutputText,
+					Destination: &Output,
+				},
+				&cli.StringFlag{
+					Name:        "hash",
+					Usage:       "Limit events to specified instance",
+					Value:       "",
+					Destination: &Infohash,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				setOutputFormat(Output)
+				CommandWatch(RPCPort, Infohash)
+				return nil
+			},
+		},
+		{
+			Name:  "reload",
+			Usage: "Reload daemon configuration file. Same as sending SIGHUP to daemon",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "rpc-port",
+					Usage:       "RPC port",
+					Value:       52523,
+					Destination: &RPCPort,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				CommandReload(RPCPort)
+				return nil
+			},
+		},
+		{
+			Name:  "apply",
+			Usage: "Start, stop and update instances according to instances directory of daemon",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "rpc-port",
+					Usage:       "RPC port",
+					Value:       52523,
+					Destination: &RPCPort,
+				},
+				&cli.BoolFlag{
+					Name:        "dry-run",
+					Usage:       "Show planned changes without applying them",
+					Destination: &DryRun,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				CommandApply(RPCPort, DryRun)
+				return nil
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Manage daemon configuration",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "check",
+					Usage: "Validate configuration file without starting daemon",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:        "config",
+							Usage:       "Path to configuration YAML file",
+							Value:       "",
+							Destination: &ConfigFile,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						CommandConfigCheck(ConfigFile)
+						return nil
+					},
+				},
+			},
+		},
 		{
 			Name:  "version",
 			Usage: "Display version number",
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats of CLI commands. Text is a legacy format of each command,
+// other formats follow schemas of output types below
+const (
+	OutputText  = "text"
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+	OutputTable = "table"
+)
+
+// outputFormat is a format selected with -output
+var outputFormat = OutputText
+
+// outputTable is a table of command output
+type outputTable struct {
+	header []string
+	rows   [][]string
+}
+
+// tabular is implemented by output that can be printed as tables
+type tabular interface {
+	tables() []outputTable
+}
+
+// setOutputFormat selects output format or exits when it's not supported
+func setOutputFormat(format string) {
+	switch format {
+	case "":
+		outputFormat = OutputText
+	case OutputText, OutputJSON, OutputYAML, OutputTable:
+		outputFormat = format
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output format %s. Supported formats: %s, %s, %s, %s\n", format, OutputText, OutputJSON, OutputYAML, OutputTable)
+		os.Exit(2)
+	}
+}
+
+// structuredOutput reports whether output is not a legacy text
+func structuredOutput() bool {
+	return outputFormat != OutputText
+}
+
+// writeOutput writes v in specified format. YAML is produced from JSON
+// encoding, so both formats share the same schema
+func writeOutput(w io.Writer, format string, v interface{}) error {
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case OutputYAML:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var doc interface{}
+		err = yaml.Unmarshal(data, &doc)
+		if err != nil {
+			return err
+		}
+		data, err = yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case OutputTable:
+		t, ok := v.(tabular)
+		if !ok {
+			return fmt.Errorf("Output can't be printed as table")
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for i, table := range t.tables() {
+			if i > 0 {
+				fmt.Fprintln(tw)
+			}
+			fmt.Fprintln(tw, strings.Join(table.header, "\t"))
+			for _, row := range table.rows {
+				fmt.Fprintln(tw, strings.Join(row, "\t"))
+			}
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("Unknown output format %s", format)
+}
+
+// exitWithOutput prints structured output and exits
+func exitWithOutput(v interface{}) {
+	err := writeOutput(os.Stdout, outputFormat, v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write output: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// outputMessage is a result of commands that modify daemon or instances
+type outputMessage struct {
+	Message string `json:"message"`
+}
+
+func (o *outputMessage) tables() []outputTable {
+	return []outputTable{{header: []string{"MESSAGE"}, rows: [][]string{{o.Message}}}}
+}
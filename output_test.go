@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/subutai-io/p2p/client"
+	"gopkg.in/yaml.v2"
+)
+
+func TestWriteOutput(t *testing.T) {
+	out := &outputStatus{
+		Instances: []outputStatusInstance{{
+			Hash: "swarm",
+			IP:   "10.10.10.1",
+			Peers: []outputStatusPeer{
+				{ID: "peer-a", IP: "10.10.10.2", State: "Connected"},
+				{ID: "peer-b", IP: "10.10.10.3", State: "Disconnected", LastError: "Timeout"},
+			},
+		}},
+		Restores: []outputRestore{},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeOutput(buf, OutputJSON, out); err != nil {
+		t.Fatalf("writeOutput(json) error = %v", err)
+	}
+	fromJSON := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &fromJSON); err != nil {
+		t.Fatalf("writeOutput(json) produced invalid JSON: %v", err)
+	}
+
+	buf.Reset()
+	if err := writeOutput(buf, OutputYAML, out); err != nil {
+		t.Fatalf("writeOutput(yaml) error = %v", err)
+	}
+	fromYAML := map[string]interface{}{}
+	if err := yaml.Unmarshal(buf.Bytes(), &fromYAML); err != nil {
+		t.Fatalf("writeOutput(yaml) produced invalid YAML: %v", err)
+	}
+	// YAML is converted through JSON, so re-encoding it gives the same document
+	data, _ := json.Marshal(convertYAML(fromYAML))
+	fromYAMLJSON := map[string]interface{}{}
+	json.Unmarshal(data, &fromYAMLJSON)
+	if !reflect.DeepEqual(fromJSON, fromYAMLJSON) {
+		t.Errorf("writeOutput() schemas differ:\njson: %v\nyaml: %v", fromJSON, fromYAMLJSON)
+	}
+
+	buf.Reset()
+	if err := writeOutput(buf, OutputTable, out); err != nil {
+		t.Fatalf("writeOutput(table) error = %v", err)
+	}
+	want := "HASH   IP          PEER    PEER IP     STATE         LAST ERROR\n" +
+		"swarm  10.10.10.1  peer-a  10.10.10.2  Connected     \n" +
+		"swarm  10.10.10.1  peer-b  10.10.10.3  Disconnected  Timeout\n"
+	if buf.String() != want {
+		t.Errorf("writeOutput(table) =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	if err := writeOutput(buf, OutputTable, &ErrorOutput{}); err == nil {
+		t.Errorf("writeOutput(table) accepted output without tables")
+	}
+}
+
+// convertYAML converts maps of YAML decoder to maps with string keys
+func convertYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, value := range v {
+			m[key.(string)] = convertYAML(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = convertYAML(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = convertYAML(value)
+		}
+	}
+	return v
+}
+
+func TestNewOutputStatus(t *testing.T) {
+	next := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	status := &client.Status{
+		Instances: []client.InstanceStatus{{
+			IP:    "10.10.10.1",
+			Peers: []client.PeerStatus{{ID: "peer", IP: "10.10.10.2", State: "Connected", LastError: "Timeout"}},
+		}},
+		Restores: []client.RestoreStatus{
+			{ID: "retrying", State: RestoreRetrying, Attempts: 2, NextAttempt: next},
+			{ID: "failed", State: RestoreFailed, Attempts: 5, NextAttempt: next},
+		},
+	}
+	got := newOutputStatus(status, "swarm")
+	want := &outputStatus{
+		Instances: []outputStatusInstance{{
+			Hash:  "swarm",
+			IP:    "10.10.10.1",
+			Peers: []outputStatusPeer{{ID: "peer", IP: "10.10.10.2", State: "Connected", LastError: "Timeout"}},
+		}},
+		Restores: []outputRestore{
+			{Hash: "retrying", State: RestoreRetrying, Attempts: 2, NextAttempt: "2026-01-02T03:04:05Z"},
+			{Hash: "failed", State: RestoreFailed, Attempts: 5},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("newOutputStatus() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+	"github.com/subutai-io/p2p/protocol"
+)
+
+// Proxy mode timeouts
+const (
+	proxyRegisterTimeout    = time.Duration(time.Second * 10)
+	proxyLoadReportInterval = time.Duration(time.Second * 30)
+)
+
+// proxyNode is a relay registered on bootstrap nodes
+type proxyNode struct {
+	relay        *ptp.Relay     // Relay forwarding traffic between peers
+	dht          *ptp.DHTClient // DHT client used for registration and load reports
+	registered   bool           // Whether bootstrap confirmed registration
+	registeredAt time.Time      // Last registration attempt
+}
+
+// ExecProxy starts p2p in proxy mode
+func ExecProxy(port int, ip, targetURL, logLevel, syslog, configFile string) {
+	if logLevel == "" {
+		ptp.SetMinLogLevelString(DefaultLog)
+	} else {
+		ptp.SetMinLogLevelString(logLevel)
+	}
+	if syslog != "" {
+		ptp.SetSyslogSocket(syslog)
+	}
+	ptp.Log(ptp.Info, "Initializing P2P Proxy")
+
+	configFile = configLocation(configFile)
+	config, err := processConfigFile(configFile)
+	if err != nil {
+		logConfErrors(configFile, err)
+		config = nil
+	}
+	targetURL = configureBootstrap(config, targetURL)
+
+	err = bootstrap.init(targetURL)
+	if err != nil {
+		ptp.Log(ptp.Warning, "Failed to find bootstrap nodes for %s: %s. Retrying in background", targetURL, err)
+	}
+	go bootstrap.run()
+	go bootstrap.monitor()
+	waitOutboundIP()
+
+	publicIP := OutboundIP
+	if ip != "" {
+		publicIP = net.ParseIP(ip)
+		if publicIP == nil || publicIP.To4() == nil {
+			ptp.Log(ptp.Error, "Bad IP address: %s", ip)
+			os.Exit(1)
+		}
+	}
+
+	node := new(proxyNode)
+	node.relay = new(ptp.Relay)
+	err = node.relay.Init(publicIP, port)
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to start proxy: %s", err)
+		os.Exit(1)
+	}
+	ptp.Log(ptp.Info, "Proxy is listening on %s:%d", publicIP.String(), node.relay.Control.GetPort())
+
+	node.dht = new(ptp.DHTClient)
+	node.dht.Init("")
+	node.dht.Mode = ptp.DHTModeProxy
+	node.dht.NetworkHash = node.dht.ID
+	inst := new(P2PInstance)
+	inst.ID = node.dht.NetworkHash
+	inst.PTP = new(ptp.PeerToPeer)
+	inst.PTP.Dht = node.dht
+	err = bootstrap.registerInstance(inst.ID, inst)
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to register proxy with bootstrap client: %s", err)
+		os.Exit(1)
+	}
+
+	SignalChannel = make(chan os.Signal, 1)
+	signal.Notify(SignalChannel, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range SignalChannel {
+			ptp.Log(ptp.Info, "Received signal: %s", sig)
+			node.relay.Close()
+			os.Exit(0)
+		}
+	}()
+
+	go node.relay.Run()
+	go node.readDHT()
+	node.run()
+}
+
+// run keeps proxy registered and reports its load
+func (p *proxyNode) run() {
+	lastReport := time.Now()
+	for {
+		if !p.registered && time.Since(p.registeredAt) > proxyRegisterTimeout {
+			p.register()
+		}
+		if p.registered && time.Since(lastReport) > proxyLoadReportInterval {
+			lastReport = time.Now()
+			err := p.dht.ReportLoad(p.relay.Clients())
+			if err != nil {
+				ptp.Log(ptp.Warning, "Failed to report load: %s", err)
+			}
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+}
+
+func (p *proxyNode) register() {
+	p.registeredAt = time.Now()
+	ptp.Log(ptp.Info, "Registering proxy on bootstrap nodes")
+	err := p.dht.RegisterProxy(p.relay.IP, p.relay.Control.GetPort())
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to register proxy: %s", err)
+	}
+}
+
+// readDHT handles packets received from bootstrap nodes
+func (p *proxyNode) readDHT() {
+	for {
+		packet := <-p.dht.IncomingData
+		if packet == nil {
+			break
+		}
+		switch packet.Type {
+		case protocol.DHTPacketType_RegisterProxy:
+			if packet.Data == "OK" {
+				ptp.Log(ptp.Info, "Proxy registration confirmed")
+				p.registered = true
+			}
+		case protocol.DHTPacketType_Unknown:
+			ptp.Log(ptp.Warning, "Bootstrap node doesn't know this proxy")
+			p.registered = false
+			p.registeredAt = time.Unix(0, 0)
+		case protocol.DHTPacketType_Error:
+			ptp.Log(ptp.Warning, "Bootstrap node returns: %s", packet.Extra)
+		default:
+			ptp.Log(ptp.Trace, "Skipping DHT packet: %+v", packet)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// daemonSettings keeps command line arguments and configuration daemon
+// was started with. Arguments have priority over configuration file
+type daemonSettings struct {
+	configFile string    // Path to configuration file
+	target     string    // Value of --target or --srv
+	logLevel   string    // Value of --log
+	mtu        int       // Value of --mtu
+	pmtu       bool      // Value of --pmtu
+	conf       *ptp.Conf // Configuration that is currently applied
+	lock       sync.Mutex
+}
+
+// getTarget returns target specified with arguments, configuration file
+// or default one
+func (s *daemonSettings) getTarget(conf *ptp.Conf) string {
+	target := conf.GetTarget(s.target)
+	if target == "" {
+		target = DefaultTarget
+	}
+	return target
+}
+
+// instanceDefaults returns options used by instances started without them
+func (s *daemonSettings) instanceDefaults() ptp.InstanceDefaults {
+	if s == nil {
+		return ptp.InstanceDefaults{}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conf == nil {
+		return ptp.InstanceDefaults{}
+	}
+	return s.conf.Defaults
+}
+
+// hooks returns hooks run on events of daemon and every instance
+func (s *daemonSettings) hooks() []ptp.HookConf {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conf == nil {
+		return nil
+	}
+	return s.conf.Hooks
+}
+
+// handleReloadSignal reloads configuration on SIGHUP
+func handleReloadSignal(d *Daemon) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			_, _, err := d.reload()
+			if err != nil {
+				ptp.Log(ptp.Error, "Failed to reload configuration: %s", err)
+			}
+		}
+	}()
+}
+
+// CommandReload asks daemon to read configuration file again
+func CommandReload(rpcPort int) {
+	exitWithResult(newClient(rpcPort).Reload(context.Background()))
+}
+
+func (d *Daemon) execRESTReload(w http.ResponseWriter, r *http.Request) {
+	if !ReadyToServe {
+		resp, _ := getResponse(105, "P2P Daemon is in initialization state")
+		w.Write(resp)
+		return
+	}
+	response := new(Response)
+	d.Reload(response)
+	resp, err := getResponse(response.ExitCode, response.Output)
+	if err != nil {
+		ptp.Log(ptp.Error, "Internal error: %s", err)
+		return
+	}
+	w.Write(resp)
+}
+
+// Reload reads configuration file again and reports applied changes
+func (d *Daemon) Reload(resp *Response) error {
+	applied, restart, err := d.reload()
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = err.Error()
+		return err
+	}
+	resp.ExitCode = 0
+	resp.Output = "Configuration reloaded"
+	if len(applied) == 0 && len(restart) == 0 {
+		resp.Output += ". Nothing has changed"
+	}
+	if len(applied) > 0 {
+		resp.Output += "\nApplied: " + strings.Join(applied, ", ")
+	}
+	if len(restart) > 0 {
+		resp.Output += "\nRequires restart: " + strings.Join(restart, ", ")
+	}
+	return nil
+}
+
+// reload applies settings of configuration file that can be changed
+// on the fly: log level, MTU, PMTU, bootstrap nodes, timeouts, instance
+// defaults, hooks and instances directory, which is applied again. Returns
+// list of applied changes and changed settings that require restart.
+// Nothing is applied when configuration is invalid or routers of new
+// bootstrap nodes can't be started
+func (d *Daemon) reload() ([]string, []string, error) {
+	s := d.settings
+	if s == nil {
+		return nil, nil, fmt.Errorf("Daemon settings are not initialized")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ptp.Log(ptp.Info, "Reloading configuration from %s", s.configFile)
+	conf, err := processConfigFile(s.configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load config file %s: %s", s.configFile, err)
+	}
+	old := s.conf
+	if old == nil {
+		old = new(ptp.Conf)
+		old.SetDefaults()
+	}
+
+	// Validate everything before applying
+	logLevel := ""
+	if s.logLevel == "" && conf.Log != old.Log {
+		logLevel = strings.ToLower(conf.Log)
+		if logLevel == "" {
+			logLevel = strings.ToLower(DefaultLog)
+		}
+		if !isLogLevel(logLevel) {
+			return nil, nil, fmt.Errorf("Unknown log level %s", conf.Log)
+		}
+	}
+	target := bootstrapTarget(conf, s.getTarget(conf))
+	oldTarget := bootstrap.getTarget()
+	if target != oldTarget && ptp.IsBootstrapList(target) {
+		err = validateDHT(target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Bootstrap list is malformed: %s", err)
+		}
+	}
+	// Bootstrap nodes are switched first, so nothing is applied when
+	// new nodes can't be reached
+	if target != oldTarget {
+		err = bootstrap.setTarget(target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to switch bootstrap nodes to %s: %s", target, err)
+		}
+	}
+
+	applied := []string{}
+	if logLevel != "" {
+		ptp.SetMinLogLevelString(logLevel)
+		applied = append(applied, "log level "+logLevel)
+	}
+	mtu := conf.GetMTU(s.mtu)
+	if mtu != ptp.GlobalMTU {
+		ptp.GlobalMTU = mtu
+		for _, inst := range d.Instances.get() {
+			if inst == nil || inst.PTP == nil || inst.PTP.Interface == nil || inst.Args.MTU > 0 {
+				// Instances with their own MTU keep it
+				continue
+			}
+			err := inst.PTP.Interface.SetMTU(mtu)
+			if err != nil {
+				ptp.Log(ptp.Warning, "Failed to change MTU of %s: %s", inst.PTP.Interface.GetName(), err)
+			}
+		}
+		applied = append(applied, fmt.Sprintf("MTU %d", mtu))
+	}
+	pmtu := s.pmtu || conf.GetPMTU()
+	if pmtu != ptp.UsePMTU {
+		ptp.UsePMTU = pmtu
+		for _, inst := range d.Instances.get() {
+			if inst == nil || inst.PTP == nil || inst.PTP.Interface == nil {
+				continue
+			}
+			if pmtu {
+				inst.PTP.Interface.EnablePMTU()
+			} else {
+				inst.PTP.Interface.DisablePMTU()
+			}
+		}
+		if pmtu {
+			applied = append(applied, "PMTU enabled")
+		} else {
+			applied = append(applied, "PMTU disabled")
+		}
+	}
+	if target != oldTarget {
+		// Instances will use the same target for UDP keep alive sessions
+		TargetURL = target
+		applied = append(applied, "bootstrap nodes "+target)
+	}
+	if conf.Timeouts != old.Timeouts {
+		configureTimeouts(conf.Timeouts)
+		applied = append(applied, "timeouts")
+	}
+	if conf.Defaults != old.Defaults {
+		applied = append(applied, "instance defaults")
+	}
+	if conf.InstancesDir != old.InstancesDir {
+		applied = append(applied, "instances directory "+conf.InstancesDir)
+	}
+	if !reflect.DeepEqual(conf.Hooks, old.Hooks) {
+		applied = append(applied, "hooks")
+	}
+
+	restart := []string{}
+	if conf.IPTool != old.IPTool {
+		restart = append(restart, "iptool")
+	}
+	if conf.TAPTool != old.TAPTool {
+		restart = append(restart, "taptool")
+	}
+	if conf.INFFile != old.INFFile {
+		restart = append(restart, "inf_file")
+	}
+	if conf.BootstrapCache != old.BootstrapCache {
+		restart = append(restart, "bootstrap_cache")
+	}
+	if !reflect.DeepEqual(conf.BootstrapTLS, old.BootstrapTLS) {
+		restart = append(restart, "bootstrap_tls")
+	}
+	if conf.RPCPort != old.RPCPort {
+		restart = append(restart, "rpc_port")
+	}
+	if conf.Save != old.Save {
+		restart = append(restart, "save")
+	}
+	if conf.SaveKey != old.SaveKey {
+		restart = append(restart, "save_key")
+	}
+	if conf.Syslog != old.Syslog {
+		restart = append(restart, "syslog")
+	}
+	if conf.Profile != old.Profile {
+		restart = append(restart, "profile")
+	}
+	if !reflect.DeepEqual(conf.Control, old.Control) {
+		restart = append(restart, "control")
+	}
+	s.conf = conf
+	// Definitions could change as well
+	triggerReconcile()
+
+	for _, change := range applied {
+		ptp.Log(ptp.Info, "Reload: applied %s", change)
+	}
+	if len(restart) > 0 {
+		ptp.Log(ptp.Warning, "Reload: changes of %s will be applied after restart", strings.Join(restart, ", "))
+	}
+	return applied, restart, nil
+}
+
+func isLogLevel(level string) bool {
+	switch level {
+	case "trace", "debug", "info", "warning", "error":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestDaemon_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-reload")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "p2p.yaml")
+
+	mtu, pmtu, level, target := ptp.GlobalMTU, ptp.UsePMTU, ptp.MinLogLevel(), bootstrap.target
+	defer func() {
+		ptp.GlobalMTU, ptp.UsePMTU, bootstrap.target = mtu, pmtu, target
+		ptp.SetMinLogLevel(level)
+		configureTimeouts(ptp.Timeouts{})
+	}()
+
+	conf := new(ptp.Conf)
+	conf.SetDefaults()
+	ptp.GlobalMTU = conf.MTU
+	ptp.UsePMTU = false
+	bootstrap.target = "tcp://127.0.0.1:6881"
+
+	d := new(Daemon)
+	d.Instances = new(InstanceList)
+	d.Instances.init()
+	d.settings = &daemonSettings{
+		configFile: configFile,
+		target:     "tcp://127.0.0.1:6881",
+		conf:       conf,
+	}
+
+	tests := []struct {
+		name        string
+		config      string
+		wantApplied []string
+		wantRestart []string
+		wantErr     bool
+	}{
+		{"Unchanged", "", []string{}, []string{}, false},
+		{"Live changes", "mtu: 1400\npmtu: true\nlog: debug\n", []string{"log level debug", "MTU 1400", "PMTU enabled"}, []string{}, false},
+		{"Restart required", "mtu: 1400\npmtu: true\nlog: debug\niptool: /bin/ip\n", []string{}, []string{"iptool"}, false},
+		{"Timeouts", "mtu: 1400\npmtu: true\nlog: debug\niptool: /bin/ip\ntimeouts:\n  shutdown: 10s\n", []string{"timeouts"}, []string{}, false},
+		{"Bad log level", "mtu: 1300\nlog: verbose\n", nil, nil, true},
+		{"Bad config", "mtu: [", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ioutil.WriteFile(configFile, []byte(tt.config), 0600)
+			applied, restart, err := d.reload()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Daemon.reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(applied, tt.wantApplied) {
+				t.Errorf("Daemon.reload() applied = %v, want %v", applied, tt.wantApplied)
+			}
+			if !reflect.DeepEqual(restart, tt.wantRestart) {
+				t.Errorf("Daemon.reload() restart = %v, want %v", restart, tt.wantRestart)
+			}
+		})
+	}
+	if ptp.GlobalMTU != 1400 || !ptp.UsePMTU || ptp.MinLogLevel() != ptp.Debug || shutdownTimeout != 10*time.Second {
+		t.Errorf("Invalid configuration was applied")
+	}
+}
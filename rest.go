@@ -1,24 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 
+	"github.com/subutai-io/p2p/client"
 	ptp "github.com/subutai-io/p2p/lib"
 )
 
-var (
-	errorFailedToMarshal           = errors.New("Failed to marshal JSON request")
-	errorFailedToCreatePOSTRequest = errors.New("Failed to create POST request")
-	errorFailedToExecuteRequest    = errors.New("Failed to execute request")
-)
-
 type request struct {
 	IP         string `json:"ip"`
 	Mac        string `json:"mac"`
@@ -34,6 +28,7 @@ type request struct {
 	All        bool   `json:"all"`        // Used for show request
 	Bind       bool   `json:"bind"`       // Used for show request
 	MTU        bool   `json:"mtu"`        // Used for MTU show request
+	Keys       bool   `json:"keys"`       // Used for show request
 }
 
 type RESTResponse struct {
@@ -54,64 +49,60 @@ func setupRESTHandlers(port int, d *Daemon) {
 	http.HandleFunc("/rest/v1/status", d.execRESTStatus)
 	http.HandleFunc("/rest/v1/debug", d.execRESTDebug)
 	http.HandleFunc("/rest/v1/set", d.execRESTSet)
-
-	go func() {
-		err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-		if err != nil {
-			fmt.Printf("Failed to start HTTP listener: %s", err)
-			os.Exit(98)
-		}
-	}()
-}
-
-func sendRequest(port int, command string, args *DaemonArgs) (*RESTResponse, error) {
-	data, err := json.Marshal(args)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal request: %s", err)
+	http.HandleFunc("/rest/v1/enable", d.execRESTEnable)
+	http.HandleFunc("/rest/v1/disable", d.execRESTDisable)
+	http.HandleFunc("/rest/v1/reload", d.execRESTReload)
+	http.HandleFunc("/rest/v1/apply", d.execRESTApply)
+
+	http.HandleFunc("/v1/instance", d.apiInstance)
+	http.HandleFunc("/v1/swarm", d.apiSwarm)
+	http.HandleFunc("/v1/daemon", d.apiDaemon)
+	http.HandleFunc("/v1/debug", d.apiDebug)
+	http.HandleFunc("/v1/events", d.apiEvents)
+
+	conf := new(ptp.Conf)
+	conf.SetDefaults()
+	if d.settings != nil && d.settings.conf != nil {
+		conf = d.settings.conf
 	}
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/rest/v1/%s", port, command), bytes.NewBuffer(data))
+	err := serveControl(port, conf.Control, http.DefaultServeMux)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create request: %s", err)
+		ptp.Log(ptp.Error, "Failed to start management API: %s", err)
+		os.Exit(98)
 	}
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// exitWithResult prints result of daemon command and exits with its code
+func exitWithResult(message string, err error) {
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't execute command. Check if p2p daemon is running.")
+		exitWithError(err)
 	}
-	defer resp.Body.Close()
-
-	body, _ := ioutil.ReadAll(resp.Body)
-	out := &RESTResponse{}
-	err = json.Unmarshal(body, out)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal response: %s", err)
+	if structuredOutput() {
+		exitWithOutput(&outputMessage{Message: strings.TrimSpace(message)})
 	}
-	return out, nil
+	fmt.Println(message)
+	os.Exit(0)
 }
 
-func sendRequestRaw(port int, command string, r *request) ([]byte, error) {
-	data, err := json.Marshal(r)
-	if err != nil {
-		ptp.Log(ptp.Error, "%s: %s", errorFailedToMarshal, err)
-		return nil, errorFailedToMarshal
-	}
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/rest/v1/%s", port, command), bytes.NewBuffer(data))
-	if err != nil {
-		ptp.Log(ptp.Error, "%s: %s", errorFailedToCreatePOSTRequest, err)
-		return nil, errorFailedToCreatePOSTRequest
+// exitWithError prints error of daemon command and exits with its code.
+// Code is 1 when request didn't reach daemon
+func exitWithError(err error) {
+	e, ok := err.(*client.Error)
+	if !ok || e.Code == 0 {
+		exitWithCode(1, err.Error())
 	}
+	exitWithCode(e.Code, e.Message)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		ptp.Log(ptp.Error, "%s. Check if p2p daemon is running", errorFailedToExecuteRequest)
-		return nil, errorFailedToExecuteRequest
+// exitWithCode prints error and exits with specified code. JSON and YAML
+// errors are printed to stdout as ErrorOutput
+func exitWithCode(code int, message string) {
+	if outputFormat == OutputJSON || outputFormat == OutputYAML {
+		writeOutput(os.Stdout, outputFormat, &ErrorOutput{Error: strings.TrimSpace(message), Code: code})
+	} else {
+		fmt.Fprintln(os.Stderr, message)
 	}
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	os.Exit(code)
 }
 
 func getJSON(body io.ReadCloser, args *DaemonArgs) error {
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// Resources of REST API described in rest/swagger.yml. Errors are
+// returned as ErrorOutput with HTTP status code and exit code of the
+// same command of CLI
+
+type apiInterface struct {
+	Name string `json:"name,omitempty"`
+	IP   string `json:"ip,omitempty"`
+	Mac  string `json:"mac,omitempty"`
+}
+
+type apiKey struct {
+	Key     string `json:"key,omitempty"`
+	Keyfile string `json:"keyfile,omitempty"`
+	KDF     string `json:"kdf,omitempty"`
+	Until   string `json:"until,omitempty"`
+}
+
+type apiInstance struct {
+	Hash      string        `json:"hash"`
+	Interface *apiInterface `json:"interface,omitempty"`
+	Port      string        `json:"port,omitempty"`
+	Fwd       bool          `json:"fwd,omitempty"`
+	MTU       int           `json:"mtu,omitempty"`
+	Key       *apiKey       `json:"key,omitempty"`
+}
+
+type apiProxy struct {
+	Addr     string `json:"addr"`
+	Endpoint string `json:"endpoint"`
+}
+
+type apiPeer struct {
+	ID           string        `json:"id"`
+	State        string        `json:"state"`
+	RState       string        `json:"rstate"`
+	Interface    *apiInterface `json:"interface"`
+	Endpoint     string        `json:"endpoint"`
+	EndpointPool []string      `json:"endpoint_pool"`
+	EndpointList []string      `json:"endpoint_list"`
+}
+
+type apiInstanceDetails struct {
+	ID        string        `json:"id"`
+	Hash      string        `json:"hash"`
+	Interface *apiInterface `json:"interface"`
+	Port      int           `json:"port"`
+	Proxies   []apiProxy    `json:"proxies"`
+	Peers     []apiPeer     `json:"peers"`
+}
+
+type apiDHT struct {
+	Endpoint string `json:"endpoint"`
+	Rx       uint64 `json:"rx"`
+	Tx       uint64 `json:"tx"`
+}
+
+type apiDaemon struct {
+	Version string   `json:"version"`
+	Build   string   `json:"build"`
+	OS      string   `json:"os"`
+	DHT     []apiDHT `json:"dht"`
+	Uptime  string   `json:"uptime"`
+}
+
+type apiLog struct {
+	Level string `json:"level"`
+}
+
+// apiDebug is a debug information of daemon. Uptime is in seconds and
+// latencies are in milliseconds
+type apiDebug struct {
+	Version    string             `json:"version"`
+	Build      string             `json:"build"`
+	Uptime     int64              `json:"uptime"`
+	Goroutines int                `json:"goroutines"`
+	PMTU       bool               `json:"pmtu"`
+	Degraded   bool               `json:"degraded"` // No active bootstrap nodes
+	Bootstrap  []apiDebugNode     `json:"bootstrap"`
+	Instances  []apiDebugInstance `json:"instances"`
+}
+
+type apiDebugNode struct {
+	Endpoint      string `json:"endpoint"`
+	Rx            uint64 `json:"rx"`
+	Tx            uint64 `json:"tx"`
+	Version       string `json:"version"`
+	PacketVersion string `json:"packet_version"`
+	Framing       int    `json:"framing"`
+	TLS           string `json:"tls"`
+	Connected     bool   `json:"connected"`
+}
+
+type apiDebugInstance struct {
+	Hash      string          `json:"hash"`
+	ID        string          `json:"id"`
+	Port      int             `json:"port"`
+	LocalIPs  []string        `json:"local_ips"`
+	Interface *apiInterface   `json:"interface"`
+	Proxies   []apiDebugProxy `json:"proxies"`
+	Peers     []apiDebugPeer  `json:"peers"`
+}
+
+type apiDebugProxy struct {
+	Addr    string `json:"addr"`
+	Port    int    `json:"port"` // Port binded for instance
+	Latency int64  `json:"latency"`
+}
+
+type apiDebugEndpoint struct {
+	Addr    string `json:"addr"`
+	Latency int64  `json:"latency"`
+}
+
+// apiDebugPeer is a peer of instance. Endpoints and stats are available
+// when peer has IP and MAC
+type apiDebugPeer struct {
+	ID          string             `json:"id"`
+	State       string             `json:"state"`
+	RemoteState string             `json:"rstate"`
+	Encryption  *apiDebugCrypto    `json:"encryption,omitempty"`
+	IP          string             `json:"ip"`
+	Mac         string             `json:"mac"`
+	Endpoint    string             `json:"endpoint,omitempty"`
+	Endpoints   []apiDebugEndpoint `json:"endpoints,omitempty"`
+	Stats       *apiDebugStats     `json:"stats,omitempty"`
+	Pool        []string           `json:"endpoint_pool"`
+}
+
+type apiDebugCrypto struct {
+	Send     string `json:"send"`
+	Recv     string `json:"recv"`
+	Sessions int    `json:"sessions"`
+	Rejected uint64 `json:"rejected"`
+}
+
+type apiDebugStats struct {
+	Connections       int `json:"connections"`
+	Reconnects        int `json:"reconnects"`
+	HolePunches       int `json:"hole_punches"`
+	ConnectionDelta   int `json:"connection_delta"`
+	ReconnectionDelta int `json:"reconnection_delta"`
+}
+
+var errEmptyBody = errors.New("Request body is empty")
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if v == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status, code int, format string, v ...interface{}) {
+	writeJSON(w, status, &ErrorOutput{
+		Error: fmt.Sprintf(format, v...),
+		Code:  code,
+	})
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, 1, "Method %s is not allowed", r.Method)
+}
+
+// apiReady writes error and returns false when daemon can't serve requests
+func apiReady(w http.ResponseWriter) bool {
+	if !ReadyToServe {
+		writeError(w, http.StatusServiceUnavailable, 105, "P2P Daemon is in initialization state")
+		return false
+	}
+	return true
+}
+
+// decodeBody reads JSON body. Unknown fields are rejected
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == io.EOF {
+		return errEmptyBody
+	}
+	return err
+}
+
+// requireHash returns hash query parameter or writes error
+func requireHash(w http.ResponseWriter, r *http.Request) (string, bool) {
+	hash := r.URL.Query().Get("hash")
+	if hash == "" {
+		writeError(w, http.StatusBadRequest, 1, "Hash is not specified")
+		return "", false
+	}
+	return hash, true
+}
+
+func (d *Daemon) apiInstance(w http.ResponseWriter, r *http.Request) {
+	if !apiReady(w) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		d.apiListInstances(w, r)
+	case http.MethodPost:
+		d.apiCreateInstance(w, r)
+	case http.MethodDelete:
+		d.apiCloseInstance(w, r)
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (d *Daemon) apiListInstances(w http.ResponseWriter, r *http.Request) {
+	list := []apiInstance{}
+	for _, inst := range d.Instances.get() {
+		if inst != nil {
+			list = append(list, newAPIInstance(inst))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hash < list[j].Hash })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (d *Daemon) apiCreateInstance(w http.ResponseWriter, r *http.Request) {
+	if !bootstrap.isConnected() {
+		writeError(w, http.StatusServiceUnavailable, 106, "Not connected to DHT nodes")
+		return
+	}
+	if bootstrap.getIP() == "" {
+		writeError(w, http.StatusServiceUnavailable, 107, "Didn't received outbound IP yet")
+		return
+	}
+	req := new(apiInstance)
+	err := decodeBody(r, req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 1, "Bad request: %s", err)
+		return
+	}
+	args, err := req.daemonArgs()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 1, "%s", err)
+		return
+	}
+	if d.Instances.getInstance(args.Hash) != nil {
+		writeError(w, http.StatusConflict, 119, "Hash already in use")
+		return
+	}
+	resp := new(Response)
+	d.Start(args, resp)
+	if resp.ExitCode != 0 {
+		status := http.StatusBadRequest
+		switch resp.ExitCode {
+		case 119:
+			status = http.StatusConflict
+		case 601, 602, 603:
+			status = http.StatusInternalServerError
+		}
+		writeError(w, status, resp.ExitCode, "%s", strings.TrimSpace(resp.Output))
+		return
+	}
+	inst := d.Instances.getInstance(args.Hash)
+	if inst == nil {
+		writeError(w, http.StatusInternalServerError, 1, "Instance %s was stopped during start", args.Hash)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPIInstance(inst))
+}
+
+func (d *Daemon) apiCloseInstance(w http.ResponseWriter, r *http.Request) {
+	hash, ok := requireHash(w, r)
+	if !ok {
+		return
+	}
+	if d.Instances.getInstance(hash) == nil {
+		writeError(w, http.StatusNotFound, 1, "Instance with hash %s was not found", hash)
+		return
+	}
+	d.Stop(&DaemonArgs{Hash: hash}, new(Response))
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (d *Daemon) apiSwarm(w http.ResponseWriter, r *http.Request) {
+	if !apiReady(w) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
+	}
+	hash, ok := requireHash(w, r)
+	if !ok {
+		return
+	}
+	inst := d.Instances.getInstance(hash)
+	if inst == nil || inst.PTP == nil {
+		writeError(w, http.StatusNotFound, 1, "Instance with hash %s was not found", hash)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, newAPIInstanceDetails(inst))
+		return
+	}
+
+	req := new(apiKey)
+	err := decodeBody(r, req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 1, "Bad request: %s", err)
+		return
+	}
+	keys, err := req.cryptoKeys(inst)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 1, "%s", err)
+		return
+	}
+	for _, key := range keys {
+		inst.PTP.Crypter.AddKey(key)
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (d *Daemon) apiDaemon(w http.ResponseWriter, r *http.Request) {
+	if !apiReady(w) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		info := &apiDaemon{
+			Version: AppVersion,
+			Build:   BuildID,
+			OS:      runtime.GOOS,
+			DHT:     []apiDHT{},
+			Uptime:  time.Since(StartTime).Truncate(time.Second).String(),
+		}
+		for _, node := range bootstrap.getRouters() {
+			if node == nil || node.addr == nil {
+				continue
+			}
+			stats := node.stats()
+			info.DHT = append(info.DHT, apiDHT{
+				Endpoint: node.addr.String(),
+				Rx:       stats.rx,
+				Tx:       stats.tx,
+			})
+		}
+		writeJSON(w, http.StatusOK, info)
+	case http.MethodPost:
+		req := new(apiLog)
+		err := decodeBody(r, req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, 1, "Bad request: %s", err)
+			return
+		}
+		level := strings.ToLower(req.Level)
+		if !isLogLevel(level) {
+			writeError(w, http.StatusBadRequest, 1, "Unknown log level %s", req.Level)
+			return
+		}
+		ptp.SetMinLogLevelString(level)
+		ptp.Log(ptp.Info, "Logging level has switched to %s level", level)
+		writeJSON(w, http.StatusOK, &apiLog{Level: level})
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (d *Daemon) apiDebug(w http.ResponseWriter, r *http.Request) {
+	if !apiReady(w) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.debugInfo())
+}
+
+// daemonArgs validates request and converts it to arguments of start
+func (i *apiInstance) daemonArgs() (*DaemonArgs, error) {
+	if i.Hash == "" {
+		return nil, errors.New("Hash is not specified")
+	}
+	if strings.Contains(i.Hash, "~") {
+		return nil, errors.New("Hash cannot contain the ~")
+	}
+	args := &DaemonArgs{
+		Hash:         i.Hash,
+		Fwd:          i.Fwd,
+		InterfaceMTU: i.MTU,
+	}
+	if i.Interface != nil {
+		if i.Interface.Mac != "" {
+			if _, err := net.ParseMAC(i.Interface.Mac); err != nil {
+				return nil, fmt.Errorf("Invalid MAC address %s", i.Interface.Mac)
+			}
+		}
+		args.IP = i.Interface.IP
+		args.Mac = i.Interface.Mac
+		args.Dev = i.Interface.Name
+	}
+	if i.Port != "" {
+		if strings.Contains(i.Port, "-") {
+			return nil, errors.New("Port ranges are not supported")
+		}
+		port, err := strconv.Atoi(i.Port)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("Bad port %s", i.Port)
+		}
+		args.Port = port
+	}
+	if i.MTU != 0 && (i.MTU < 576 || i.MTU > 65535) {
+		return nil, fmt.Errorf("MTU %d is out of range 576-65535", i.MTU)
+	}
+	if i.Key != nil {
+		args.Key = i.Key.Key
+		args.Keyfile = i.Key.Keyfile
+		args.KDF = i.Key.KDF
+		args.TTL = i.Key.Until
+	}
+	return args, nil
+}
+
+// cryptoKeys returns keys of request. Keys are derived from passphrases
+// with swarm hash when KDF is specified in request or instance was started
+// with it. Raw keys are padded the same way as on start
+func (k *apiKey) cryptoKeys(inst *P2PInstance) ([]ptp.CryptoKey, error) {
+	if k.Keyfile != "" {
+		if k.Key != "" {
+			return nil, errors.New("Key and keyfile can't be used together")
+		}
+		return ptp.LoadKeyFile(k.Keyfile, inst.ID)
+	}
+	if k.Key == "" {
+		return nil, errors.New("Key or keyfile is not specified")
+	}
+	spec := k.KDF
+	if spec == "" {
+		spec = inst.Args.KDF
+	}
+	kdf, err := ptp.ParseKDF(spec)
+	if err != nil {
+		return nil, err
+	}
+	key := padKey(inst.ID, k.Key)
+	if kdf.Name != ptp.KDFRaw {
+		derived, err := ptp.DeriveKey(k.Key, inst.ID, kdf)
+		if err != nil {
+			return nil, err
+		}
+		key = string(derived)
+	}
+	return []ptp.CryptoKey{inst.PTP.Crypter.EnrichKeyValues(ptp.CryptoKey{}, key, k.Until)}, nil
+}
+
+func newAPIInterface(inst *P2PInstance) *apiInterface {
+	inf := &apiInterface{}
+	if inst.PTP == nil || inst.PTP.Interface == nil {
+		return inf
+	}
+	inf.Name = inst.PTP.Interface.GetName()
+	if ip := inst.PTP.Interface.GetIP(); ip != nil {
+		inf.IP = ip.String()
+	}
+	if mac := inst.PTP.Interface.GetHardwareAddress(); mac != nil {
+		inf.Mac = mac.String()
+	}
+	return inf
+}
+
+// newAPIInstance returns instance without keys
+func newAPIInstance(inst *P2PInstance) apiInstance {
+	i := apiInstance{
+		Hash:      inst.ID,
+		Interface: newAPIInterface(inst),
+		Fwd:       inst.Args.Fwd,
+		MTU:       inst.Args.MTU,
+	}
+	if inst.PTP != nil && inst.PTP.UDPSocket != nil {
+		i.Port = strconv.Itoa(inst.PTP.UDPSocket.GetPort())
+	}
+	return i
+}
+
+func newAPIInstanceDetails(inst *P2PInstance) *apiInstanceDetails {
+	details := &apiInstanceDetails{
+		Hash:      inst.ID,
+		Interface: newAPIInterface(inst),
+		Proxies:   []apiProxy{},
+		Peers:     []apiPeer{},
+	}
+	if inst.PTP.Dht != nil {
+		details.ID = inst.PTP.Dht.ID
+	}
+	if inst.PTP.UDPSocket != nil {
+		details.Port = inst.PTP.UDPSocket.GetPort()
+	}
+	if inst.PTP.ProxyManager != nil {
+		for _, proxy := range inst.PTP.ProxyManager.GetList() {
+			if proxy.Addr == nil || proxy.Endpoint == nil {
+				continue
+			}
+			details.Proxies = append(details.Proxies, apiProxy{
+				Addr:     proxy.Addr.String(),
+				Endpoint: proxy.Endpoint.String(),
+			})
+		}
+	}
+	if inst.PTP.Swarm == nil {
+		return details
+	}
+	for _, peer := range inst.PTP.Swarm.Get() {
+		p := apiPeer{
+			ID:           peer.ID,
+			State:        ptp.StringifyState(peer.State),
+			RState:       ptp.StringifyState(peer.RemoteState),
+			Interface:    &apiInterface{},
+			EndpointPool: []string{},
+			EndpointList: []string{},
+		}
+		if peer.PeerLocalIP != nil {
+			p.Interface.IP = peer.PeerLocalIP.String()
+		}
+		if peer.PeerHW != nil {
+			p.Interface.Mac = peer.PeerHW.String()
+		}
+		if peer.Endpoint != nil {
+			p.Endpoint = peer.Endpoint.String()
+		}
+		for _, addr := range append(append([]*net.UDPAddr{}, peer.KnownIPs...), peer.Proxies...) {
+			p.EndpointPool = append(p.EndpointPool, addr.String())
+		}
+		for _, ep := range peer.EndpointsHeap {
+			if ep.Addr != nil {
+				p.EndpointList = append(p.EndpointList, ep.Addr.String())
+			}
+		}
+		details.Peers = append(details.Peers, p)
+	}
+	return details
+}
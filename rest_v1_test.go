@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestDaemon_api(t *testing.T) {
+	ready := ReadyToServe
+	defer func() { ReadyToServe = ready }()
+
+	d := new(Daemon)
+	d.Instances = new(InstanceList)
+	d.Instances.init()
+	d.Restore = new(Restore)
+
+	tests := []struct {
+		name    string
+		ready   bool
+		handler http.HandlerFunc
+		method  string
+		url     string
+		body    string
+		want    int
+		wantErr int
+	}{
+		{"Not ready", false, d.apiInstance, "GET", "/v1/instance", "", http.StatusServiceUnavailable, 105},
+		{"List instances", true, d.apiInstance, "GET", "/v1/instance", "", http.StatusOK, 0},
+		{"Bad method", true, d.apiInstance, "PUT", "/v1/instance", "", http.StatusMethodNotAllowed, 1},
+		{"Delete without hash", true, d.apiInstance, "DELETE", "/v1/instance", "", http.StatusBadRequest, 1},
+		{"Delete unknown", true, d.apiInstance, "DELETE", "/v1/instance?hash=unknown", "", http.StatusNotFound, 1},
+		{"Swarm unknown", true, d.apiSwarm, "GET", "/v1/swarm?hash=unknown", "", http.StatusNotFound, 1},
+		{"Swarm bad method", true, d.apiSwarm, "DELETE", "/v1/swarm?hash=unknown", "", http.StatusMethodNotAllowed, 1},
+		{"Daemon info", true, d.apiDaemon, "GET", "/v1/daemon", "", http.StatusOK, 0},
+		{"Debug info", true, d.apiDebug, "GET", "/v1/debug", "", http.StatusOK, 0},
+		{"Debug bad method", true, d.apiDebug, "POST", "/v1/debug", "", http.StatusMethodNotAllowed, 1},
+		{"Events bad method", true, d.apiEvents, "POST", "/v1/events", "", http.StatusMethodNotAllowed, 1},
+		{"Log level", true, d.apiDaemon, "POST", "/v1/daemon", `{"level":"INFO"}`, http.StatusOK, 0},
+		{"Bad log level", true, d.apiDaemon, "POST", "/v1/daemon", `{"level":"verbose"}`, http.StatusBadRequest, 1},
+		{"Unknown field", true, d.apiDaemon, "POST", "/v1/daemon", `{"lvl":"info"}`, http.StatusBadRequest, 1},
+		{"Empty body", true, d.apiDaemon, "POST", "/v1/daemon", "", http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ReadyToServe = tt.ready
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("%s %s status = %d, want %d: %s", tt.method, tt.url, w.Code, tt.want, w.Body.String())
+			}
+			if tt.wantErr == 0 {
+				return
+			}
+			out := new(ErrorOutput)
+			err := json.Unmarshal(w.Body.Bytes(), out)
+			if err != nil || out.Code != tt.wantErr || out.Error == "" {
+				t.Errorf("%s %s error = %s, want code %d", tt.method, tt.url, w.Body.String(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAPIInstance_daemonArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     apiInstance
+		want    DaemonArgs
+		wantErr bool
+	}{
+		{"Minimal", apiInstance{Hash: "swarm"}, DaemonArgs{Hash: "swarm"}, false},
+		{"Full", apiInstance{
+			Hash:      "swarm",
+			Interface: &apiInterface{Name: "p2p1", IP: "10.10.10.1", Mac: "06:00:00:00:00:01"},
+			Port:      "6000",
+			MTU:       1400,
+			Key:       &apiKey{Key: "passphrase", KDF: "scrypt", Until: "1700000000"},
+		}, DaemonArgs{Hash: "swarm", Dev: "p2p1", IP: "10.10.10.1", Mac: "06:00:00:00:00:01", Port: 6000, InterfaceMTU: 1400, Key: "passphrase", KDF: "scrypt", TTL: "1700000000"}, false},
+		{"No hash", apiInstance{}, DaemonArgs{}, true},
+		{"Bad MAC", apiInstance{Hash: "swarm", Interface: &apiInterface{Mac: "06:00"}}, DaemonArgs{}, true},
+		{"Port range", apiInstance{Hash: "swarm", Port: "6000-6100"}, DaemonArgs{}, true},
+		{"Bad MTU", apiInstance{Hash: "swarm", MTU: 100}, DaemonArgs{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.req.daemonArgs()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apiInstance.daemonArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("apiInstance.daemonArgs() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIKey_cryptoKeys(t *testing.T) {
+	scrypt, _ := ptp.ParseKDF("scrypt:n=1024")
+	derived, _ := ptp.DeriveKey("passphrase", "swarm", scrypt)
+	tests := []struct {
+		name    string
+		kdf     string
+		req     apiKey
+		want    string
+		wantErr bool
+	}{
+		{"Raw key", "", apiKey{Key: "0123456789abcdef"}, "0123456789abcdef", false},
+		{"Short raw key", "", apiKey{Key: "short"}, "short00000000000", false},
+		{"Passphrase swarm", "scrypt:n=1024", apiKey{Key: "passphrase"}, string(derived), false},
+		{"KDF of request", "", apiKey{Key: "passphrase", KDF: "scrypt:n=1024"}, string(derived), false},
+		{"Bad KDF", "", apiKey{Key: "passphrase", KDF: "pbkdf2"}, "", true},
+		{"No key", "", apiKey{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inst := &P2PInstance{ID: "swarm", Args: RunArgs{KDF: tt.kdf}, PTP: new(ptp.PeerToPeer)}
+			got, err := tt.req.cryptoKeys(inst)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apiKey.cryptoKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (len(got) != 1 || string(got[0].Key) != tt.want) {
+				t.Errorf("apiKey.cryptoKeys() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
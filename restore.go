@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,25 +20,47 @@ import (
 // This class keeps a list of so-called "save entries", which is
 // a binding for instance information
 // Restore system saves entries in a YAML-formatted save file, specified
-// as an argument on daemon launch using `--save`
+// as an argument on daemon launch using `--save`. File is replaced
+// atomically on every save. Older formats are migrated on load
 type Restore struct {
 	entries  []saveEntry
 	filepath string
 	lock     sync.RWMutex
 	active   bool
+	sealer   *saveSealer // Encrypts keys. Keys are saved in plain text when nil
 }
 
-// saveEntry is a YAML binding for data save file
+// saveFileVersion is a version of save file schema. Versions:
+//
+//	0 - gob or `~`-separated list
+//	1 - YAML list of entries
+//	2 - YAML document with version and every instance argument
+const saveFileVersion = 2
+
+// saveDocument is a YAML binding for data save file
+type saveDocument struct {
+	Version   int         `yaml:"version"`
+	Instances []saveEntry `yaml:"instances"`
+}
+
+// saveEntry is a YAML binding for a single instance in data save file
 type saveEntry struct {
 	IP          string `yaml:"ip"`
 	Mac         string `yaml:"mac"`
 	Dev         string `yaml:"dev"`
 	Hash        string `yaml:"hash"`
+	Dht         string `yaml:"dht"`
 	Keyfile     string `yaml:"keyfile"`
 	Key         string `yaml:"key"`
+	KDF         string `yaml:"kdf,omitempty"`
 	TTL         string `yaml:"ttl"`
+	Fwd         bool   `yaml:"fwd"`
+	Port        int    `yaml:"port"`
+	MTU         int    `yaml:"mtu,omitempty"`
+	Source      string `yaml:"source,omitempty"` // Definition file of instance managed by instances directory
 	LastSuccess string `yaml:"last_success"`
-	Enabled     bool
+	LastError   string `yaml:"last_error,omitempty"` // Error of the last restore attempt
+	Enabled     bool   `yaml:"enabled"`              // Disabled instances are kept, but not restored
 }
 
 // init will initialize restore subsystem by checking if
@@ -46,7 +70,7 @@ func (r *Restore) init(filepath string) error {
 		r.active = false
 		return nil
 	}
-	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_RDWR, 0700)
+	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return err
 	}
@@ -56,29 +80,59 @@ func (r *Restore) init(filepath string) error {
 	return nil
 }
 
-// save will write dump of entries into a save file
+// initSecrets enables encryption of keys in the save file
+func (r *Restore) initSecrets(keyPath string) error {
+	sealer, err := newSaveSealer(keyPath)
+	if err != nil {
+		return err
+	}
+	r.sealer = sealer
+	return nil
+}
+
+// save will write dump of entries into a save file. Data is written into
+// a temporary file, which replaces save file when it's flushed to disk
 func (r *Restore) save() error {
 	if r.filepath == "" {
 		return nil
 	}
 	r.lock.Lock()
-	file, err := os.OpenFile(r.filepath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0700)
+	defer r.lock.Unlock()
+	data, err := r.encode()
 	if err != nil {
-		r.lock.Unlock()
 		return err
 	}
-	data, err := r.encode()
+	ptp.Log(ptp.Info, "Saving instances")
+	dir, name := filepath.Split(r.filepath)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := ioutil.TempFile(dir, name+".tmp")
 	if err != nil {
-		r.lock.Unlock()
 		return err
 	}
-	ptp.Log(ptp.Info, "Saving instances")
 	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Chmod(0600)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), r.filepath)
+	}
 	if err != nil {
-		r.lock.Unlock()
+		os.Remove(file.Name())
 		return err
 	}
-	r.lock.Unlock()
+	// Persist rename. Not supported on every platform
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
 	return nil
 }
 
@@ -95,15 +149,29 @@ func (r *Restore) load() error {
 	}
 	r.lock.Unlock()
 	data = bytes.Trim(data, "\x00") // TODO: add more security to this
-	if len(data) == 0 {
+	if len(bytes.TrimSpace(data)) == 0 {
 		return nil
 	}
-	if string(data[0]) == "-" || string(data[0]) == "[" {
-		r.decode(data)
+	if isYAMLSaveFile(data) {
+		err = r.decode(data)
+		if err != nil {
+			ptp.Log(ptp.Error, "Failed to decode save file %s: %s", r.filepath, err)
+		}
 		return nil
 	}
 	// TODO: This code is deprecated and must be removed in version 9
-	return r.decodeInstances(data)
+	err = r.decodeInstances(data)
+	if err != nil {
+		return err
+	}
+	ptp.Log(ptp.Info, "Migrating save file from legacy format to version %d", saveFileVersion)
+	return r.save()
+}
+
+// isYAMLSaveFile returns true if data is a YAML list or a versioned document
+func isYAMLSaveFile(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return data[0] == '-' || data[0] == '[' || bytes.HasPrefix(data, []byte("version:")) || bytes.HasPrefix(data, []byte("instances:"))
 }
 
 // addInstance will create new save file entry from instance
@@ -114,9 +182,15 @@ func (r *Restore) addInstance(inst *P2PInstance) error {
 		Mac:         inst.Args.Mac,
 		Dev:         inst.Args.Dev,
 		Hash:        inst.Args.Hash,
+		Dht:         inst.Args.Dht,
 		Keyfile:     inst.Args.Keyfile,
 		Key:         inst.Args.Key,
+		KDF:         inst.Args.KDF,
 		TTL:         inst.Args.TTL,
+		Fwd:         inst.Args.Fwd,
+		Port:        inst.Args.Port,
+		MTU:         inst.Args.MTU,
+		Source:      inst.Args.Source,
 		LastSuccess: string(ls),
 		Enabled:     true,
 	})
@@ -148,6 +222,65 @@ func (r *Restore) removeEntry(hash string) error {
 	return fmt.Errorf("Can't delete save entry: %s not found", hash)
 }
 
+// setEnabled will mark save entry as enabled or disabled
+func (r *Restore) setEnabled(hash string, enabled bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, e := range r.entries {
+		if e.Hash == hash {
+			r.entries[i].Enabled = enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("Instance %s is not in list of saved entries", hash)
+}
+
+// setLastError will record result of the last restore attempt
+func (r *Restore) setLastError(hash string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, e := range r.entries {
+		if e.Hash == hash {
+			r.entries[i].LastError = ""
+			if err != nil {
+				r.entries[i].LastError = err.Error()
+			}
+			return
+		}
+	}
+}
+
+// getEntry returns save entry with specified hash
+func (r *Restore) getEntry(hash string) (saveEntry, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, e := range r.entries {
+		if e.Hash == hash {
+			return e, true
+		}
+	}
+	return saveEntry{}, false
+}
+
+// runArgs returns arguments used to start instance of a save entry
+func (e saveEntry) runArgs() *RunArgs {
+	return &RunArgs{
+		IP:      e.IP,
+		Mac:     e.Mac,
+		Dev:     e.Dev,
+		Hash:    e.Hash,
+		Dht:     e.Dht,
+		Keyfile: e.Keyfile,
+		Key:     e.Key,
+		KDF:     e.KDF,
+		TTL:     e.TTL,
+		Fwd:     e.Fwd,
+		Port:    e.Port,
+		MTU:     e.MTU,
+		Source:  e.Source,
+	}
+}
+
 func (r *Restore) bumpInstance(hash string) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -182,16 +315,19 @@ func (r *Restore) disableStaleInstances(inst *P2PInstance) error {
 	return nil
 }
 
-// encode will generate YAML
+// encode will generate YAML document of the current version. Must be
+// called under lock
 func (r *Restore) encode() ([]byte, error) {
-	if len(r.entries) == 0 {
-		return nil, nil
-	}
-	var data []saveEntry
+	data := saveDocument{Version: saveFileVersion, Instances: []saveEntry{}}
 	for _, e := range r.entries {
-		if e.Enabled {
-			data = append(data, e)
+		if r.sealer != nil && e.Key != "" && !isSealed(e.Key) {
+			sealed, err := r.sealer.seal(e.Key, e.Hash)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to encrypt key of %s: %s", e.Hash, err)
+			}
+			e.Key = sealed
 		}
+		data.Instances = append(data.Instances, e)
 	}
 	output, err := yaml.Marshal(data)
 	if err != nil {
@@ -200,19 +336,65 @@ func (r *Restore) encode() ([]byte, error) {
 	return output, nil
 }
 
-// decode will accept YAML and generate a slice of RunArgs
+// decode will accept YAML document or a list of entries of version 1.
+// Save file is rewritten when it was created by older version or contains
+// keys in plain text
 func (r *Restore) decode(data []byte) error {
-	var saved []saveEntry
+	var saved saveDocument
 	err := yaml.Unmarshal(data, &saved)
 	if err != nil {
-		return err
+		// Version 1 is a plain list of entries
+		saved = saveDocument{Version: 1}
+		err = yaml.Unmarshal(data, &saved.Instances)
+		if err != nil {
+			return err
+		}
+	}
+	if saved.Version > saveFileVersion {
+		return fmt.Errorf("Save file version %d is not supported. Latest supported version is %d", saved.Version, saveFileVersion)
 	}
+	plain := r.unseal(saved.Instances)
 	r.lock.Lock()
-	r.entries = saved
+	r.entries = saved.Instances
 	r.lock.Unlock()
+	if saved.Version < saveFileVersion {
+		ptp.Log(ptp.Info, "Migrating save file from version %d to %d", saved.Version, saveFileVersion)
+		return r.save()
+	}
+	if plain > 0 && r.sealer != nil {
+		ptp.Log(ptp.Info, "Encrypting %d keys stored in save file as plain text", plain)
+		return r.save()
+	}
 	return nil
 }
 
+// unseal decrypts keys of entries and returns number of keys stored in
+// plain text. Keys that can't be decrypted are kept as is, so they are not
+// lost on the next save
+func (r *Restore) unseal(entries []saveEntry) int {
+	plain := 0
+	for i, e := range entries {
+		if e.Key == "" {
+			continue
+		}
+		if !isSealed(e.Key) {
+			plain++
+			continue
+		}
+		if r.sealer == nil {
+			ptp.Log(ptp.Error, "Key of %s in save file is encrypted, but no secret is configured", e.Hash)
+			continue
+		}
+		key, err := r.sealer.open(e.Key, e.Hash)
+		if err != nil {
+			ptp.Log(ptp.Error, "Failed to decrypt key of %s in save file: %s", e.Hash, err)
+			continue
+		}
+		entries[i].Key = key
+	}
+	return plain
+}
+
 // decodeInstances is an obsolet variant of instances unmarshal
 // TODO: Remove in version 10
 func (r *Restore) decodeInstances(data []byte) error {
@@ -246,7 +428,7 @@ func (r *Restore) decodeInstances(data []byte) error {
 			item.Mac = string(blocksOfArguments[1])
 			item.Dev = string(blocksOfArguments[2])
 			item.Hash = string(blocksOfArguments[3])
-			//item.Dht = string(blocksOfArguments[4])
+			item.Dht = string(blocksOfArguments[4])
 			item.Keyfile = string(blocksOfArguments[5])
 			item.Key = string(blocksOfArguments[6])
 			item.TTL = string(blocksOfArguments[7])
@@ -255,14 +437,11 @@ func (r *Restore) decodeInstances(data []byte) error {
 			item.Enabled = true
 			ls, _ := time.Now().MarshalText()
 			item.LastSuccess = string(ls)
-			//item.Fwd = false
-			// if string(blocksOfArguments[8]) == "1" {
-			// 	item.Fwd = true
-			// }
-			//item.Port, err = strconv.Atoi(string(blocksOfArguments[9]))
-			// if err != nil {
-			// 	return fmt.Errorf("Couldn't decode the Port: %v", err)
-			// }
+			item.Fwd = string(blocksOfArguments[8]) == "1"
+			item.Port, err = strconv.Atoi(string(blocksOfArguments[9]))
+			if err != nil {
+				return fmt.Errorf("Couldn't decode the Port: %v", err)
+			}
 			args = append(args, item)
 		}
 	}
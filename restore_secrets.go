@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	ptp "github.com/subutai-io/p2p/lib"
+	"golang.org/x/crypto/argon2"
+)
+
+// Keys in the save file are encrypted with AES-256-GCM. Encryption key is
+// derived from a passphrase in P2P_SAVE_PASSPHRASE environment variable or
+// is read from a machine key file, which is created on first use. Encrypted
+// value has the following format:
+//
+//	enc:v1:k:<base64(nonce|ciphertext)>                 - machine key
+//	enc:v1:p:<base64(salt)>:<base64(nonce|ciphertext)>  - passphrase
+const (
+	savePassphraseEnv = "P2P_SAVE_PASSPHRASE"
+	saveSecretPrefix  = "enc:v1:"
+	saveKeySize       = 32
+	saveSaltSize      = 16
+)
+
+// saveSealer encrypts secrets stored in the save file
+type saveSealer struct {
+	kind       string                 // k for machine key, p for passphrase
+	aead       cipher.AEAD            // Cipher of machine key or of passphrase with salt
+	salt       []byte                 // Salt used for new passphrase secrets
+	passphrase string                 // Passphrase
+	derived    map[string]cipher.AEAD // Ciphers of passphrase by salt
+}
+
+// newSaveSealer creates sealer from environment passphrase or from machine
+// key file. Key file is generated when it doesn't exist
+func newSaveSealer(keyPath string) (*saveSealer, error) {
+	if passphrase := os.Getenv(savePassphraseEnv); passphrase != "" {
+		s := &saveSealer{
+			kind:       "p",
+			passphrase: passphrase,
+			salt:       make([]byte, saveSaltSize),
+			derived:    make(map[string]cipher.AEAD),
+		}
+		_, err := rand.Read(s.salt)
+		if err != nil {
+			return nil, err
+		}
+		s.aead, err = s.cipherFor(s.salt)
+		return s, err
+	}
+
+	key, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key = make([]byte, saveKeySize)
+		_, err = rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(keyPath, key, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create machine key %s: %s", keyPath, err)
+		}
+		ptp.Log(ptp.Info, "Created machine key %s for save file secrets", keyPath)
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read machine key %s: %s", keyPath, err)
+	}
+	if len(key) != saveKeySize {
+		return nil, fmt.Errorf("Machine key %s must be %d bytes long", keyPath, saveKeySize)
+	}
+	s := &saveSealer{kind: "k"}
+	s.aead, err = newSaveCipher(key)
+	return s, err
+}
+
+func newSaveCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *saveSealer) cipherFor(salt []byte) (cipher.AEAD, error) {
+	if c, e := s.derived[string(salt)]; e {
+		return c, nil
+	}
+	c, err := newSaveCipher(argon2.IDKey([]byte(s.passphrase), salt, 3, 64*1024, 4, saveKeySize))
+	if err != nil {
+		return nil, err
+	}
+	s.derived[string(salt)] = c
+	return c, nil
+}
+
+// isSealed returns true if value is encrypted
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, saveSecretPrefix)
+}
+
+// seal encrypts value. Hash of an instance is authenticated, so secrets
+// can't be swapped between entries
+func (s *saveSealer) seal(value, hash string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	data := base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(value), []byte(hash)))
+	if s.kind == "p" {
+		return saveSecretPrefix + "p:" + base64.StdEncoding.EncodeToString(s.salt) + ":" + data, nil
+	}
+	return saveSecretPrefix + "k:" + data, nil
+}
+
+// open decrypts sealed value
+func (s *saveSealer) open(value, hash string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(value, saveSecretPrefix), ":")
+	aead := s.aead
+	encoded := ""
+	switch {
+	case len(parts) == 2 && parts[0] == "k" && s.kind == "k":
+		encoded = parts[1]
+	case len(parts) == 3 && parts[0] == "p" && s.kind == "p":
+		salt, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return "", fmt.Errorf("Bad salt")
+		}
+		aead, err = s.cipherFor(salt)
+		if err != nil {
+			return "", err
+		}
+		encoded = parts[2]
+	case len(parts) > 1 && parts[0] == "p":
+		return "", fmt.Errorf("Secret is protected with a passphrase. Set %s", savePassphraseEnv)
+	case len(parts) > 1 && parts[0] == "k":
+		return "", fmt.Errorf("Secret is protected with a machine key, but %s is set", savePassphraseEnv)
+	default:
+		return "", fmt.Errorf("Unknown secret format")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("Malformed secret")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(hash))
+	if err != nil {
+		return "", fmt.Errorf("Wrong key or corrupted secret")
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+const (
+	defaultRestoreInitialDelay = time.Duration(time.Second * 5)
+	defaultRestoreMaxDelay     = time.Duration(time.Minute * 10)
+	restoreCheckInterval       = time.Duration(time.Second * 1)
+)
+
+// Saved instances that failed to start are retried with exponential
+// backoff. Delay is doubled after every failed attempt up to
+// restoreMaxDelay
+var (
+	restoreInitialDelay = defaultRestoreInitialDelay
+	restoreMaxDelay     = defaultRestoreMaxDelay
+)
+
+// States of instances being restored
+const (
+	RestorePending  = "pending"  // Instance waits for the first attempt
+	RestoreRetrying = "retrying" // Last attempt failed and will be repeated
+	RestoreFailed   = "failed"   // Instance can't be restored without user intervention
+)
+
+// restoreAttempt is a restore state of a single save entry
+type restoreAttempt struct {
+	Hash        string
+	State       string
+	Attempts    int
+	LastAttempt time.Time
+	NextAttempt time.Time
+	LastError   string
+}
+
+// restoreSupervisor starts saved instances and keeps retrying those
+// that failed until they're started, disabled or removed
+type restoreSupervisor struct {
+	attempts map[string]*restoreAttempt
+	restore  *Restore
+	start    func(saveEntry) error // Starts instance of a save entry
+	running  func(string) bool     // Returns true if instance is already running
+	stopped  bool
+	lock     sync.Mutex
+}
+
+func newRestoreSupervisor(restore *Restore, start func(saveEntry) error, running func(string) bool) *restoreSupervisor {
+	return &restoreSupervisor{
+		attempts: make(map[string]*restoreAttempt),
+		restore:  restore,
+		start:    start,
+		running:  running,
+	}
+}
+
+// restoreBackoff returns delay before the next attempt
+func restoreBackoff(attempts int) time.Duration {
+	delay := restoreInitialDelay
+	for i := 1; i < attempts && delay < restoreMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > restoreMaxDelay {
+		delay = restoreMaxDelay
+	}
+	return delay
+}
+
+// add schedules restore of a save entry
+func (s *restoreSupervisor) add(hash string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, e := s.attempts[hash]; e || s.stopped {
+		return
+	}
+	s.attempts[hash] = &restoreAttempt{
+		Hash:  hash,
+		State: RestorePending,
+	}
+}
+
+// remove stops restoring of a save entry
+func (s *restoreSupervisor) remove(hash string) {
+	s.lock.Lock()
+	delete(s.attempts, hash)
+	s.lock.Unlock()
+}
+
+// get returns copy of restore states sorted by hash
+func (s *restoreSupervisor) get() []restoreAttempt {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := []restoreAttempt{}
+	for _, a := range s.attempts {
+		result = append(result, *a)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Hash < result[j].Hash })
+	return result
+}
+
+// stop cancels every scheduled restore
+func (s *restoreSupervisor) stop() {
+	s.lock.Lock()
+	s.stopped = true
+	s.attempts = make(map[string]*restoreAttempt)
+	s.lock.Unlock()
+}
+
+func (s *restoreSupervisor) due(now time.Time) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	hashes := []string{}
+	if s.stopped {
+		return hashes
+	}
+	for hash, a := range s.attempts {
+		if a.State != RestoreFailed && !now.Before(a.NextAttempt) {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func (s *restoreSupervisor) run() {
+	for {
+		s.check(time.Now())
+		time.Sleep(restoreCheckInterval)
+	}
+}
+
+// check starts every save entry that is due and records results
+func (s *restoreSupervisor) check(now time.Time) {
+	for _, hash := range s.due(now) {
+		entry, exists := s.restore.getEntry(hash)
+		if !exists || !entry.Enabled || s.running(hash) {
+			s.remove(hash)
+			continue
+		}
+		var err error
+		retry := true
+		if isSealed(entry.Key) {
+			// Instance would start with a wrong key
+			err = errors.New("Key can't be decrypted")
+			retry = false
+		} else {
+			err = s.start(entry)
+		}
+		if err == nil {
+			ptp.Log(ptp.Info, "Restored instance %s", hash)
+			s.remove(hash)
+			s.restore.bumpInstance(hash)
+		} else {
+			s.failed(hash, err, retry, now)
+		}
+		s.restore.setLastError(hash, err)
+		if saveErr := s.restore.save(); saveErr != nil {
+			ptp.Log(ptp.Error, "Failed to save restore file: %s", saveErr)
+		}
+	}
+}
+
+func (s *restoreSupervisor) failed(hash string, err error, retry bool, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, e := s.attempts[hash]
+	if !e {
+		return
+	}
+	a.Attempts++
+	a.LastAttempt = now
+	a.LastError = err.Error()
+	if !retry {
+		a.State = RestoreFailed
+		ptp.Log(ptp.Error, "Failed to restore instance %s: %s", hash, err)
+		return
+	}
+	a.State = RestoreRetrying
+	a.NextAttempt = now.Add(restoreBackoff(a.Attempts))
+	ptp.Log(ptp.Error, "Failed to restore instance %s: %s. Attempt %d, retrying in %s", hash, err, a.Attempts, a.NextAttempt.Sub(now))
+}
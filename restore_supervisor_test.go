@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestoreBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		want     time.Duration
+	}{
+		{"First attempt", 1, restoreInitialDelay},
+		{"Second attempt", 2, restoreInitialDelay * 2},
+		{"Fifth attempt", 5, restoreInitialDelay * 16},
+		{"Limit", 20, restoreMaxDelay},
+		{"Overflow", 1000, restoreMaxDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restoreBackoff(tt.attempts); got != tt.want {
+				t.Errorf("restoreBackoff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreSupervisor_check(t *testing.T) {
+	r := &Restore{entries: []saveEntry{
+		{Hash: "hash1", Enabled: true},
+		{Hash: "hash2", Enabled: true, Key: "enc:v1:k:AAAA"},
+		{Hash: "hash3", Enabled: true},
+	}}
+	started := map[string]int{}
+	fail := true
+	s := newRestoreSupervisor(r, func(e saveEntry) error {
+		started[e.Hash]++
+		if fail {
+			return errors.New("No free IP")
+		}
+		return nil
+	}, func(hash string) bool {
+		return hash == "hash3"
+	})
+	s.add("hash1")
+	s.add("hash2")
+	s.add("hash3")
+	s.add("hash4")
+
+	now := time.Now()
+	s.check(now)
+	attempts := s.get()
+	if len(attempts) != 2 {
+		t.Fatalf("Running and removed instances weren't dropped: %+v", attempts)
+	}
+	if attempts[0].State != RestoreRetrying || attempts[0].Attempts != 1 || attempts[0].LastError != "No free IP" {
+		t.Errorf("Wrong state of failed instance: %+v", attempts[0])
+	}
+	if !attempts[0].NextAttempt.Equal(now.Add(restoreInitialDelay)) {
+		t.Errorf("Wrong time of the next attempt: %v", attempts[0].NextAttempt)
+	}
+	if attempts[1].State != RestoreFailed {
+		t.Errorf("Instance with sealed key will be retried: %+v", attempts[1])
+	}
+	if e, _ := r.getEntry("hash1"); e.LastError != "No free IP" {
+		t.Errorf("Error wasn't saved: %+v", e)
+	}
+
+	s.check(now.Add(time.Second))
+	if started["hash1"] != 1 {
+		t.Errorf("Instance was retried before backoff: %d attempts", started["hash1"])
+	}
+
+	fail = false
+	s.check(now.Add(restoreInitialDelay))
+	if started["hash1"] != 2 || started["hash2"] != 0 {
+		t.Errorf("Wrong number of attempts: %+v", started)
+	}
+	attempts = s.get()
+	if len(attempts) != 1 || attempts[0].Hash != "hash2" {
+		t.Errorf("Restored instance wasn't removed: %+v", attempts)
+	}
+	e, _ := r.getEntry("hash1")
+	if e.LastError != "" || e.LastSuccess == "" {
+		t.Errorf("Successful attempt wasn't saved: %+v", e)
+	}
+}
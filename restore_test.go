@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -111,15 +114,15 @@ func TestRestore_load(t *testing.T) {
 	}
 
 	presaved1 := "- empty"
-	f1, _ := os.OpenFile("/tmp/restore-load-test1", os.O_CREATE|os.O_RDWR, 0700)
+	f1, _ := os.OpenFile("/tmp/restore-load-test1", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0700)
 	f1.Write([]byte(presaved1))
 	f1.Close()
 
-	f2, _ := os.OpenFile("/tmp/restore-load-test2", os.O_CREATE|os.O_RDWR, 0700)
+	f2, _ := os.OpenFile("/tmp/restore-load-test2", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0700)
 	f2.Write([]byte(""))
 	f2.Close()
 
-	f3, _ := os.OpenFile("/tmp/restore-load-test3", os.O_CREATE|os.O_RDWR, 0700)
+	f3, _ := os.OpenFile("/tmp/restore-load-test3", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0700)
 	f3.Write([]byte("10.132.190.1~~p2p8~swarm-5565bd8c-d570-4fc8-bf39-eca47b918585~~~630a05b329266ac8a69adfe7d2d87003~1540794362~0~0|||10.243.26.1~~p2p4~swarm-9de835d3-eae8-49c3-9d61-1e65767618d9~~~3ea66ea049506bc018d33f82ec3b3cce~1527854837~0~0|||10.54.31.1~~p2p2~swarm-f98003ee-27c4-41ef-bc29-b6a1da5d779b~~~998e37ba12867e1dc6d074f0d3313ea9~1540710496~0~0|||10.36.162.2~~p2p6~swarm-ef0e47f8-6821-44e0-b821-ce909d661c4e~~~be2833276389bc76528cb8b227b50db5~1540750940~0~0|||10.205.196.1~~p2p9~swarm-2777bdf0-ede6-4c0d-b352-a3c474e7d7e0~~~48bd3833d2fad84e374b98c2e7c9f6ef~1539596713~0~0|||10.159.190.1~~p2p7~swarm-2120b53e-cd49-4eef-8927-24273686f3ab~~~0c46bd9eec679d4b97d26cb8a90d15b3~1539600413~0~0"))
 	f3.Close()
 
@@ -327,16 +330,22 @@ func TestRestore_encode(t *testing.T) {
 		active   bool
 	}
 
-	ee1 := `- ip: ""
+	entry := func(enabled bool) string {
+		return `version: 2
+instances:
+- ip: ""
   mac: ""
   dev: ""
   hash: hash
+  dht: ""
   keyfile: ""
   key: ""
   ttl: ""
+  fwd: false
+  port: 0
   last_success: ""
-  enabled: true
-`
+  enabled: ` + fmt.Sprintf("%t", enabled) + "\n"
+	}
 
 	tests := []struct {
 		name    string
@@ -344,9 +353,9 @@ func TestRestore_encode(t *testing.T) {
 		want    []byte
 		wantErr bool
 	}{
-		{"No entries", fields{}, nil, false},
-		{"Single Disabled Entry", fields{entries: []saveEntry{{Hash: "hash"}}}, []byte{91, 93, 10}, false},
-		{"Single Enabled Entry", fields{entries: []saveEntry{{Hash: "hash", Enabled: true}}}, []byte(ee1), false},
+		{"No entries", fields{}, []byte("version: 2\ninstances: []\n"), false},
+		{"Single Disabled Entry", fields{entries: []saveEntry{{Hash: "hash"}}}, []byte(entry(false)), false},
+		{"Single Enabled Entry", fields{entries: []saveEntry{{Hash: "hash", Enabled: true}}}, []byte(entry(true)), false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -362,7 +371,7 @@ func TestRestore_encode(t *testing.T) {
 				return
 			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("Restore.encode() = %v, want %v", got, tt.want)
+				t.Errorf("Restore.encode() = %s, want %s", got, tt.want)
 			}
 		})
 	}
@@ -493,3 +502,147 @@ func TestRestore_isActive(t *testing.T) {
 		})
 	}
 }
+
+func TestRestore_secrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-restore")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	saveFile := filepath.Join(dir, "save.yaml")
+	keyFile := saveFile + ".key"
+	plain := "- hash: hash1\n  key: secretkey1234567\n  enabled: true\n- hash: hash2\n  keyfile: /etc/p2p/keys.yaml\n  enabled: true\n"
+	ioutil.WriteFile(saveFile, []byte(plain), 0700)
+
+	newRestore := func() *Restore {
+		r := new(Restore)
+		if err := r.init(saveFile); err != nil {
+			t.Fatalf("Restore.init() error = %v", err)
+		}
+		if err := r.initSecrets(keyFile); err != nil {
+			t.Fatalf("Restore.initSecrets() error = %v", err)
+		}
+		return r
+	}
+
+	r := newRestore()
+	if err := r.load(); err != nil {
+		t.Fatalf("Restore.load() error = %v", err)
+	}
+	if entries := r.get(); len(entries) != 2 || entries[0].Key != "secretkey1234567" {
+		t.Fatalf("Bad entries after migration: %+v", entries)
+	}
+	data, _ := ioutil.ReadFile(saveFile)
+	if strings.Contains(string(data), "secretkey1234567") || !strings.Contains(string(data), saveSecretPrefix+"k:") {
+		t.Fatalf("Key wasn't encrypted during migration:\n%s", data)
+	}
+	if !strings.Contains(string(data), "/etc/p2p/keys.yaml") {
+		t.Errorf("Key file reference was lost:\n%s", data)
+	}
+
+	r = newRestore()
+	r.load()
+	if entries := r.get(); entries[0].Key != "secretkey1234567" {
+		t.Errorf("Failed to decrypt key: %s", entries[0].Key)
+	}
+
+	// Secret bound to another instance is rejected
+	sealed, _ := r.sealer.seal("secretkey1234567", "hash1")
+	if _, err := r.sealer.open(sealed, "hash2"); err == nil {
+		t.Errorf("Secret of another instance was accepted")
+	}
+
+	os.Setenv(savePassphraseEnv, "passphrase")
+	defer os.Unsetenv(savePassphraseEnv)
+	r = newRestore()
+	r.load()
+	if entries := r.get(); !isSealed(entries[0].Key) {
+		t.Errorf("Key protected with machine key was decrypted with passphrase")
+	}
+	sealed, _ = r.sealer.seal("secretkey1234567", "hash1")
+	if !strings.HasPrefix(sealed, saveSecretPrefix+"p:") {
+		t.Errorf("Bad passphrase secret: %s", sealed)
+	}
+	other := newRestore()
+	if key, err := other.sealer.open(sealed, "hash1"); err != nil || key != "secretkey1234567" {
+		t.Errorf("Failed to open passphrase secret: %s %v", key, err)
+	}
+}
+
+func TestRestore_migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-restore")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	sFile := filepath.Join(dir, "save.yaml")
+
+	want := saveEntry{IP: "10.10.10.1", Dev: "p2p1", Hash: "swarm-1", Dht: "dht", Key: "key", TTL: "1540794362", Fwd: true, Port: 1234, Enabled: true}
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"separated", "10.10.10.1~~p2p1~swarm-1~dht~~key~1540794362~1~1234"},
+		{"version 1", "- ip: 10.10.10.1\n  dev: p2p1\n  hash: swarm-1\n  dht: dht\n  key: key\n  ttl: \"1540794362\"\n  fwd: true\n  port: 1234\n  enabled: true\n"},
+		{"version 2", "version: 2\ninstances:\n- ip: 10.10.10.1\n  dev: p2p1\n  hash: swarm-1\n  dht: dht\n  key: key\n  ttl: \"1540794362\"\n  fwd: true\n  port: 1234\n  enabled: true\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ioutil.WriteFile(sFile, []byte(tt.data), 0600)
+			r := &Restore{filepath: sFile}
+			if err := r.load(); err != nil {
+				t.Fatalf("Restore.load() error = %v", err)
+			}
+			entries := r.get()
+			if len(entries) != 1 {
+				t.Fatalf("Restore.load() loaded %d entries", len(entries))
+			}
+			entries[0].LastSuccess = ""
+			if entries[0] != want {
+				t.Errorf("Restore.load() = %+v, want %+v", entries[0], want)
+			}
+			data, _ := ioutil.ReadFile(sFile)
+			if !strings.HasPrefix(string(data), "version: 2\n") {
+				t.Errorf("Save file wasn't migrated:\n%s", data)
+			}
+			files, _ := ioutil.ReadDir(dir)
+			if len(files) != 1 {
+				t.Errorf("Temporary files were left: %d files", len(files))
+			}
+		})
+	}
+
+	ioutil.WriteFile(sFile, []byte("version: 3\ninstances: []\n"), 0600)
+	r := &Restore{filepath: sFile}
+	r.load()
+	data, _ := ioutil.ReadFile(sFile)
+	if string(data) != "version: 3\ninstances: []\n" {
+		t.Errorf("Save file of newer version was overwritten")
+	}
+}
+
+func TestRestore_setEnabled(t *testing.T) {
+	r := &Restore{entries: []saveEntry{{Hash: "hash1", Enabled: true}, {Hash: "hash2", Enabled: true}}}
+	if err := r.setEnabled("hash1", false); err != nil {
+		t.Fatalf("Restore.setEnabled() error = %v", err)
+	}
+	if e, _ := r.getEntry("hash1"); e.Enabled {
+		t.Errorf("Entry wasn't disabled")
+	}
+	if e, _ := r.getEntry("hash2"); !e.Enabled {
+		t.Errorf("Wrong entry was disabled")
+	}
+	if err := r.setEnabled("hash3", false); err == nil {
+		t.Errorf("Restore.setEnabled() of unknown entry didn't fail")
+	}
+	if _, exists := r.getEntry("hash3"); exists {
+		t.Errorf("Restore.getEntry() returned unknown entry")
+	}
+	data, err := r.encode()
+	if err != nil {
+		t.Fatalf("Restore.encode() error = %v", err)
+	}
+	if !strings.Contains(string(data), "hash: hash1") {
+		t.Errorf("Disabled entry wasn't saved")
+	}
+}
@@ -1,25 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 
+	"github.com/subutai-io/p2p/client"
 	ptp "github.com/subutai-io/p2p/lib"
 )
 
 // Set modifies different options of P2P daemon
 func CommandSet(rpcPort int, log, hash, keyfile, key, ttl, ip string) {
-	out, err := sendRequest(rpcPort, "set", &DaemonArgs{Log: log, Keyfile: keyfile, Key: key, TTL: ttl, IP: ip, Hash: hash})
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
-	}
-
-	fmt.Println(out.Message)
-	os.Exit(out.Code)
+	c := newClient(rpcPort)
+	ctx := context.Background()
+	if log != "" {
+		exitWithResult(c.SetLog(ctx, log))
+	} else if ip != "" && hash != "" {
+		exitWithResult(c.SetIP(ctx, hash, ip))
+	} else if (key != "" || keyfile != "") && hash != "" {
+		err := c.SetKey(ctx, hash, client.KeyOptions{Key: key, Keyfile: keyfile, Until: ttl})
+		exitWithResult("Key was added to "+hash, err)
+	}
+	exitWithResult("Unknown command", nil)
 }
 
 func (d *Daemon) execRESTSet(w http.ResponseWriter, r *http.Request) {
@@ -28,16 +32,6 @@ func (d *Daemon) execRESTSet(w http.ResponseWriter, r *http.Request) {
 		w.Write(resp)
 		return
 	}
-	if !bootstrap.isActive {
-		resp, _ := getResponse(106, "Not connected to DHT nodes")
-		w.Write(resp)
-		return
-	}
-	if bootstrap.ip == "" {
-		resp, _ := getResponse(107, "Didn't received outbound IP yet")
-		w.Write(resp)
-		return
-	}
 	args := new(DaemonArgs)
 	err := getJSON(r.Body, args)
 	if handleMarshalError(err, w) != nil {
@@ -130,30 +124,3 @@ func (d *Daemon) SetLog(args *NameValueArg, resp *Response) error {
 	}
 	return nil
 }
-
-// AddKey adds a new crypto-key
-func (p *Daemon) AddKey(args *RunArgs, resp *Response) error {
-	resp.ExitCode = 0
-	if args.Hash == "" {
-		resp.ExitCode = 1
-		resp.Output = "You have not specified hash"
-	}
-	if args.Key == "" {
-		resp.ExitCode = 1
-		resp.Output = "You have not specified key"
-	}
-	inst := p.Instances.getInstance(args.Hash)
-	if inst == nil {
-		resp.ExitCode = 1
-		resp.Output = "No instances with specified hash were found"
-	}
-	if resp.ExitCode == 0 {
-		resp.Output = "New key added"
-		var newKey ptp.CryptoKey
-
-		newKey = inst.PTP.Crypter.EnrichKeyValues(newKey, args.Key, args.TTL)
-		inst.PTP.Crypter.Keys = append(inst.PTP.Crypter.Keys, newKey)
-		p.Instances.update(args.Hash, inst)
-	}
-	return nil
-}
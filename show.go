@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/subutai-io/p2p/client"
 	ptp "github.com/subutai-io/p2p/lib"
 )
 
@@ -21,101 +25,223 @@ type ShowOutput struct {
 	InterfaceName   string `json:"interface"`
 	Hash            string `json:"hash"`
 	MTU             string `json:"mtu"`
+	Key             string `json:"key"`     // Fingerprint of encryption key
+	Until           string `json:"until"`   // Expiration date of encryption key
+	State           string `json:"state"`   // State of encryption key
+	Rotated         string `json:"rotated"` // Time of the last key rotation
 }
 
-// Show outputs information about P2P instances and interfaces
-func CommandShow(queryPort int, hash, ip string, interfaces, all, bind, mtu bool) {
-	req := &request{}
-	if hash != "" {
-		req.Hash = hash
-	} else {
-		req.Hash = ""
+// outputInstance is a running instance in output of show command
+type outputInstance struct {
+	Hash string `json:"hash"`
+	IP   string `json:"ip"`
+	Mac  string `json:"mac"`
+}
+
+type outputInstances []outputInstance
+
+func (o outputInstances) tables() []outputTable {
+	t := outputTable{header: []string{"HASH", "IP", "MAC"}}
+	for _, inst := range o {
+		t.rows = append(t.rows, []string{inst.Hash, inst.IP, inst.Mac})
 	}
-	req.IP = ip
-	req.Interfaces = interfaces
-	req.All = all
-	req.Bind = bind
-	req.MTU = mtu
+	return []outputTable{t}
+}
 
-	out, err := sendRequestRaw(queryPort, "show", req)
-	if err != nil {
-		fmt.Println(err.Error())
-		if err == errorFailedToMarshal {
-			os.Exit(112)
-		} else if err == errorFailedToCreatePOSTRequest {
-			os.Exit(113)
-		} else if err == errorFailedToExecuteRequest {
-			os.Exit(115)
-		}
-		os.Exit(1)
+// outputPeer is a peer in output of show -hash command
+type outputPeer struct {
+	ID       string `json:"id"`
+	IP       string `json:"ip"`
+	Mac      string `json:"mac"`
+	Endpoint string `json:"endpoint"`
+}
+
+type outputPeers []outputPeer
+
+func (o outputPeers) tables() []outputTable {
+	t := outputTable{header: []string{"ID", "IP", "MAC", "ENDPOINT"}}
+	for _, p := range o {
+		t.rows = append(t.rows, []string{p.ID, p.IP, p.Mac, p.Endpoint})
 	}
-	show := []ShowOutput{}
-	err = json.Unmarshal(out, &show)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to unmarshal JSON. Error %s\n", err)
-		os.Exit(99)
+	return []outputTable{t}
+}
+
+// outputKeys is an output of show -hash -keys command. Last rotation is
+// empty when keys were never rotated
+type outputKeys struct {
+	Keys         []outputKey `json:"keys"`
+	LastRotation string      `json:"last_rotation"`
+}
+
+type outputKey struct {
+	Key   string `json:"key"`
+	Until string `json:"until"`
+	State string `json:"state"`
+}
+
+func (o *outputKeys) tables() []outputTable {
+	t := outputTable{header: []string{"KEY", "UNTIL", "STATE"}}
+	for _, k := range o.Keys {
+		t.rows = append(t.rows, []string{k.Key, k.Until, k.State})
+	}
+	rotated := o.LastRotation
+	if rotated == "" {
+		rotated = "never"
 	}
+	return []outputTable{t, {header: []string{"LAST ROTATION"}, rows: [][]string{{rotated}}}}
+}
 
-	if req.Hash != "" {
-		if req.IP != "" {
-			for _, m := range show {
-				if m.Code != 0 {
-					fmt.Fprintln(os.Stderr, m.Error)
-				} else {
-					fmt.Println(m.Text)
-				}
-				os.Exit(m.Code)
+// outputInterface is an interface in output of show -interfaces command.
+// Hash is specified with -bind
+type outputInterface struct {
+	Name string `json:"name"`
+	Hash string `json:"hash,omitempty"`
+}
+
+type outputInterfaces []outputInterface
+
+func (o outputInterfaces) tables() []outputTable {
+	t := outputTable{header: []string{"NAME", "HASH"}}
+	for _, inf := range o {
+		t.rows = append(t.rows, []string{inf.Name, inf.Hash})
+	}
+	return []outputTable{t}
+}
+
+// outputMTU is an output of show -mtu command
+type outputMTU struct {
+	MTU int `json:"mtu"`
+}
+
+func (o *outputMTU) tables() []outputTable {
+	return []outputTable{{header: []string{"MTU"}, rows: [][]string{{fmt.Sprintf("%d", o.MTU)}}}}
+}
+
+// Show outputs information about P2P instances and interfaces
+func CommandShow(queryPort int, hash, ip string, interfaces, all, bind, mtu, keys bool) {
+	c := newClient(queryPort)
+	ctx := context.Background()
+	if hash != "" {
+		if ip != "" {
+			text, err := c.CheckIP(ctx, hash, ip)
+			if err != nil {
+				exitWithShowError(err)
 			}
-			fmt.Println("No data available")
-			os.Exit(102)
-		} else {
-			fmt.Println("< Peer ID >\t< IP >\t< Endpoint >\t< HW >")
-			for _, m := range show {
-				if m.Code != 0 {
-					fmt.Println(m.Error)
-					os.Exit(m.Code)
+			exitWithResult(text, nil)
+		} else if keys {
+			list, err := c.Keys(ctx, hash)
+			if err != nil {
+				exitWithShowError(err)
+			}
+			out := &outputKeys{Keys: []outputKey{}}
+			for _, k := range list {
+				out.Keys = append(out.Keys, outputKey{Key: k.Fingerprint, Until: k.Until, State: k.State})
+				if k.Rotated != "" {
+					out.LastRotation = k.Rotated
 				}
-				fmt.Printf("%s\t%s\t%s\t%s\n", m.ID, m.IP, m.Endpoint, m.HardwareAddress)
 			}
+			if structuredOutput() {
+				exitWithOutput(out)
+			}
+			fmt.Println("< Key >\t< Valid until >\t< State >")
+			for _, k := range out.Keys {
+				fmt.Printf("%s\t%s\t%s\n", k.Key, k.Until, k.State)
+			}
+			if out.LastRotation == "" {
+				out.LastRotation = "never"
+			}
+			fmt.Printf("Last rotation: %s\n", out.LastRotation)
 			os.Exit(0)
 		}
+		peers, err := c.Peers(ctx, hash)
+		if err != nil {
+			exitWithShowError(err)
+		}
+		out := outputPeers{}
+		for _, p := range peers {
+			out = append(out, outputPeer{ID: p.ID, IP: p.IP, Mac: p.HardwareAddress, Endpoint: p.Endpoint})
+		}
+		if structuredOutput() {
+			exitWithOutput(out)
+		}
+		fmt.Println("< Peer ID >\t< IP >\t< Endpoint >\t< HW >")
+		for _, p := range out {
+			fmt.Printf("%s\t%s\t%s\t%s\n", p.ID, p.IP, p.Endpoint, p.Mac)
+		}
+		os.Exit(0)
 	}
-	if req.Interfaces {
-		if req.Bind {
-			for _, m := range show {
-				fmt.Printf("%s|%s\n", m.Hash, m.InterfaceName)
+	if interfaces {
+		out := outputInterfaces{}
+		if bind && !all {
+			bindings, err := c.Bindings(ctx)
+			if err != nil {
+				exitWithShowError(err)
+			}
+			for _, b := range bindings {
+				out = append(out, outputInterface{Name: b.Interface, Hash: b.Hash})
 			}
-			os.Exit(0)
 		} else {
-			for _, m := range show {
-				if m.Code != 0 {
-					fmt.Println(m.Error)
-					os.Exit(m.Code)
-				}
-				fmt.Println(m.InterfaceName)
+			names, err := c.Interfaces(ctx, all)
+			if err != nil {
+				exitWithShowError(err)
 			}
-			os.Exit(0)
+			for _, name := range names {
+				out = append(out, outputInterface{Name: name})
+			}
+		}
+		if structuredOutput() {
+			exitWithOutput(out)
 		}
+		for _, inf := range out {
+			if bind && !all {
+				fmt.Printf("%s|%s\n", inf.Hash, inf.Name)
+			} else {
+				fmt.Println(inf.Name)
+			}
+		}
+		os.Exit(0)
 	}
-	if req.MTU {
-		for _, s := range show {
-			fmt.Println(s.MTU)
-			os.Exit(0)
+	if mtu {
+		value, err := c.MTU(ctx)
+		if err != nil {
+			exitWithShowError(err)
 		}
-		fmt.Fprintln(os.Stderr, "Failed to retrieve MTU value")
-		os.Exit(114)
+		if structuredOutput() {
+			exitWithOutput(&outputMTU{MTU: value})
+		}
+		fmt.Println(value)
+		os.Exit(0)
 	}
 
-	for _, m := range show {
-		if m.Code != 0 {
-			fmt.Fprintln(os.Stderr, m.Error)
-			os.Exit(m.Code)
-		}
-		fmt.Printf("%s\t%s\t%s\n", m.HardwareAddress, m.IP, m.Hash)
+	instances, err := c.Show(ctx)
+	if err != nil {
+		exitWithShowError(err)
+	}
+	out := outputInstances{}
+	for _, inst := range instances {
+		out = append(out, outputInstance{Hash: inst.Hash, IP: inst.IP, Mac: inst.HardwareAddress})
+	}
+	if structuredOutput() {
+		exitWithOutput(out)
+	}
+	for _, inst := range out {
+		fmt.Printf("%s\t%s\t%s\n", inst.Mac, inst.IP, inst.Hash)
 	}
 	os.Exit(0)
 }
 
+// exitWithShowError exits with codes of show command for requests that
+// didn't reach daemon or got malformed response
+func exitWithShowError(err error) {
+	if errors.Is(err, client.ErrUnavailable) {
+		exitWithCode(115, err.Error())
+	}
+	if errors.Is(err, client.ErrBadResponse) {
+		exitWithCode(99, err.Error())
+	}
+	exitWithError(err)
+}
+
 func (d *Daemon) execRESTShow(w http.ResponseWriter, r *http.Request) {
 	args := new(DaemonArgs)
 	err := getJSON(r.Body, args)
@@ -129,6 +255,7 @@ func (d *Daemon) execRESTShow(w http.ResponseWriter, r *http.Request) {
 		Bind:       args.Bind,
 		MTU:        args.MTU,
 		All:        args.All,
+		Keys:       args.Keys,
 	})
 	if err != nil {
 		ptp.Log(ptp.Error, "Internal error: %s", err)
@@ -143,14 +270,6 @@ func (d *Daemon) Show(args *request) ([]byte, error) {
 		out := []ShowOutput{ShowOutput{Error: "P2P Daemon is in initialization mode. Can't handle request", Code: 105}}
 		return d.showOutput(out)
 	}
-	if !bootstrap.isActive {
-		out := []ShowOutput{ShowOutput{Error: "Not connected to DHT nodes", Code: 106}}
-		return d.showOutput(out)
-	}
-	if bootstrap.ip == "" {
-		out := []ShowOutput{ShowOutput{Error: "Didn't received outbound IP yet", Code: 107}}
-		return d.showOutput(out)
-	}
 
 	if args.Hash != "" {
 		inst := d.Instances.getInstance(args.Hash)
@@ -159,6 +278,9 @@ func (d *Daemon) Show(args *request) ([]byte, error) {
 				out, err := d.showIP(args.IP, inst)
 				return out, err
 			}
+			if args.Keys {
+				return d.showKeys(inst)
+			}
 			out, err := d.showHash(inst)
 			return out, err
 		}
@@ -227,6 +349,26 @@ func (d *Daemon) showHash(instance *P2PInstance) ([]byte, error) {
 	return d.showOutput(out)
 }
 
+func (d *Daemon) showKeys(instance *P2PInstance) ([]byte, error) {
+	out := []ShowOutput{}
+	if instance.PTP == nil || !instance.PTP.Crypter.Active {
+		return d.showOutput(out)
+	}
+	rotated := ""
+	if last := instance.PTP.Crypter.LastRotation(); !last.IsZero() {
+		rotated = last.Format(time.RFC3339)
+	}
+	for _, key := range instance.PTP.Crypter.KeyStatus() {
+		out = append(out, ShowOutput{
+			Key:     key.Fingerprint,
+			Until:   key.Until.Format(time.RFC3339),
+			State:   key.State,
+			Rotated: rotated,
+		})
+	}
+	return d.showOutput(out)
+}
+
 func (d *Daemon) showInterfaces() ([]byte, error) {
 	instances := d.Instances.get()
 	out := []ShowOutput{}
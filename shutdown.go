@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+const defaultShutdownTimeout = time.Duration(time.Second * 30)
+
+// shutdownTimeout limits time spent on stopping instances. Daemon exits
+// when it passes even if some instances are still stopping
+var shutdownTimeout = defaultShutdownTimeout
+
+// handleSignals shuts daemon down on SIGINT or SIGTERM. Second signal
+// terminates daemon immediately
+func handleSignals(d *Daemon) {
+	SignalChannel = make(chan os.Signal, 1)
+	signal.Notify(SignalChannel, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-SignalChannel
+		ptp.Log(ptp.Info, "Received signal: %s. Shutting down", sig)
+		go func() {
+			sig := <-SignalChannel
+			ptp.Log(ptp.Warning, "Received signal: %s. Exiting immediately", sig)
+			os.Exit(1)
+		}()
+		d.shutdown(shutdownTimeout)
+		pprof.StopCPUProfile()
+		os.Exit(0)
+	}()
+}
+
+// isStopping returns true when daemon is shutting down
+func (d *Daemon) isStopping() bool {
+	return atomic.LoadInt32(&d.stopping) == 1
+}
+
+// shutdown stops every instance, flushes save file and waits for hooks to
+// deliver remaining events. Instances are kept in save file, so they're
+// restored on next launch
+func (d *Daemon) shutdown(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&d.stopping, 0, 1) {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	ReadyToServe = false
+	if controlListener != nil {
+		// Removes socket file
+		controlListener.Close()
+	}
+	if d.Supervisor != nil {
+		d.Supervisor.stop()
+	}
+
+	instances := d.Instances.get()
+	ptp.Log(ptp.Info, "Stopping %d instances", len(instances))
+	var wg sync.WaitGroup
+	for _, inst := range instances {
+		if inst == nil || inst.PTP == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(inst *P2PInstance) {
+			defer wg.Done()
+			// Peers and bootstrap node are notified about departure
+			// and interface is removed
+			inst.PTP.Close()
+			bootstrap.unregisterInstance(inst.ID)
+			ptp.Events.Publish(ptp.Event{Type: ptp.EventInstanceStopped, Hash: inst.ID, Message: "Instance stopped"})
+		}(inst)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		ptp.Log(ptp.Info, "All instances were stopped")
+	case <-time.After(time.Until(deadline)):
+		ptp.Log(ptp.Warning, "Shutdown timeout passed. Some instances weren't stopped")
+	}
+
+	if d.Restore != nil && d.Restore.isActive() {
+		err := d.Restore.save()
+		if err != nil {
+			ptp.Log(ptp.Error, "Failed to save instances: %s", err)
+		}
+	}
+	d.flushHooks(deadline)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -9,13 +10,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/subutai-io/p2p/client"
 	ptp "github.com/subutai-io/p2p/lib"
 )
 
 // CommandStart will create new P2P instance
-func CommandStart(restPort int, ip, hash, mac, dev, keyfile, key, ttl string, fwd bool, port int) {
-	args := &DaemonArgs{}
-	args.IP = ip
+func CommandStart(restPort int, ip, hash, mac, dev, keyfile, key, kdf, ttl string, fwd bool, port, mtu int) {
 	if hash == "" {
 		fmt.Fprintln(os.Stderr, "Hash cannot be empty. Please start new instances with -hash VALUE argument")
 		os.Exit(12)
@@ -24,7 +24,6 @@ func CommandStart(restPort int, ip, hash, mac, dev, keyfile, key, ttl string, fw
 		fmt.Fprintln(os.Stderr, "Hash cannot contain the ~. Please start new instances with hash value that doesn't contain it")
 		os.Exit(17)
 	}
-	args.Hash = hash
 	if mac != "" {
 		_, err := net.ParseMAC(mac)
 		if err != nil {
@@ -32,26 +31,19 @@ func CommandStart(restPort int, ip, hash, mac, dev, keyfile, key, ttl string, fw
 			os.Exit(13)
 		}
 	}
-	args.Mac = mac
-	args.Dev = dev
-	args.Keyfile = keyfile
-	args.Key = key
-	args.TTL = ttl
-	args.Fwd = fwd
-	args.Port = port
-
-	out, err := sendRequest(restPort, "start", args)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
-	}
-
-	if out.Code > 0 {
-		fmt.Fprintln(os.Stderr, out.Message)
-	} else {
-		fmt.Println(out.Message)
-	}
-	os.Exit(out.Code)
+	exitWithResult(newClient(restPort).Start(context.Background(), client.StartOptions{
+		Hash:    hash,
+		IP:      ip,
+		Mac:     mac,
+		Dev:     dev,
+		Keyfile: keyfile,
+		Key:     key,
+		KDF:     kdf,
+		TTL:     ttl,
+		Fwd:     fwd,
+		Port:    port,
+		MTU:     mtu,
+	}))
 }
 
 func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
@@ -60,12 +52,12 @@ func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
 		w.Write(resp)
 		return
 	}
-	if !bootstrap.isActive {
+	if !bootstrap.isConnected() {
 		resp, _ := getResponse(106, "Not connected to DHT nodes")
 		w.Write(resp)
 		return
 	}
-	if bootstrap.ip == "" {
+	if bootstrap.getIP() == "" {
 		resp, _ := getResponse(107, "Didn't received outbound IP yet")
 		w.Write(resp)
 		return
@@ -75,10 +67,33 @@ func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
 	if handleMarshalError(err, w) != nil {
 		return
 	}
+	response := new(Response)
+	d.Start(args, response)
+	resp, err := getResponse(response.ExitCode, response.Output)
+	if err != nil {
+		ptp.Log(ptp.Error, "Internal error: %s", err)
+		return
+	}
+	w.Write(resp)
+}
 
+// Start runs new instance with defaults from configuration file and
+// adds it to the save file
+func (d *Daemon) Start(args *DaemonArgs, resp *Response) error {
+	applyInstanceDefaults(args, d.settings.instanceDefaults())
 	ptp.Log(ptp.Debug, "Executing start command: %+v", args)
-	response := new(Response)
-	err = d.run(&RunArgs{
+	kdf, err := ptp.ParseKDF(args.KDF)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = err.Error()
+		return err
+	}
+	// Parameters are saved in full, so key doesn't change with defaults
+	args.KDF = ""
+	if kdf.Name != ptp.KDFRaw {
+		args.KDF = kdf.String()
+	}
+	runErr := d.run(&RunArgs{
 		IP:      args.IP,
 		Mac:     args.Mac,
 		Dev:     args.Dev,
@@ -86,10 +101,12 @@ func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
 		Dht:     args.Dht,
 		Keyfile: args.Keyfile,
 		Key:     args.Key,
+		KDF:     args.KDF,
 		TTL:     args.TTL,
 		Fwd:     args.Fwd,
 		Port:    args.Port,
-	}, response)
+		MTU:     args.InterfaceMTU,
+	}, resp)
 
 	ls, _ := time.Unix(0, 0).MarshalText()
 
@@ -100,9 +117,14 @@ func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
 		Mac:         args.Mac,
 		Dev:         args.Dev,
 		Hash:        args.Hash,
+		Dht:         args.Dht,
 		Keyfile:     args.Keyfile,
 		Key:         args.Key,
+		KDF:         args.KDF,
 		TTL:         args.TTL,
+		Fwd:         args.Fwd,
+		Port:        args.Port,
+		MTU:         args.InterfaceMTU,
 		LastSuccess: string(ls),
 		Enabled:     true,
 	}) != nil {
@@ -112,12 +134,7 @@ func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		ptp.Log(ptp.Error, "Failed to save instance information: %s", err.Error())
 	}
-	resp, err := getResponse(response.ExitCode, response.Output)
-	if err != nil {
-		ptp.Log(ptp.Error, "Internal error: %s", err)
-		return
-	}
-	w.Write(resp)
+	return runErr
 }
 
 // Run starts a P2P instance
@@ -142,22 +159,33 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 	inst := d.Instances.getInstance(args.Hash)
 	if inst == nil {
 		resp.Output = resp.Output + "Lookup finished\n"
+		key := args.Key
 		if args.Key != "" {
-			if len(args.Key) < 16 {
-				args.Key += "0000000000000000"[:16-len(args.Key)]
-			} else if len(args.Key) > 16 && len(args.Key) < 24 {
-				args.Key += "000000000000000000000000"[:24-len(args.Key)]
-			} else if len(args.Key) > 24 && len(args.Key) < 32 {
-				args.Key += "00000000000000000000000000000000"[:32-len(args.Key)]
-			} else if len(args.Key) > 32 {
-				args.Key = args.Key[:32]
+			kdf, err := ptp.ParseKDF(args.KDF)
+			if err != nil {
+				resp.ExitCode = 1
+				resp.Output = resp.Output + err.Error()
+				return err
+			}
+			if kdf.Name == ptp.KDFRaw {
+				args.Key = padKey(args.Hash, args.Key)
+				key = args.Key
+			} else {
+				// Passphrase is kept in arguments, so key is derived again on restore
+				derived, err := ptp.DeriveKey(args.Key, args.Hash, kdf)
+				if err != nil {
+					resp.ExitCode = 1
+					resp.Output = resp.Output + err.Error()
+					return err
+				}
+				key = string(derived)
 			}
 		}
 
 		newInst := new(P2PInstance)
 		newInst.ID = args.Hash
 		newInst.Args = *args
-		newInst.PTP = ptp.New(args.Mac, args.Hash, args.Keyfile, args.Key, args.TTL, TargetURL, args.Fwd, args.Port, OutboundIP)
+		newInst.PTP = ptp.New(args.Mac, args.Hash, args.Keyfile, key, args.TTL, TargetURL, args.Fwd, args.Port, OutboundIP)
 		if newInst.PTP == nil {
 			resp.Output = resp.Output + "Failed to create P2P Instance"
 			resp.ExitCode = 1
@@ -203,6 +231,12 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 			resp.ExitCode = 603
 			return errors.New("Failed to configure network interface")
 		}
+		if args.MTU > 0 {
+			err = newInst.PTP.Interface.SetMTU(args.MTU)
+			if err != nil {
+				ptp.Log(ptp.Warning, "Failed to set MTU %d on %s: %s", args.MTU, newInst.PTP.Interface.GetName(), err)
+			}
+		}
 		go newInst.PTP.ListenInterface()
 
 		// Saving interface name
@@ -220,6 +254,12 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 		ptp.Log(ptp.Info, "Instance created")
 		newInst.Args.LastSuccess = time.Now()
 		d.Instances.update(args.Hash, newInst)
+		ptp.Events.Publish(ptp.Event{
+			Type:    ptp.EventInstanceStarted,
+			Hash:    args.Hash,
+			Message: "Instance created",
+			Data:    map[string]string{"interface": newInst.PTP.Interface.GetName(), "ip": newInst.PTP.Interface.GetIP().String()},
+		})
 
 		go newInst.PTP.Run()
 		resp.Output = resp.Output + "Instance created: " + args.Hash + "\n"
@@ -229,3 +269,38 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 	}
 	return nil
 }
+
+// applyInstanceDefaults fills options that weren't specified with defaults
+// from configuration file. Default key file is used only when no key was
+// specified
+func applyInstanceDefaults(args *DaemonArgs, defaults ptp.InstanceDefaults) {
+	if args.IP == "" {
+		args.IP = defaults.IP
+	}
+	if args.IP == "" {
+		args.IP = "dhcp"
+	}
+	if args.Keyfile == "" && args.Key == "" {
+		args.Keyfile = defaults.Keyfile
+	}
+	if defaults.Fwd {
+		args.Fwd = true
+	}
+}
+
+// padKey pads or truncates raw key to the nearest length supported by AES
+func padKey(hash, key string) string {
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		ptp.Log(ptp.Warning, "Key of %s is %d bytes long and will be padded or truncated. Consider deriving it from a passphrase with -kdf", hash, len(key))
+	}
+	if len(key) < 16 {
+		key += "0000000000000000"[:16-len(key)]
+	} else if len(key) > 16 && len(key) < 24 {
+		key += "000000000000000000000000"[:24-len(key)]
+	} else if len(key) > 24 && len(key) < 32 {
+		key += "00000000000000000000000000000000"[:32-len(key)]
+	} else if len(key) > 32 {
+		key = key[:32]
+	}
+	return key
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/subutai-io/p2p/client"
 	ptp "github.com/subutai-io/p2p/lib"
 )
 
 type statusResponse struct {
 	Instances []*statusInstance `json:"instances"`
+	Restores  []*statusRestore  `json:"restores,omitempty"`
 	Code      int               `json:"code"`
 }
 
@@ -27,65 +32,157 @@ type statusPeer struct {
 	LastError string `json:"lastError"`
 }
 
-// CommandStatus outputs connectivity status of each peer
-func CommandStatus(restPort int, hash string) {
-	out, err := sendRequestRaw(restPort, "status", &request{Hash: hash})
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+// statusRestore is a state of saved instance that wasn't restored yet
+type statusRestore struct {
+	ID          string    `json:"id"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	LastSuccess string    `json:"lastSuccess"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// outputStatus is an output of status command. Restores are instances
+// of save file that weren't restored yet
+type outputStatus struct {
+	Instances []outputStatusInstance `json:"instances"`
+	Restores  []outputRestore        `json:"restores"`
+}
+
+type outputStatusInstance struct {
+	Hash  string             `json:"hash"`
+	IP    string             `json:"ip"`
+	Peers []outputStatusPeer `json:"peers"`
+}
+
+// outputStatusPeer is a peer state. ID is omitted only in legacy output
+// of status -hash command
+type outputStatusPeer struct {
+	ID        string `json:"id,omitempty"`
+	IP        string `json:"ip"`
+	State     string `json:"state"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// outputRestore is a restore state. Next attempt is set for retrying
+// restores
+type outputRestore struct {
+	Hash        string `json:"hash"`
+	State       string `json:"state"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	LastSuccess string `json:"last_success,omitempty"`
+	NextAttempt string `json:"next_attempt,omitempty"`
+}
+
+func (o *outputStatus) tables() []outputTable {
+	peers := outputTable{header: []string{"HASH", "IP", "PEER", "PEER IP", "STATE", "LAST ERROR"}}
+	for _, inst := range o.Instances {
+		if len(inst.Peers) == 0 {
+			peers.rows = append(peers.rows, []string{inst.Hash, inst.IP, "", "", "", ""})
+		}
+		for _, p := range inst.Peers {
+			peers.rows = append(peers.rows, []string{inst.Hash, inst.IP, p.ID, p.IP, p.State, p.LastError})
+		}
+	}
+	if len(o.Restores) == 0 {
+		return []outputTable{peers}
+	}
+	restores := outputTable{header: []string{"HASH", "RESTORE", "ATTEMPTS", "NEXT ATTEMPT", "LAST ERROR"}}
+	for _, r := range o.Restores {
+		restores.rows = append(restores.rows, []string{r.Hash, r.State, fmt.Sprintf("%d", r.Attempts), r.NextAttempt, r.LastError})
 	}
+	return []outputTable{peers, restores}
+}
 
-	response := new(statusResponse)
-	err = json.Unmarshal(out, response)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to unmarshal status response: %s", err)
-		os.Exit(125)
+func newOutputStatus(status *client.Status, hash string) *outputStatus {
+	out := &outputStatus{
+		Instances: []outputStatusInstance{},
+		Restores:  []outputRestore{},
+	}
+	for _, instance := range status.Instances {
+		inst := outputStatusInstance{
+			Hash:  instance.ID,
+			IP:    instance.IP,
+			Peers: []outputStatusPeer{},
+		}
+		if inst.Hash == "" {
+			// Daemon omits hash of requested instance
+			inst.Hash = hash
+		}
+		for _, peer := range instance.Peers {
+			inst.Peers = append(inst.Peers, outputStatusPeer{
+				ID:        peer.ID,
+				IP:        peer.IP,
+				State:     peer.State,
+				LastError: peer.LastError,
+			})
+		}
+		out.Instances = append(out.Instances, inst)
 	}
+	for _, restore := range status.Restores {
+		r := outputRestore{
+			Hash:        restore.ID,
+			State:       restore.State,
+			Attempts:    restore.Attempts,
+			LastError:   restore.LastError,
+			LastSuccess: restore.LastSuccess,
+		}
+		if restore.State == RestoreRetrying {
+			r.NextAttempt = restore.NextAttempt.Format(time.RFC3339)
+		}
+		out.Restores = append(out.Restores, r)
+	}
+	return out
+}
 
-	if response.Code != 0 {
-		fmt.Fprintln(os.Stderr, "Failed to execute `status` command")
-		os.Exit(response.Code)
+// CommandStatus outputs connectivity status of each peer
+func CommandStatus(restPort int, hash string) {
+	response, err := newClient(restPort).Status(context.Background(), hash)
+	if errors.Is(err, client.ErrBadResponse) {
+		exitWithCode(125, err.Error())
+	} else if err != nil {
+		exitWithError(err)
+	}
+	out := newOutputStatus(response, hash)
+	if structuredOutput() {
+		exitWithOutput(out)
 	}
 
 	if len(hash) == 0 {
-		for _, instance := range response.Instances {
-			if len(hash) == 0 {
-				fmt.Printf("%s|%s\n", instance.ID, instance.IP)
-			}
+		for _, instance := range out.Instances {
+			fmt.Printf("%s|%s\n", instance.Hash, instance.IP)
 			for _, peer := range instance.Peers {
-				if len(hash) == 0 {
-					fmt.Printf("%s|", peer.ID)
-				}
-				fmt.Printf("%s|State:%s|", peer.IP, peer.State)
+				fmt.Printf("%s|%s|State:%s|", peer.ID, peer.IP, peer.State)
 				if peer.LastError != "" {
 					fmt.Printf("LastError:%s", peer.LastError)
 				}
 				fmt.Printf("\n")
 			}
 		}
+		for _, restore := range out.Restores {
+			fmt.Printf("%s|Restore:%s|Attempts:%d|", restore.Hash, restore.State, restore.Attempts)
+			if restore.NextAttempt != "" {
+				fmt.Printf("NextAttempt:%s|", restore.NextAttempt)
+			}
+			if restore.LastError != "" {
+				fmt.Printf("LastError:%s", restore.LastError)
+			}
+			fmt.Printf("\n")
+		}
 	} else {
-		fmt.Printf("[\n")
-		for _, instance := range response.Instances {
-			i := 0
+		peers := []outputStatusPeer{}
+		for _, instance := range out.Instances {
 			for _, peer := range instance.Peers {
-				i++
-				fmt.Printf("\t{\n")
-				fmt.Printf("\t\t\"ip\": \"%s\",\n", peer.IP)
-				fmt.Printf("\t\t\"state\": \"%s\"", peer.State)
-				if peer.LastError != "" {
-					fmt.Printf(",\n")
-					fmt.Printf("\t\t\"last_error\": \"%s\"\n", peer.IP)
-				} else {
-					fmt.Printf("\n")
-				}
-				fmt.Printf("\t}")
-				if i != len(instance.Peers) {
-					fmt.Printf(",")
-				}
-				fmt.Printf("\n")
+				peer.ID = ""
+				peers = append(peers, peer)
 			}
 		}
-		fmt.Printf("]\n")
+		data, err := json.MarshalIndent(peers, "", "\t")
+		if err != nil {
+			exitWithCode(1, err.Error())
+		}
+		fmt.Println(string(data))
 	}
 	os.Exit(0)
 }
@@ -96,16 +193,6 @@ func (d *Daemon) execRESTStatus(w http.ResponseWriter, r *http.Request) {
 		w.Write(resp)
 		return
 	}
-	if !bootstrap.isActive {
-		resp, _ := getResponse(106, "Not connected to DHT nodes")
-		w.Write(resp)
-		return
-	}
-	if bootstrap.ip == "" {
-		resp, _ := getResponse(107, "Didn't received outbound IP yet")
-		w.Write(resp)
-		return
-	}
 	args := new(DaemonArgs)
 	err := getJSON(r.Body, args)
 	if handleMarshalError(err, w) != nil {
@@ -156,5 +243,23 @@ func (d *Daemon) Status(hash string) (*statusResponse, error) {
 		}
 		response.Instances = append(response.Instances, instance)
 	}
+	if d.Supervisor != nil {
+		for _, a := range d.Supervisor.get() {
+			if hash != "" && hash != a.Hash {
+				continue
+			}
+			restore := &statusRestore{
+				ID:          a.Hash,
+				State:       a.State,
+				Attempts:    a.Attempts,
+				LastError:   a.LastError,
+				NextAttempt: a.NextAttempt,
+			}
+			if e, exists := d.Restore.getEntry(a.Hash); exists {
+				restore.LastSuccess = e.LastSuccess
+			}
+			response.Restores = append(response.Restores, restore)
+		}
+	}
 	return response, nil
 }
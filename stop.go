@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"os"
 
 	ptp "github.com/subutai-io/p2p/lib"
 )
@@ -13,25 +13,13 @@ import (
 // specified hash that is needed to stop or interface name that's
 // needed to be removed from saved interfaces list
 func CommandStop(rpcPort int, hash, dev string) {
-	args := &DaemonArgs{}
+	c := newClient(rpcPort)
 	if hash != "" {
-		args.Hash = hash
-		args.Dev = ""
+		exitWithResult(c.Stop(context.Background(), hash))
 	} else if dev != "" {
-		args.Dev = dev
-		args.Hash = ""
-	} else {
-		fmt.Printf("Not enough parameters for stop command")
-		return
-	}
-	out, err := sendRequest(rpcPort, "stop", args)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		exitWithResult(c.RemoveInterface(context.Background(), dev))
 	}
-
-	fmt.Println(out.Message)
-	os.Exit(out.Code)
+	fmt.Printf("Not enough parameters for stop command")
 }
 
 func (d *Daemon) execRESTStop(w http.ResponseWriter, r *http.Request) {
@@ -40,16 +28,6 @@ func (d *Daemon) execRESTStop(w http.ResponseWriter, r *http.Request) {
 		w.Write(resp)
 		return
 	}
-	if !bootstrap.isActive {
-		resp, _ := getResponse(106, "Not connected to DHT nodes")
-		w.Write(resp)
-		return
-	}
-	if bootstrap.ip == "" {
-		resp, _ := getResponse(107, "Didn't received outbound IP yet")
-		w.Write(resp)
-		return
-	}
 	args := new(DaemonArgs)
 	err := getJSON(r.Body, args)
 	if handleMarshalError(err, w) != nil {
@@ -79,10 +57,8 @@ func (p *Daemon) Stop(args *DaemonArgs, resp *Response) error {
 			resp.Output = "Instance with hash " + args.Hash + " was not found"
 			return nil
 		} else {
-			ip := inst.PTP.Interface.GetIP().String()
 			resp.Output = "Shutting down " + args.Hash
-			inst.PTP.Close()
-			p.Instances.delete(args.Hash)
+			p.stopInstance(inst)
 			if p.Restore.isActive() {
 				err := p.Restore.removeEntry(args.Hash)
 				if err != nil {
@@ -94,15 +70,6 @@ func (p *Daemon) Stop(args *DaemonArgs, resp *Response) error {
 					}
 				}
 			}
-			k := 0
-			for k, i := range usedIPs {
-				if i != ip {
-					usedIPs[k] = i
-					k++
-				}
-			}
-			usedIPs = usedIPs[:k]
-			bootstrap.unregisterInstance(args.Hash)
 			return nil
 		}
 	} else if args.Dev != "" {
@@ -131,3 +98,21 @@ func (p *Daemon) Stop(args *DaemonArgs, resp *Response) error {
 	resp.Output = "Not enough parameters for stop"
 	return nil
 }
+
+// stopInstance shuts down instance and releases its resources. Save
+// entry of the instance is kept
+func (p *Daemon) stopInstance(inst *P2PInstance) {
+	ip := inst.PTP.Interface.GetIP().String()
+	inst.PTP.Close()
+	p.Instances.delete(inst.ID)
+	k := 0
+	for _, i := range usedIPs {
+		if i != ip {
+			usedIPs[k] = i
+			k++
+		}
+	}
+	usedIPs = usedIPs[:k]
+	bootstrap.unregisterInstance(inst.ID)
+	ptp.Events.Publish(ptp.Event{Type: ptp.EventInstanceStopped, Hash: inst.ID, Message: "Instance stopped"})
+}
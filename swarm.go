@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const defaultReconcileInterval = time.Duration(time.Minute * 1)
+
+// Instances directory is applied periodically, on reload and with apply
+// command
+var (
+	reconcileInterval = defaultReconcileInterval
+	reconcileTrigger  = make(chan struct{}, 1)
+	reconcileLock     sync.Mutex
+)
+
+var errNoInstancesDir = errors.New("Instances directory is not configured")
+
+// Actions performed during reconciliation
+const (
+	SwarmStart   = "start"   // Declared instance is not running
+	SwarmStop    = "stop"    // Definition of managed instance was removed
+	SwarmRestart = "restart" // Definition changed and instance must be started again
+	SwarmUpdate  = "update"  // Definition changed and can be applied to running instance
+)
+
+// swarmDefinition declares desired state of an instance. Definitions are
+// read by `p2p start --file` and from instances directory
+type swarmDefinition struct {
+	Hash    string         `yaml:"hash"`
+	IP      string         `yaml:"ip"` // IP address in CIDR format or "dhcp"
+	Dev     string         `yaml:"dev"`
+	Mac     string         `yaml:"mac"`
+	Keyfile string         `yaml:"keyfile"`
+	Fwd     bool           `yaml:"fwd"`
+	Port    int            `yaml:"port"`
+	MTU     int            `yaml:"mtu"`   // Global MTU is used when zero
+	Hooks   []ptp.HookConf `yaml:"hooks"` // Hooks run on events of this instance
+	source  string         // File definition was loaded from
+}
+
+// swarmChange is a single step of reconciliation
+type swarmChange struct {
+	Action string
+	Hash   string
+	Reason string
+	Error  string
+	def    *swarmDefinition
+	inst   *P2PInstance
+}
+
+func (c swarmChange) String() string {
+	s := fmt.Sprintf("%s %s: %s", c.Action, c.Hash, c.Reason)
+	if c.Error != "" {
+		s += ". Failed: " + c.Error
+	}
+	return s
+}
+
+// loadSwarmDefinition reads and validates definition file
+func loadSwarmDefinition(path string) (*swarmDefinition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(swarmDefinition)
+	err = yaml.UnmarshalStrict(data, s)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", path, err)
+	}
+	s.source = path
+	err = s.validate()
+	if err != nil {
+		return nil, fmt.Errorf("Bad definition in %s: %s", path, err)
+	}
+	return s, nil
+}
+
+func (s *swarmDefinition) validate() error {
+	if s.Hash == "" {
+		return errors.New("Hash is not specified")
+	}
+	if strings.Contains(s.Hash, "~") {
+		return errors.New("Hash cannot contain the ~")
+	}
+	if s.IP == "" {
+		s.IP = "dhcp"
+	}
+	if s.IP != "dhcp" && net.ParseIP(s.IP) == nil {
+		if _, _, err := net.ParseCIDR(s.IP); err != nil {
+			return fmt.Errorf("IP %s is not an address or \"dhcp\"", s.IP)
+		}
+	}
+	if s.Mac != "" {
+		if _, err := net.ParseMAC(s.Mac); err != nil {
+			return fmt.Errorf("Invalid MAC address %s", s.Mac)
+		}
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("Port %d is out of range", s.Port)
+	}
+	if s.MTU != 0 && (s.MTU < 576 || s.MTU > 65535) {
+		return fmt.Errorf("MTU %d is out of range 576-65535", s.MTU)
+	}
+	for i, h := range s.Hooks {
+		if err := h.Validate(); err != nil {
+			return fmt.Errorf("Bad hook %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// override replaces values of definition with arguments that were specified
+func (s *swarmDefinition) override(ip, hash, mac, dev, keyfile string, fwd bool, port int) {
+	if ip != "" {
+		s.IP = ip
+	}
+	if hash != "" {
+		s.Hash = hash
+	}
+	if mac != "" {
+		s.Mac = mac
+	}
+	if dev != "" {
+		s.Dev = dev
+	}
+	if keyfile != "" {
+		s.Keyfile = keyfile
+	}
+	if fwd {
+		s.Fwd = true
+	}
+	if port != 0 {
+		s.Port = port
+	}
+}
+
+func (s *swarmDefinition) runArgs() *RunArgs {
+	return &RunArgs{
+		IP:      s.IP,
+		Mac:     s.Mac,
+		Dev:     s.Dev,
+		Hash:    s.Hash,
+		Keyfile: s.Keyfile,
+		Fwd:     s.Fwd,
+		Port:    s.Port,
+		MTU:     s.MTU,
+		Source:  s.source,
+		Hooks:   s.Hooks,
+	}
+}
+
+// diff returns list of options that differ from running instance
+func (s *swarmDefinition) diff(args RunArgs) []string {
+	changed := []string{}
+	if s.IP != args.IP {
+		changed = append(changed, "ip")
+	}
+	if s.Dev != args.Dev {
+		changed = append(changed, "dev")
+	}
+	if s.Mac != args.Mac {
+		changed = append(changed, "mac")
+	}
+	if s.Keyfile != args.Keyfile {
+		changed = append(changed, "keyfile")
+	}
+	if s.Fwd != args.Fwd {
+		changed = append(changed, "fwd")
+	}
+	if s.Port != args.Port {
+		changed = append(changed, "port")
+	}
+	return changed
+}
+
+// loadSwarmDirectory reads every *.yaml and *.yml file of directory.
+// Returns valid definitions, set of files that failed to load and their
+// errors
+func loadSwarmDirectory(dir string) ([]*swarmDefinition, map[string]bool, []error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	defs := []*swarmDefinition{}
+	broken := make(map[string]bool)
+	errs := []error{}
+	hashes := make(map[string]string)
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if f.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		def, err := loadSwarmDefinition(path)
+		if err == nil {
+			if other, e := hashes[def.Hash]; e {
+				err = fmt.Errorf("Hash %s of %s is already declared in %s", def.Hash, path, other)
+			}
+		}
+		if err != nil {
+			broken[path] = true
+			errs = append(errs, err)
+			continue
+		}
+		hashes[def.Hash] = path
+		defs = append(defs, def)
+	}
+	return defs, broken, errs
+}
+
+// planSwarms compares definitions with running instances. Only instances
+// started from instances directory are stopped. Instances of files that
+// failed to load are left untouched, as well as disabled ones
+func planSwarms(defs []*swarmDefinition, broken map[string]bool, running map[string]*P2PInstance, disabled func(string) bool) []swarmChange {
+	changes := []swarmChange{}
+	declared := make(map[string]bool)
+	for _, def := range defs {
+		declared[def.Hash] = true
+		inst, e := running[def.Hash]
+		if !e || inst == nil {
+			if disabled(def.Hash) {
+				continue
+			}
+			changes = append(changes, swarmChange{Action: SwarmStart, Hash: def.Hash, Reason: "declared in " + def.source, def: def})
+			continue
+		}
+		if changed := def.diff(inst.Args); len(changed) > 0 {
+			changes = append(changes, swarmChange{Action: SwarmRestart, Hash: def.Hash, Reason: "changed " + strings.Join(changed, ", "), def: def, inst: inst})
+			continue
+		}
+		changed := []string{}
+		if def.MTU != inst.Args.MTU {
+			changed = append(changed, "mtu")
+		}
+		if def.source != inst.Args.Source {
+			changed = append(changed, "source")
+		}
+		if !reflect.DeepEqual(def.Hooks, inst.Args.Hooks) {
+			changed = append(changed, "hooks")
+		}
+		if len(changed) > 0 {
+			changes = append(changes, swarmChange{Action: SwarmUpdate, Hash: def.Hash, Reason: "changed " + strings.Join(changed, ", "), def: def, inst: inst})
+		}
+	}
+	hashes := []string{}
+	for hash := range running {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		inst := running[hash]
+		if inst == nil || inst.Args.Source == "" || declared[hash] || broken[inst.Args.Source] {
+			continue
+		}
+		changes = append(changes, swarmChange{Action: SwarmStop, Hash: hash, Reason: "removed from " + inst.Args.Source, inst: inst})
+	}
+	return changes
+}
+
+// CommandStartFile starts instance declared in a file. Specified
+// arguments have priority over the file
+func CommandStartFile(restPort int, file, ip, hash, mac, dev, keyfile, key, kdf, ttl string, fwd bool, port int) {
+	def, err := loadSwarmDefinition(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	def.override(ip, hash, mac, dev, keyfile, fwd, port)
+	if len(def.Hooks) > 0 {
+		fmt.Fprintf(os.Stderr, "Hooks of %s are ignored. Hooks are run only for instances directory of daemon\n", file)
+	}
+	CommandStart(restPort, def.IP, def.Hash, def.Mac, def.Dev, def.Keyfile, key, kdf, ttl, def.Fwd, def.Port, def.MTU)
+}
+
+// CommandApply applies instances directory of daemon or shows planned
+// changes when dryRun is set
+func CommandApply(rpcPort int, dryRun bool) {
+	exitWithResult(newClient(rpcPort).Apply(context.Background(), dryRun))
+}
+
+func (d *Daemon) execRESTApply(w http.ResponseWriter, r *http.Request) {
+	if !ReadyToServe {
+		resp, _ := getResponse(105, "P2P Daemon is in initialization state")
+		w.Write(resp)
+		return
+	}
+	args := new(DaemonArgs)
+	err := getJSON(r.Body, args)
+	if handleMarshalError(err, w) != nil {
+		return
+	}
+	response := new(Response)
+	d.Apply(args, response)
+	resp, err := getResponse(response.ExitCode, response.Output)
+	if err != nil {
+		ptp.Log(ptp.Error, "Internal error: %s", err)
+		return
+	}
+	w.Write(resp)
+}
+
+// Apply reconciles instances with instances directory
+func (d *Daemon) Apply(args *DaemonArgs, resp *Response) error {
+	changes, errs := d.reconcile(args.DryRun)
+	lines := []string{}
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	if len(errs) == 1 && errs[0] == errNoInstancesDir {
+		resp.ExitCode = 1
+		resp.Output = errNoInstancesDir.Error()
+		return errNoInstancesDir
+	}
+	resp.ExitCode = 0
+	if len(errs) > 0 {
+		resp.ExitCode = 1
+	}
+	for _, c := range changes {
+		lines = append(lines, c.String())
+		if c.Error != "" {
+			resp.ExitCode = 1
+		}
+	}
+	if len(changes) == 0 {
+		lines = append(lines, "Nothing to change")
+	} else if args.DryRun {
+		lines = append([]string{"Planned changes:"}, lines...)
+	}
+	resp.Output = strings.Join(lines, "\n")
+	return nil
+}
+
+// triggerReconcile asks reconciliation loop to apply instances directory
+func triggerReconcile() {
+	select {
+	case reconcileTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// reconcileInstances applies instances directory periodically and when
+// triggered
+func reconcileInstances(d *Daemon) {
+	for !bootstrap.isConnected() || OutboundIP == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	for !d.isStopping() {
+		_, errs := d.reconcile(false)
+		for _, err := range errs {
+			if err != errNoInstancesDir {
+				ptp.Log(ptp.Error, "Instances directory: %s", err)
+			}
+		}
+		select {
+		case <-reconcileTrigger:
+		case <-time.After(reconcileInterval):
+		}
+	}
+}
+
+// reconcile starts, stops and updates instances, so they match instances
+// directory. Nothing is changed when dryRun is set
+func (d *Daemon) reconcile(dryRun bool) ([]swarmChange, []error) {
+	dir := ""
+	if d.settings != nil {
+		d.settings.lock.Lock()
+		if d.settings.conf != nil {
+			dir = d.settings.conf.InstancesDir
+		}
+		d.settings.lock.Unlock()
+	}
+	if dir == "" {
+		return nil, []error{errNoInstancesDir}
+	}
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	defs, broken, errs := loadSwarmDirectory(dir)
+	if defs == nil {
+		return nil, errs
+	}
+	changes := planSwarms(defs, broken, d.Instances.get(), func(hash string) bool {
+		if d.Restore == nil {
+			return false
+		}
+		e, exists := d.Restore.getEntry(hash)
+		return exists && !e.Enabled
+	})
+	if dryRun || len(changes) == 0 {
+		return changes, errs
+	}
+	for i := range changes {
+		c := &changes[i]
+		ptp.Log(ptp.Info, "Instances directory: %s", c)
+		var err error
+		switch c.Action {
+		case SwarmStart:
+			err = d.startSwarm(c.def)
+		case SwarmRestart:
+			d.stopInstance(c.inst)
+			err = d.startSwarm(c.def)
+		case SwarmUpdate:
+			err = d.updateSwarm(c.inst, c.def)
+		case SwarmStop:
+			d.stopInstance(c.inst)
+			if d.Restore != nil && d.Restore.isActive() {
+				d.Restore.removeEntry(c.Hash)
+			}
+		}
+		if err != nil {
+			c.Error = err.Error()
+			ptp.Log(ptp.Error, "Instances directory: %s", c)
+		}
+	}
+	if d.Restore != nil && d.Restore.isActive() {
+		err := d.Restore.save()
+		if err != nil {
+			ptp.Log(ptp.Error, "Failed to save instances: %s", err)
+		}
+	}
+	return changes, errs
+}
+
+// startSwarm starts declared instance and replaces its save entry
+func (d *Daemon) startSwarm(def *swarmDefinition) error {
+	if d.Supervisor != nil {
+		// Declared options have priority over saved ones
+		d.Supervisor.remove(def.Hash)
+	}
+	resp := new(Response)
+	err := d.run(def.runArgs(), resp)
+	if err == nil && resp.ExitCode != 0 {
+		err = errors.New(strings.TrimSpace(resp.Output))
+	}
+	if err != nil {
+		return err
+	}
+	return d.saveSwarm(def.Hash)
+}
+
+// updateSwarm applies options that don't require restart
+func (d *Daemon) updateSwarm(inst *P2PInstance, def *swarmDefinition) error {
+	if def.MTU != inst.Args.MTU && inst.PTP != nil && inst.PTP.Interface != nil {
+		mtu := def.MTU
+		if mtu == 0 {
+			mtu = ptp.GlobalMTU
+		}
+		err := inst.PTP.Interface.SetMTU(mtu)
+		if err != nil {
+			return err
+		}
+	}
+	inst.Args.MTU = def.MTU
+	inst.Args.Source = def.source
+	inst.Args.Hooks = def.Hooks
+	return d.saveSwarm(def.Hash)
+}
+
+func (d *Daemon) saveSwarm(hash string) error {
+	if d.Restore == nil || !d.Restore.isActive() {
+		return nil
+	}
+	inst := d.Instances.getInstance(hash)
+	if inst == nil {
+		return nil
+	}
+	d.Restore.removeEntry(hash)
+	return d.Restore.addInstance(inst)
+}
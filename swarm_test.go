@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestLoadSwarmDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-swarms")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.yaml":    "hash: swarm-a\nip: 10.10.10.1/24\ndev: p2pa\nmtu: 1400\n",
+		"b.yml":     "hash: swarm-b\n",
+		"c.yaml":    "hash: swarm-a\n",
+		"d.yaml":    "hash: swarm-d\nmtu: 100\n",
+		"e.yaml":    "hash: swarm-e\ninterface: p2pe\n",
+		"notes.txt": "hash: swarm-f\n",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+	}
+
+	defs, broken, errs := loadSwarmDirectory(dir)
+	if len(defs) != 2 || defs[0].Hash != "swarm-a" || defs[1].Hash != "swarm-b" {
+		t.Fatalf("loadSwarmDirectory() defs = %+v", defs)
+	}
+	if defs[0].MTU != 1400 || defs[0].Dev != "p2pa" || defs[1].IP != "dhcp" {
+		t.Errorf("loadSwarmDirectory() loaded wrong options: %+v, %+v", defs[0], defs[1])
+	}
+	if defs[1].source != filepath.Join(dir, "b.yml") {
+		t.Errorf("loadSwarmDirectory() source = %s", defs[1].source)
+	}
+	wantBroken := map[string]bool{
+		filepath.Join(dir, "c.yaml"): true,
+		filepath.Join(dir, "d.yaml"): true,
+		filepath.Join(dir, "e.yaml"): true,
+	}
+	if !reflect.DeepEqual(broken, wantBroken) || len(errs) != 3 {
+		t.Errorf("loadSwarmDirectory() broken = %v, errors = %v", broken, errs)
+	}
+
+	_, _, errs = loadSwarmDirectory(filepath.Join(dir, "missing"))
+	if len(errs) != 1 {
+		t.Errorf("loadSwarmDirectory() didn't fail on missing directory")
+	}
+}
+
+func TestPlanSwarms(t *testing.T) {
+	defs := []*swarmDefinition{
+		{Hash: "new", IP: "dhcp", source: "/etc/p2p/instances/new.yaml"},
+		{Hash: "same", IP: "dhcp", source: "/etc/p2p/instances/same.yaml"},
+		{Hash: "changed", IP: "10.10.10.1/24", Dev: "p2p1", source: "/etc/p2p/instances/changed.yaml"},
+		{Hash: "mtu", IP: "dhcp", MTU: 1300, source: "/etc/p2p/instances/mtu.yaml"},
+		{Hash: "adopted", IP: "dhcp", source: "/etc/p2p/instances/adopted.yaml"},
+		{Hash: "disabled", IP: "dhcp", source: "/etc/p2p/instances/disabled.yaml"},
+		{Hash: "hooks", IP: "dhcp", Hooks: []ptp.HookConf{{Exec: "/etc/p2p/up.sh"}}, source: "/etc/p2p/instances/hooks.yaml"},
+	}
+	broken := map[string]bool{"/etc/p2p/instances/broken.yaml": true}
+	running := map[string]*P2PInstance{
+		"same":     {ID: "same", Args: RunArgs{IP: "dhcp", Source: "/etc/p2p/instances/same.yaml"}},
+		"changed":  {ID: "changed", Args: RunArgs{IP: "dhcp", Source: "/etc/p2p/instances/changed.yaml"}},
+		"mtu":      {ID: "mtu", Args: RunArgs{IP: "dhcp", Source: "/etc/p2p/instances/mtu.yaml"}},
+		"adopted":  {ID: "adopted", Args: RunArgs{IP: "dhcp"}},
+		"removed":  {ID: "removed", Args: RunArgs{IP: "dhcp", Source: "/etc/p2p/instances/removed.yaml"}},
+		"broken":   {ID: "broken", Args: RunArgs{IP: "dhcp", Source: "/etc/p2p/instances/broken.yaml"}},
+		"imported": {ID: "imported", Args: RunArgs{IP: "dhcp"}},
+		"hooks":    {ID: "hooks", Args: RunArgs{IP: "dhcp", Source: "/etc/p2p/instances/hooks.yaml"}},
+	}
+	changes := planSwarms(defs, broken, running, func(hash string) bool {
+		return hash == "disabled"
+	})
+	got := []string{}
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"start new: declared in /etc/p2p/instances/new.yaml",
+		"restart changed: changed ip, dev",
+		"update mtu: changed mtu",
+		"update adopted: changed source",
+		"update hooks: changed hooks",
+		"stop removed: removed from /etc/p2p/instances/removed.yaml",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("planSwarms() = %q, want %q", got, want)
+	}
+}
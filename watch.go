@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/subutai-io/p2p/client"
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// eventsKeepAlive is an interval of comments sent to idle event streams,
+// so proxies and clients don't close them
+const eventsKeepAlive = time.Duration(time.Second * 15)
+
+// CommandWatch prints events of daemon until interrupted
+func CommandWatch(restPort int, hash string) {
+	if outputFormat == OutputTable {
+		fmt.Fprintf(os.Stderr, "Output format %s is not supported by watch\n", OutputTable)
+		os.Exit(2)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	err := newClient(restPort).Watch(ctx, hash, printEvent)
+	if errors.Is(err, context.Canceled) {
+		os.Exit(0)
+	}
+	exitWithError(err)
+}
+
+// printEvent writes event in selected output format. JSON events are
+// written one per line
+func printEvent(e client.Event) error {
+	switch outputFormat {
+	case OutputJSON:
+		return json.NewEncoder(os.Stdout).Encode(e)
+	case OutputYAML:
+		fmt.Println("---")
+		return writeOutput(os.Stdout, OutputYAML, e)
+	}
+	fmt.Println(formatEvent(e))
+	return nil
+}
+
+// formatEvent returns event as a single line of text
+func formatEvent(e client.Event) string {
+	line := fmt.Sprintf("%s %s", e.Time.Local().Format("2006-01-02 15:04:05"), e.Type)
+	if e.Hash != "" {
+		line += " " + e.Hash
+	}
+	if e.Peer != "" {
+		line += " " + e.Peer
+	}
+	line += ": " + e.Message
+	keys := []string{}
+	for key := range e.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := []string{}
+	for _, key := range keys {
+		data = append(data, key+"="+e.Data[key])
+	}
+	if len(data) > 0 {
+		line += " [" + strings.Join(data, " ") + "]"
+	}
+	return line
+}
+
+// apiEvents streams events of daemon as server-sent events. Hash query
+// parameter limits stream to events of instance and daemon
+func (d *Daemon) apiEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, 1, "Streaming is not supported")
+		return
+	}
+	events := ptp.Events.Subscribe(r.URL.Query().Get("hash"))
+	defer func() {
+		dropped := ptp.Events.Unsubscribe(events)
+		if dropped > 0 {
+			ptp.Log(ptp.Warning, "%d events were dropped for slow subscriber", dropped)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-events:
+			data, _ := json.Marshal(e)
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/subutai-io/p2p/client"
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestFormatEvent(t *testing.T) {
+	when := time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+	tests := []struct {
+		name  string
+		event client.Event
+		want  string
+	}{
+		{"Daemon", client.Event{Time: when, Type: ptp.EventBootstrapConnected, Message: "Connected to a bootstrap node", Data: map[string]string{"router": "10.0.0.1:6881"}},
+			"2026-01-02 03:04:05 bootstrap.connected: Connected to a bootstrap node [router=10.0.0.1:6881]"},
+		{"Peer", client.Event{Time: when, Type: ptp.EventPeerState, Hash: "swarm", Peer: "peer", Message: "Peer changed state", Data: map[string]string{"to": "Connected", "from": "Init"}},
+			"2026-01-02 03:04:05 peer.state swarm peer: Peer changed state [from=Init to=Connected]"},
+		{"No data", client.Event{Time: when, Type: ptp.EventInstanceStopped, Hash: "swarm", Message: "Instance stopped"},
+			"2026-01-02 03:04:05 instance.stopped swarm: Instance stopped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatEvent(tt.event); got != tt.want {
+				t.Errorf("formatEvent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	d := new(Daemon)
+	server := httptest.NewServer(http.HandlerFunc(d.apiEvents))
+	defer server.Close()
+	c := client.NewHTTP(server.URL, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Events are published until stream is subscribed and first event is
+	// received
+	go func() {
+		for ctx.Err() == nil {
+			ptp.Events.Publish(ptp.Event{Type: ptp.EventPeerIP, Hash: "other", Message: "Other"})
+			ptp.Events.Publish(ptp.Event{Type: ptp.EventPeerIP, Hash: "swarm", Peer: "peer", Message: "Peer changed IP", Data: map[string]string{"ip": "10.10.10.2"}})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	errStop := errors.New("stop")
+	var got client.Event
+	err := c.Watch(ctx, "swarm", func(e client.Event) error {
+		got = e
+		return errStop
+	})
+	cancel()
+	if err != errStop {
+		t.Fatalf("Client.Watch() error = %v", err)
+	}
+	if got.Type != ptp.EventPeerIP || got.Hash != "swarm" || got.Peer != "peer" || got.Data["ip"] != "10.10.10.2" || got.Time.IsZero() {
+		t.Errorf("Client.Watch() received %+v", got)
+	}
+
+	canceled, stop := context.WithCancel(context.Background())
+	stop()
+	err = c.Watch(canceled, "", func(e client.Event) error { return nil })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Client.Watch() error = %v, want canceled", err)
+	}
+}